@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	stdcrypto "crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/ceremony"
+	"github.com/lamassuiot/enroller/pkg/enroller/configs"
+	"github.com/lamassuiot/enroller/pkg/enroller/crypto"
+	"github.com/lamassuiot/enroller/pkg/enroller/secrets/passphrase"
+	secretspkcs11 "github.com/lamassuiot/enroller/pkg/enroller/secrets/pkcs11"
+	"github.com/lamassuiot/enroller/pkg/enroller/secrets/seal"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+const caUsage = "usage: ca init | issue-intermediate | split-key [flags]"
+
+// runCA implements the "ca init", "ca issue-intermediate" and "ca split-key"
+// commands of a key ceremony, recording every step in a transcript.
+func runCA(args []string, prefix string, cfg configs.Config, logger log.Logger) int {
+	if len(args) > 0 && args[0] == "split-key" {
+		return runSplitKey(args[1:], prefix, cfg, logger)
+	}
+	if len(args) == 0 || (args[0] != "init" && args[0] != "issue-intermediate") {
+		fmt.Println(caUsage)
+		return 2
+	}
+	command := args[0]
+	intermediate := command == "issue-intermediate"
+	// Roots are long lived and allow one level of intermediate CAs, the
+	// intermediate CAs only issue end entity certificates.
+	defaultDays, defaultPathLen := 7300, 1
+	if intermediate {
+		defaultDays, defaultPathLen = 3650, 0
+	}
+	fs := flag.NewFlagSet("ca "+command, flag.ExitOnError)
+	name := fs.String("ca", configs.DefaultCAName, "CA whose configuration selects where the key and certificate are written")
+	keyType := fs.String("key-type", "p384", "CA key type: rsa2048, rsa3072, rsa4096, p256, p384 or p521")
+	cn := fs.String("cn", "", "common name of the CA")
+	o := fs.String("o", "", "organization of the CA")
+	ou := fs.String("ou", "", "organizational unit of the CA")
+	c := fs.String("c", "", "country of the CA")
+	days := fs.Int("days", defaultDays, "days the certificate is valid")
+	pathLen := fs.Int("path-len", defaultPathLen, "intermediate CAs allowed below the CA, -1 for no limit")
+	transcriptPath := fs.String("transcript", "", "ceremony transcript file (the certificate file with a .ceremony.txt suffix if empty)")
+	custodianList := fs.String("custodians", "", "comma separated custodians who receive one unseal share each of the CA key passphrase, with a shamir: CA key passphrase source")
+	sharesDir := fs.String("shares-dir", ".", "directory the unseal share file of each custodian is written to")
+	var csrPath, rootCertPath, rootKeyPath, rootKeyPassphrase *string
+	if intermediate {
+		csrPath = fs.String("csr", "", "file the CSR is written to (the certificate file with a .csr suffix if empty)")
+		rootCertPath = fs.String("root-cert", "", "root CA certificate, to issue the intermediate certificate")
+		rootKeyPath = fs.String("root-key", "", "root CA key, to issue the intermediate certificate")
+		rootKeyPassphrase = fs.String("root-key-passphrase", "", "source of the root CA key passphrase, as ENROLLER_CAKEYPASSPHRASE")
+	}
+	fs.Parse(args[1:])
+
+	caCfg, err := caConfig(prefix, cfg, *name)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not read configuration of CA "+*name)
+		return 1
+	}
+	if *cn == "" || caCfg.CACertFile == "" {
+		level.Error(logger).Log("msg", "The CA common name and certificate file are required")
+		return 2
+	}
+	spec, err := crypto.ParseKeySpec(*keyType)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Unknown key type "+*keyType)
+		return 2
+	}
+	subject := pkix.Name{CommonName: *cn}
+	if *o != "" {
+		subject.Organization = []string{*o}
+	}
+	if *ou != "" {
+		subject.OrganizationalUnit = []string{*ou}
+	}
+	if *c != "" {
+		subject.Country = []string{*c}
+	}
+	custodians, err := ceremony.ParseCustodians(*custodianList)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Invalid custodians "+*custodianList)
+		return 2
+	}
+	if *transcriptPath == "" {
+		*transcriptPath = caCfg.CACertFile + ".ceremony.txt"
+	}
+	transcript, err := ceremony.NewTranscript(*transcriptPath)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not create ceremony transcript")
+		return 1
+	}
+	operator, host := os.Getenv("USER"), "unknown host"
+	if operator == "" {
+		operator = "unknown operator"
+	}
+	if h, err := os.Hostname(); err == nil {
+		host = h
+	}
+	transcript.Record("ceremony started: ca %s for CA %s by %s on %s", command, *name, operator, host)
+
+	var shares [][]byte
+	err = func() error {
+		ctx := context.Background()
+		var caKeyPassphrase []byte
+		if caCfg.SecretEngine == "file" {
+			if caKeyPassphrase, shares, err = newCAKeyPassphrase(ctx, caCfg, len(custodians)); err != nil {
+				return err
+			}
+		}
+		key, closeKey, err := generateCAKey(caCfg, spec, caKeyPassphrase, logger)
+		if err != nil {
+			return err
+		}
+		defer closeKey()
+		keyFingerprint, err := ceremony.PublicKeyFingerprint(key.Public())
+		if err != nil {
+			return err
+		}
+		if caCfg.SecretEngine == "pkcs11" {
+			transcript.Record("%s key generated in PKCS#11 token %s with label %s, public key SHA-256 %s", *keyType, caCfg.PKCS11TokenLabel, caCfg.PKCS11KeyLabel, keyFingerprint)
+		} else {
+			transcript.Record("%s key generated and written to %s, public key SHA-256 %s", *keyType, caCfg.CAKeyFile, keyFingerprint)
+		}
+		if shares != nil {
+			transcript.Record("CA key passphrase split into %d unseal shares, %s", len(shares), caCfg.CAKeyPassphrase)
+			if err := writeShares(transcript, *sharesDir, custodians, shares); err != nil {
+				return err
+			}
+		}
+		validity := time.Duration(*days) * 24 * time.Hour
+
+		if !intermediate {
+			template, err := ceremony.RootTemplate(subject, validity, *pathLen)
+			if err != nil {
+				return err
+			}
+			der, err := ceremony.Sign(template, key.Public(), template, key)
+			if err != nil {
+				return err
+			}
+			return writeCACert(transcript, caCfg.CACertFile, der)
+		}
+
+		csrDER, err := ceremony.NewCSR(subject, key)
+		if err != nil {
+			return err
+		}
+		if *csrPath == "" {
+			*csrPath = strings.TrimSuffix(caCfg.CACertFile, ".crt") + ".csr"
+		}
+		if err := ceremony.WriteFile(*csrPath, pem.EncodeToMemory(&pem.Block{Type: crypto.CSRPEMBlockType, Bytes: csrDER}), 0644); err != nil {
+			return err
+		}
+		transcript.Record("CSR for %s written to %s, SHA-256 %s", subject, *csrPath, ceremony.Fingerprint(csrDER))
+		if *rootKeyPath == "" {
+			return nil
+		}
+
+		root, err := crypto.LoadCert(*rootCertPath)
+		if err != nil {
+			return err
+		}
+		rootKey, err := loadKey(ctx, *rootKeyPath, *rootKeyPassphrase)
+		if err != nil {
+			return err
+		}
+		if err := crypto.CheckCA(root, rootKey); err != nil {
+			return err
+		}
+		transcript.Record("root CA %s loaded from %s, SHA-256 %s", root.Subject, *rootCertPath, ceremony.Fingerprint(root.Raw))
+		csr, err := x509.ParseCertificateRequest(csrDER)
+		if err != nil {
+			return err
+		}
+		template, err := ceremony.IntermediateTemplate(csr, root, validity, *pathLen)
+		if err != nil {
+			return err
+		}
+		der, err := ceremony.Sign(template, csr.PublicKey, root, rootKey)
+		if err != nil {
+			return err
+		}
+		if err := writeCACert(transcript, caCfg.CACertFile, der); err != nil {
+			return err
+		}
+		if caCfg.CAChainFile == "" {
+			return nil
+		}
+		if err := ceremony.WriteFile(caCfg.CAChainFile, pem.EncodeToMemory(&pem.Block{Type: crypto.CertPEMBlockType, Bytes: root.Raw}), 0644); err != nil {
+			return err
+		}
+		transcript.Record("CA chain written to %s", caCfg.CAChainFile)
+		return nil
+	}()
+	if err != nil {
+		transcript.Record("ceremony failed: %s", err)
+		transcript.Close()
+		level.Error(logger).Log("err", err, "msg", "CA ceremony failed")
+		return 1
+	}
+	transcript.Record("ceremony completed")
+	if err := transcript.Close(); err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not write ceremony transcript")
+		return 1
+	}
+	fmt.Println("Ceremony transcript written to " + *transcriptPath)
+	return 0
+}
+
+// runSplitKey implements the "ca split-key" command. It writes the CA key
+// encrypted with a new random passphrase and the unseal shares of the
+// passphrase, one file for each custodian.
+func runSplitKey(args []string, prefix string, cfg configs.Config, logger log.Logger) int {
+	fs := flag.NewFlagSet("ca split-key", flag.ExitOnError)
+	name := fs.String("ca", configs.DefaultCAName, "CA whose key is split")
+	custodianList := fs.String("custodians", "", "comma separated custodians who receive one unseal share each of the CA key passphrase")
+	sharesDir := fs.String("shares-dir", ".", "directory the unseal share file of each custodian is written to")
+	keyPassphrase := fs.String("key-passphrase", "", "source of the current CA key passphrase, as ENROLLER_CAKEYPASSPHRASE")
+	out := fs.String("out", "", "file the encrypted CA key is written to")
+	transcriptPath := fs.String("transcript", "", "ceremony transcript file (the encrypted key file with a .ceremony.txt suffix if empty)")
+	fs.Parse(args)
+
+	caCfg, err := caConfig(prefix, cfg, *name)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not read configuration of CA "+*name)
+		return 1
+	}
+	if *out == "" || caCfg.CAKeyFile == "" {
+		level.Error(logger).Log("msg", "The CA key file and the encrypted key file are required")
+		return 2
+	}
+	custodians, err := ceremony.ParseCustodians(*custodianList)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Invalid custodians "+*custodianList)
+		return 2
+	}
+	if *transcriptPath == "" {
+		*transcriptPath = *out + ".ceremony.txt"
+	}
+	transcript, err := ceremony.NewTranscript(*transcriptPath)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not create ceremony transcript")
+		return 1
+	}
+	transcript.Record("ceremony started: ca split-key for CA %s", *name)
+
+	var shares [][]byte
+	err = func() error {
+		ctx := context.Background()
+		key, err := loadKey(ctx, caCfg.CAKeyFile, *keyPassphrase)
+		if err != nil {
+			return err
+		}
+		keyFingerprint, err := ceremony.PublicKeyFingerprint(key.Public())
+		if err != nil {
+			return err
+		}
+		transcript.Record("CA key loaded from %s, public key SHA-256 %s", caCfg.CAKeyFile, keyFingerprint)
+		var caKeyPassphrase []byte
+		if caKeyPassphrase, shares, err = newCAKeyPassphrase(ctx, caCfg, len(custodians)); err != nil {
+			return err
+		}
+		if shares == nil {
+			return errors.New("the CA key passphrase source must be " + seal.Source + "<threshold>")
+		}
+		block, err := crypto.MarshalPrivateKey(key, caKeyPassphrase)
+		if err != nil {
+			return err
+		}
+		if err := ceremony.WriteFile(*out, pem.EncodeToMemory(block), 0600); err != nil {
+			return err
+		}
+		transcript.Record("CA key encrypted and written to %s, passphrase split into %d unseal shares, %s", *out, len(shares), caCfg.CAKeyPassphrase)
+		return writeShares(transcript, *sharesDir, custodians, shares)
+	}()
+	if err != nil {
+		transcript.Record("ceremony failed: %s", err)
+		transcript.Close()
+		level.Error(logger).Log("err", err, "msg", "CA ceremony failed")
+		return 1
+	}
+	transcript.Record("ceremony completed")
+	if err := transcript.Close(); err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not write ceremony transcript")
+		return 1
+	}
+	fmt.Println("Ceremony transcript written to " + *transcriptPath)
+	return 0
+}
+
+// caConfig returns the configuration of the CA named name.
+func caConfig(prefix string, cfg configs.Config, name string) (configs.CAConfig, error) {
+	if name == configs.DefaultCAName {
+		return cfg.CAConfig, nil
+	}
+	err, caCfg := configs.NewCAConfig(prefix, name)
+	return caCfg, err
+}
+
+// newCAKeyPassphrase returns the passphrase a new CA key file is encrypted
+// with. With a shamir: source it is a random passphrase split into
+// shareCount unseal shares, which are returned too.
+func newCAKeyPassphrase(ctx context.Context, cfg configs.CAConfig, shareCount int) ([]byte, [][]byte, error) {
+	threshold, sealed, err := seal.ParseSource(cfg.CAKeyPassphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !sealed {
+		caKeyPassphrase, err := readCAKeyPassphrase(ctx, cfg)
+		return caKeyPassphrase, nil, err
+	}
+	if shareCount < threshold {
+		return nil, nil, fmt.Errorf("at least %d custodians are needed", threshold)
+	}
+	return seal.NewPassphrase(shareCount, threshold)
+}
+
+// writeShares writes the unseal share of each custodian to its own file in
+// dir. Only which custodian received which share is recorded in the
+// transcript, never the shares.
+func writeShares(transcript *ceremony.Transcript, dir string, custodians []string, shares [][]byte) error {
+	for i, share := range shares {
+		path, err := ceremony.WriteShare(dir, custodians[i], share)
+		if err != nil {
+			return err
+		}
+		transcript.Record("unseal share %d written to %s for custodian %s", i+1, path, custodians[i])
+		fmt.Printf("Unseal share %d of custodian %s written to %s\n", i+1, custodians[i], path)
+	}
+	return nil
+}
+
+// generateCAKey generates the CA key in the PKCS#11 token of cfg, or writes
+// it to its CA key file, encrypted with caKeyPassphrase unless it is empty.
+// The returned function releases the key.
+func generateCAKey(cfg configs.CAConfig, spec crypto.KeySpec, caKeyPassphrase []byte, logger log.Logger) (stdcrypto.Signer, func(), error) {
+	switch cfg.SecretEngine {
+	case "pkcs11":
+		return secretspkcs11.GenerateKey(secretspkcs11.Config{
+			Module:     cfg.PKCS11Module,
+			TokenLabel: cfg.PKCS11TokenLabel,
+			Slot:       cfg.PKCS11Slot,
+			PIN:        cfg.PKCS11PIN,
+			KeyLabel:   cfg.PKCS11KeyLabel,
+		}, spec, logger)
+	case "file":
+		if cfg.CAKeyFile == "" {
+			return nil, nil, errors.New("no CA key file configured")
+		}
+		key, err := crypto.GenerateKey(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		block, err := crypto.MarshalPrivateKey(key, caKeyPassphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := ceremony.WriteFile(cfg.CAKeyFile, pem.EncodeToMemory(block), 0600); err != nil {
+			return nil, nil, err
+		}
+		return key, func() {}, nil
+	}
+	return nil, nil, errors.New("secret engine " + cfg.SecretEngine + " can not generate CA keys")
+}
+
+// loadKey reads the CA key at path, decrypting it with the passphrase
+// read from source.
+func loadKey(ctx context.Context, path string, source string) (stdcrypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rootKeyPassphrase, err := passphrase.Read(ctx, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	return crypto.DecryptPrivateKey(block, rootKeyPassphrase)
+}
+
+func writeCACert(transcript *ceremony.Transcript, path string, der []byte) error {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	if err := ceremony.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: crypto.CertPEMBlockType, Bytes: der}), 0644); err != nil {
+		return err
+	}
+	transcript.Record("certificate of %s issued by %s written to %s, serial %x, valid from %s to %s, SHA-256 %s",
+		cert.Subject, cert.Issuer, path, cert.SerialNumber, cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339), ceremony.Fingerprint(der))
+	return nil
+}
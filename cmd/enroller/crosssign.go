@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"os"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/crypto"
+	"github.com/lamassuiot/enroller/pkg/enroller/secrets"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// runCrossSign implements the "cross-sign" command. It signs the
+// certificate of the successor of a CA with the CA key and writes it as
+// PEM, to be added to the chain of the successor. It returns a non zero
+// exit code on failure.
+func runCrossSign(args []string, cas *secrets.CAs, logger log.Logger) int {
+	fs := flag.NewFlagSet("cross-sign", flag.ExitOnError)
+	name := fs.String("ca", "", "CA whose successor is cross-signed (default CA if empty)")
+	out := fs.String("out", "", "file the cross-signed certificate is written to (standard output if empty)")
+	fs.Parse(args)
+
+	ca, err := cas.Lookup(*name)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not find CA "+*name)
+		return 1
+	}
+	if ca.Successor == "" {
+		level.Error(logger).Log("msg", "CA "+ca.Name+" has no successor")
+		return 1
+	}
+	signer, ok := ca.Secrets.(secrets.CrossSigner)
+	if !ok {
+		level.Error(logger).Log("err", secrets.ErrCrossSignNotSupported, "msg", "Could not cross-sign with CA "+ca.Name)
+		return 1
+	}
+	successor, err := cas.Lookup(ca.Successor)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not find CA "+ca.Successor)
+		return 1
+	}
+	successorCert, err := successor.Secrets.GetCACert()
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not get certificate of CA "+successor.Name)
+		return 1
+	}
+	der, err := signer.CrossSign(context.Background(), successorCert)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not cross-sign certificate of CA "+successor.Name)
+		return 1
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: crypto.CertPEMBlockType, Bytes: der})
+	if *out == "" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = ioutil.WriteFile(*out, data, 0644)
+	}
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not write cross-signed certificate")
+		return 1
+	}
+	level.Info(logger).Log("msg", "Certificate of CA "+successor.Name+" cross-signed by CA "+ca.Name)
+	return 0
+}
@@ -1,21 +1,37 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 
 	"github.com/lamassuiot/enroller/pkg/enroller/api"
 	"github.com/lamassuiot/enroller/pkg/enroller/auth"
 	"github.com/lamassuiot/enroller/pkg/enroller/configs"
 	"github.com/lamassuiot/enroller/pkg/enroller/discovery/consul"
-	certsdb "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store/db"
-	certsfile "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store/file"
-	csrdb "github.com/lamassuiot/enroller/pkg/enroller/models/csr/store/db"
-	csrfile "github.com/lamassuiot/enroller/pkg/enroller/models/csr/store/file"
-	secrets "github.com/lamassuiot/enroller/pkg/enroller/secrets/file"
+	certstore "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store"
+	certspostgres "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store/db"
+	certsdbfile "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store/dbfile"
+	certsfilesystem "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store/file"
+	certss3 "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store/s3"
+	certssqlite "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store/sqlite"
+	csrstore "github.com/lamassuiot/enroller/pkg/enroller/models/csr/store"
+	csrpostgres "github.com/lamassuiot/enroller/pkg/enroller/models/csr/store/db"
+	csrdbfile "github.com/lamassuiot/enroller/pkg/enroller/models/csr/store/dbfile"
+	csrfilesystem "github.com/lamassuiot/enroller/pkg/enroller/models/csr/store/file"
+	csrs3 "github.com/lamassuiot/enroller/pkg/enroller/models/csr/store/s3"
+	csrsqlite "github.com/lamassuiot/enroller/pkg/enroller/models/csr/store/sqlite"
+	journalstore "github.com/lamassuiot/enroller/pkg/enroller/models/journal/store"
+	journalpostgres "github.com/lamassuiot/enroller/pkg/enroller/models/journal/store/db"
+	journalsqlite "github.com/lamassuiot/enroller/pkg/enroller/models/journal/store/sqlite"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/migrations"
+	"github.com/lamassuiot/enroller/pkg/enroller/objectstore"
+	"github.com/lamassuiot/enroller/pkg/migrate"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -41,31 +57,220 @@ func main() {
 	}
 	level.Info(logger).Log("msg", "Environment configuration values loaded")
 
-	csrConnStr := "dbname=" + cfg.PostgresDB + " user=" + cfg.PostgresUser + " password=" + cfg.PostgresPassword + " host=" + cfg.PostgresHostname + " port=" + cfg.PostgresPort + " sslmode=disable"
-	csrdb, err := csrdb.NewDB("postgres", csrConnStr, logger)
+	if len(os.Args) > 1 && os.Args[1] == "ca" {
+		os.Exit(runCA(os.Args[2:], "enroller", cfg, logger))
+	}
+
+	// Interrupting the service while it waits for the database stops it.
+	startCtx, cancelStart := context.WithCancel(context.Background())
+	startSignals := make(chan os.Signal, 1)
+	signal.Notify(startSignals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-startSignals:
+			cancelStart()
+		case <-startCtx.Done():
+		}
+	}()
+
+	var csrdb csrstore.DB
+	var certsdb certstore.DB
+	var journaldb journalstore.DB
+	var dataSourceName string
+	connStr := cfg.Postgres().DataSourceName()
+	switch cfg.Driver {
+	case "postgres":
+		dataSourceName = connStr
+		csrdb, err = csrpostgres.NewDB(startCtx, "postgres", connStr, cfg.DatabaseOptions(), logger)
+		if err == nil {
+			certsdb, err = certspostgres.NewDB(startCtx, "postgres", connStr, cfg.DatabaseOptions(), logger)
+		}
+		if err == nil {
+			journaldb, err = journalpostgres.NewDB(startCtx, "postgres", connStr, cfg.DatabaseOptions(), logger)
+		}
+	case "sqlite":
+		if cfg.FileStore == "postgres" {
+			level.Error(logger).Log("msg", "The postgres file store can not be used with the sqlite driver")
+			os.Exit(1)
+		}
+		dataSourceName = "file:" + cfg.SQLitePath + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)"
+		csrdb, err = csrsqlite.NewDB(dataSourceName, logger)
+		if err == nil {
+			certsdb, err = certssqlite.NewDB(dataSourceName, logger)
+		}
+		if err == nil {
+			journaldb, err = journalsqlite.NewDB(dataSourceName, logger)
+		}
+	default:
+		level.Error(logger).Log("msg", "Unknown database driver "+cfg.Driver)
+		os.Exit(1)
+	}
 	if err != nil {
-		level.Error(logger).Log("err", err, "msg", "Could not start connection with CSRs database")
+		level.Error(logger).Log("err", err, "msg", "Could not start connection with "+cfg.Driver+" database")
 		os.Exit(1)
 	}
-	level.Info(logger).Log("msg", "Connection established with CSRs database")
-	csrfile := csrfile.NewFile(cfg.HomePath, logger)
-	level.Info(logger).Log("msg", "CSRs filesystem home path created")
+	level.Info(logger).Log("msg", "Connection established with "+cfg.Driver+" database")
 
-	certsConnStr := "dbname=" + cfg.PostgresDB + " user=" + cfg.PostgresUser + " password=" + cfg.PostgresPassword + " host=" + cfg.PostgresHostname + " port=" + cfg.PostgresPort + " sslmode=disable"
-	certsdb, err := certsdb.NewDB("postgres", certsConnStr, logger)
+	migrationList, err := migrations.ForDriver(cfg.Driver)
 	if err != nil {
-		level.Error(logger).Log("err", err, "msg", "Could not start connection with signed certificates database")
+		level.Error(logger).Log("err", err, "msg", "Could not load database migrations")
 		os.Exit(1)
 	}
-	level.Info(logger).Log("msg", "Connection established with signed certificates database")
-	certsfile := certsfile.NewFile(cfg.HomePath, logger)
-	level.Info(logger).Log("msg", "Signed certificates home path created")
+	migrationsDB, err := sql.Open(cfg.Driver, dataSourceName)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not open database connection for migrations")
+		os.Exit(1)
+	}
+	migrator := migrate.NewMigrator(migrationsDB, cfg.Driver, migrationList, logger)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(migrate.RunCommand(os.Args[2:], migrator, logger))
+	}
 
-	auth := auth.NewAuth(cfg.KeycloakHostname, cfg.KeycloakPort, cfg.KeycloakProtocol, cfg.KeycloakRealm, cfg.KeycloakCA)
-	level.Info(logger).Log("msg", "Connection established with authentication system")
-	secrets := secrets.NewFile(cfg.CACertFile, cfg.CAKeyFile, cfg.OCSPServer, certsdb, logger)
-	level.Info(logger).Log("msg", "Connection established with secret engine")
+	var objectClient *objectstore.Client
+	if cfg.FileStore == "s3" {
+		objectClient, err = objectstore.NewClient(objectstore.Config{
+			Endpoint:    cfg.S3Endpoint,
+			Region:      cfg.S3Region,
+			Bucket:      cfg.S3Bucket,
+			Prefix:      cfg.S3Prefix,
+			AccessKey:   cfg.S3AccessKey,
+			SecretKey:   cfg.S3SecretKey,
+			SSE:         cfg.S3SSE,
+			SSEKMSKeyID: cfg.S3SSEKMSKeyID,
+			CA:          cfg.S3CA,
+			MaxRetries:  cfg.S3MaxRetries,
+		})
+		if err != nil {
+			level.Error(logger).Log("err", err, "msg", "Could not create object store client")
+			os.Exit(1)
+		}
+		level.Info(logger).Log("msg", "Object store client created")
+	}
+
+	var csrfile csrstore.File
+	switch cfg.FileStore {
+	case "postgres":
+		csrfile, err = csrdbfile.NewFile(startCtx, "postgres", connStr, cfg.DatabaseOptions(), logger)
+		if err != nil {
+			level.Error(logger).Log("err", err, "msg", "Could not start connection with CSRs data database")
+			os.Exit(1)
+		}
+		level.Info(logger).Log("msg", "Connection established with CSRs data database")
+	case "filesystem":
+		csrfile = csrfilesystem.NewFile(cfg.HomePath, logger)
+		level.Info(logger).Log("msg", "CSRs filesystem home path created")
+	case "s3":
+		csrfile = csrs3.NewFile(objectClient, logger)
+		level.Info(logger).Log("msg", "CSRs object store created")
+	default:
+		level.Error(logger).Log("msg", "Unknown file store "+cfg.FileStore)
+		os.Exit(1)
+	}
+
+	var certsfile certstore.File
+	switch cfg.FileStore {
+	case "postgres":
+		certsfile, err = certsdbfile.NewFile(startCtx, "postgres", connStr, cfg.DatabaseOptions(), logger)
+		if err != nil {
+			level.Error(logger).Log("err", err, "msg", "Could not start connection with signed certificates data database")
+			os.Exit(1)
+		}
+		level.Info(logger).Log("msg", "Connection established with signed certificates data database")
+	case "s3":
+		certsfile = certss3.NewFile(objectClient, logger)
+		level.Info(logger).Log("msg", "Signed certificates object store created")
+	default:
+		certsfile = certsfilesystem.NewFile(cfg.HomePath, logger)
+		level.Info(logger).Log("msg", "Signed certificates home path created")
+	}
+	signal.Stop(startSignals)
+	cancelStart()
 
+	applied, err := migrator.Up()
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not apply database migrations")
+		os.Exit(1)
+	}
+	migrationsDB.Close()
+	level.Info(logger).Log("msg", strconv.Itoa(applied)+" database migrations applied")
+
+	// Only the issues left once the interrupted operations are recovered are
+	// reported, without waiting for the secret engines.
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		err = api.Recover(context.Background(), journaldb, csrdb, csrfile, certsdb, certsfile, cfg.OperationTimeout, logger)
+		if err != nil {
+			level.Error(logger).Log("err", err, "msg", "Could not recover interrupted operations")
+			os.Exit(1)
+		}
+		os.Exit(runReconcile(os.Args[2:], journaldb, csrdb, csrfile, certsdb, certsfile, cfg.HomePath, cfg.FileStore, logger))
+	}
+
+	cas, closeCAs, err := newCAs(context.Background(), "enroller", cfg, certsdb, logger)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not start issuing CAs")
+		os.Exit(1)
+	}
+	defer closeCAs()
+	level.Info(logger).Log("msg", "Connection established with secret engines")
+
+	// Cross-signing only needs the CAs and the serials of the certificate
+	// database.
+	if len(os.Args) > 1 && os.Args[1] == "cross-sign" {
+		code := runCrossSign(os.Args[2:], cas, logger)
+		closeCAs()
+		os.Exit(code)
+	}
+
+	err = api.Recover(context.Background(), journaldb, csrdb, csrfile, certsdb, certsfile, cfg.OperationTimeout, logger)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not recover interrupted operations")
+		os.Exit(1)
+	}
+	level.Info(logger).Log("msg", "Interrupted operations recovered")
+
+	authConfig := auth.Config{
+		Hostname:          cfg.KeycloakHostname,
+		Port:              cfg.KeycloakPort,
+		Protocol:          cfg.KeycloakProtocol,
+		Realm:             cfg.KeycloakRealm,
+		CA:                cfg.KeycloakCA,
+		Issuer:            cfg.KeycloakIssuer,
+		Audience:          cfg.KeycloakAudience,
+		AuthorizedParties: cfg.KeycloakAuthorizedParties,
+		Leeway:            cfg.KeycloakLeeway,
+		RefreshInterval:   cfg.KeycloakJWKSRefresh,
+		Claims: auth.ClaimPaths{
+			Username:   cfg.OIDCUsernameClaim,
+			Roles:      cfg.OIDCRolesClaim,
+			Groups:     cfg.OIDCGroupsClaim,
+			GroupRoles: cfg.OIDCGroupRoles,
+		},
+	}
+	if cfg.OIDCIssuer != "" {
+		authConfig.IssuerURL, authConfig.CA = cfg.OIDCIssuer, cfg.OIDCCA
+	}
+	jwtAuth, err := auth.NewAuth(authConfig, log.With(logger, "component", "auth"))
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not start authentication system")
+		os.Exit(1)
+	}
+	defer jwtAuth.Close()
+	level.Info(logger).Log("msg", "Connection established with authentication system")
+	var introspector *auth.Introspector
+	if cfg.IntrospectionURL != "" {
+		introspector, err = auth.NewIntrospector(auth.IntrospectionConfig{
+			URL:           cfg.IntrospectionURL,
+			ClientID:      cfg.IntrospectionClientID,
+			ClientSecret:  cfg.IntrospectionClientSecret,
+			CA:            cfg.IntrospectionCA,
+			CacheTTL:      cfg.IntrospectionCacheTTL,
+			RequireIssuer: cfg.IntrospectionRequireIssuer,
+		}, jwtAuth, log.With(logger, "component", "auth"))
+		if err != nil {
+			level.Error(logger).Log("err", err, "msg", "Could not start token introspection")
+			os.Exit(1)
+		}
+	}
 	jcfg, err := jaegercfg.FromEnv()
 	if err != nil {
 		level.Error(logger).Log("err", err, "msg", "Could not load Jaeger configuration values fron environment")
@@ -84,7 +289,7 @@ func main() {
 
 	var s api.Service
 	{
-		s = api.NewEnrollerService(csrdb, csrfile, certsdb, certsfile, secrets, cfg.HomePath)
+		s = api.NewEnrollerService(csrdb, csrfile, certsdb, certsfile, journaldb, cas, cfg.HomePath)
 		s = api.LoggingMiddleware(logger)(s)
 		s = api.NewInstrumentingMiddleware(
 			kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
@@ -102,6 +307,12 @@ func main() {
 		)(s)
 	}
 
+	if cfg.OperationRecoveryInterval > 0 {
+		recoverCtx, stopRecover := context.WithCancel(context.Background())
+		defer stopRecover()
+		go api.RecoverEvery(recoverCtx, cfg.OperationRecoveryInterval, journaldb, csrdb, csrfile, certsdb, certsfile, cfg.OperationTimeout, log.With(logger, "component", "recovery"))
+	}
+
 	consulsd, err := consul.NewServiceDiscovery(cfg.ConsulProtocol, cfg.ConsulHost, cfg.ConsulPort, cfg.ConsulCA, logger)
 	if err != nil {
 		level.Error(logger).Log("err", err, "msg", "Could not start connection with Consul Service Discovery")
@@ -117,7 +328,7 @@ func main() {
 
 	mux := http.NewServeMux()
 
-	mux.Handle("/v1/", api.MakeHTTPHandler(s, log.With(logger, "component", "HTTPS"), auth, tracer))
+	mux.Handle("/v1/", api.MakeHTTPHandler(s, log.With(logger, "component", "HTTPS"), jwtAuth, introspector, tracer))
 	http.Handle("/", accessControl(mux, cfg.EnrollerUIProtocol, cfg.EnrollerUIHost, cfg.EnrollerUIPort))
 	http.Handle("/metrics", promhttp.Handler())
 
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	certstore "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store"
+	csrstore "github.com/lamassuiot/enroller/pkg/enroller/models/csr/store"
+	journalstore "github.com/lamassuiot/enroller/pkg/enroller/models/journal/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/reconcile"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// runReconcile implements the "reconcile" command. It skips the CSRs of
+// journaled operations and returns a non zero exit code if any issue is left.
+func runReconcile(args []string, journalDBStore journalstore.DB, csrDBStore csrstore.DB, csrFileStore csrstore.File, certsDBStore certstore.DB, certsFileStore certstore.File, homePath string, fileStore string, logger log.Logger) int {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "repair the inconsistencies that can be fixed automatically")
+	fs.Parse(args)
+
+	ctx := context.Background()
+	r := reconcile.NewReconciler(csrDBStore, csrFileStore, certsDBStore, certsFileStore, homePath, fileStore == "filesystem", logger)
+	issues, err := r.Scan(ctx)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not scan CSR and certificate stores")
+		return 1
+	}
+	ops, err := journalDBStore.SelectAll(ctx)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not read operations journal")
+		return 1
+	}
+	running := make(map[int]bool)
+	for _, op := range ops {
+		running[op.CSRID] = true
+	}
+	found := issues[:0]
+	for _, issue := range issues {
+		if running[issue.ID] {
+			fmt.Println("skipped, operation in progress:", issue)
+			continue
+		}
+		found = append(found, issue)
+	}
+	issues = found
+	for _, issue := range issues {
+		fmt.Println(issue)
+	}
+	fmt.Printf("%d issues found\n", len(issues))
+
+	if *repair && len(issues) > 0 {
+		issues = r.Repair(ctx, issues)
+		for _, issue := range issues {
+			fmt.Println("not repaired:", issue)
+		}
+		fmt.Printf("%d issues left after repair\n", len(issues))
+	}
+	if len(issues) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -5,4 +5,4 @@ OUTPUT=../../build
 
 mkdir -p ${OUTPUT}
 
-CGO_ENABLED=0 go build -o ${OUTPUT}/$NAME ./*.go
+CGO_ENABLED=${CGO_ENABLED:-0} go build -o ${OUTPUT}/$NAME ./*.go
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	stdcrypto "crypto"
+	"crypto/x509"
+	"errors"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/configs"
+	"github.com/lamassuiot/enroller/pkg/enroller/crypto"
+	certstore "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/secrets"
+	secretsfile "github.com/lamassuiot/enroller/pkg/enroller/secrets/file"
+	"github.com/lamassuiot/enroller/pkg/enroller/secrets/passphrase"
+	secretspkcs11 "github.com/lamassuiot/enroller/pkg/enroller/secrets/pkcs11"
+	secretsremote "github.com/lamassuiot/enroller/pkg/enroller/secrets/remote"
+	"github.com/lamassuiot/enroller/pkg/enroller/secrets/seal"
+	secretsvault "github.com/lamassuiot/enroller/pkg/enroller/secrets/vault"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// newCAs creates the default issuing CA and the ones named in cfg.CAs,
+// configured with prefix_CA_<NAME>_ variables. The returned function
+// releases their secret engines.
+func newCAs(ctx context.Context, prefix string, cfg configs.Config, certsDBStore certstore.DB, logger log.Logger) (*secrets.CAs, func(), error) {
+	cfgs := map[string]configs.CAConfig{configs.DefaultCAName: cfg.CAConfig}
+	names := []string{configs.DefaultCAName}
+	for _, name := range cfg.CAs {
+		err, caCfg := configs.NewCAConfig(prefix, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		cfgs[name] = caCfg
+		names = append(names, name)
+	}
+	var cas []*secrets.CA
+	var closers []func()
+	closeAll := func() {
+		for _, close := range closers {
+			close()
+		}
+	}
+	for _, name := range names {
+		caLogger := log.With(logger, "ca", name)
+		ca, closeCA, err := newCA(ctx, name, cfgs[name], certsDBStore, caLogger)
+		if err != nil {
+			level.Error(caLogger).Log("err", err, "msg", "Could not start "+cfgs[name].SecretEngine+" secret engine")
+			closeAll()
+			return nil, nil, err
+		}
+		cas = append(cas, ca)
+		closers = append(closers, closeCA)
+	}
+	c, err := secrets.NewCAs(cfg.DefaultCA, cas...)
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	return c, closeAll, nil
+}
+
+func newCA(ctx context.Context, name string, cfg configs.CAConfig, certsDBStore certstore.DB, logger log.Logger) (*secrets.CA, func(), error) {
+	var chain []*x509.Certificate
+	if cfg.CAChainFile != "" {
+		var err error
+		if chain, err = crypto.LoadCerts(cfg.CAChainFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	s, closeSecrets, err := newSecrets(ctx, cfg, certsDBStore, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	if remote, ok := s.(*secretsremote.Remote); ok && chain == nil {
+		chain = remote.Chain()
+	}
+	return &secrets.CA{Name: name, Secrets: s, Chain: chain, Successor: cfg.CASuccessor, RolloverAt: cfg.CARolloverAt}, closeSecrets, nil
+}
+
+// newSecrets creates the secret engine selected in cfg. The returned
+// function releases it.
+func newSecrets(ctx context.Context, cfg configs.CAConfig, certsDBStore certstore.DB, logger log.Logger) (secrets.Secrets, func(), error) {
+	caHash, err := crypto.ParseHash(cfg.CAHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch cfg.SecretEngine {
+	case "file":
+		threshold, sealed, err := seal.ParseSource(cfg.CAKeyPassphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+		if sealed {
+			return newSealedFile(cfg, threshold, caHash, certsDBStore, logger)
+		}
+		caKeyPassphrase, err := readCAKeyPassphrase(ctx, cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return newFile(cfg, caKeyPassphrase, caHash, certsDBStore, logger)
+	case "pkcs11":
+		hsm, err := secretspkcs11.NewHSM(secretspkcs11.Config{
+			Module:     cfg.PKCS11Module,
+			TokenLabel: cfg.PKCS11TokenLabel,
+			Slot:       cfg.PKCS11Slot,
+			PIN:        cfg.PKCS11PIN,
+			KeyLabel:   cfg.PKCS11KeyLabel,
+			CACert:     cfg.CACertFile,
+			OCSPServer: cfg.OCSPServer,
+			CRLServer:  cfg.CRLServer,
+			Hash:       caHash,
+			Sessions:   cfg.PKCS11Sessions,
+		}, certsDBStore, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		return hsm, hsm.Close, nil
+	case "vault":
+		auth, err := vaultAuth(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		vault, err := secretsvault.NewVault(ctx, vaultConfig(cfg), auth, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		return vault, vault.Close, nil
+	case "remote":
+		remote, err := secretsremote.NewRemote(ctx, secretsremote.Config{
+			Address:    cfg.RemoteSignerAddress,
+			CA:         cfg.RemoteSignerCA,
+			Cert:       cfg.RemoteSignerCert,
+			Key:        cfg.RemoteSignerKey,
+			OCSPServer: cfg.OCSPServer,
+			CRLServer:  cfg.CRLServer,
+			Hash:       caHash,
+		}, certsDBStore, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		return remote, remote.Close, nil
+	}
+	return nil, nil, errors.New("unknown secret engine " + cfg.SecretEngine)
+}
+
+func newFile(cfg configs.CAConfig, caKeyPassphrase []byte, caHash stdcrypto.Hash, certsDBStore certstore.DB, logger log.Logger) (secrets.Secrets, func(), error) {
+	file, err := secretsfile.NewFile(cfg.CACertFile, cfg.CAKeyFile, caKeyPassphrase, cfg.OCSPServer, cfg.CRLServer, caHash, certsDBStore, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.CAReloadInterval > 0 {
+		file.Watch(cfg.CAReloadInterval)
+	}
+	stopReload := reloadOnSIGHUP(file, logger)
+	return file, func() {
+		stopReload()
+		file.Close()
+	}, nil
+}
+
+// newSealedFile returns a file secret engine that is sealed until
+// threshold custodians submit their share of the CA key passphrase.
+func newSealedFile(cfg configs.CAConfig, threshold int, caHash stdcrypto.Hash, certsDBStore certstore.DB, logger log.Logger) (secrets.Secrets, func(), error) {
+	caCert, err := crypto.LoadCert(cfg.CACertFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	sealed, err := seal.New(caCert, threshold, func(passphrase []byte) (secrets.Secrets, func(), error) {
+		return newFile(cfg, passphrase, caHash, certsDBStore, logger)
+	}, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	level.Warn(logger).Log("msg", "CA key is sealed, "+strconv.Itoa(threshold)+" custodians must submit their unseal shares")
+	return sealed, sealed.Close, nil
+}
+
+// readCAKeyPassphrase reads the passphrase of the CA key file from its
+// source, logging in to Vault first for Vault KV sources.
+func readCAKeyPassphrase(ctx context.Context, cfg configs.CAConfig) ([]byte, error) {
+	var kv passphrase.KV
+	if strings.HasPrefix(cfg.CAKeyPassphrase, passphrase.VaultSource) {
+		auth, err := vaultAuth(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if kv, err = secretsvault.NewKV(ctx, vaultConfig(cfg), auth); err != nil {
+			return nil, err
+		}
+	}
+	return passphrase.Read(ctx, cfg.CAKeyPassphrase, kv)
+}
+
+// reloadOnSIGHUP reloads the CA files of file when the enroller receives
+// SIGHUP. The returned function stops it.
+func reloadOnSIGHUP(file *secretsfile.File, logger log.Logger) func() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-c:
+				level.Info(logger).Log("msg", "SIGHUP received, reloading CA certificate and key")
+				file.Reload()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
+}
+
+func vaultConfig(cfg configs.CAConfig) secretsvault.Config {
+	return secretsvault.Config{
+		Address:  cfg.VaultAddress,
+		CA:       cfg.VaultCA,
+		PKIMount: cfg.VaultPKIMount,
+		Roles:    cfg.VaultRoles,
+		TTL:      cfg.VaultTTL,
+	}
+}
+
+func vaultAuth(cfg configs.CAConfig) (secretsvault.Auth, error) {
+	switch cfg.VaultAuthMethod {
+	case "approle":
+		return secretsvault.AppRole{Mount: cfg.VaultAuthMount, RoleID: cfg.VaultRoleID, SecretID: cfg.VaultSecretID, SecretIDFile: cfg.VaultSecretIDFile}, nil
+	case "kubernetes":
+		return secretsvault.Kubernetes{Mount: cfg.VaultAuthMount, Role: cfg.VaultK8sRole, TokenFile: cfg.VaultK8sTokenFile}, nil
+	}
+	return nil, errors.New("unknown Vault auth method " + cfg.VaultAuthMethod)
+}
@@ -1,17 +1,23 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 
+	"github.com/lamassuiot/enroller/pkg/migrate"
 	"github.com/lamassuiot/enroller/pkg/scep/api"
 	"github.com/lamassuiot/enroller/pkg/scep/auth"
 	"github.com/lamassuiot/enroller/pkg/scep/configs"
 	"github.com/lamassuiot/enroller/pkg/scep/discovery/consul"
 	"github.com/lamassuiot/enroller/pkg/scep/models/db"
+	"github.com/lamassuiot/enroller/pkg/scep/models/db/sqlite"
+	"github.com/lamassuiot/enroller/pkg/scep/models/migrations"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -38,14 +44,61 @@ func main() {
 	}
 	level.Info(logger).Log("msg", "Environment configuration values loaded")
 
-	connStr := "dbname=" + cfg.PostgresDB + " user=" + cfg.PostgresUser + " password=" + cfg.PostgresPassword + " host=" + cfg.PostgresHostname + " port=" + cfg.PostgresPort + " sslmode=disable"
-	db, err := db.NewDB("postgres", connStr, logger)
+	// Interrupting the service while it waits for the database stops it.
+	startCtx, cancelStart := context.WithCancel(context.Background())
+	startSignals := make(chan os.Signal, 1)
+	signal.Notify(startSignals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-startSignals:
+			cancelStart()
+		case <-startCtx.Done():
+		}
+	}()
+
+	var scepDB db.DBSCEPStore
+	var dataSourceName string
+	switch cfg.Driver {
+	case "postgres":
+		dataSourceName = cfg.Postgres().DataSourceName()
+		scepDB, err = db.NewDB(startCtx, "postgres", dataSourceName, cfg.DatabaseOptions(), logger)
+	case "sqlite":
+		dataSourceName = "file:" + cfg.SQLitePath + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+		scepDB, err = sqlite.NewDB(dataSourceName, logger)
+	default:
+		level.Error(logger).Log("msg", "Unknown database driver "+cfg.Driver)
+		os.Exit(1)
+	}
 	if err != nil {
 		level.Error(logger).Log("err", err, "msg", "Could not start connection with signed certificates database")
 		os.Exit(1)
 	}
+	signal.Stop(startSignals)
+	cancelStart()
 	level.Info(logger).Log("msg", "Connection established with signed certificates database")
 
+	migrationList, err := migrations.ForDriver(cfg.Driver)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not load database migrations")
+		os.Exit(1)
+	}
+	migrationsDB, err := sql.Open(cfg.Driver, dataSourceName)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not open database connection for migrations")
+		os.Exit(1)
+	}
+	migrator := migrate.NewMigrator(migrationsDB, cfg.Driver, migrationList, logger)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(migrate.RunCommand(os.Args[2:], migrator, logger))
+	}
+	applied, err := migrator.Up()
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not apply database migrations")
+		os.Exit(1)
+	}
+	migrationsDB.Close()
+	level.Info(logger).Log("msg", strconv.Itoa(applied)+" database migrations applied")
+
 	auth := auth.NewAuth(cfg.KeycloakHostname, cfg.KeycloakPort, cfg.KeycloakProtocol, cfg.KeycloakRealm, cfg.KeycloakCA)
 	level.Info(logger).Log("msg", "Connection established with authentication system")
 
@@ -67,7 +120,7 @@ func main() {
 
 	var s api.Service
 	{
-		s = api.NewSCEPService(db)
+		s = api.NewSCEPService(scepDB)
 		s = api.LoggingMiddleware(logger)(s)
 		s = api.NewInstrumentingMiddleware(
 			kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
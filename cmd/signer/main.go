@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	stdcrypto "crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/crypto"
+	"github.com/lamassuiot/enroller/pkg/enroller/secrets/passphrase"
+	secretspkcs11 "github.com/lamassuiot/enroller/pkg/enroller/secrets/pkcs11"
+	"github.com/lamassuiot/enroller/pkg/signer"
+	"github.com/lamassuiot/enroller/pkg/signer/configs"
+	"github.com/lamassuiot/enroller/pkg/signer/signerpb"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+func main() {
+	var logger log.Logger
+	{
+		logger = log.NewJSONLogger(os.Stdout)
+		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
+		logger = log.With(logger, "caller", log.DefaultCaller)
+		logger = level.NewFilter(logger, level.AllowInfo())
+	}
+
+	err, cfg := configs.NewConfig("signer")
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not read environment configuration values")
+		os.Exit(1)
+	}
+	level.Info(logger).Log("msg", "Environment configuration values loaded")
+
+	caCert, err := crypto.LoadCert(cfg.CACertFile)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not load CA certificate")
+		os.Exit(1)
+	}
+	var chain []*x509.Certificate
+	if cfg.CAChainFile != "" {
+		if chain, err = crypto.LoadCerts(cfg.CAChainFile); err != nil {
+			level.Error(logger).Log("err", err, "msg", "Could not load CA chain")
+			os.Exit(1)
+		}
+	}
+	caHash, err := crypto.ParseHash(cfg.CAHash)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not parse CA hash")
+		os.Exit(1)
+	}
+	key, closeKey, err := newKey(cfg, caHash, logger)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not load CA key from "+cfg.SecretEngine+" secret engine")
+		os.Exit(1)
+	}
+	defer closeKey()
+	server, err := signer.NewServer(caCert, chain, key, caHash, log.With(logger, "component", "gRPC"))
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "CA certificate and key cannot be used to sign certificates")
+		os.Exit(1)
+	}
+	level.Info(logger).Log("msg", "CA certificate and key loaded", "subject", caCert.Subject.String(), "not_after", caCert.NotAfter)
+
+	tlsConfig, err := signer.ServerTLSConfig(cfg.CertFile, cfg.KeyFile, cfg.ClientCA)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not load TLS configuration")
+		os.Exit(1)
+	}
+	grpcServer := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)))
+	signerpb.RegisterSignerServer(grpcServer, server)
+
+	listener, err := net.Listen("tcp", ":"+cfg.Port)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not listen on port "+cfg.Port)
+		os.Exit(1)
+	}
+
+	errs := make(chan error)
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+		errs <- fmt.Errorf("%s", <-c)
+	}()
+
+	go func() {
+		level.Info(logger).Log("transport", "gRPC", "address", ":"+cfg.Port, "msg", "listening")
+		errs <- grpcServer.Serve(listener)
+	}()
+
+	level.Info(logger).Log("exit", <-errs)
+	grpcServer.GracefulStop()
+}
+
+// newKey loads the CA key from the secret engine selected in cfg. The
+// returned function releases it.
+func newKey(cfg configs.Config, caHash stdcrypto.Hash, logger log.Logger) (stdcrypto.Signer, func(), error) {
+	switch cfg.SecretEngine {
+	case "file":
+		caKeyPassphrase, err := passphrase.Read(context.Background(), cfg.CAKeyPassphrase, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		keyPEM, err := ioutil.ReadFile(cfg.CAKeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		keyBlock, _ := pem.Decode(keyPEM)
+		key, err := crypto.DecryptPrivateKey(keyBlock, caKeyPassphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, func() {}, nil
+	case "pkcs11":
+		hsm, err := secretspkcs11.NewHSM(secretspkcs11.Config{
+			Module:     cfg.PKCS11Module,
+			TokenLabel: cfg.PKCS11TokenLabel,
+			Slot:       cfg.PKCS11Slot,
+			PIN:        cfg.PKCS11PIN,
+			KeyLabel:   cfg.PKCS11KeyLabel,
+			CACert:     cfg.CACertFile,
+			Hash:       caHash,
+			Sessions:   cfg.PKCS11Sessions,
+		}, nil, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		return hsm.Signer(context.Background()), hsm.Close, nil
+	}
+	return nil, nil, errors.New("unknown secret engine " + cfg.SecretEngine)
+}
@@ -0,0 +1,8 @@
+#!/bin/bash
+
+NAME=signer
+OUTPUT=../../build
+
+mkdir -p ${OUTPUT}
+
+CGO_ENABLED=${CGO_ENABLED:-0} go build -o ${OUTPUT}/$NAME ./*.go
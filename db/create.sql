@@ -1,22 +1,3 @@
-CREATE TABLE csr_store (
-    id SERIAL,
-    c TEXT,
-    st TEXT,
-    l TEXT,
-    o TEXT,
-    ou TEXT,
-    cn TEXT,
-    email TEXT,
-    status TEXT,
-    csrPath TEXT
-);
-
-CREATE TABLE ca_store (
-    id INTEGER,
-    status CHAR(1),
-    expirationDate TEXT,
-    revocationDate TEXT,
-    serial TEXT,
-    dn TEXT,
-    certPath TEXT
-);
\ No newline at end of file
+-- The enroller schema is created and upgraded by the enroller service on
+-- startup, see pkg/enroller/models/migrations. This file is kept so the
+-- database image and the Kubernetes configuration keep working.
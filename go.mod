@@ -6,6 +6,7 @@ require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/go-kit/kit v0.10.0
 	github.com/go-stack/stack v1.8.0 // indirect
+	github.com/golang/protobuf v1.4.3
 	github.com/gorilla/mux v1.7.4
 	github.com/hashicorp/consul/api v1.4.0
 	github.com/hashicorp/vault v1.6.0
@@ -13,9 +14,15 @@ require (
 	github.com/hashicorp/vault/sdk v0.1.14-0.20201109203410-5e6e24692b32
 	github.com/kelseyhightower/envconfig v1.4.0
 	github.com/lib/pq v1.8.0
+	github.com/miekg/pkcs11 v1.0.3
 	github.com/nvellon/hal v0.3.0
 	github.com/opentracing/opentracing-go v1.1.0
 	github.com/prometheus/client_golang v1.8.0
-	github.com/uber/jaeger-client-go v2.25.0+incompatible // indirect
+	github.com/uber/jaeger-client-go v2.25.0+incompatible
 	github.com/uber/jaeger-lib v2.4.0+incompatible // indirect
+	github.com/youmark/pkcs8 v0.0.0-20201027041543-1326539a0a0a
+	golang.org/x/crypto v0.0.0-20201002170205-7f63de1d35b0
+	google.golang.org/grpc v1.29.1
+	google.golang.org/protobuf v1.25.0
+	modernc.org/sqlite v1.14.6
 )
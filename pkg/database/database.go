@@ -0,0 +1,128 @@
+// Package database opens the SQL connection pools used by the stores,
+// waiting for the database to become reachable with exponential backoff.
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+var (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 10 * time.Second
+)
+
+// Options tunes the connection pool. Zero values keep the database/sql
+// defaults. ConnectTimeout bounds how long Open waits for the database to
+// become reachable; with zero it waits until the context is done.
+type Options struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnectTimeout  time.Duration
+}
+
+// Pinger is implemented by the stores backed by a database connection pool,
+// so that their connectivity can be reported by the health endpoints.
+type Pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// Open opens a connection pool and pings the database until it answers,
+// the ConnectTimeout elapses or ctx is done.
+func Open(ctx context.Context, driverName string, dataSourceName string, opts Options, logger log.Logger) (*sql.DB, error) {
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(opts.MaxOpenConns)
+	if opts.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(opts.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+
+	if opts.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.ConnectTimeout)
+		defer cancel()
+	}
+	backoff := minBackoff
+	for {
+		err = db.PingContext(ctx)
+		if err == nil {
+			return db, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		level.Warn(logger).Log("err", err, "msg", "Could not connect to database, retrying in "+backoff.String())
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+	db.Close()
+	if errors.Is(err, ctx.Err()) {
+		return nil, fmt.Errorf("could not connect to database: %w", ctx.Err())
+	}
+	return nil, fmt.Errorf("could not connect to database: %v: %w", err, ctx.Err())
+}
+
+// PostgresConfig holds the Postgres connection settings of a service.
+type PostgresConfig struct {
+	Host        string
+	Port        string
+	DB          string
+	User        string
+	Password    string
+	SSLMode     string
+	SSLCert     string
+	SSLKey      string
+	SSLRootCert string
+}
+
+// DataSourceName returns the lib/pq connection string for c. Empty
+// settings are left out so that the driver defaults apply.
+func (c PostgresConfig) DataSourceName() string {
+	var params []string
+	for _, p := range []struct{ key, value string }{
+		{"dbname", c.DB},
+		{"user", c.User},
+		{"password", c.Password},
+		{"host", c.Host},
+		{"port", c.Port},
+		{"sslmode", c.SSLMode},
+		{"sslcert", c.SSLCert},
+		{"sslkey", c.SSLKey},
+		{"sslrootcert", c.SSLRootCert},
+	} {
+		if p.value != "" {
+			params = append(params, p.key+"="+quote(p.value))
+		}
+	}
+	return strings.Join(params, " ")
+}
+
+// quote quotes v as a lib/pq connection string value if needed.
+func quote(v string) string {
+	if !strings.ContainsAny(v, ` '\`) {
+		return v
+	}
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `'`, `\'`, -1)
+	return "'" + v + "'"
+}
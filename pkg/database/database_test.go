@@ -0,0 +1,108 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// flakyDriver refuses connections until its failures are used up.
+type flakyDriver struct {
+	mu       sync.Mutex
+	failures int
+	attempts int
+}
+
+func (d *flakyDriver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.attempts++
+	if d.failures != 0 {
+		d.failures--
+		return nil, errors.New("connection refused")
+	}
+	return conn{}, nil
+}
+
+type conn struct{}
+
+func (conn) Prepare(query string) (driver.Stmt, error) { return nil, errors.New("not implemented") }
+func (conn) Close() error                              { return nil }
+func (conn) Begin() (driver.Tx, error)                 { return nil, errors.New("not implemented") }
+
+var flaky = &flakyDriver{}
+
+func init() {
+	sql.Register("flaky", flaky)
+	minBackoff = time.Millisecond
+	maxBackoff = 4 * time.Millisecond
+}
+
+func reset(failures int) {
+	flaky.mu.Lock()
+	flaky.failures = failures
+	flaky.attempts = 0
+	flaky.mu.Unlock()
+}
+
+func TestOpenRetries(t *testing.T) {
+	reset(5)
+	db, err := Open(context.Background(), "flaky", "", Options{MaxOpenConns: 3, ConnectTimeout: time.Minute}, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	defer db.Close()
+	if flaky.attempts != 6 {
+		t.Errorf("attempts = %d, want 6", flaky.attempts)
+	}
+	if max := db.Stats().MaxOpenConnections; max != 3 {
+		t.Errorf("MaxOpenConnections = %d, want 3", max)
+	}
+}
+
+func TestOpenDeadline(t *testing.T) {
+	reset(-1)
+	start := time.Now()
+	_, err := Open(context.Background(), "flaky", "", Options{ConnectTimeout: 50 * time.Millisecond}, log.NewNopLogger())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Open error = %v, want deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Open returned after %s", elapsed)
+	}
+}
+
+func TestOpenCancel(t *testing.T) {
+	reset(-1)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	_, err := Open(ctx, "flaky", "", Options{}, log.NewNopLogger())
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Open error = %v, want canceled", err)
+	}
+}
+
+func TestDataSourceName(t *testing.T) {
+	c := PostgresConfig{
+		Host:        "db",
+		Port:        "5432",
+		DB:          "enrollerdb",
+		User:        "enroller",
+		Password:    `it's a \secret`,
+		SSLMode:     "verify-full",
+		SSLRootCert: "/certs/ca.crt",
+	}
+	want := `dbname=enrollerdb user=enroller password='it\'s a \\secret' host=db port=5432 sslmode=verify-full sslrootcert=/certs/ca.crt`
+	if got := c.DataSourceName(); got != want {
+		t.Errorf("DataSourceName = %s, want %s", got, want)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/lamassuiot/enroller/pkg/enroller/models/csr"
+	"github.com/lamassuiot/enroller/pkg/enroller/secrets"
 
 	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/tracing/opentracing"
@@ -19,6 +20,8 @@ type Endpoints struct {
 	PutChangeCSRStatusEndpoint endpoint.Endpoint
 	DeleteCSREndpoint          endpoint.Endpoint
 	GetCRTEndpoint             endpoint.Endpoint
+	GetCAsEndpoint             endpoint.Endpoint
+	UnsealEndpoint             endpoint.Endpoint
 }
 
 func MakeServerEndpoints(s Service, otTracer stdopentracing.Tracer) Endpoints {
@@ -62,6 +65,16 @@ func MakeServerEndpoints(s Service, otTracer stdopentracing.Tracer) Endpoints {
 		getCRTEndpoint = MakeGetCTREndpoint(s)
 		getCRTEndpoint = opentracing.TraceServer(otTracer, "GetCRT")(getCRTEndpoint)
 	}
+	var getCAsEndpoint endpoint.Endpoint
+	{
+		getCAsEndpoint = MakeGetCAsEndpoint(s)
+		getCAsEndpoint = opentracing.TraceServer(otTracer, "GetCAs")(getCAsEndpoint)
+	}
+	var unsealEndpoint endpoint.Endpoint
+	{
+		unsealEndpoint = MakeUnsealEndpoint(s)
+		unsealEndpoint = opentracing.TraceServer(otTracer, "Unseal")(unsealEndpoint)
+	}
 
 	return Endpoints{
 		HealthEndpoint:             healthEndpoint,
@@ -72,13 +85,15 @@ func MakeServerEndpoints(s Service, otTracer stdopentracing.Tracer) Endpoints {
 		PutChangeCSRStatusEndpoint: putChangeCSRStatusEndpoint,
 		DeleteCSREndpoint:          deleteCSREndpoint,
 		GetCRTEndpoint:             getCRTEndpoint,
+		GetCAsEndpoint:             getCAsEndpoint,
+		UnsealEndpoint:             unsealEndpoint,
 	}
 }
 
 func MakeHealthEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		healthy := s.Health(ctx)
-		return healthResponse{Healthy: healthy}, nil
+		return healthResponse{Healthy: healthy, Seals: s.GetSealStatus(ctx)}, nil
 	}
 }
 
@@ -93,8 +108,8 @@ func MakePostCSREndpoint(s Service) endpoint.Endpoint {
 func MakeGetPendingCSRsEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		_ = request.(getPendingCSRsRequest)
-		csrs := s.GetPendingCSRs(ctx)
-		return getPendingCSRsResponse{CSRs: csrs}, nil
+		csrs, err := s.GetPendingCSRs(ctx)
+		return getPendingCSRsResponse{CSRs: csrs, Err: err}, nil
 	}
 }
 
@@ -117,6 +132,8 @@ func MakeGetPendingCSRFileEndpoint(s Service) endpoint.Endpoint {
 func MakePutChangeCSRStatusEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		req := request.(putChangeCSRStatusRequest)
+		ctx = secrets.WithProfile(ctx, req.Profile)
+		ctx = secrets.WithCA(ctx, req.CA)
 		csr, err := s.PutChangeCSRStatus(ctx, req.CSR, req.ID)
 		return putChangeCSRsResponse{CSR: csr, Err: err}, nil
 	}
@@ -138,11 +155,31 @@ func MakeGetCTREndpoint(s Service) endpoint.Endpoint {
 	}
 }
 
+func MakeGetCAsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		_ = request.(getCAsRequest)
+		cas, err := s.GetCAs(ctx)
+		return getCAsResponse{CAs: cas, Err: err}, nil
+	}
+}
+
+func MakeUnsealEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(unsealRequest)
+		status, err := s.Unseal(ctx, req.CA, req.Share)
+		return unsealResponse{SealStatus: status, Err: err}, nil
+	}
+}
+
 type healthRequest struct{}
 
 type healthResponse struct {
-	Healthy bool  `json:"healthy,omitempty"`
-	Err     error `json:"err,omitempty"`
+	Healthy bool `json:"healthy"`
+	// Seals are the seal status of the CAs whose key is split among
+	// custodians. A sealed CA does not make the service unhealthy, so that
+	// it can still be unsealed behind a load balancer.
+	Seals []SealStatus `json:"seals,omitempty"`
+	Err   error        `json:"err,omitempty"`
 }
 
 type getCRTRequest struct {
@@ -169,8 +206,11 @@ type getPendingCSRsRequest struct{}
 
 type getPendingCSRsResponse struct {
 	CSRs csr.CSRs `json:"CSRs,omitempty"`
+	Err  error    `json:"err,omitempty"`
 }
 
+func (r getPendingCSRsResponse) error() error { return r.Err }
+
 type getPendingCSRRequest struct {
 	ID int
 }
@@ -190,6 +230,11 @@ type getPendingCSRFileResponse struct {
 type putChangeCSRStatusRequest struct {
 	CSR csr.CSR
 	ID  int
+	// Profile is the certificate profile used when the CSR is approved.
+	Profile string
+	// CA is the name of the CA that issues the certificate when the CSR is
+	// approved, empty for the default CA.
+	CA string
 }
 
 type putChangeCSRsResponse struct {
@@ -208,3 +253,24 @@ type deleteCSRResponse struct {
 }
 
 func (r deleteCSRResponse) error() error { return r.Err }
+
+type getCAsRequest struct{}
+
+type getCAsResponse struct {
+	CAs []CA  `json:"cas"`
+	Err error `json:"-"`
+}
+
+func (r getCAsResponse) error() error { return r.Err }
+
+type unsealRequest struct {
+	CA    string `json:"-"`
+	Share []byte `json:"share"`
+}
+
+type unsealResponse struct {
+	SealStatus
+	Err error `json:"-"`
+}
+
+func (r unsealResponse) error() error { return r.Err }
@@ -46,9 +46,9 @@ func (mw *instrumentingMiddleware) PostCSR(ctx context.Context, data []byte) (cs
 	return mw.next.PostCSR(ctx, data)
 }
 
-func (mw *instrumentingMiddleware) GetPendingCSRs(ctx context.Context) csrmodel.CSRs {
+func (mw *instrumentingMiddleware) GetPendingCSRs(ctx context.Context) (csrs csrmodel.CSRs, err error) {
 	defer func(begin time.Time) {
-		lvs := []string{"method", "GetPendingCSRs", "error", "false"}
+		lvs := []string{"method", "GetPendingCSRs", "error", fmt.Sprint(err != nil)}
 		mw.requestCount.With(lvs...).Add(1)
 		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
 	}(time.Now())
@@ -105,3 +105,33 @@ func (mw *instrumentingMiddleware) GetCRT(ctx context.Context, id int) (crt []by
 
 	return mw.next.GetCRT(ctx, id)
 }
+
+func (mw *instrumentingMiddleware) Unseal(ctx context.Context, ca string, share []byte) (status SealStatus, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "Unseal", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.Unseal(ctx, ca, share)
+}
+
+func (mw *instrumentingMiddleware) GetSealStatus(ctx context.Context) []SealStatus {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "GetSealStatus", "error", "false"}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.GetSealStatus(ctx)
+}
+
+func (mw *instrumentingMiddleware) GetCAs(ctx context.Context) (cas []CA, err error) {
+	defer func(begin time.Time) {
+		lvs := []string{"method", "GetCAs", "error", fmt.Sprint(err != nil)}
+		mw.requestCount.With(lvs...).Add(1)
+		mw.requestLatency.With(lvs...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return mw.next.GetCAs(ctx)
+}
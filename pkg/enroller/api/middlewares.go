@@ -48,12 +48,13 @@ func (mw loggingMiddleware) PostCSR(ctx context.Context, data []byte) (csr csr.C
 	return mw.next.PostCSR(ctx, data)
 }
 
-func (mw loggingMiddleware) GetPendingCSRs(ctx context.Context) (csrs csr.CSRs) {
+func (mw loggingMiddleware) GetPendingCSRs(ctx context.Context) (csrs csr.CSRs, err error) {
 	defer func(begin time.Time) {
 		mw.logger.Log(
 			"method", "GetPendingCSRs",
 			"number_csrs", len(csrs.CSRs),
 			"took", time.Since(begin),
+			"err", err,
 		)
 	}(time.Now())
 	return mw.next.GetPendingCSRs(ctx)
@@ -122,3 +123,40 @@ func (mw loggingMiddleware) GetCRT(ctx context.Context, id int) (data []byte, er
 	}(time.Now())
 	return mw.next.GetCRT(ctx, id)
 }
+
+func (mw loggingMiddleware) Unseal(ctx context.Context, ca string, share []byte) (status SealStatus, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "Unseal",
+			"ca", ca,
+			"sealed", status.Sealed,
+			"progress", status.Progress,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.Unseal(ctx, ca, share)
+}
+
+func (mw loggingMiddleware) GetSealStatus(ctx context.Context) (statuses []SealStatus) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "GetSealStatus",
+			"number_cas", len(statuses),
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.GetSealStatus(ctx)
+}
+
+func (mw loggingMiddleware) GetCAs(ctx context.Context) (cas []CA, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"method", "GetCAs",
+			"number_cas", len(cas),
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+	return mw.next.GetCAs(ctx)
+}
@@ -0,0 +1,256 @@
+package api
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	certstore "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store"
+	csrmodel "github.com/lamassuiot/enroller/pkg/enroller/models/csr"
+	csrstore "github.com/lamassuiot/enroller/pkg/enroller/models/csr/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/journal"
+	journalstore "github.com/lamassuiot/enroller/pkg/enroller/models/journal/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// unitOfWork tracks the steps of an operation spanning the database and
+// file stores, each registering how to undo it. Its journal entry, with a
+// heartbeat while it runs, lets Recover finish it if the replica dies.
+type unitOfWork struct {
+	journal journalstore.DB
+	id      int
+	undo    []func(ctx context.Context) error
+	stop    chan struct{}
+}
+
+// endTimeout bounds the rollback and commit of an operation. They do not use
+// the request context, so a client going away does not leave the operation
+// half done.
+const endTimeout = 30 * time.Second
+
+// heartbeatInterval is how often a running operation refreshes its journal
+// entry. The operation timeout must be longer.
+var heartbeatInterval = 30 * time.Second
+
+func (s *enrollerService) beginOperation(ctx context.Context, kind string, csrID int) (*unitOfWork, error) {
+	id, err := s.journalDBStore.Insert(ctx, journal.Operation{Kind: kind, CSRID: csrID})
+	if err != nil {
+		return nil, err
+	}
+	u := &unitOfWork{journal: s.journalDBStore, id: id, stop: make(chan struct{})}
+	go u.heartbeat(heartbeatInterval)
+	return u, nil
+}
+
+// heartbeat refreshes the journal entry until the operation ends. A failed
+// refresh is retried on the next tick.
+func (u *unitOfWork) heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-u.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			u.journal.Heartbeat(ctx, u.id)
+			cancel()
+		}
+	}
+}
+
+func (u *unitOfWork) setCSRID(ctx context.Context, csrID int) error {
+	return u.journal.UpdateCSRID(ctx, u.id, csrID)
+}
+
+func (u *unitOfWork) onRollback(fn func(ctx context.Context) error) {
+	u.undo = append(u.undo, fn)
+}
+
+// rollback undoes the completed steps in reverse order. If any of them
+// fails the journal entry is kept so that Recover retries the operation.
+func (u *unitOfWork) rollback() {
+	close(u.stop)
+	ctx, cancel := context.WithTimeout(context.Background(), endTimeout)
+	defer cancel()
+	for i := len(u.undo) - 1; i >= 0; i-- {
+		if err := u.undo[i](ctx); err != nil {
+			return
+		}
+	}
+	u.journal.Delete(ctx, u.id)
+}
+
+// commit ends the operation. A failure to remove the journal entry is not
+// an error for the caller: Recover will find every step done and drop it.
+func (u *unitOfWork) commit() {
+	close(u.stop)
+	ctx, cancel := context.WithTimeout(context.Background(), endTimeout)
+	defer cancel()
+	u.journal.Delete(ctx, u.id)
+}
+
+// Recover finishes or rolls back the journaled operations without a
+// heartbeat for maxAge, which were interrupted before reaching their end.
+// The others are still running on some replica. It is run at startup and
+// then by RecoverEvery.
+func Recover(ctx context.Context, journalDBStore journalstore.DB, csrDBStore csrstore.DB, csrFileStore csrstore.File, certsDBStore certstore.DB, certsFileStore certstore.File, maxAge time.Duration, logger log.Logger) error {
+	ops, err := journalDBStore.SelectAll(ctx)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if time.Since(op.Heartbeat) < maxAge {
+			continue
+		}
+		var err error
+		switch op.Kind {
+		case journal.PostCSR:
+			err = recoverPostCSR(ctx, op, csrDBStore, csrFileStore, logger)
+		case journal.ApprobeCSR:
+			err = recoverApprobeCSR(ctx, op, csrDBStore, certsDBStore, certsFileStore)
+		case journal.DeleteCSR:
+			err = recoverDeleteCSR(ctx, op, csrDBStore, csrFileStore)
+		case journal.RevokeCert:
+			err = recoverRevokeCert(ctx, op, csrDBStore, certsDBStore)
+		}
+		if err != nil {
+			level.Error(logger).Log("err", err, "msg", "Could not recover "+op.Kind+" operation with ID "+strconv.Itoa(op.ID))
+			continue
+		}
+		err = journalDBStore.Delete(ctx, op.ID)
+		if err != nil {
+			return err
+		}
+		level.Info(logger).Log("msg", op.Kind+" operation with ID "+strconv.Itoa(op.ID)+" recovered")
+	}
+	return nil
+}
+
+// RecoverEvery runs Recover every interval until ctx is done, so that the
+// operations interrupted on a replica that is not restarted, or whose
+// rollback failed, are recovered by the running replicas.
+func RecoverEvery(ctx context.Context, interval time.Duration, journalDBStore journalstore.DB, csrDBStore csrstore.DB, csrFileStore csrstore.File, certsDBStore certstore.DB, certsFileStore certstore.File, maxAge time.Duration, logger log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := Recover(ctx, journalDBStore, csrDBStore, csrFileStore, certsDBStore, certsFileStore, maxAge, logger)
+			if err != nil {
+				level.Error(logger).Log("err", err, "msg", "Could not recover interrupted operations")
+			}
+		}
+	}
+}
+
+// recoverPostCSR keeps the CSR if both its row and file were stored and
+// removes whatever part was written otherwise. An operation interrupted
+// before recording the CSR ID finds its row by the operation ID.
+func recoverPostCSR(ctx context.Context, op journal.Operation, csrDBStore csrstore.DB, csrFileStore csrstore.File, logger log.Logger) error {
+	if op.CSRID == 0 {
+		c, err := csrDBStore.SelectByOperation(ctx, op.ID)
+		if storeerr.IsNotFound(err) {
+			level.Warn(logger).Log("msg", "Interrupted "+op.Kind+" operation with ID "+strconv.Itoa(op.ID)+" has no CSR assigned, nothing to recover")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		op.CSRID = c.Id
+	}
+	_, err := csrFileStore.SelectByID(ctx, op.CSRID)
+	if err != nil && !storeerr.IsNotFound(err) {
+		return err
+	}
+	fileExists := err == nil
+	_, err = csrDBStore.SelectByID(ctx, op.CSRID)
+	if err != nil && !storeerr.IsNotFound(err) {
+		return err
+	}
+	rowExists := err == nil
+
+	if fileExists && rowExists {
+		return nil
+	}
+	if fileExists {
+		return ignoreNotExist(csrFileStore.Delete(ctx, op.CSRID))
+	}
+	if rowExists {
+		return csrDBStore.Delete(ctx, op.CSRID)
+	}
+	return nil
+}
+
+// recoverApprobeCSR removes the certificate if the CSR status change was
+// not committed. An approbed CSR always has both certificate row and file.
+func recoverApprobeCSR(ctx context.Context, op journal.Operation, csrDBStore csrstore.DB, certsDBStore certstore.DB, certsFileStore certstore.File) error {
+	c, err := csrDBStore.SelectByID(ctx, op.CSRID)
+	if err != nil && !storeerr.IsNotFound(err) {
+		return err
+	}
+	if err == nil && c.Status != csrmodel.PendingStatus {
+		return nil
+	}
+	err = ignoreNotExist(certsFileStore.Delete(ctx, op.CSRID))
+	if err != nil {
+		return err
+	}
+	_, err = certsDBStore.SelectByID(ctx, op.CSRID)
+	if storeerr.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return certsDBStore.Delete(ctx, op.CSRID)
+}
+
+// recoverDeleteCSR rolls the deletion forward, as the CSR was already
+// checked to be deletable when the operation started.
+func recoverDeleteCSR(ctx context.Context, op journal.Operation, csrDBStore csrstore.DB, csrFileStore csrstore.File) error {
+	err := ignoreNotExist(csrFileStore.Delete(ctx, op.CSRID))
+	if err != nil {
+		return err
+	}
+	_, err = csrDBStore.SelectByID(ctx, op.CSRID)
+	if storeerr.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return csrDBStore.Delete(ctx, op.CSRID)
+}
+
+// recoverRevokeCert makes the certificate valid again if the CSR status
+// change was not committed.
+func recoverRevokeCert(ctx context.Context, op journal.Operation, csrDBStore csrstore.DB, certsDBStore certstore.DB) error {
+	c, err := csrDBStore.SelectByID(ctx, op.CSRID)
+	if err != nil {
+		return ignoreNotExist(err)
+	}
+	if c.Status != csrmodel.ApprobedStatus {
+		return nil
+	}
+	crt, err := certsDBStore.SelectByID(ctx, op.CSRID)
+	if err != nil {
+		return ignoreNotExist(err)
+	}
+	if crt.Status != "R" {
+		return nil
+	}
+	return certsDBStore.Unrevoke(ctx, op.CSRID)
+}
+
+func ignoreNotExist(err error) error {
+	if storeerr.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
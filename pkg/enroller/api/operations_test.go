@@ -0,0 +1,470 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/models/certs"
+	certstore "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store"
+	csrmodel "github.com/lamassuiot/enroller/pkg/enroller/models/csr"
+	csrstore "github.com/lamassuiot/enroller/pkg/enroller/models/csr/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/journal"
+	journalstore "github.com/lamassuiot/enroller/pkg/enroller/models/journal/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
+
+	"github.com/go-kit/kit/log"
+)
+
+var errInjected = storeerr.Unavailable(errors.New("injected failure"))
+
+// failures names the store calls that fail, as in "csrdb.Insert".
+type failures map[string]bool
+
+func (f failures) check(call string) error {
+	if f[call] {
+		return errInjected
+	}
+	return nil
+}
+
+type faultyCSRDB struct {
+	csrstore.DB
+	fail failures
+}
+
+func (db faultyCSRDB) Insert(ctx context.Context, c csrmodel.CSR) (int, error) {
+	if err := db.fail.check("csrdb.Insert"); err != nil {
+		return 0, err
+	}
+	return db.DB.Insert(ctx, c)
+}
+
+func (db faultyCSRDB) UpdateFilePath(ctx context.Context, c csrmodel.CSR) error {
+	if err := db.fail.check("csrdb.UpdateFilePath"); err != nil {
+		return err
+	}
+	return db.DB.UpdateFilePath(ctx, c)
+}
+
+// Transition runs the operation but fails to commit the status change.
+func (db faultyCSRDB) Transition(ctx context.Context, id int, from string, to string, fn func() error) error {
+	if db.fail["csrdb.Transition"] {
+		if err := fn(); err != nil {
+			return err
+		}
+		return errInjected
+	}
+	return db.DB.Transition(ctx, id, from, to, fn)
+}
+
+func (db faultyCSRDB) Delete(ctx context.Context, id int) error {
+	if err := db.fail.check("csrdb.Delete"); err != nil {
+		return err
+	}
+	return db.DB.Delete(ctx, id)
+}
+
+type faultyCSRFile struct {
+	csrstore.File
+	fail failures
+}
+
+func (f faultyCSRFile) Insert(ctx context.Context, id int, data []byte) error {
+	if err := f.fail.check("csrfile.Insert"); err != nil {
+		return err
+	}
+	return f.File.Insert(ctx, id, data)
+}
+
+func (f faultyCSRFile) Delete(ctx context.Context, id int) error {
+	if err := f.fail.check("csrfile.Delete"); err != nil {
+		return err
+	}
+	return f.File.Delete(ctx, id)
+}
+
+type faultyCertsDB struct {
+	certstore.DB
+	fail failures
+}
+
+func (db faultyCertsDB) Insert(ctx context.Context, crt certs.CRT) error {
+	if err := db.fail.check("certsdb.Insert"); err != nil {
+		return err
+	}
+	return db.DB.Insert(ctx, crt)
+}
+
+func (db faultyCertsDB) Delete(ctx context.Context, id int) error {
+	if err := db.fail.check("certsdb.Delete"); err != nil {
+		return err
+	}
+	return db.DB.Delete(ctx, id)
+}
+
+type faultyCertsFile struct {
+	certstore.File
+	fail failures
+}
+
+func (f faultyCertsFile) Insert(ctx context.Context, id int, data []byte) error {
+	if err := f.fail.check("certsfile.Insert"); err != nil {
+		return err
+	}
+	return f.File.Insert(ctx, id, data)
+}
+
+type faultyJournalDB struct {
+	journalstore.DB
+	fail failures
+}
+
+func (db faultyJournalDB) UpdateCSRID(ctx context.Context, id int, csrID int) error {
+	if err := db.fail.check("journal.UpdateCSRID"); err != nil {
+		return err
+	}
+	return db.DB.UpdateCSRID(ctx, id, csrID)
+}
+
+// faultyService returns the service of stu with the store calls in fail
+// failing.
+func faultyService(stu *serviceSetUp, fail failures) Service {
+	return NewEnrollerService(faultyCSRDB{stu.csrdb, fail}, faultyCSRFile{stu.csrfile, fail}, faultyCertsDB{stu.certdb, fail}, faultyCertsFile{stu.certfile, fail}, faultyJournalDB{stu.journaldb, fail}, stu.cas, stu.homePath)
+}
+
+// insertTestCSR stores a CSR with status, with its row and file.
+func insertTestCSR(t *testing.T, stu *serviceSetUp, status string) int {
+	t.Helper()
+	ctx := context.Background()
+	id, err := stu.csrdb.Insert(ctx, csrmodel.CSR{CommonName: "test.com", Status: status})
+	if err != nil {
+		t.Fatal("Could not insert CSR in database")
+	}
+	err = stu.csrfile.Insert(ctx, id, testCSR())
+	if err != nil {
+		t.Fatal("Could not insert CSR in file system")
+	}
+	return id
+}
+
+// insertTestCert stores the certificate of the CSR with id, with its row and
+// file.
+func insertTestCert(t *testing.T, stu *serviceSetUp, id int, status string) {
+	t.Helper()
+	ctx := context.Background()
+	err := stu.certdb.Insert(ctx, certs.CRT{ID: id, Status: status, Serial: big.NewInt(int64(id)), Issuer: "CN=Enroller Test CA"})
+	if err != nil {
+		t.Fatal("Could not insert certificate in database")
+	}
+	err = stu.certfile.Insert(ctx, id, []byte("certificate"))
+	if err != nil {
+		t.Fatal("Could not insert certificate in file system")
+	}
+}
+
+// checkStores checks which of the CSR and certificate rows and files with
+// id exist, and that no operation is left in the journal.
+func checkStores(t *testing.T, stu *serviceSetUp, id int, csrRow bool, csrFile bool, certRow bool, certFile bool) {
+	t.Helper()
+	ctx := context.Background()
+	_, err := stu.csrdb.SelectByID(ctx, id)
+	if (err == nil) != csrRow {
+		t.Errorf("Got CSR row %t; want %t", err == nil, csrRow)
+	}
+	_, err = stu.csrfile.SelectByID(ctx, id)
+	if (err == nil) != csrFile {
+		t.Errorf("Got CSR file %t; want %t", err == nil, csrFile)
+	}
+	_, err = stu.certdb.SelectByID(ctx, id)
+	if (err == nil) != certRow {
+		t.Errorf("Got certificate row %t; want %t", err == nil, certRow)
+	}
+	_, err = stu.certfile.SelectByID(ctx, id)
+	if (err == nil) != certFile {
+		t.Errorf("Got certificate file %t; want %t", err == nil, certFile)
+	}
+	if ops, _ := stu.journaldb.SelectAll(ctx); len(ops) != 0 {
+		t.Errorf("Got %d journaled operations; want none", len(ops))
+	}
+}
+
+func TestPostCSRRollback(t *testing.T) {
+	testCases := []struct {
+		name string
+		fail string
+		ret  error
+	}{
+		{"CSR row insert fails", "csrdb.Insert", ErrUnavailable},
+		{"Journal update fails", "journal.UpdateCSRID", ErrUnavailable},
+		{"CSR file path update fails", "csrdb.UpdateFilePath", ErrUnavailable},
+		{"CSR file insert fails", "csrfile.Insert", ErrUnavailable},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			stu := setup()
+			srv := faultyService(stu, failures{tc.fail: true})
+			_, err := srv.PostCSR(context.Background(), testCSR())
+			if err != tc.ret {
+				t.Errorf("Got result is %v; want %s", err, tc.ret)
+			}
+			if csrs, _ := stu.csrdb.SelectAll(context.Background()); len(csrs.CSRs) != 0 {
+				t.Errorf("Got %d CSR rows; want none", len(csrs.CSRs))
+			}
+			if ids, _ := stu.csrfile.SelectIDs(context.Background()); len(ids) != 0 {
+				t.Errorf("Got %d CSR files; want none", len(ids))
+			}
+			if ops, _ := stu.journaldb.SelectAll(context.Background()); len(ops) != 0 {
+				t.Errorf("Got %d journaled operations; want none", len(ops))
+			}
+		})
+	}
+}
+
+func TestApprobeCSRRollback(t *testing.T) {
+	testCases := []struct {
+		name string
+		fail string
+		ret  error
+	}{
+		{"Certificate row insert fails", "certsdb.Insert", ErrUnavailable},
+		{"Certificate file insert fails", "certsfile.Insert", ErrUnavailable},
+		{"Status change commit fails", "csrdb.Transition", ErrUnavailable},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			stu := setup()
+			id := insertTestCSR(t, stu, csrmodel.PendingStatus)
+			srv := faultyService(stu, failures{tc.fail: true})
+			_, err := srv.PutChangeCSRStatus(context.Background(), csrmodel.CSR{Status: csrmodel.ApprobedStatus}, id)
+			if err != tc.ret {
+				t.Errorf("Got result is %v; want %s", err, tc.ret)
+			}
+			checkStores(t, stu, id, true, true, false, false)
+			if c, _ := stu.csrdb.SelectByID(context.Background(), id); c.Status != csrmodel.PendingStatus {
+				t.Errorf("Got status %s; want %s", c.Status, csrmodel.PendingStatus)
+			}
+		})
+	}
+}
+
+func TestDeleteCSRRollback(t *testing.T) {
+	testCases := []struct {
+		name string
+		fail string
+		ret  error
+	}{
+		{"CSR file delete fails", "csrfile.Delete", ErrUnavailable},
+		{"CSR row delete fails", "csrdb.Delete", ErrUnavailable},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			stu := setup()
+			id := insertTestCSR(t, stu, csrmodel.DeniedStatus)
+			srv := faultyService(stu, failures{tc.fail: true})
+			err := srv.DeleteCSR(context.Background(), id)
+			if err != tc.ret {
+				t.Errorf("Got result is %v; want %s", err, tc.ret)
+			}
+			checkStores(t, stu, id, true, true, false, false)
+		})
+	}
+}
+
+// TestFailedRollback checks that an operation whose rollback fails is kept
+// in the journal and recovered afterwards.
+func TestFailedRollback(t *testing.T) {
+	stu := setup()
+	ctx := context.Background()
+	id := insertTestCSR(t, stu, csrmodel.PendingStatus)
+	srv := faultyService(stu, failures{"certsfile.Insert": true, "certsdb.Delete": true})
+	_, err := srv.PutChangeCSRStatus(ctx, csrmodel.CSR{Status: csrmodel.ApprobedStatus}, id)
+	if err != ErrUnavailable {
+		t.Errorf("Got result is %v; want %s", err, ErrUnavailable)
+	}
+	if ops, _ := stu.journaldb.SelectAll(ctx); len(ops) != 1 || ops[0].Kind != journal.ApprobeCSR {
+		t.Fatalf("Got journaled operations %v; want the approbation", ops)
+	}
+
+	err = Recover(ctx, stu.journaldb, stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, 0, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Got result is %s; want nil", err)
+	}
+	checkStores(t, stu, id, true, true, false, false)
+}
+
+func TestRecover(t *testing.T) {
+	testCases := []struct {
+		name string
+		kind string
+		// seed stores the data left by the interrupted operation, returning
+		// the ID of its CSR.
+		seed    func(t *testing.T, stu *serviceSetUp) int
+		csrRow  bool
+		csrFile bool
+		certRow bool
+		crtFile bool
+		// status is the certificate status after recovery, if any.
+		status string
+	}{
+		{"Posted CSR without ID", journal.PostCSR, func(t *testing.T, stu *serviceSetUp) int { return 0 }, false, false, false, false, ""},
+		{"Posted CSR stored", journal.PostCSR, func(t *testing.T, stu *serviceSetUp) int {
+			return insertTestCSR(t, stu, csrmodel.PendingStatus)
+		}, true, true, false, false, ""},
+		{"Posted CSR without file", journal.PostCSR, func(t *testing.T, stu *serviceSetUp) int {
+			id := insertTestCSR(t, stu, csrmodel.PendingStatus)
+			stu.csrfile.Delete(context.Background(), id)
+			return id
+		}, false, false, false, false, ""},
+		{"Posted CSR without row", journal.PostCSR, func(t *testing.T, stu *serviceSetUp) int {
+			id := insertTestCSR(t, stu, csrmodel.PendingStatus)
+			stu.csrdb.Delete(context.Background(), id)
+			return id
+		}, false, false, false, false, ""},
+		{"Approbation not committed", journal.ApprobeCSR, func(t *testing.T, stu *serviceSetUp) int {
+			id := insertTestCSR(t, stu, csrmodel.PendingStatus)
+			insertTestCert(t, stu, id, "V")
+			return id
+		}, true, true, false, false, ""},
+		{"Approbation committed", journal.ApprobeCSR, func(t *testing.T, stu *serviceSetUp) int {
+			id := insertTestCSR(t, stu, csrmodel.ApprobedStatus)
+			insertTestCert(t, stu, id, "V")
+			return id
+		}, true, true, true, true, "V"},
+		{"Deletion interrupted", journal.DeleteCSR, func(t *testing.T, stu *serviceSetUp) int {
+			id := insertTestCSR(t, stu, csrmodel.DeniedStatus)
+			stu.csrfile.Delete(context.Background(), id)
+			return id
+		}, false, false, false, false, ""},
+		{"Revocation not committed", journal.RevokeCert, func(t *testing.T, stu *serviceSetUp) int {
+			id := insertTestCSR(t, stu, csrmodel.ApprobedStatus)
+			insertTestCert(t, stu, id, "R")
+			return id
+		}, true, true, true, true, "V"},
+		{"Revocation committed", journal.RevokeCert, func(t *testing.T, stu *serviceSetUp) int {
+			id := insertTestCSR(t, stu, csrmodel.RevokedStatus)
+			insertTestCert(t, stu, id, "R")
+			return id
+		}, true, true, true, true, "R"},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			stu := setup()
+			ctx := context.Background()
+			id := tc.seed(t, stu)
+			if _, err := stu.journaldb.Insert(ctx, journal.Operation{Kind: tc.kind, CSRID: id}); err != nil {
+				t.Fatal("Could not insert operation in journal")
+			}
+
+			err := Recover(ctx, stu.journaldb, stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, 0, log.NewNopLogger())
+			if err != nil {
+				t.Fatalf("Got result is %s; want nil", err)
+			}
+			checkStores(t, stu, id, tc.csrRow, tc.csrFile, tc.certRow, tc.crtFile)
+			if tc.status != "" {
+				if crt, _ := stu.certdb.SelectByID(ctx, id); crt.Status != tc.status {
+					t.Errorf("Got certificate status %s; want %s", crt.Status, tc.status)
+				}
+			}
+		})
+	}
+}
+
+func TestRecoverPostCSRWithoutID(t *testing.T) {
+	stu := setup()
+	ctx := context.Background()
+	opID, err := stu.journaldb.Insert(ctx, journal.Operation{Kind: journal.PostCSR})
+	if err != nil {
+		t.Fatal("Could not insert operation in journal")
+	}
+	id, err := stu.csrdb.Insert(ctx, csrmodel.CSR{CommonName: "test.com", Status: csrmodel.PendingStatus, OperationID: opID})
+	if err != nil {
+		t.Fatal("Could not insert CSR in database")
+	}
+
+	err = Recover(ctx, stu.journaldb, stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, 0, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Got result is %s; want nil", err)
+	}
+	checkStores(t, stu, id, false, false, false, false)
+}
+
+func TestRecoverSkipsRunningOperations(t *testing.T) {
+	stu := setup()
+	ctx := context.Background()
+	id := insertTestCSR(t, stu, csrmodel.PendingStatus)
+	insertTestCert(t, stu, id, "V")
+	if _, err := stu.journaldb.Insert(ctx, journal.Operation{Kind: journal.ApprobeCSR, CSRID: id}); err != nil {
+		t.Fatal("Could not insert operation in journal")
+	}
+
+	err := Recover(ctx, stu.journaldb, stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, time.Hour, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Got result is %s; want nil", err)
+	}
+	if ops, _ := stu.journaldb.SelectAll(ctx); len(ops) != 1 {
+		t.Errorf("Got %d journaled operations; want the running one", len(ops))
+	}
+	if _, err := stu.certdb.SelectByID(ctx, id); err != nil {
+		t.Errorf("Got result is %s; want the certificate of the running operation", err)
+	}
+}
+
+func TestRecoverSkipsOperationsWithHeartbeat(t *testing.T) {
+	defer func(interval time.Duration) { heartbeatInterval = interval }(heartbeatInterval)
+	heartbeatInterval = 10 * time.Millisecond
+	stu := setup()
+	srv := NewEnrollerService(stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, stu.journaldb, stu.cas, stu.homePath).(*enrollerService)
+	ctx := context.Background()
+	id := insertTestCSR(t, stu, csrmodel.PendingStatus)
+	insertTestCert(t, stu, id, "V")
+	op, err := srv.beginOperation(ctx, journal.ApprobeCSR, id)
+	if err != nil {
+		t.Fatalf("Got result is %s; want nil", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	err = Recover(ctx, stu.journaldb, stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, 250*time.Millisecond, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Got result is %s; want nil", err)
+	}
+	if _, err := stu.certdb.SelectByID(ctx, id); err != nil {
+		t.Errorf("Got result is %s; want the certificate of the running operation", err)
+	}
+	op.commit()
+	if ops, _ := stu.journaldb.SelectAll(ctx); len(ops) != 0 {
+		t.Errorf("Got %d journaled operations; want none", len(ops))
+	}
+}
+
+func TestRecoverEvery(t *testing.T) {
+	stu := setup()
+	ctx, cancel := context.WithCancel(context.Background())
+	id := insertTestCSR(t, stu, csrmodel.DeniedStatus)
+	if _, err := stu.journaldb.Insert(ctx, journal.Operation{Kind: journal.DeleteCSR, CSRID: id}); err != nil {
+		t.Fatal("Could not insert operation in journal")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		RecoverEvery(ctx, 10*time.Millisecond, stu.journaldb, stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, 0, log.NewNopLogger())
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ops, _ := stu.journaldb.SelectAll(ctx)
+		if len(ops) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Got operation still journaled; want it recovered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	checkStores(t, stu, id, false, false, false, false)
+}
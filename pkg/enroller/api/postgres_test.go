@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/configs"
+	"github.com/lamassuiot/enroller/pkg/enroller/crypto"
+	certsdb "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store/db"
+	certsmemory "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store/memory"
+	csrmodel "github.com/lamassuiot/enroller/pkg/enroller/models/csr"
+	csrdb "github.com/lamassuiot/enroller/pkg/enroller/models/csr/store/db"
+	csrmemory "github.com/lamassuiot/enroller/pkg/enroller/models/csr/store/memory"
+	journaldb "github.com/lamassuiot/enroller/pkg/enroller/models/journal/store/db"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/migrations"
+	"github.com/lamassuiot/enroller/pkg/enroller/secrets"
+	secretsfile "github.com/lamassuiot/enroller/pkg/enroller/secrets/file"
+	"github.com/lamassuiot/enroller/pkg/migrate"
+
+	"github.com/go-kit/kit/log"
+)
+
+// TestApprobeCSRPostgres approves a CSR with the Postgres stores, where the
+// certificate row references the CSR row locked by the status transition.
+func TestApprobeCSRPostgres(t *testing.T) {
+	err, cfg := configs.NewConfig("enrollertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.PostgresHostname == "" {
+		t.Skip("ENROLLERTEST_POSTGRESHOSTNAME not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	connStr := cfg.Postgres().DataSourceName()
+	sqlDB, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlDB.Close()
+	if _, err := migrate.NewMigrator(sqlDB, "postgres", migrations.Postgres, log.NewNopLogger()).Up(); err != nil {
+		t.Fatal(err)
+	}
+	csrDB, err := csrdb.NewDB(ctx, "postgres", connStr, cfg.DatabaseOptions(), log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	certDB, err := certsdb.NewDB(ctx, "postgres", connStr, cfg.DatabaseOptions(), log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	journalDB, err := journaldb.NewDB(ctx, "postgres", connStr, cfg.DatabaseOptions(), log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultSecrets, err := secretsfile.NewFile(homePath+"/enroller.crt", homePath+"/enroller.key", nil, "http://ocsp.test.com", "", 0, certDB, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cas, err := secrets.NewCAs("default", &secrets.CA{Name: "default", Secrets: defaultSecrets})
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrfile := csrmemory.NewFile()
+	srv := NewEnrollerService(csrDB, csrfile, certDB, certsmemory.NewFile(), journalDB, cas, homePath)
+
+	csrRaw := testCSR()
+	certReq, err := crypto.ParseNewCSR(csrRaw)
+	if err != nil {
+		t.Fatal("Could not parse CSR")
+	}
+	csr := csrmodel.CSR{CommonName: certReq.Subject.CommonName, Status: csrmodel.PendingStatus}
+	id, err := csrDB.Insert(ctx, csr)
+	if err != nil {
+		t.Fatal("Could not insert CSR in database")
+	}
+	defer csrDB.Delete(context.Background(), id)
+	if err := csrfile.Insert(ctx, id, csrRaw); err != nil {
+		t.Fatal("Could not insert CSR in file system")
+	}
+
+	csr.Status = csrmodel.ApprobedStatus
+	if _, err := srv.PutChangeCSRStatus(ctx, csr, id); err != nil {
+		t.Fatalf("Got result is %v; want nil", err)
+	}
+	defer certDB.Delete(context.Background(), id)
+	stored, err := csrDB.SelectByID(ctx, id)
+	if err != nil || stored.Status != csrmodel.ApprobedStatus {
+		t.Errorf("Got status %s, %v; want %s", stored.Status, err, csrmodel.ApprobedStatus)
+	}
+	if _, err := certDB.SelectByID(ctx, id); err != nil {
+		t.Errorf("Got result is %v; want the certificate in DB", err)
+	}
+}
@@ -1,26 +1,29 @@
 package api
 
 import (
-	"bytes"
 	"context"
 	"crypto/x509"
-	"database/sql"
+	"encoding/pem"
 	"errors"
 	"fmt"
-	"os"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/lamassuiot/enroller/pkg/database"
 	"github.com/lamassuiot/enroller/pkg/enroller/auth"
 	"github.com/lamassuiot/enroller/pkg/enroller/crypto"
+	"github.com/lamassuiot/enroller/pkg/enroller/lint"
 	"github.com/lamassuiot/enroller/pkg/enroller/models/certs"
 	certstore "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store"
 	"github.com/lamassuiot/enroller/pkg/enroller/models/csr"
 	csrmodel "github.com/lamassuiot/enroller/pkg/enroller/models/csr"
 	csrstore "github.com/lamassuiot/enroller/pkg/enroller/models/csr/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/journal"
+	journalstore "github.com/lamassuiot/enroller/pkg/enroller/models/journal/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
 	"github.com/lamassuiot/enroller/pkg/enroller/secrets"
+	"github.com/lamassuiot/enroller/pkg/enroller/secrets/seal"
 
 	"github.com/go-kit/kit/auth/jwt"
 )
@@ -28,12 +31,42 @@ import (
 type Service interface {
 	Health(ctx context.Context) bool
 	PostCSR(ctx context.Context, data []byte) (csrmodel.CSR, error)
-	GetPendingCSRs(ctx context.Context) csrmodel.CSRs
+	GetPendingCSRs(ctx context.Context) (csrmodel.CSRs, error)
 	GetPendingCSRDB(ctx context.Context, id int) (csrmodel.CSR, error)
 	GetPendingCSRFile(ctx context.Context, id int) ([]byte, error)
 	PutChangeCSRStatus(ctx context.Context, csr csrmodel.CSR, id int) (csrmodel.CSR, error)
 	DeleteCSR(ctx context.Context, id int) error
 	GetCRT(ctx context.Context, id int) ([]byte, error)
+	GetCAs(ctx context.Context) ([]CA, error)
+	Unseal(ctx context.Context, ca string, share []byte) (SealStatus, error)
+	GetSealStatus(ctx context.Context) []SealStatus
+}
+
+// CA is an issuing CA as listed by GetCAs.
+type CA struct {
+	Name    string `json:"name"`
+	Default bool   `json:"default"`
+	Subject string `json:"subject"`
+	// Chain holds the PEM certificate of the CA followed by its issuers.
+	Chain []string `json:"chain"`
+	// Issuing is false once the CA has been replaced by its successor.
+	Issuing    bool       `json:"issuing"`
+	Successor  string     `json:"successor,omitempty"`
+	RolloverAt *time.Time `json:"rollover_at,omitempty"`
+	// ActiveCertificates counts the unexpired certificates issued by the
+	// CA. Its CRL and OCSP responses are needed until the last of them
+	// expires at LastExpiration.
+	ActiveCertificates int        `json:"active_certificates"`
+	LastExpiration     *time.Time `json:"last_expiration,omitempty"`
+}
+
+// SealStatus tells whether the key of a CA split among custodians is
+// sealed, and how many of the Threshold unseal shares were submitted.
+type SealStatus struct {
+	CA        string `json:"ca"`
+	Sealed    bool   `json:"sealed"`
+	Threshold int    `json:"threshold"`
+	Progress  int    `json:"progress"`
 }
 
 type enrollerService struct {
@@ -42,7 +75,8 @@ type enrollerService struct {
 	csrFileStore   csrstore.File
 	certsDBStore   certstore.DB
 	certsFileStore certstore.File
-	secrets        secrets.Secrets
+	journalDBStore journalstore.DB
+	cas            *secrets.CAs
 	homePath       string
 }
 
@@ -56,7 +90,14 @@ var (
 	ErrInvalidDenyOp    = errors.New("invalid operation, only pending status CSRs can be denied")            //400
 	ErrInvalidDeleteOp  = errors.New("invalid operation, only denied or revoked status CSRs can be deleted") //400
 	ErrIncorrectType    = errors.New("unsupported media type")                                               //415
+	ErrCSRConflict      = errors.New("CSR status was changed by another request, retry the operation")       //409
 	ErrEmptyBody        = errors.New("empty body")
+	ErrInvalidProfile   = errors.New("invalid certificate profile")                             //400
+	ErrInvalidCA        = errors.New("invalid issuing CA")                                      //400
+	ErrNotSealable      = errors.New("CA key is not split among custodians")                    //400
+	ErrInvalidShare     = errors.New("invalid unseal share, submitted shares discarded")        //400
+	ErrSameCustodian    = errors.New("an unseal share was already submitted by this custodian") //409
+	ErrForbidden        = errors.New("operation not allowed for this user")                     //403
 
 	//Server errors
 	ErrInvalidOperation = errors.New("invalid operation")
@@ -67,22 +108,46 @@ var (
 	ErrUpdateCSR        = errors.New("unable to update CSR")
 	ErrDeleteCSR        = errors.New("unable to delete CSR")
 	ErrSignCSR          = errors.New("unable to sign CSR")
+	ErrGetCA            = errors.New("unable to get CA certificate")
+	ErrLintCert         = errors.New("certificate does not pass pre-issuance checks")
 	ErrRevokeCert       = errors.New("unable to revoke certificate")
 	ErrResponseEncode   = errors.New("error encoding response")
+	ErrUnavailable      = errors.New("storage is unavailable, retry later")                          //503
+	ErrSealed           = errors.New("CA key is sealed, custodians must submit their unseal shares") //503
+
+	errDuplicateSerial = errors.New("duplicate certificate serial")
 )
 
-func NewEnrollerService(csrDBStore csrstore.DB, csrFileStore csrstore.File, certsDBStore certstore.DB, certsFileStore certstore.File, secrets secrets.Secrets, homePath string) Service {
+// maxSerialAttempts bounds how many times a CSR is re-signed with a fresh
+// serial when the store reports a collision for the issuer.
+const maxSerialAttempts = 3
+
+// healthTimeout bounds the database checks of a health request.
+const healthTimeout = 5 * time.Second
+
+func NewEnrollerService(csrDBStore csrstore.DB, csrFileStore csrstore.File, certsDBStore certstore.DB, certsFileStore certstore.File, journalDBStore journalstore.DB, cas *secrets.CAs, homePath string) Service {
 	return &enrollerService{
 		csrDBStore:     csrDBStore,
 		csrFileStore:   csrFileStore,
 		certsDBStore:   certsDBStore,
 		certsFileStore: certsFileStore,
-		secrets:        secrets,
+		journalDBStore: journalDBStore,
+		cas:            cas,
 		homePath:       homePath,
 	}
 }
 
+// Health reports whether the database backed stores are reachable.
 func (s *enrollerService) Health(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+	for _, st := range []interface{}{s.csrDBStore, s.csrFileStore, s.certsDBStore, s.certsFileStore, s.journalDBStore} {
+		if p, ok := st.(database.Pinger); ok {
+			if err := p.PingContext(ctx); err != nil {
+				return false
+			}
+		}
+	}
 	return true
 }
 
@@ -91,14 +156,21 @@ func (s *enrollerService) PostCSR(ctx context.Context, data []byte) (csrmodel.CS
 	if err != nil {
 		return csrmodel.CSR{}, err
 	}
-	csr, err = s.insertCSRInDB(csr)
+	op, err := s.beginOperation(ctx, journal.PostCSR, 0)
 	if err != nil {
+		return csrmodel.CSR{}, storeError(err, ErrInsertCSR)
+	}
+	csr, err = s.insertCSRInDB(ctx, op, csr)
+	if err != nil {
+		op.rollback()
 		return csrmodel.CSR{}, err
 	}
-	err = s.insertCSRFile(data, csr.Id)
+	err = s.insertCSRFile(ctx, op, data, csr.Id)
 	if err != nil {
+		op.rollback()
 		return csrmodel.CSR{}, err
 	}
+	op.commit()
 	return csr, nil
 }
 
@@ -120,59 +192,63 @@ func parseCSRDataModel(data []byte) (csrmodel.CSR, error) {
 	return csr, nil
 }
 
-func (s *enrollerService) insertCSRInDB(csr csrmodel.CSR) (csrmodel.CSR, error) {
-	id, err := s.csrDBStore.Insert(csr)
+func (s *enrollerService) insertCSRInDB(ctx context.Context, op *unitOfWork, csr csrmodel.CSR) (csrmodel.CSR, error) {
+	csr.OperationID = op.id
+	id, err := s.csrDBStore.Insert(ctx, csr)
 	if err != nil {
-		return csrmodel.CSR{}, ErrInsertCSR
+		return csrmodel.CSR{}, storeError(err, ErrInsertCSR)
+	}
+	op.onRollback(func(ctx context.Context) error { return s.csrDBStore.Delete(ctx, id) })
+	err = op.setCSRID(ctx, id)
+	if err != nil {
+		return csrmodel.CSR{}, storeError(err, ErrInsertCSR)
 	}
 	csr.Id = id
-	csr.CsrFilePath = s.homePath + "/" + strconv.Itoa(id) + ".csr"
-	err = s.csrDBStore.UpdateFilePath(csr)
+	csr.CsrFilePath = csrmodel.FilePath(s.homePath, id)
+	err = s.csrDBStore.UpdateFilePath(ctx, csr)
 	if err != nil {
-		return csrmodel.CSR{}, ErrInsertCSR
+		return csrmodel.CSR{}, storeError(err, ErrInsertCSR)
 	}
 	return csr, nil
 }
 
-func (s *enrollerService) insertCSRFile(data []byte, id int) error {
-	err := s.csrFileStore.Insert(id, data)
+func (s *enrollerService) insertCSRFile(ctx context.Context, op *unitOfWork, data []byte, id int) error {
+	err := s.csrFileStore.Insert(ctx, id, data)
 	if err != nil {
-		s.csrDBStore.Delete(id)
-		return ErrInsertCSR
+		return storeError(err, ErrInsertCSR)
 	}
+	op.onRollback(func(ctx context.Context) error { return s.csrFileStore.Delete(ctx, id) })
 	return nil
 }
 
-func (s *enrollerService) GetPendingCSRs(ctx context.Context) csrmodel.CSRs {
+func (s *enrollerService) GetPendingCSRs(ctx context.Context) (csrmodel.CSRs, error) {
 	var csrs csr.CSRs
+	var err error
 	claims := ctx.Value(jwt.JWTClaimsContextKey).(*auth.KeycloakClaims)
-	admin := containsRole(claims.RealmAccess.RoleNames, "admin")
+	admin := claims.HasRole("admin")
 	if admin {
-		csrs = s.csrDBStore.SelectAll()
+		csrs, err = s.csrDBStore.SelectAll(ctx)
 	} else {
-		csrs = s.csrDBStore.SelectAllByCN(claims.PreferredUsername)
+		csrs, err = s.csrDBStore.SelectAllByCN(ctx, claims.PreferredUsername)
+	}
+	if err != nil {
+		return csrmodel.CSRs{}, storeError(err, ErrGetCSR)
 	}
-	return csrs
+	return csrs, nil
 }
 
 func (s *enrollerService) GetPendingCSRDB(ctx context.Context, id int) (csrmodel.CSR, error) {
-	c, err := s.csrDBStore.SelectByID(id)
+	c, err := s.csrDBStore.SelectByID(ctx, id)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return csrmodel.CSR{}, ErrInvalidID
-		}
-		return csrmodel.CSR{}, ErrGetCSR
+		return csrmodel.CSR{}, storeError(err, ErrGetCSR)
 	}
 	return c, nil
 }
 
 func (s *enrollerService) GetPendingCSRFile(ctx context.Context, id int) ([]byte, error) {
-	data, err := s.csrFileStore.SelectByID(id)
+	data, err := s.csrFileStore.SelectByID(ctx, id)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, ErrInvalidID
-		}
-		return nil, ErrGetCSR
+		return nil, storeError(err, ErrGetCSR)
 	}
 	return data, nil
 }
@@ -180,46 +256,56 @@ func (s *enrollerService) GetPendingCSRFile(ctx context.Context, id int) ([]byte
 func (s *enrollerService) PutChangeCSRStatus(ctx context.Context, csr csrmodel.CSR, id int) (csrmodel.CSR, error) {
 	var err error
 
-	prevCSR, err := s.csrDBStore.SelectByID(id)
+	prevCSR, err := s.csrDBStore.SelectByID(ctx, id)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return csrmodel.CSR{}, ErrInvalidID
-		}
-		return csrmodel.CSR{}, ErrGetCSR
+		return csrmodel.CSR{}, storeError(err, ErrGetCSR)
 	}
 
 	switch status := csr.Status; status {
 	case csrmodel.ApprobedStatus:
-		if prevCSR.Status == csrmodel.PendingStatus {
-			err = s.approbeCSR(id, csr)
-			if err != nil {
-				return csrmodel.CSR{}, err
-			}
-		} else {
+		if prevCSR.Status != csrmodel.PendingStatus {
 			return csrmodel.CSR{}, ErrInvalidApprobeOp
 		}
+		op, err := s.beginOperation(ctx, journal.ApprobeCSR, id)
+		if err != nil {
+			return csrmodel.CSR{}, storeError(err, ErrUpdateCSR)
+		}
+		var opErr error
+		err = s.csrDBStore.Transition(ctx, id, csrmodel.PendingStatus, csrmodel.ApprobedStatus, func() error {
+			opErr = s.approbeCSR(ctx, op, id)
+			return opErr
+		})
+		if err != nil {
+			op.rollback()
+			return csrmodel.CSR{}, transitionError(err, opErr)
+		}
+		op.commit()
 	case csrmodel.RevokedStatus:
-		if prevCSR.Status == csrmodel.ApprobedStatus {
-			_, err = s.csrDBStore.UpdateByID(id, csr)
-			if err != nil {
-				return csrmodel.CSR{}, ErrUpdateCSR
-			}
-			err = s.revokeCert(id)
-			if err != nil {
-				return csrmodel.CSR{}, err
-			}
-		} else {
+		if prevCSR.Status != csrmodel.ApprobedStatus {
 			return csrmodel.CSR{}, ErrInvalidRevokeOp
 		}
+		op, err := s.beginOperation(ctx, journal.RevokeCert, id)
+		if err != nil {
+			return csrmodel.CSR{}, storeError(err, ErrUpdateCSR)
+		}
+		var opErr error
+		err = s.csrDBStore.Transition(ctx, id, csrmodel.ApprobedStatus, csrmodel.RevokedStatus, func() error {
+			opErr = s.revokeCert(ctx, op, id)
+			return opErr
+		})
+		if err != nil {
+			op.rollback()
+			return csrmodel.CSR{}, transitionError(err, opErr)
+		}
+		op.commit()
 	case csrmodel.DeniedStatus:
-		if prevCSR.Status == csrmodel.PendingStatus {
-			_, err = s.csrDBStore.UpdateByID(id, csr)
-			if err != nil {
-				return csrmodel.CSR{}, ErrUpdateCSR
-			}
-		} else {
+		if prevCSR.Status != csrmodel.PendingStatus {
 			return csrmodel.CSR{}, ErrInvalidDenyOp
 		}
+		err = s.csrDBStore.UpdateStatus(ctx, id, csrmodel.PendingStatus, csrmodel.DeniedStatus)
+		if err != nil {
+			return csrmodel.CSR{}, transitionError(err, nil)
+		}
 	default:
 		return csrmodel.CSR{}, ErrInvalidOperation
 	}
@@ -227,43 +313,100 @@ func (s *enrollerService) PutChangeCSRStatus(ctx context.Context, csr csrmodel.C
 	return csr, nil
 }
 
-func (s *enrollerService) revokeCert(id int) error {
-	revocationDate := makeOpenSSLTime(time.Now())
-	err := s.certsDBStore.Revoke(id, revocationDate)
+// transitionError maps the result of a CSR status transition to a service
+// error. opErr is the error returned by the operation run inside it, if any.
+func transitionError(err error, opErr error) error {
+	switch {
+	case opErr != nil:
+		return opErr
+	case errors.Is(err, csrstore.ErrStatusConflict):
+		return ErrCSRConflict
+	default:
+		return storeError(err, ErrUpdateCSR)
+	}
+}
+
+// storeError maps a store error to the service error returned to clients.
+// Missing data and unreachable stores have their own errors, anything else
+// is reported as fallback.
+func storeError(err error, fallback error) error {
+	switch {
+	case storeerr.IsNotFound(err):
+		return ErrInvalidID
+	case storeerr.IsUnavailable(err):
+		return ErrUnavailable
+	default:
+		return fallback
+	}
+}
+
+// revokeCert revokes the certificate of the CSR. The certificates are in
+// another store than the CSR status, so the revocation is undone if the
+// status change is not committed.
+func (s *enrollerService) revokeCert(ctx context.Context, op *unitOfWork, id int) error {
+	revocationDate := crypto.MakeOpenSSLTime(time.Now())
+	err := s.certsDBStore.Revoke(ctx, id, revocationDate)
 	if err != nil {
-		return ErrRevokeCert
+		return storeError(err, ErrRevokeCert)
 	}
+	op.onRollback(func(ctx context.Context) error { return s.certsDBStore.Unrevoke(ctx, id) })
 	return nil
 
 }
 
-func (s *enrollerService) approbeCSR(id int, csr csrmodel.CSR) error {
-	csrData, err := s.readCSRFromFile(id)
+// approbeCSR issues the certificate of the CSR with the CA selected in ctx.
+func (s *enrollerService) approbeCSR(ctx context.Context, op *unitOfWork, id int) error {
+	ca, err := s.cas.Get(secrets.CAName(ctx))
 	if err != nil {
-		return err
+		return ErrInvalidCA
 	}
-	crt, err := s.signCSR(csrData)
+	csrData, err := s.readCSRFromFile(ctx, id)
 	if err != nil {
 		return err
 	}
-	err = s.insertCertInDB(id, crt)
-	if err != nil {
-		return err
+	var crt *x509.Certificate
+	for i := 0; i < maxSerialAttempts; i++ {
+		crt, err = s.signCSR(ctx, ca, csrData)
+		if err != nil {
+			return err
+		}
+		err = s.lintCert(ca, crt)
+		if err != nil {
+			return err
+		}
+		err = s.insertCertInDB(ctx, id, ca, crt)
+		if err != errDuplicateSerial {
+			break
+		}
 	}
-	err = s.insertCertFile(id, crt)
-	if err != nil {
+	if err == errDuplicateSerial {
 		return ErrInsertCert
 	}
-	_, err = s.csrDBStore.UpdateByID(id, csr)
 	if err != nil {
-		return ErrUpdateCSR
+		return err
+	}
+	op.onRollback(func(ctx context.Context) error { return s.certsDBStore.Delete(ctx, id) })
+	err = s.insertCertFile(ctx, id, crt)
+	if err != nil {
+		return err
 	}
+	op.onRollback(func(ctx context.Context) error { return s.certsFileStore.Delete(ctx, id) })
 	return nil
 
 }
 
-func (s *enrollerService) signCSR(csr *x509.CertificateRequest) (*x509.Certificate, error) {
-	crtData, err := s.secrets.SignCSR(csr)
+func (s *enrollerService) signCSR(ctx context.Context, ca *secrets.CA, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	crtData, err := ca.Secrets.SignCSR(ctx, csr)
+	if errors.Is(err, secrets.ErrUnknownProfile) {
+		return nil, ErrInvalidProfile
+	}
+	if errors.Is(err, secrets.ErrSealed) {
+		return nil, ErrSealed
+	}
+	var lintErr *secrets.LintError
+	if errors.As(err, &lintErr) {
+		return nil, fmt.Errorf("%w: %s", ErrLintCert, lintErr.Findings)
+	}
 	if err != nil {
 		return nil, ErrSignCSR
 	}
@@ -275,13 +418,26 @@ func (s *enrollerService) signCSR(csr *x509.CertificateRequest) (*x509.Certifica
 	return crt, nil
 }
 
-func (s *enrollerService) readCSRFromFile(id int) (*x509.CertificateRequest, error) {
-	csrData, err := s.csrFileStore.SelectByID(id)
+// lintCert checks the certificate issued by ca. The secret engines that
+// sign with a CA key of their own check a draft before signing, so this
+// catches the certificates built by Vault and any signer mistake before
+// they are persisted.
+func (s *enrollerService) lintCert(ca *secrets.CA, crt *x509.Certificate) error {
+	caCert, err := ca.Secrets.GetCACert()
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, ErrInvalidID
-		}
-		return nil, ErrGetCSR
+		return ErrSignCSR
+	}
+	findings := lint.Certificate(crt, caCert)
+	if findings.HasErrors() {
+		return fmt.Errorf("%w: %s", ErrLintCert, findings.Errors())
+	}
+	return nil
+}
+
+func (s *enrollerService) readCSRFromFile(ctx context.Context, id int) (*x509.CertificateRequest, error) {
+	csrData, err := s.csrFileStore.SelectByID(ctx, id)
+	if err != nil {
+		return nil, storeError(err, ErrGetCSR)
 	}
 	csr, err := crypto.ParseNewCSR(csrData)
 	if err != nil {
@@ -290,107 +446,167 @@ func (s *enrollerService) readCSRFromFile(id int) (*x509.CertificateRequest, err
 	return csr, nil
 }
 
-func (s *enrollerService) insertCertInDB(id int, crt *x509.Certificate) error {
-	dn := makeDn(crt)
-	expirationDate := makeOpenSSLTime(crt.NotAfter)
-	serialHex := fmt.Sprintf("%x", crt.SerialNumber)
-	certPath := s.homePath + "/" + crt.Subject.CommonName + "." + serialHex + ".crt"
+func (s *enrollerService) insertCertInDB(ctx context.Context, id int, ca *secrets.CA, crt *x509.Certificate) error {
+	dn := crypto.MakeDN(crt)
+	expirationDate := crypto.MakeOpenSSLTime(crt.NotAfter)
+	certPath := certs.FilePath(s.homePath, id)
 
 	cert := certs.CRT{
 		ID:             id,
 		DN:             dn,
 		ExpirationDate: expirationDate,
 		Serial:         crt.SerialNumber,
+		Issuer:         crt.Issuer.String(),
+		CA:             ca.Name,
 		RevocationDate: "",
 		CertPath:       certPath,
 		Status:         "V",
 	}
-	err := s.certsDBStore.Insert(cert)
+	err := s.certsDBStore.Insert(ctx, cert)
 	if err != nil {
-		return ErrInsertCert
+		if errors.Is(err, certstore.ErrDuplicateSerial) {
+			return errDuplicateSerial
+		}
+		return storeError(err, ErrInsertCert)
 	}
 	return nil
 }
 
-func (s *enrollerService) insertCertFile(id int, crt *x509.Certificate) error {
-	err := s.certsFileStore.Insert(id, crt.Raw)
+func (s *enrollerService) insertCertFile(ctx context.Context, id int, crt *x509.Certificate) error {
+	err := s.certsFileStore.Insert(ctx, id, crt.Raw)
 	if err != nil {
-		return ErrInsertCert
+		return storeError(err, ErrInsertCert)
 	}
 	return nil
 }
 
 func (s *enrollerService) DeleteCSR(ctx context.Context, id int) error {
-	csr, err := s.csrDBStore.SelectByID(id)
+	csr, err := s.csrDBStore.SelectByID(ctx, id)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return ErrInvalidID
-		}
-		return ErrGetCSR
+		return storeError(err, ErrGetCSR)
 	}
-	if csr.Status == csrmodel.DeniedStatus || csr.Status == csrmodel.RevokedStatus {
-		err = s.csrDBStore.Delete(id)
-		if err != nil {
-			return ErrDeleteCSR
-		}
-		err = s.csrFileStore.Delete(id)
+	if csr.Status != csrmodel.DeniedStatus && csr.Status != csrmodel.RevokedStatus {
+		return ErrInvalidDeleteOp
+	}
+	op, err := s.beginOperation(ctx, journal.DeleteCSR, id)
+	if err != nil {
+		return storeError(err, ErrDeleteCSR)
+	}
+	data, err := s.csrFileStore.SelectByID(ctx, id)
+	if err != nil && !storeerr.IsNotFound(err) {
+		op.rollback()
+		return storeError(err, ErrDeleteCSR)
+	}
+	if err == nil {
+		err = s.csrFileStore.Delete(ctx, id)
 		if err != nil {
-			return ErrDeleteCSR
+			op.rollback()
+			return storeError(err, ErrDeleteCSR)
 		}
-		return nil
+		op.onRollback(func(ctx context.Context) error { return s.csrFileStore.Insert(ctx, id, data) })
 	}
-	return ErrInvalidDeleteOp
+	err = s.csrDBStore.Delete(ctx, id)
+	if err != nil {
+		op.rollback()
+		return storeError(err, ErrDeleteCSR)
+	}
+	op.commit()
+	return nil
 }
 
 func (s *enrollerService) GetCRT(ctx context.Context, id int) ([]byte, error) {
-	data, err := s.certsFileStore.SelectByID(id)
+	data, err := s.certsFileStore.SelectByID(ctx, id)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, ErrInvalidID
-		}
-		return nil, ErrGetCert
+		return nil, storeError(err, ErrGetCert)
 	}
 	return data, nil
 }
 
-func makeDn(cert *x509.Certificate) string {
-	var dn bytes.Buffer
-
-	if len(cert.Subject.Country) > 0 && len(cert.Subject.Country[0]) > 0 {
-		dn.WriteString("/C=" + cert.Subject.Country[0])
-	}
-	if len(cert.Subject.Province) > 0 && len(cert.Subject.Province[0]) > 0 {
-		dn.WriteString("/ST=" + cert.Subject.Province[0])
+// GetCAs returns the issuing CAs with their certificate chains, rollover
+// schedule and the certificates they issued that have not expired.
+func (s *enrollerService) GetCAs(ctx context.Context) ([]CA, error) {
+	crts, err := s.certsDBStore.SelectAll(ctx)
+	if err != nil {
+		return nil, storeError(err, ErrGetCert)
 	}
-	if len(cert.Subject.Locality) > 0 && len(cert.Subject.Locality[0]) > 0 {
-		dn.WriteString("/L=" + cert.Subject.Locality[0])
+	now := time.Now()
+	cas := make([]CA, 0, len(s.cas.List()))
+	for _, ca := range s.cas.List() {
+		caCert, err := ca.Secrets.GetCACert()
+		if err != nil {
+			return nil, ErrGetCA
+		}
+		chain := []string{string(pem.EncodeToMemory(&pem.Block{Type: crypto.CertPEMBlockType, Bytes: caCert.Raw}))}
+		for _, cert := range ca.Chain {
+			chain = append(chain, string(pem.EncodeToMemory(&pem.Block{Type: crypto.CertPEMBlockType, Bytes: cert.Raw})))
+		}
+		c := CA{
+			Name:      ca.Name,
+			Default:   ca.Name == s.cas.Default(),
+			Subject:   caCert.Subject.String(),
+			Chain:     chain,
+			Issuing:   ca.Successor == "" || now.Before(ca.RolloverAt),
+			Successor: ca.Successor,
+		}
+		if ca.Successor != "" {
+			rolloverAt := ca.RolloverAt
+			c.RolloverAt = &rolloverAt
+		}
+		for _, crt := range crts {
+			// Certificates issued before CAs had names are matched by
+			// their issuer.
+			if crt.CA != ca.Name && (crt.CA != "" || crt.Issuer != caCert.Subject.String()) {
+				continue
+			}
+			expiration, err := crypto.ParseOpenSSLTime(crt.ExpirationDate)
+			if err != nil || expiration.Before(now) {
+				continue
+			}
+			c.ActiveCertificates++
+			if c.LastExpiration == nil || expiration.After(*c.LastExpiration) {
+				c.LastExpiration = &expiration
+			}
+		}
+		cas = append(cas, c)
 	}
-	if len(cert.Subject.Organization) > 0 && len(cert.Subject.Organization[0]) > 0 {
-		dn.WriteString("/O=" + cert.Subject.Organization[0])
+	return cas, nil
+}
+
+// Unseal submits the unseal share of the authenticated admin for the named
+// CA. Each admin can submit one share.
+func (s *enrollerService) Unseal(ctx context.Context, ca string, share []byte) (SealStatus, error) {
+	claims, _ := ctx.Value(jwt.JWTClaimsContextKey).(*auth.KeycloakClaims)
+	if claims == nil || !claims.HasRole("admin") {
+		return SealStatus{}, ErrForbidden
 	}
-	if len(cert.Subject.OrganizationalUnit) > 0 && len(cert.Subject.OrganizationalUnit[0]) > 0 {
-		dn.WriteString("/OU=" + cert.Subject.OrganizationalUnit[0])
+	c, err := s.cas.Lookup(ca)
+	if err != nil {
+		return SealStatus{}, ErrInvalidCA
 	}
-	if len(cert.Subject.CommonName) > 0 {
-		dn.WriteString("/CN=" + cert.Subject.CommonName)
+	unsealer, ok := c.Secrets.(secrets.Unsealer)
+	if !ok {
+		return SealStatus{}, ErrNotSealable
 	}
-	if len(cert.EmailAddresses) > 0 {
-		dn.WriteString("/emailAddress=" + cert.EmailAddresses[0])
+	status, err := unsealer.Unseal(claims.PreferredUsername, share)
+	sealStatus := SealStatus{CA: c.Name, Sealed: status.Sealed, Threshold: status.Threshold, Progress: status.Progress}
+	switch {
+	case errors.Is(err, seal.ErrSameCustodian):
+		return sealStatus, ErrSameCustodian
+	case err != nil:
+		return sealStatus, ErrInvalidShare
 	}
-	return dn.String()
-}
-
-func makeOpenSSLTime(t time.Time) string {
-	y := (int(t.Year()) % 100)
-	validDate := fmt.Sprintf("%02d%02d%02d%02d%02d%02dZ", y, t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second())
-	return validDate
+	return sealStatus, nil
 }
 
-func containsRole(list []string, value string) bool {
-	for _, item := range list {
-		if item == value {
-			return true
+// GetSealStatus returns the seal status of the CAs whose key is split among
+// custodians.
+func (s *enrollerService) GetSealStatus(ctx context.Context) []SealStatus {
+	var statuses []SealStatus
+	for _, ca := range s.cas.List() {
+		if unsealer, ok := ca.Secrets.(secrets.Unsealer); ok {
+			status := unsealer.SealStatus()
+			statuses = append(statuses, SealStatus{CA: ca.Name, Sealed: status.Sealed, Threshold: status.Threshold, Progress: status.Progress})
 		}
 	}
-	return false
+	return statuses
 }
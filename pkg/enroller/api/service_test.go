@@ -8,40 +8,52 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/lamassuiot/enroller/pkg/enroller/auth"
-	"github.com/lamassuiot/enroller/pkg/enroller/configs"
 	"github.com/lamassuiot/enroller/pkg/enroller/crypto"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/certs"
 	certstore "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store"
-	certsdb "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store/db"
-	certsfile "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store/file"
+	certsmemory "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store/memory"
 	csrmodel "github.com/lamassuiot/enroller/pkg/enroller/models/csr"
 	csrstore "github.com/lamassuiot/enroller/pkg/enroller/models/csr/store"
-	csrdb "github.com/lamassuiot/enroller/pkg/enroller/models/csr/store/db"
-	csrfile "github.com/lamassuiot/enroller/pkg/enroller/models/csr/store/file"
+	csrmemory "github.com/lamassuiot/enroller/pkg/enroller/models/csr/store/memory"
+	journalstore "github.com/lamassuiot/enroller/pkg/enroller/models/journal/store"
+	journalmemory "github.com/lamassuiot/enroller/pkg/enroller/models/journal/store/memory"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
 	"github.com/lamassuiot/enroller/pkg/enroller/secrets"
 	secretsfile "github.com/lamassuiot/enroller/pkg/enroller/secrets/file"
+	"github.com/lamassuiot/enroller/pkg/enroller/secrets/seal"
 
 	"github.com/go-kit/kit/auth/jwt"
 	"github.com/go-kit/kit/log"
 )
 
 type serviceSetUp struct {
-	csrdb    csrstore.DB
-	csrfile  csrstore.File
-	certdb   certstore.DB
-	certfile certstore.File
-	secrets  secrets.Secrets
-	homePath string
+	csrdb     csrstore.DB
+	csrfile   csrstore.File
+	certdb    certstore.DB
+	certfile  certstore.File
+	journaldb journalstore.DB
+	secrets   secrets.Secrets
+	cas       *secrets.CAs
+	homePath  string
 }
 
 func TestPostCSR(t *testing.T) {
 	stu := setup()
-	srv := NewEnrollerService(stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, stu.secrets, stu.homePath)
+	srv := NewEnrollerService(stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, stu.journaldb, stu.cas, stu.homePath)
 	ctx := context.Background()
 
 	testCases := []struct {
@@ -60,12 +72,12 @@ func TestPostCSR(t *testing.T) {
 				t.Errorf("Got result is %s; want %s", err, tc.ret)
 			}
 			if err == nil {
-				err = stu.csrdb.Delete(csr.Id)
+				err = stu.csrdb.Delete(ctx, csr.Id)
 				if err != nil {
 					t.Fatal("Could not delete CSR from DB")
 				}
 
-				err = stu.csrfile.Delete(csr.Id)
+				err = stu.csrfile.Delete(ctx, csr.Id)
 				if err != nil {
 					t.Fatal("Could not delete CSR from file system")
 				}
@@ -77,7 +89,7 @@ func TestPostCSR(t *testing.T) {
 
 func TestGetPendingCSRs(t *testing.T) {
 	stu := setup()
-	srv := NewEnrollerService(stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, stu.secrets, stu.homePath)
+	srv := NewEnrollerService(stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, stu.journaldb, stu.cas, stu.homePath)
 	ctx := context.Background()
 
 	certReq, err := crypto.ParseNewCSR(testCSR())
@@ -94,7 +106,7 @@ func TestGetPendingCSRs(t *testing.T) {
 		CommonName:             certReq.Subject.CommonName,
 		Status:                 csrmodel.PendingStatus,
 	}
-	id, err := stu.csrdb.Insert(csr)
+	id, err := stu.csrdb.Insert(ctx, csr)
 	if err != nil {
 		t.Fatal("Could not insert CSR in database")
 	}
@@ -130,7 +142,10 @@ func TestGetPendingCSRs(t *testing.T) {
 	}
 	for _, tc := range testCases {
 		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
-			csrs := srv.GetPendingCSRs(tc.ctx)
+			csrs, err := srv.GetPendingCSRs(tc.ctx)
+			if err != nil {
+				t.Fatalf("GetPendingCSRs: %s", err)
+			}
 			if tc.numCSRs != len(csrs.CSRs) {
 				t.Errorf("Got number of CSRs is %d; want %d", len(csrs.CSRs), tc.numCSRs)
 			}
@@ -142,15 +157,43 @@ func TestGetPendingCSRs(t *testing.T) {
 		})
 	}
 
-	err = stu.csrdb.Delete(id)
+	err = stu.csrdb.Delete(ctx, id)
 	if err != nil {
 		t.Fatal("Could not delete CSR from DB")
 	}
 }
 
+// failingCSRDB is a CSR store whose database connection is lost.
+type failingCSRDB struct {
+	csrstore.DB
+}
+
+func (failingCSRDB) SelectAll(ctx context.Context) (csrmodel.CSRs, error) {
+	return csrmodel.CSRs{}, storeerr.Unavailable(errors.New("connection refused"))
+}
+
+func (failingCSRDB) SelectAllByCN(ctx context.Context, cn string) (csrmodel.CSRs, error) {
+	return csrmodel.CSRs{}, errors.New("invalid row")
+}
+
+func TestGetPendingCSRsStoreErrors(t *testing.T) {
+	stu := setup()
+	srv := NewEnrollerService(failingCSRDB{stu.csrdb}, stu.csrfile, stu.certdb, stu.certfile, stu.journaldb, stu.cas, stu.homePath)
+	ctx := context.Background()
+
+	admin := context.WithValue(ctx, jwt.JWTClaimsContextKey, &auth.KeycloakClaims{RealmAccess: auth.Roles{RoleNames: []string{"admin"}}})
+	if _, err := srv.GetPendingCSRs(admin); err != ErrUnavailable {
+		t.Errorf("GetPendingCSRs with an unreachable database returned %v; want %s", err, ErrUnavailable)
+	}
+	user := context.WithValue(ctx, jwt.JWTClaimsContextKey, &auth.KeycloakClaims{PreferredUsername: "test.com"})
+	if _, err := srv.GetPendingCSRs(user); err != ErrGetCSR {
+		t.Errorf("GetPendingCSRs with a failing database returned %v; want %s", err, ErrGetCSR)
+	}
+}
+
 func TestGetPendingCSRDB(t *testing.T) {
 	stu := setup()
-	srv := NewEnrollerService(stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, stu.secrets, stu.homePath)
+	srv := NewEnrollerService(stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, stu.journaldb, stu.cas, stu.homePath)
 	ctx := context.Background()
 
 	certReq, err := crypto.ParseNewCSR(testCSR())
@@ -167,7 +210,7 @@ func TestGetPendingCSRDB(t *testing.T) {
 		CommonName:             certReq.Subject.CommonName,
 		Status:                 csrmodel.PendingStatus,
 	}
-	id, err := stu.csrdb.Insert(csr)
+	id, err := stu.csrdb.Insert(ctx, csr)
 	if err != nil {
 		t.Fatal("Could not insert CSR in database")
 	}
@@ -188,7 +231,7 @@ func TestGetPendingCSRDB(t *testing.T) {
 			}
 		})
 	}
-	err = stu.csrdb.Delete(id)
+	err = stu.csrdb.Delete(ctx, id)
 	if err != nil {
 		t.Fatal("Could not delete CSR from DB")
 	}
@@ -196,12 +239,12 @@ func TestGetPendingCSRDB(t *testing.T) {
 
 func TestGetPendingCSRFile(t *testing.T) {
 	stu := setup()
-	srv := NewEnrollerService(stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, stu.secrets, stu.homePath)
+	srv := NewEnrollerService(stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, stu.journaldb, stu.cas, stu.homePath)
 	ctx := context.Background()
 
 	certReq := testCSR()
 	id := 1
-	err := stu.csrfile.Insert(id, certReq)
+	err := stu.csrfile.Insert(ctx, id, certReq)
 	if err != nil {
 		t.Fatal("Could not insert CSR in file system")
 	}
@@ -223,7 +266,7 @@ func TestGetPendingCSRFile(t *testing.T) {
 		})
 	}
 
-	err = stu.csrfile.Delete(id)
+	err = stu.csrfile.Delete(ctx, id)
 	if err != nil {
 		t.Fatal("Could not delete CSR from file system")
 	}
@@ -231,7 +274,7 @@ func TestGetPendingCSRFile(t *testing.T) {
 
 func TestPutChangeCSRStatus(t *testing.T) {
 	stu := setup()
-	srv := NewEnrollerService(stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, stu.secrets, stu.homePath)
+	srv := NewEnrollerService(stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, stu.journaldb, stu.cas, stu.homePath)
 	ctx := context.Background()
 
 	csrRaw := testCSR()
@@ -249,12 +292,12 @@ func TestPutChangeCSRStatus(t *testing.T) {
 		CommonName:             certReq.Subject.CommonName,
 		Status:                 csrmodel.PendingStatus,
 	}
-	id, err := stu.csrdb.Insert(csr)
+	id, err := stu.csrdb.Insert(ctx, csr)
 	if err != nil {
 		t.Fatal("Could not insert CSR in database")
 	}
 
-	err = stu.csrfile.Insert(id, csrRaw)
+	err = stu.csrfile.Insert(ctx, id, csrRaw)
 	if err != nil {
 		t.Fatal("Could not insert CSR in file system")
 	}
@@ -288,30 +331,434 @@ func TestPutChangeCSRStatus(t *testing.T) {
 		})
 	}
 
-	err = stu.csrdb.Delete(id)
+	err = stu.csrdb.Delete(ctx, id)
 	if err != nil {
 		t.Fatal("Could not delete CSR from DB")
 	}
 
-	err = stu.csrfile.Delete(id)
+	err = stu.csrfile.Delete(ctx, id)
 	if err != nil {
 		t.Fatal("Could not delete CSR from file system")
 	}
 
-	err = stu.certdb.Delete(id)
+	err = stu.certdb.Delete(ctx, id)
 	if err != nil {
 		t.Fatal("Could not delete certificate from DB")
 	}
 
-	err = stu.certfile.Delete(id)
+	err = stu.certfile.Delete(ctx, id)
 	if err != nil {
 		t.Fatal("Could not delete certificate from file system")
 	}
 }
 
+// countingSecrets counts the CSRs signed.
+type countingSecrets struct {
+	secrets.Secrets
+	signatures int32
+}
+
+func (s *countingSecrets) SignCSR(ctx context.Context, csr *x509.CertificateRequest) ([]byte, error) {
+	atomic.AddInt32(&s.signatures, 1)
+	return s.Secrets.SignCSR(ctx, csr)
+}
+
+// barrierCSRDB makes the requests wait for each other after reading the
+// CSR, so that they all see it in the same status.
+type barrierCSRDB struct {
+	csrstore.DB
+	read *sync.WaitGroup
+}
+
+func (db barrierCSRDB) SelectByID(ctx context.Context, id int) (csrmodel.CSR, error) {
+	c, err := db.DB.SelectByID(ctx, id)
+	db.read.Done()
+	db.read.Wait()
+	return c, err
+}
+
+func TestPutChangeCSRStatusConcurrentApprovals(t *testing.T) {
+	stu := setup()
+	ctx := context.Background()
+	sec := &countingSecrets{Secrets: stu.secrets}
+	cas, err := secrets.NewCAs("default", &secrets.CA{Name: "default", Secrets: sec})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csrRaw := testCSR()
+	csr := csrmodel.CSR{CommonName: "test.com", Status: csrmodel.PendingStatus}
+	id, err := stu.csrdb.Insert(ctx, csr)
+	if err != nil {
+		t.Fatal("Could not insert CSR in database")
+	}
+	err = stu.csrfile.Insert(ctx, id, csrRaw)
+	if err != nil {
+		t.Fatal("Could not insert CSR in file system")
+	}
+
+	const approvals = 2
+	read := &sync.WaitGroup{}
+	read.Add(approvals)
+	srv := NewEnrollerService(barrierCSRDB{stu.csrdb, read}, stu.csrfile, stu.certdb, stu.certfile, stu.journaldb, cas, stu.homePath)
+	csr.Status = csrmodel.ApprobedStatus
+	errs := make(chan error, approvals)
+	for i := 0; i < approvals; i++ {
+		go func() {
+			_, err := srv.PutChangeCSRStatus(ctx, csr, id)
+			errs <- err
+		}()
+	}
+	var ok, conflicts int
+	for i := 0; i < approvals; i++ {
+		switch err := <-errs; err {
+		case nil:
+			ok++
+		case ErrCSRConflict:
+			conflicts++
+			if code := codeFrom(err); code != http.StatusConflict {
+				t.Errorf("Got result is %d; want %d", code, http.StatusConflict)
+			}
+		default:
+			t.Errorf("Got result is %s; want nil or %s", err, ErrCSRConflict)
+		}
+	}
+	if ok != 1 || conflicts != 1 {
+		t.Errorf("Got %d approvals and %d conflicts; want 1 and 1", ok, conflicts)
+	}
+	if sec.signatures != 1 {
+		t.Errorf("Got %d signatures; want 1", sec.signatures)
+	}
+}
+
+func TestPutChangeCSRStatusRevokeRollback(t *testing.T) {
+	stu := setup()
+	srv := NewEnrollerService(stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, stu.journaldb, stu.cas, stu.homePath)
+	ctx := context.Background()
+
+	csrRaw := testCSR()
+	csr := csrmodel.CSR{CommonName: "test.com", Status: csrmodel.PendingStatus}
+	id, err := stu.csrdb.Insert(ctx, csr)
+	if err != nil {
+		t.Fatal("Could not insert CSR in database")
+	}
+	err = stu.csrfile.Insert(ctx, id, csrRaw)
+	if err != nil {
+		t.Fatal("Could not insert CSR in file system")
+	}
+	csr.Status = csrmodel.ApprobedStatus
+	if _, err := srv.PutChangeCSRStatus(ctx, csr, id); err != nil {
+		t.Fatalf("Got result is %s; want nil", err)
+	}
+
+	srv = faultyService(stu, failures{"csrdb.Transition": true})
+	csr.Status = csrmodel.RevokedStatus
+	if _, err := srv.PutChangeCSRStatus(ctx, csr, id); err != ErrUnavailable {
+		t.Errorf("Got result is %v; want %s", err, ErrUnavailable)
+	}
+	crt, err := stu.certdb.SelectByID(ctx, id)
+	if err != nil {
+		t.Fatal("Could not get certificate from DB")
+	}
+	if crt.Status != "V" || crt.RevocationDate != "" {
+		t.Errorf("Got certificate status %s revoked on %q; want it valid", crt.Status, crt.RevocationDate)
+	}
+	if ops, _ := stu.journaldb.SelectAll(ctx); len(ops) != 0 {
+		t.Errorf("Got %d journaled operations; want none", len(ops))
+	}
+}
+
+func TestPutChangeCSRStatusProfile(t *testing.T) {
+	stu := setup()
+	srv := NewEnrollerService(stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, stu.journaldb, stu.cas, stu.homePath)
+	ctx := context.Background()
+
+	csrRaw := testCSR()
+	certReq, err := crypto.ParseNewCSR(csrRaw)
+	if err != nil {
+		t.Fatal("Could not parse CSR")
+	}
+	csr := csrmodel.CSR{CommonName: certReq.Subject.CommonName, Status: csrmodel.PendingStatus}
+	id, err := stu.csrdb.Insert(ctx, csr)
+	if err != nil {
+		t.Fatal("Could not insert CSR in database")
+	}
+	err = stu.csrfile.Insert(ctx, id, csrRaw)
+	if err != nil {
+		t.Fatal("Could not insert CSR in file system")
+	}
+
+	csr.Status = csrmodel.ApprobedStatus
+	_, err = srv.PutChangeCSRStatus(secrets.WithProfile(ctx, "server"), csr, id)
+	if err != ErrInvalidProfile {
+		t.Errorf("Got result is %s; want %s", err, ErrInvalidProfile)
+	}
+	stored, err := stu.csrdb.SelectByID(ctx, id)
+	if err != nil {
+		t.Fatal("Could not get CSR from DB")
+	}
+	if stored.Status != csrmodel.PendingStatus {
+		t.Errorf("Got status %s; want %s", stored.Status, csrmodel.PendingStatus)
+	}
+
+	_, err = srv.PutChangeCSRStatus(secrets.WithProfile(ctx, secrets.DefaultProfile), csr, id)
+	if err != nil {
+		t.Errorf("Got result is %s; want nil", err)
+	}
+}
+
+func TestPutChangeCSRStatusCA(t *testing.T) {
+	stu := setup()
+	srv := NewEnrollerService(stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, stu.journaldb, stu.cas, stu.homePath)
+	ctx := context.Background()
+
+	testCases := []struct {
+		name     string
+		ca       string
+		ret      error
+		wantCA   string
+		wantCN   string
+		wantCRLs int
+	}{
+		{"default CA", "", nil, "default", "Enroller Test CA", 0},
+		{"named CA", "test", nil, "test", "Test Fleet CA", 1},
+		{"unknown CA", "missing", ErrInvalidCA, "", "", 0},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			csrRaw := testCSR()
+			certReq, err := crypto.ParseNewCSR(csrRaw)
+			if err != nil {
+				t.Fatal("Could not parse CSR")
+			}
+			csr := csrmodel.CSR{CommonName: certReq.Subject.CommonName, Status: csrmodel.PendingStatus}
+			id, err := stu.csrdb.Insert(ctx, csr)
+			if err != nil {
+				t.Fatal("Could not insert CSR in database")
+			}
+			err = stu.csrfile.Insert(ctx, id, csrRaw)
+			if err != nil {
+				t.Fatal("Could not insert CSR in file system")
+			}
+
+			csr.Status = csrmodel.ApprobedStatus
+			_, err = srv.PutChangeCSRStatus(secrets.WithCA(ctx, tc.ca), csr, id)
+			if err != tc.ret {
+				t.Fatalf("Got result is %v; want %v", err, tc.ret)
+			}
+			if tc.ret != nil {
+				return
+			}
+			stored, err := stu.certdb.SelectByID(ctx, id)
+			if err != nil {
+				t.Fatal("Could not get certificate from DB")
+			}
+			if stored.CA != tc.wantCA {
+				t.Errorf("Got CA %s; want %s", stored.CA, tc.wantCA)
+			}
+			data, err := stu.certfile.SelectByID(ctx, id)
+			if err != nil {
+				t.Fatal("Could not get certificate from file system")
+			}
+			block, _ := pem.Decode(data)
+			crt, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				t.Fatal("Could not parse certificate")
+			}
+			if crt.Issuer.CommonName != tc.wantCN {
+				t.Errorf("Got issuer %s; want %s", crt.Issuer.CommonName, tc.wantCN)
+			}
+			if len(crt.CRLDistributionPoints) != tc.wantCRLs {
+				t.Errorf("Got CRL distribution points %v; want %d", crt.CRLDistributionPoints, tc.wantCRLs)
+			}
+		})
+	}
+}
+
+func TestPutChangeCSRStatusLint(t *testing.T) {
+	stu := setup()
+	srv := NewEnrollerService(stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, stu.journaldb, stu.cas, stu.homePath)
+	ctx := context.Background()
+
+	// A CSR without subject or SAN gives a certificate that does not pass
+	// the pre-issuance checks.
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	der, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	csrRaw := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+	csr := csrmodel.CSR{Status: csrmodel.PendingStatus}
+	id, err := stu.csrdb.Insert(ctx, csr)
+	if err != nil {
+		t.Fatal("Could not insert CSR in database")
+	}
+	err = stu.csrfile.Insert(ctx, id, csrRaw)
+	if err != nil {
+		t.Fatal("Could not insert CSR in file system")
+	}
+
+	csr.Status = csrmodel.ApprobedStatus
+	_, err = srv.PutChangeCSRStatus(ctx, csr, id)
+	if !errors.Is(err, ErrLintCert) {
+		t.Fatalf("Got result is %v; want %s", err, ErrLintCert)
+	}
+	if code := codeFrom(err); code != http.StatusUnprocessableEntity {
+		t.Errorf("Got result is %d; want %d", code, http.StatusUnprocessableEntity)
+	}
+	stored, err := stu.csrdb.SelectByID(ctx, id)
+	if err != nil {
+		t.Fatal("Could not get CSR from DB")
+	}
+	if stored.Status != csrmodel.PendingStatus {
+		t.Errorf("Got status %s; want %s", stored.Status, csrmodel.PendingStatus)
+	}
+	if _, err := stu.certdb.SelectByID(ctx, id); err == nil {
+		t.Error("Got certificate in DB; want none")
+	}
+}
+
+func TestGetCAs(t *testing.T) {
+	stu := setup()
+	srv := NewEnrollerService(stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, stu.journaldb, stu.cas, stu.homePath)
+
+	cas, err := srv.GetCAs(context.Background())
+	if err != nil {
+		t.Fatalf("Got result is %s; want nil", err)
+	}
+	if len(cas) != 2 {
+		t.Fatalf("Got %d CAs; want 2", len(cas))
+	}
+	if cas[0].Name != "default" || !cas[0].Default {
+		t.Errorf("Got first CA %s, default %t; want default CA", cas[0].Name, cas[0].Default)
+	}
+	if cas[1].Name != "test" || cas[1].Default {
+		t.Errorf("Got second CA %s, default %t; want test CA", cas[1].Name, cas[1].Default)
+	}
+	if !cas[0].Issuing || cas[0].Successor != "" || cas[0].RolloverAt != nil {
+		t.Errorf("Got issuing %t, successor %q; want an issuing CA without successor", cas[0].Issuing, cas[0].Successor)
+	}
+	block, _ := pem.Decode([]byte(cas[1].Chain[0]))
+	if crt, err := x509.ParseCertificate(block.Bytes); err != nil || crt.Subject.CommonName != "Test Fleet CA" {
+		t.Errorf("Got chain %v; want the Test Fleet CA certificate", cas[1].Chain)
+	}
+}
+
+func TestGetCAsSuccessor(t *testing.T) {
+	stu := setup()
+	ctx := context.Background()
+	defaultCA, _ := stu.cas.Lookup("default")
+	testCA, _ := stu.cas.Lookup("test")
+	rolloverAt := time.Now().Add(-time.Hour)
+	cas, err := secrets.NewCAs("default", &secrets.CA{Name: "default", Secrets: defaultCA.Secrets, Successor: "test", RolloverAt: rolloverAt}, testCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := defaultCA.Secrets.GetCACert()
+	now := time.Now().UTC()
+	last := now.Add(48 * time.Hour).Truncate(time.Second)
+	crts := []certs.CRT{
+		{ID: 1, CA: "default", ExpirationDate: crypto.MakeOpenSSLTime(now.Add(24 * time.Hour))},
+		// Issued before CAs had names.
+		{ID: 2, Issuer: caCert.Subject.String(), ExpirationDate: crypto.MakeOpenSSLTime(last)},
+		{ID: 3, CA: "default", ExpirationDate: crypto.MakeOpenSSLTime(now.Add(-time.Hour))},
+		{ID: 4, CA: "test", ExpirationDate: crypto.MakeOpenSSLTime(now.Add(24 * time.Hour))},
+	}
+	for _, crt := range crts {
+		crt.Status, crt.Serial = "V", big.NewInt(int64(crt.ID))
+		if err := stu.certdb.Insert(ctx, crt); err != nil {
+			t.Fatal("Could not insert certificate in database")
+		}
+	}
+	srv := NewEnrollerService(stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, stu.journaldb, cas, stu.homePath)
+
+	got, err := srv.GetCAs(ctx)
+	if err != nil {
+		t.Fatalf("Got result is %s; want nil", err)
+	}
+	if got[0].Issuing || got[0].Successor != "test" || got[0].RolloverAt == nil || !got[0].RolloverAt.Equal(rolloverAt) {
+		t.Errorf("Got issuing %t, successor %q, rollover %v; want a retired CA succeeded by test at %v", got[0].Issuing, got[0].Successor, got[0].RolloverAt, rolloverAt)
+	}
+	if got[0].ActiveCertificates != 2 {
+		t.Errorf("Got %d active certificates; want 2", got[0].ActiveCertificates)
+	}
+	if got[0].LastExpiration == nil || !got[0].LastExpiration.Equal(last) {
+		t.Errorf("Got last expiration %v; want %v", got[0].LastExpiration, last)
+	}
+	if !got[1].Issuing || got[1].ActiveCertificates != 1 {
+		t.Errorf("Got issuing %t, %d active certificates; want an issuing successor with 1", got[1].Issuing, got[1].ActiveCertificates)
+	}
+}
+
+func TestUnseal(t *testing.T) {
+	stu := setup()
+	passphrase, shares, err := seal.NewPassphrase(3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := stu.secrets.GetCACert()
+	sealed, err := seal.New(caCert, 2, func(p []byte) (secrets.Secrets, func(), error) {
+		if !bytes.Equal(p, passphrase) {
+			return nil, nil, errors.New("wrong passphrase")
+		}
+		return stu.secrets, func() {}, nil
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cas, err := secrets.NewCAs("default", &secrets.CA{Name: "default", Secrets: sealed}, &secrets.CA{Name: "test", Secrets: stu.secrets})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewEnrollerService(stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, stu.journaldb, cas, stu.homePath)
+	ctx := context.Background()
+	custodian := func(name string) context.Context {
+		return context.WithValue(ctx, jwt.JWTClaimsContextKey, &auth.KeycloakClaims{PreferredUsername: name, RealmAccess: auth.Roles{RoleNames: []string{"admin"}}})
+	}
+
+	id, err := srv.PostCSR(ctx, testCSR())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.PutChangeCSRStatus(ctx, csrmodel.CSR{Status: csrmodel.ApprobedStatus}, id.Id); err != ErrSealed {
+		t.Errorf("Got result is %v; want %s", err, ErrSealed)
+	}
+
+	testCases := []struct {
+		name   string
+		ctx    context.Context
+		ca     string
+		share  []byte
+		sealed bool
+		ret    error
+	}{
+		{"Not an admin", context.WithValue(ctx, jwt.JWTClaimsContextKey, &auth.KeycloakClaims{PreferredUsername: "user"}), "default", shares[0], true, ErrForbidden},
+		{"CA not split", custodian("alice"), "test", shares[0], false, ErrNotSealable},
+		{"Unknown CA", custodian("alice"), "unknown", shares[0], false, ErrInvalidCA},
+		{"First share", custodian("alice"), "default", shares[0], true, nil},
+		{"Same custodian", custodian("alice"), "default", shares[1], true, ErrSameCustodian},
+		{"Second share", custodian("bob"), "default", shares[2], false, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			status, err := srv.Unseal(tc.ctx, tc.ca, tc.share)
+			if tc.ret != err {
+				t.Errorf("Got result is %v; want %v", err, tc.ret)
+			}
+			if err == nil && status.Sealed != tc.sealed {
+				t.Errorf("Got sealed %t; want %t", status.Sealed, tc.sealed)
+			}
+		})
+	}
+
+	if statuses := srv.GetSealStatus(ctx); len(statuses) != 1 || statuses[0].CA != "default" || statuses[0].Sealed {
+		t.Errorf("Got seal status %+v; want default CA unsealed", statuses)
+	}
+	if _, err := srv.PutChangeCSRStatus(ctx, csrmodel.CSR{Status: csrmodel.ApprobedStatus}, id.Id); err != nil {
+		t.Errorf("Got result is %s; want nil once unsealed", err)
+	}
+}
+
 func TestGetCRT(t *testing.T) {
 	stu := setup()
-	srv := NewEnrollerService(stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, stu.secrets, stu.homePath)
+	srv := NewEnrollerService(stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, stu.journaldb, stu.cas, stu.homePath)
 	ctx := context.Background()
 
 	csrRaw := testCSR()
@@ -329,17 +776,17 @@ func TestGetCRT(t *testing.T) {
 		CommonName:             certReq.Subject.CommonName,
 		Status:                 csrmodel.PendingStatus,
 	}
-	id, err := stu.csrdb.Insert(csr)
+	id, err := stu.csrdb.Insert(ctx, csr)
 	if err != nil {
 		t.Fatal("Could not insert CSR in DB")
 	}
 
-	crtData, err := stu.secrets.SignCSR(certReq)
+	crtData, err := stu.secrets.SignCSR(ctx, certReq)
 	if err != nil {
 		t.Fatal("Could not sign CSR")
 	}
 
-	err = stu.certfile.Insert(id, crtData)
+	err = stu.certfile.Insert(ctx, id, crtData)
 	if err != nil {
 		t.Fatal("Could not insert certificate in file system")
 	}
@@ -361,12 +808,12 @@ func TestGetCRT(t *testing.T) {
 		})
 	}
 
-	err = stu.csrdb.Delete(id)
+	err = stu.csrdb.Delete(ctx, id)
 	if err != nil {
 		t.Fatal("Could not delete CSR from DB")
 	}
 
-	err = stu.certfile.Delete(id)
+	err = stu.certfile.Delete(ctx, id)
 	if err != nil {
 		t.Fatal("Could not delete certificate from file system")
 	}
@@ -374,7 +821,7 @@ func TestGetCRT(t *testing.T) {
 
 func TestDelete(t *testing.T) {
 	stu := setup()
-	srv := NewEnrollerService(stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, stu.secrets, stu.homePath)
+	srv := NewEnrollerService(stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, stu.journaldb, stu.cas, stu.homePath)
 	ctx := context.Background()
 
 	csrRaw := testCSR()
@@ -392,23 +839,28 @@ func TestDelete(t *testing.T) {
 		CommonName:             certReq.Subject.CommonName,
 		Status:                 csrmodel.PendingStatus,
 	}
-	newID, err := stu.csrdb.Insert(csr)
+	newID, err := stu.csrdb.Insert(ctx, csr)
 	if err != nil {
 		t.Fatal("Could not insert CSR in DB")
 	}
 
-	err = stu.csrfile.Insert(newID, csrRaw)
+	err = stu.csrfile.Insert(ctx, newID, csrRaw)
 	if err != nil {
 		t.Fatal("Could not insert CSR in file system")
 	}
 
-	approbeID, err := stu.csrdb.Insert(csr)
+	err = stu.csrdb.UpdateStatus(ctx, newID, csrmodel.PendingStatus, csrmodel.DeniedStatus)
+	if err != nil {
+		t.Fatal("Could not update CSR status in DB")
+	}
+
+	approbeID, err := stu.csrdb.Insert(ctx, csr)
 	if err != nil {
 		t.Fatal("Could not insert CSR in DB")
 	}
 
 	csr.Status = csrmodel.ApprobedStatus
-	_, err = stu.csrdb.UpdateByID(approbeID, csr)
+	_, err = stu.csrdb.UpdateByID(ctx, approbeID, csr)
 	if err != nil {
 		t.Fatal("Could not update CSR status in DB")
 	}
@@ -418,9 +870,9 @@ func TestDelete(t *testing.T) {
 		id   int
 		ret  error
 	}{
-		{"Delete CSR status is not NEW", approbeID, ErrInvalidDeleteOp},
+		{"Delete CSR status is APPROBED", approbeID, ErrInvalidDeleteOp},
 		{"Delete CSR ID does not exist", newID + 1000, ErrInvalidID},
-		{"Delete CSR ID exists", newID, nil},
+		{"Delete DENIED Status CSR", newID, nil},
 	}
 	for _, tc := range testCases {
 		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
@@ -431,60 +883,94 @@ func TestDelete(t *testing.T) {
 		})
 	}
 
-	err = stu.csrdb.Delete(approbeID)
+	err = stu.csrdb.Delete(ctx, approbeID)
 	if err != nil {
 		t.Fatal("Could not delete CSR from DB")
 	}
 }
 
+// unreachableCertsDB is a certificates store whose database does not answer.
+type unreachableCertsDB struct {
+	certstore.DB
+}
+
+func (unreachableCertsDB) PingContext(ctx context.Context) error {
+	return errors.New("connection refused")
+}
+
+func TestHealth(t *testing.T) {
+	stu := setup()
+	srv := NewEnrollerService(stu.csrdb, stu.csrfile, stu.certdb, stu.certfile, stu.journaldb, stu.cas, stu.homePath)
+	if !srv.Health(context.Background()) {
+		t.Error("Health = false with reachable stores")
+	}
+	srv = NewEnrollerService(stu.csrdb, stu.csrfile, unreachableCertsDB{stu.certdb}, stu.certfile, stu.journaldb, stu.cas, stu.homePath)
+	if srv.Health(context.Background()) {
+		t.Error("Health = true with an unreachable certificates database")
+	}
+}
+
+// homePath holds the CA certificate and key generated for the tests.
+var homePath string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "enroller")
+	if err != nil {
+		panic(err)
+	}
+	homePath = dir
+	writeTestCA(homePath, "enroller", "Enroller Test CA")
+	writeTestCA(homePath, "test", "Test Fleet CA")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
 func setup() *serviceSetUp {
 	buf := &bytes.Buffer{}
 	logger := log.NewJSONLogger(buf)
-	err, cfg := configs.NewConfig("enrollertest")
+	certdb := certsmemory.NewDB()
+	defaultSecrets, err := secretsfile.NewFile(homePath+"/enroller.crt", homePath+"/enroller.key", nil, "http://ocsp.test.com", "", 0, certdb, logger)
 	if err != nil {
 		panic(err)
 	}
-	connStr := "dbname=" + cfg.PostgresDB + " user=" + cfg.PostgresUser + " password=" + cfg.PostgresPassword + " host=" + cfg.PostgresHostname + " port=" + cfg.PostgresPort + " sslmode=disable"
-	csrdb, err := setupCSRDB(connStr, logger)
+	testSecrets, err := secretsfile.NewFile(homePath+"/test.crt", homePath+"/test.key", nil, "http://ocsp.test.com", "http://crl.test.com/test.crl", 0, certdb, logger)
 	if err != nil {
 		panic(err)
 	}
-	certdb, err := setupCertDB(connStr, logger)
+	cas, err := secrets.NewCAs("default", &secrets.CA{Name: "default", Secrets: defaultSecrets}, &secrets.CA{Name: "test", Secrets: testSecrets})
 	if err != nil {
 		panic(err)
 	}
-	csrfile := setupCSRFile(cfg.HomePath, logger)
-	certfile := setupCertFile(cfg.HomePath, logger)
-	secrets := setupSecrets(cfg.CACertFile, cfg.CAKeyFile, cfg.OCSPServer, certdb, logger)
-	return &serviceSetUp{csrdb, csrfile, certdb, certfile, secrets, cfg.HomePath}
+	return &serviceSetUp{csrmemory.NewDB(), csrmemory.NewFile(), certdb, certsmemory.NewFile(), journalmemory.NewDB(), defaultSecrets, cas, homePath}
 }
 
-func setupCSRDB(connStr string, logger log.Logger) (csrstore.DB, error) {
-	db, err := csrdb.NewDB("postgres", connStr, logger)
+func writeTestCA(dir string, name string, commonName string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
-		return nil, err
+		panic(err)
 	}
-	return db, nil
-}
-
-func setupCertDB(connStr string, logger log.Logger) (certstore.DB, error) {
-	db, err := certsdb.NewDB("postgres", connStr, logger)
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{"Test"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
 	if err != nil {
-		return nil, err
+		panic(err)
+	}
+	crt := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(dir+"/"+name+".crt", crt, 0644); err != nil {
+		panic(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(dir+"/"+name+".key", keyPEM, 0600); err != nil {
+		panic(err)
 	}
-	return db, nil
-}
-
-func setupCSRFile(path string, logger log.Logger) csrstore.File {
-	return csrfile.NewFile(path, logger)
-}
-
-func setupCertFile(path string, logger log.Logger) certstore.File {
-	return certsfile.NewFile(path, logger)
-}
-
-func setupSecrets(CACertFile string, CAKeyFile string, OCSPServer string, certsdb certstore.DB, logger log.Logger) secrets.Secrets {
-	return secretsfile.NewFile(CACertFile, CAKeyFile, OCSPServer, certsdb, logger)
 }
 
 func testCSR() []byte {
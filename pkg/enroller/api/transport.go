@@ -3,6 +3,7 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -31,9 +32,16 @@ type errorer interface {
 
 var claims = &auth.KeycloakClaims{}
 
-func MakeHTTPHandler(s Service, logger log.Logger, auth auth.Auth, otTracer stdopentracing.Tracer) http.Handler {
+// MakeHTTPHandler returns the enroller API handler. Its requests are
+// authenticated with the JWTs verified by auth and, when introspector is
+// not nil, also with the opaque tokens it introspects.
+func MakeHTTPHandler(s Service, logger log.Logger, auth auth.Auth, introspector *auth.Introspector, otTracer stdopentracing.Tracer) http.Handler {
 	r := mux.NewRouter()
 	e := MakeServerEndpoints(s, otTracer)
+	authenticate := jwt.NewParser(auth.Kf, stdjwt.SigningMethodRS256, auth.KeycloakClaimsFactory)
+	if introspector != nil {
+		authenticate = introspector.NewParser(authenticate)
+	}
 	options := []httptransport.ServerOption{
 		httptransport.ServerErrorHandler(transport.NewLogErrorHandler(logger)),
 		httptransport.ServerErrorEncoder(encodeError),
@@ -43,59 +51,73 @@ func MakeHTTPHandler(s Service, logger log.Logger, auth auth.Auth, otTracer stdo
 	r.Methods("GET").Path("/v1/health").Handler(httptransport.NewServer(
 		e.HealthEndpoint,
 		decodeHealthRequest,
-		encodeResponse,
+		encodeHealthResponse,
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "Health", logger)))...,
 	))
 
 	r.Methods("POST").Path("/v1/csrs").Handler(httptransport.NewServer(
-		jwt.NewParser(auth.Kf, stdjwt.SigningMethodRS256, auth.KeycloakClaimsFactory)(e.PostCSREndpoint),
+		authenticate(e.PostCSREndpoint),
 		decodePostCSRRequest,
 		encodePostCSRResponse,
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "PostCSR", logger)))...,
 	))
 
 	r.Methods("GET").Path("/v1/csrs").Handler(httptransport.NewServer(
-		jwt.NewParser(auth.Kf, stdjwt.SigningMethodRS256, auth.KeycloakClaimsFactory)(e.GetPendingCSRsEndpoint),
+		authenticate(e.GetPendingCSRsEndpoint),
 		decodeGetPendingCSRsRequest,
 		encodeGetPendingCSRsResponse,
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "GetPendingCSRs", logger)))...,
 	))
 
 	r.Methods("GET").Path("/v1/csrs/{id}").Handler(httptransport.NewServer(
-		jwt.NewParser(auth.Kf, stdjwt.SigningMethodRS256, auth.KeycloakClaimsFactory)(e.GetPendingCSRDBEndpoint),
+		authenticate(e.GetPendingCSRDBEndpoint),
 		decodeGetPendingCSRRequest,
 		encodeGetPendingCSRResponse,
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "GetPendingCSRDB", logger)))...,
 	))
 
 	r.Methods("GET").Path("/v1/csrs/{id}/file").Handler(httptransport.NewServer(
-		jwt.NewParser(auth.Kf, stdjwt.SigningMethodRS256, auth.KeycloakClaimsFactory)(e.GetPendingCSRFileEndpoint),
+		authenticate(e.GetPendingCSRFileEndpoint),
 		decodeGetPendingCSRRequest,
 		encodeGetPendingCSRFileResponse,
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "GetPendingCSRFile", logger)))...,
 	))
 
 	r.Methods("PUT").Path("/v1/csrs/{id}").Handler(httptransport.NewServer(
-		jwt.NewParser(auth.Kf, stdjwt.SigningMethodRS256, auth.KeycloakClaimsFactory)(e.PutChangeCSRStatusEndpoint),
+		authenticate(e.PutChangeCSRStatusEndpoint),
 		decodePutChangeCSRStatusRequest,
 		encodePutChangeCSRStatusResponse,
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "PutChangeCSRStatus", logger)))...,
 	))
 
 	r.Methods("GET").Path("/v1/csrs/{id}/crt").Handler(httptransport.NewServer(
-		jwt.NewParser(auth.Kf, stdjwt.SigningMethodRS256, auth.KeycloakClaimsFactory)(e.GetCRTEndpoint),
+		authenticate(e.GetCRTEndpoint),
 		decodeGetCRTRequest,
 		encodeGetCRTResponse,
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "GetCRT", logger)))...,
 	))
 
 	r.Methods("DELETE").Path("/v1/csrs/{id}").Handler(httptransport.NewServer(
-		jwt.NewParser(auth.Kf, stdjwt.SigningMethodRS256, auth.KeycloakClaimsFactory)(e.DeleteCSREndpoint),
+		authenticate(e.DeleteCSREndpoint),
 		decodeDeleteCSRRequest,
 		encodeResponse,
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "DeleteCSR", logger)))...,
 	))
 
+	r.Methods("GET").Path("/v1/cas").Handler(httptransport.NewServer(
+		authenticate(e.GetCAsEndpoint),
+		decodeGetCAsRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "GetCAs", logger)))...,
+	))
+
+	r.Methods("POST").Path("/v1/cas/{ca}/unseal").Handler(httptransport.NewServer(
+		authenticate(e.UnsealEndpoint),
+		decodeUnsealRequest,
+		encodeResponse,
+		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "Unseal", logger)))...,
+	))
+
 	return r
 }
 
@@ -155,8 +177,24 @@ func decodePutChangeCSRStatusRequest(ctx context.Context, r *http.Request) (requ
 	if c.Status == "" {
 		return nil, ErrInvalidCSR
 	}
-	return putChangeCSRStatusRequest{CSR: c, ID: idNum}, nil
+	profile := r.URL.Query().Get("profile")
+	ca := r.URL.Query().Get("ca")
+	return putChangeCSRStatusRequest{CSR: c, ID: idNum, Profile: profile, CA: ca}, nil
+
+}
+
+func decodeGetCAsRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	var req getCAsRequest
+	return req, nil
+}
 
+func decodeUnsealRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	var req unsealRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Share) == 0 {
+		return nil, ErrInvalidShare
+	}
+	req.CA = mux.Vars(r)["ca"]
+	return req, nil
 }
 
 func decodeDeleteCSRRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
@@ -199,6 +237,10 @@ func encodePostCSRResponse(ctx context.Context, w http.ResponseWriter, response
 
 func encodeGetPendingCSRsResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	resp := response.(getPendingCSRsResponse)
+	if resp.Err != nil {
+		encodeError(ctx, resp.Err, w)
+		return nil
+	}
 	w.Header().Set("Content-Type", "application/hal+json; charset=utf-8")
 	url := "http://" + os.Getenv("ENROLLER_HOST") + os.Getenv("ENROLLER_PORT") + "/v1/csrs"
 	embedHal := hal.NewResource(resp.CSRs, url)
@@ -237,6 +279,17 @@ func encodePutChangeCSRStatusResponse(ctx context.Context, w http.ResponseWriter
 	return json.NewEncoder(w).Encode(csrHal)
 }
 
+// encodeHealthResponse answers 503 when the service is not healthy, so
+// that Consul health checks fail while the database is unreachable.
+func encodeHealthResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	resp := response.(healthResponse)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if !resp.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return json.NewEncoder(w).Encode(resp)
+}
+
 func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	if e, ok := response.(errorer); ok && e.error() != nil {
 		// Not a Go kit transport error, but a business-logic error.
@@ -278,14 +331,24 @@ func encodeError(_ context.Context, err error, w http.ResponseWriter) {
 }
 
 func codeFrom(err error) int {
+	if errors.Is(err, ErrLintCert) {
+		return http.StatusUnprocessableEntity
+	}
 	switch err {
-	case ErrInvalidCSR, ErrInvalidIDFormat, ErrInvalidApprobeOp, ErrInvalidDenyOp, ErrInvalidRevokeOp, ErrInvalidDeleteOp, ErrInvalidOperation:
+	case ErrInvalidCSR, ErrInvalidIDFormat, ErrInvalidApprobeOp, ErrInvalidDenyOp, ErrInvalidRevokeOp, ErrInvalidDeleteOp, ErrInvalidOperation, ErrInvalidProfile, ErrInvalidCA, ErrNotSealable, ErrInvalidShare:
 		return http.StatusBadRequest
+	case ErrForbidden:
+		return http.StatusForbidden
 	case ErrInvalidID:
 		return http.StatusNotFound
 	case ErrIncorrectType:
 		return http.StatusUnsupportedMediaType
-	case jwt.ErrTokenExpired, jwt.ErrTokenInvalid, jwt.ErrTokenMalformed, jwt.ErrTokenNotActive, jwt.ErrTokenContextMissing, jwt.ErrUnexpectedSigningMethod:
+	case ErrCSRConflict, ErrSameCustodian:
+		return http.StatusConflict
+	case ErrUnavailable, ErrSealed, auth.ErrIntrospection:
+		return http.StatusServiceUnavailable
+	case jwt.ErrTokenExpired, jwt.ErrTokenInvalid, jwt.ErrTokenMalformed, jwt.ErrTokenNotActive, jwt.ErrTokenContextMissing, jwt.ErrUnexpectedSigningMethod,
+		auth.ErrUnknownKey, auth.ErrIssuer, auth.ErrAudience, auth.ErrAuthorizedParty, auth.ErrInactiveToken:
 		return http.StatusUnauthorized
 	default:
 		return http.StatusInternalServerError
@@ -2,33 +2,68 @@ package auth
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
-	"github.com/lamassuiot/enroller/pkg/enroller/crypto"
 	"net/http"
+	"time"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/crypto"
 
 	stdjwt "github.com/dgrijalva/jwt-go"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 )
 
 type Auth interface {
 	Kf(token *stdjwt.Token) (interface{}, error)
 	KeycloakClaimsFactory() stdjwt.Claims
+	// Close stops refreshing the token signing keys.
+	Close()
+}
+
+// Config configures how the tokens issued by a Keycloak realm, or by any
+// OpenID Connect provider, are verified.
+type Config struct {
+	Hostname string
+	Port     string
+	Protocol string
+	Realm    string
+	// IssuerURL is the URL of an OpenID Connect provider, whose JWKS
+	// endpoint is discovered from it. It replaces the Keycloak settings.
+	IssuerURL string
+	// CA verifies the provider certificate, with the system CAs if empty.
+	CA string
+
+	// Issuer is the iss claim of the tokens, by default IssuerURL or the
+	// realm URL.
+	Issuer string
+	// Audience must be in the aud claim of the tokens, when set.
+	Audience string
+	// AuthorizedParties are the clients accepted in the azp claim, any if
+	// empty.
+	AuthorizedParties []string
+	// Leeway is the clock skew allowed checking the token times.
+	Leeway time.Duration
+	// RefreshInterval is how often the token signing keys are fetched.
+	RefreshInterval time.Duration
+	// Claims locate the user in the tokens.
+	Claims ClaimPaths
 }
 
 type auth struct {
-	keycloakHost     string
-	keycloakPort     string
-	keycloakProtocol string
-	keycloakRealm    string
-	keycloakCA       string
+	cfg    Config
+	issuer string
+	keys   *keySet
 }
 
 type Roles struct {
 	RoleNames []string `json:"roles"`
 }
 
+// Account holds the client roles of the account client.
 type Account struct {
-	roles []Roles `json:"account"`
+	Roles Roles `json:"account"`
 }
 
 type KeycloakClaims struct {
@@ -48,68 +83,213 @@ type KeycloakClaims struct {
 	GivenName                 string   `json:"given_name,omitempty"`
 	FamilyName                string   `json:"family_name,omitempty"`
 	Email                     string   `json:"email,omitempty"`
+	// Audience replaces the aud claim of StandardClaims, which can also be
+	// a list.
+	Audience Audience `json:"aud,omitempty"`
+	// Groups are read from the claim at ClaimPaths.Groups.
+	Groups []string `json:"-"`
 	stdjwt.StandardClaims
-}
 
-var (
-	errBadKey              = errors.New("unexpected JWT key signing method")
-	errBadPublicKeyRequest = errors.New("unable to obtain public key from Keycloak")
-	errBadPublicKeyParse   = errors.New("unable to parse Keycloak public key")
-	errKeycloakCA          = errors.New("error reading Keycloak CA")
-)
-
-type KeycloakPublic struct {
-	Realm           string `json:"realm"`
-	PublicKey       string `json:"public_key"`
-	TokenService    string `json:"token-service"`
-	AccountService  string `json:"account-service"`
-	TokensNotBefore int    `json:"tokens-not-before"`
+	// paths locate the username, roles and groups of the tokens parsed
+	// by Auth, and validate checks their claims. optionalIssuer accepts
+	// claims without iss, which introspection responses may omit.
+	paths          *ClaimPaths
+	validate       func(*KeycloakClaims) error
+	optionalIssuer bool
 }
 
-func NewAuth(keycloakHost string, keycloakPort string, keycloakProtocol string, keycloakRealm string, keycloakCA string) Auth {
-	return &auth{keycloakHost: keycloakHost,
-		keycloakPort:     keycloakPort,
-		keycloakProtocol: keycloakProtocol,
-		keycloakRealm:    keycloakRealm,
-		keycloakCA:       keycloakCA,
+// UnmarshalJSON reads the claims, taking the username, roles and groups
+// from the claim paths of Auth when the claims are created by it, so that
+// tokens of providers other than Keycloak fill the same fields.
+func (c *KeycloakClaims) UnmarshalJSON(data []byte) error {
+	type keycloakClaims KeycloakClaims
+	if err := json.Unmarshal(data, (*keycloakClaims)(c)); err != nil {
+		return err
+	}
+	if c.paths == nil {
+		return nil
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return err
+	}
+	if c.paths.Username != "" {
+		if usernames := lookupStrings(claims, c.paths.Username); len(usernames) == 1 {
+			c.PreferredUsername = usernames[0]
+		} else {
+			c.PreferredUsername = ""
+		}
+	}
+	if c.paths.Roles != "" {
+		c.RealmAccess.RoleNames = lookupStrings(claims, c.paths.Roles)
 	}
+	if c.paths.Groups != "" {
+		c.Groups = lookupStrings(claims, c.paths.Groups)
+	}
+	return nil
 }
 
-func (a *auth) KeycloakClaimsFactory() stdjwt.Claims {
-	return &KeycloakClaims{}
+// HasRole tells whether the user has role, or belongs to a group that
+// ClaimPaths.GroupRoles maps to role.
+func (c *KeycloakClaims) HasRole(role string) bool {
+	if contains(c.RealmAccess.RoleNames, role) {
+		return true
+	}
+	if c.paths == nil {
+		return false
+	}
+	for _, group := range c.Groups {
+		if c.paths.GroupRoles[group] == role {
+			return true
+		}
+	}
+	return false
 }
 
-func (a *auth) Kf(token *stdjwt.Token) (interface{}, error) {
+// Audience is the aud claim, a single audience or a list of them.
+type Audience []string
 
-	if _, ok := token.Method.(*stdjwt.SigningMethodRSA); !ok {
-		return nil, errBadKey
+// UnmarshalJSON reads a single audience or a list of them.
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	var audience string
+	if err := json.Unmarshal(data, &audience); err == nil {
+		*a = Audience{audience}
+		return nil
 	}
+	var audiences []string
+	if err := json.Unmarshal(data, &audiences); err != nil {
+		return err
+	}
+	*a = audiences
+	return nil
+}
 
-	keycloakURL := a.keycloakProtocol + "://" + a.keycloakHost + ":" + a.keycloakPort + "/auth/realms/" + a.keycloakRealm
-	caCertPool, err := crypto.CreateCAPool(a.keycloakCA)
-	if err != nil {
-		return nil, errKeycloakCA
+// Contains tells whether audience is one of the audiences.
+func (a Audience) Contains(audience string) bool {
+	for _, aud := range a {
+		if aud == audience {
+			return true
+		}
 	}
+	return false
+}
 
+// Valid checks the claims of a token parsed by Auth against its
+// configuration, and otherwise only the token times.
+func (c *KeycloakClaims) Valid() error {
+	if c.validate != nil {
+		return c.validate(c)
+	}
+	return c.StandardClaims.Valid()
+}
+
+var (
+	errBadKey = errors.New("unexpected JWT key signing method")
+
+	// ErrUnknownKey is returned for tokens signed with a key that is not
+	// in the key set of the realm.
+	ErrUnknownKey = errors.New("token signed with an unknown key")
+	// ErrIssuer is returned for tokens from another issuer.
+	ErrIssuer = errors.New("token issued by an unexpected issuer")
+	// ErrAudience is returned for tokens for another audience.
+	ErrAudience = errors.New("token issued for an unexpected audience")
+	// ErrAuthorizedParty is returned for tokens issued to another client.
+	ErrAuthorizedParty = errors.New("token issued to an unexpected client")
+)
+
+// NewAuth returns the verification of the tokens of the provider in cfg,
+// whose keys are refreshed every cfg.RefreshInterval and on unknown keys.
+func NewAuth(cfg Config, logger log.Logger) (Auth, error) {
+	var caCertPool *x509.CertPool
+	if cfg.CA != "" {
+		var err error
+		if caCertPool, err = crypto.CreateCAPool(cfg.CA); err != nil {
+			return nil, err
+		}
+	}
 	client := &http.Client{
+		Timeout: 10 * time.Second,
 		Transport: &http.Transport{
 			TLSClientConfig: &tls.Config{
 				RootCAs: caCertPool,
 			},
 		},
 	}
+	a := &auth{cfg: cfg, issuer: cfg.Issuer}
+	if cfg.IssuerURL != "" {
+		if a.issuer == "" {
+			a.issuer = cfg.IssuerURL
+		}
+		a.keys = newKeySet("", client, logger)
+		a.keys.discover = func() (string, error) {
+			return discover(client, cfg.IssuerURL, a.issuer)
+		}
+	} else {
+		realmURL := cfg.Protocol + "://" + cfg.Hostname + ":" + cfg.Port + "/auth/realms/" + cfg.Realm
+		if a.issuer == "" {
+			a.issuer = realmURL
+		}
+		a.keys = newKeySet(realmURL+"/protocol/openid-connect/certs", client, logger)
+	}
+	if err := a.keys.refresh(); err != nil {
+		level.Warn(logger).Log("err", err, "msg", "Token signing keys will be fetched again when a token is received")
+	}
+	if cfg.RefreshInterval > 0 {
+		a.keys.run(cfg.RefreshInterval)
+	}
+	return a, nil
+}
 
-	r, err := client.Get(keycloakURL)
-	if err != nil {
-		return nil, err
+func (a *auth) KeycloakClaimsFactory() stdjwt.Claims {
+	return &KeycloakClaims{paths: &a.cfg.Claims, validate: a.validate}
+}
+
+func (a *auth) Kf(token *stdjwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*stdjwt.SigningMethodRSA); !ok {
+		return nil, errBadKey
+	}
+	kid, _ := token.Header["kid"].(string)
+	return a.keys.get(kid)
+}
+
+func (a *auth) Close() {
+	a.keys.close()
+}
+
+// validate checks the times of the token, allowing the configured clock
+// skew, and that it was issued by the realm for the enroller.
+func (a *auth) validate(c *KeycloakClaims) error {
+	now := time.Now().Add(-a.cfg.Leeway).Unix()
+	if !c.VerifyExpiresAt(now, true) {
+		return stdjwt.NewValidationError("token is expired", stdjwt.ValidationErrorExpired)
 	}
-	var keyPublic KeycloakPublic
-	if err := json.NewDecoder(r.Body).Decode(&keyPublic); err != nil {
-		return nil, errBadPublicKeyRequest
+	now = time.Now().Add(a.cfg.Leeway).Unix()
+	if !c.VerifyIssuedAt(now, false) {
+		return stdjwt.NewValidationError("token used before issued", stdjwt.ValidationErrorNotValidYet)
 	}
-	pubKey, err := crypto.ParseKeycloakPublicKey([]byte(crypto.PublicKeyHeader + "\n" + keyPublic.PublicKey + "\n" + crypto.PublicKeyFooter))
-	if err != nil {
-		return nil, errBadPublicKeyParse
+	if !c.VerifyNotBefore(now, false) {
+		return stdjwt.NewValidationError("token is not valid yet", stdjwt.ValidationErrorNotValidYet)
+	}
+	if c.Issuer != a.issuer && !(c.Issuer == "" && c.optionalIssuer) {
+		return ErrIssuer
+	}
+	if a.cfg.Audience != "" && !c.Audience.Contains(a.cfg.Audience) {
+		return ErrAudience
+	}
+	if len(a.cfg.AuthorizedParties) > 0 && !contains(a.cfg.AuthorizedParties, c.AuthorizedParty) {
+		return ErrAuthorizedParty
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
 	}
-	return pubKey, nil
+	return false
 }
@@ -1,81 +1,282 @@
 package auth
 
 import (
+	"crypto/rand"
 	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
-
-	"github.com/lamassuiot/enroller/pkg/enroller/configs"
-	"github.com/lamassuiot/enroller/pkg/enroller/crypto"
+	"time"
 
 	stdjwt "github.com/dgrijalva/jwt-go"
+	"github.com/go-kit/kit/log"
 )
 
-func TestKf(t *testing.T) {
-	auth := setup(t)
-	key := loadAuthPublicKey(t)
+// keycloak serves the JWKS endpoint of the realm test, and the discovery
+// document and JWKS endpoint of an OpenID Connect provider at /oidc.
+type keycloak struct {
+	*httptest.Server
+	mu   sync.Mutex
+	keys map[string]*rsa.PrivateKey
+	// discoveredIssuer is the issuer in the discovery document.
+	discoveredIssuer string
+}
 
-	token := createJWTTtoken(t)
+func newKeycloak(t *testing.T, keys map[string]*rsa.PrivateKey) *keycloak {
+	t.Helper()
+	k := &keycloak{keys: keys}
+	k.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		switch r.URL.Path {
+		case "/auth/realms/test/protocol/openid-connect/certs", "/oidc/keys":
+		case "/oidc" + DiscoveryPath:
+			json.NewEncoder(w).Encode(map[string]string{"issuer": k.discoveredIssuer, "jwks_uri": k.URL + "/oidc/keys"})
+			return
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		var set struct {
+			Keys []jwk `json:"keys"`
+		}
+		for kid, key := range k.keys {
+			set.Keys = append(set.Keys, jwk{
+				Kid: kid,
+				Kty: "RSA",
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	k.discoveredIssuer = k.URL + "/oidc"
+	return k
+}
 
-	authKey, err := auth.Kf(token)
-	if err != nil {
-		t.Errorf("Auth service returned an error: %s", err)
-	}
+func (k *keycloak) setKeys(keys map[string]*rsa.PrivateKey) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+}
 
-	if !authKey.(*rsa.PublicKey).Equal(key) {
-		t.Error("Key returned from Auth service is not correct")
-	}
+func (k *keycloak) issuer() string {
+	return k.URL + "/auth/realms/test"
 }
 
-func createJWTTtoken(t *testing.T) *stdjwt.Token {
+func setup(t *testing.T, k *keycloak, dir string, cfg Config) *auth {
 	t.Helper()
-	token := stdjwt.NewWithClaims(stdjwt.SigningMethodRS256, &KeycloakClaims{
-		Type:                      "Bearer",
-		AuthorizedParty:           "lamassu-enroller",
-		Nonce:                     "3353e747-c5f8-405e-81d6-4dc845394bad",
-		AuthTime:                  1608654546,
-		SessionState:              "86932f09-c705-44dd-9c30-5a0e31f94e93",
-		AuthContextClassReference: "0",
-		AllowedOrigins:            []string{"*"},
-		RealmAccess:               Roles{RoleNames: []string{"offline_access", "admin", "uma_authorization"}},
-		ResourceAccess:            Account{roles: []Roles{Roles{RoleNames: []string{"manage-account", "manage-account-links", "view-profile"}}}},
-		Scope:                     "openid email profile",
-		EmailVerified:             false,
-		PreferredUsername:         "enroller",
-	})
-	return token
+	caFile := filepath.Join(dir, "keycloak.crt")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: k.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(k.URL)
+	cfg.Protocol, cfg.Hostname, cfg.Port, cfg.Realm, cfg.CA = "https", u.Hostname(), u.Port(), "test", caFile
+	a, err := NewAuth(cfg, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a.(*auth)
 }
 
-func loadAuthPublicKey(t *testing.T) *rsa.PublicKey {
+func createJWTToken(t *testing.T, kid string, key *rsa.PrivateKey, claims *KeycloakClaims) string {
 	t.Helper()
+	token := stdjwt.NewWithClaims(stdjwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
 
-	fileKey, err := ioutil.ReadFile("testdata/keycloak.key")
+func parse(a *auth, token string) error {
+	_, err := stdjwt.ParseWithClaims(token, a.KeycloakClaimsFactory(), a.Kf)
+	if vErr, ok := err.(*stdjwt.ValidationError); ok && vErr.Inner != nil {
+		return vErr.Inner
+	}
+	return err
+}
+
+func TestKf(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	k := newKeycloak(t, map[string]*rsa.PrivateKey{"key1": key})
+	defer k.Close()
+	dir, err := ioutil.TempDir("", "enroller")
 	if err != nil {
-		t.Fatal("Unable to read public key file")
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := setup(t, k, dir, Config{Audience: "lamassu-enroller", AuthorizedParties: []string{"lamassu-ui"}, Leeway: 30 * time.Second})
+	defer a.Close()
+
+	claims := func(change func(c *KeycloakClaims)) *KeycloakClaims {
+		c := &KeycloakClaims{
+			AuthorizedParty:   "lamassu-ui",
+			PreferredUsername: "enroller",
+			RealmAccess:       Roles{RoleNames: []string{"admin"}},
+			Audience:          Audience{"lamassu-enroller"},
+			StandardClaims: stdjwt.StandardClaims{
+				Issuer:    k.issuer(),
+				IssuedAt:  time.Now().Unix(),
+				ExpiresAt: time.Now().Add(5 * time.Minute).Unix(),
+			},
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+	testCases := []struct {
+		name  string
+		token string
+		ret   error
+	}{
+		{"Correct", createJWTToken(t, "key1", key, claims(nil)), nil},
+		{"Expired within leeway", createJWTToken(t, "key1", key, claims(func(c *KeycloakClaims) { c.ExpiresAt = time.Now().Add(-10 * time.Second).Unix() })), nil},
+		{"Expired", createJWTToken(t, "key1", key, claims(func(c *KeycloakClaims) { c.ExpiresAt = time.Now().Add(-time.Minute).Unix() })), stdjwt.NewValidationError("token is expired", stdjwt.ValidationErrorExpired)},
+		{"Without expiration", createJWTToken(t, "key1", key, claims(func(c *KeycloakClaims) { c.ExpiresAt = 0 })), stdjwt.NewValidationError("token is expired", stdjwt.ValidationErrorExpired)},
+		{"Issued in the future", createJWTToken(t, "key1", key, claims(func(c *KeycloakClaims) { c.IssuedAt = time.Now().Add(time.Minute).Unix() })), stdjwt.NewValidationError("token used before issued", stdjwt.ValidationErrorNotValidYet)},
+		{"Other issuer", createJWTToken(t, "key1", key, claims(func(c *KeycloakClaims) { c.Issuer = "https://keycloak/auth/realms/other" })), ErrIssuer},
+		{"Several audiences", createJWTToken(t, "key1", key, claims(func(c *KeycloakClaims) { c.Audience = Audience{"account", "lamassu-enroller"} })), nil},
+		{"Other audience", createJWTToken(t, "key1", key, claims(func(c *KeycloakClaims) { c.Audience = Audience{"account"} })), ErrAudience},
+		{"Other client", createJWTToken(t, "key1", key, claims(func(c *KeycloakClaims) { c.AuthorizedParty = "other" })), ErrAuthorizedParty},
+		{"Unknown key", createJWTToken(t, "key2", otherKey, claims(nil)), ErrUnknownKey},
+		{"Forged signature", createJWTToken(t, "key1", otherKey, claims(nil)), rsa.ErrVerification},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			err := parse(a, tc.token)
+			if fmt.Sprint(err) != fmt.Sprint(tc.ret) {
+				t.Errorf("Got result is %v; want %v", err, tc.ret)
+			}
+		})
 	}
+}
 
-	key, err := crypto.ParseKeycloakPublicKey([]byte(crypto.PublicKeyHeader + "\n" + string(fileKey) + "\n" + crypto.PublicKeyFooter))
+func TestKeyRotation(t *testing.T) {
+	key1, _ := rsa.GenerateKey(rand.Reader, 2048)
+	key2, _ := rsa.GenerateKey(rand.Reader, 2048)
+	k := newKeycloak(t, map[string]*rsa.PrivateKey{"key1": key1})
+	defer k.Close()
+	dir, err := ioutil.TempDir("", "enroller")
 	if err != nil {
-		t.Fatal("Unable to parse public key")
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := setup(t, k, dir, Config{})
+	defer a.Close()
+	claims := func() *KeycloakClaims {
+		return &KeycloakClaims{StandardClaims: stdjwt.StandardClaims{Issuer: k.issuer(), ExpiresAt: time.Now().Add(time.Minute).Unix()}}
 	}
+	token1 := createJWTToken(t, "key1", key1, claims())
+	token2 := createJWTToken(t, "key2", key2, claims())
 
-	return key
+	// Unknown keys are not fetched again right after a refresh.
+	k.setKeys(map[string]*rsa.PrivateKey{"key2": key2})
+	if err := parse(a, token2); err != ErrUnknownKey {
+		t.Errorf("Got result is %v; want %s", err, ErrUnknownKey)
+	}
 
-}
+	// Then the new key replaces the retired one.
+	a.keys.fetched = time.Time{}
+	if err := parse(a, token2); err != nil {
+		t.Errorf("Got result is %s; want token signed with the new key", err)
+	}
+	if err := parse(a, token1); err != ErrUnknownKey {
+		t.Errorf("Got result is %v; want %s", err, ErrUnknownKey)
+	}
 
-func setup(t *testing.T) *auth {
-	t.Helper()
+	// Cached keys are used while Keycloak is down.
+	k.Close()
+	a.keys.fetched = time.Time{}
+	if err := a.keys.refresh(); err == nil {
+		t.Error("Got result is nil; want error fetching keys from a stopped Keycloak")
+	}
+	if err := parse(a, token2); err != nil {
+		t.Errorf("Got result is %s; want token verified with the cached key", err)
+	}
+}
 
-	cfg, err := configs.NewConfig("enrollertest")
+func TestDiscovery(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	k := newKeycloak(t, map[string]*rsa.PrivateKey{"key1": key})
+	defer k.Close()
+	dir, err := ioutil.TempDir("", "enroller")
 	if err != nil {
-		t.Fatal("Unable to get configuration variables")
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := setup(t, k, dir, Config{IssuerURL: k.URL + "/oidc", Claims: ClaimPaths{Username: "email", Roles: "roles", Groups: "groups"}})
+	defer a.Close()
+
+	token := createJWTToken(t, "key1", key, &KeycloakClaims{StandardClaims: stdjwt.StandardClaims{Issuer: k.URL + "/oidc", ExpiresAt: time.Now().Add(time.Minute).Unix()}})
+	if err := parse(a, token); err != nil {
+		t.Errorf("Got result is %s; want token verified with the discovered key", err)
+	}
+	token = createJWTToken(t, "key1", key, &KeycloakClaims{StandardClaims: stdjwt.StandardClaims{Issuer: k.issuer(), ExpiresAt: time.Now().Add(time.Minute).Unix()}})
+	if err := parse(a, token); err != ErrIssuer {
+		t.Errorf("Got result is %v; want %s", err, ErrIssuer)
 	}
 
-	return &auth{
-		keycloakCA:       cfg.KeycloakCA,
-		keycloakHost:     cfg.KeycloakHostname,
-		keycloakPort:     cfg.KeycloakPort,
-		keycloakProtocol: cfg.KeycloakProtocol,
-		keycloakRealm:    cfg.KeycloakRealm,
+	// A discovery document for another issuer is not trusted.
+	k.mu.Lock()
+	k.discoveredIssuer = "https://other"
+	k.mu.Unlock()
+	other := setup(t, k, dir, Config{IssuerURL: k.URL + "/oidc"})
+	defer other.Close()
+	if err := other.keys.refresh(); err != errDiscoveryIssuer {
+		t.Errorf("Got result is %v; want %s", err, errDiscoveryIssuer)
+	}
+}
+
+func TestClaimPaths(t *testing.T) {
+	token := []byte(`{
+		"email": "admin@example.com",
+		"preferred_username": "keycloak-user",
+		"realm_access": {"roles": ["offline_access"]},
+		"resource_access": {"account": {"roles": ["view-profile"]}, "lamassu-enroller": {"roles": ["admin"]}},
+		"groups": ["operators", "admin"]
+	}`)
+	testCases := []struct {
+		name     string
+		paths    *ClaimPaths
+		username string
+		admin    bool
+		operator bool
+	}{
+		{"Keycloak claims", nil, "keycloak-user", false, false},
+		{"Default paths", &ClaimPaths{}, "keycloak-user", false, false},
+		{"Client roles", &ClaimPaths{Username: "email", Roles: "resource_access.lamassu-enroller.roles"}, "admin@example.com", true, false},
+		{"Unmapped groups", &ClaimPaths{Groups: "groups"}, "keycloak-user", false, false},
+		{"Mapped groups", &ClaimPaths{Groups: "groups", GroupRoles: map[string]string{"operators": "admin"}}, "keycloak-user", true, false},
+		{"Mapped groups without groups claim", &ClaimPaths{GroupRoles: map[string]string{"operators": "admin"}}, "keycloak-user", false, false},
+		{"Missing claims", &ClaimPaths{Username: "upn", Roles: "roles"}, "", false, false},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			claims := &KeycloakClaims{paths: tc.paths}
+			if err := json.Unmarshal(token, claims); err != nil {
+				t.Fatal(err)
+			}
+			if roles := claims.ResourceAccess.Roles.RoleNames; len(roles) != 1 || roles[0] != "view-profile" {
+				t.Errorf("Got account roles %v; want [view-profile]", roles)
+			}
+			if claims.PreferredUsername != tc.username || claims.HasRole("admin") != tc.admin || claims.HasRole("operators") != tc.operator {
+				t.Errorf("Got username %q, admin %t, operator %t; want %q, %t, %t", claims.PreferredUsername, claims.HasRole("admin"), claims.HasRole("operators"), tc.username, tc.admin, tc.operator)
+			}
+		})
 	}
 }
@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/crypto"
+
+	stdjwt "github.com/dgrijalva/jwt-go"
+	"github.com/go-kit/kit/auth/jwt"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// maxCachedTokens bounds the introspection cache, which is emptied when
+// it is full of unexpired tokens.
+const maxCachedTokens = 10000
+
+var (
+	// ErrInactiveToken is returned for tokens the introspection endpoint
+	// reports as not active: expired, revoked or unknown.
+	ErrInactiveToken = errors.New("token is not active")
+	// ErrIntrospection is returned when the introspection endpoint cannot
+	// be reached or gives an unexpected response.
+	ErrIntrospection = errors.New("could not introspect token")
+)
+
+// IntrospectionConfig configures the OAuth 2.0 token introspection
+// endpoint, RFC 7662, that validates opaque access tokens.
+type IntrospectionConfig struct {
+	URL string
+	// ClientID and ClientSecret authenticate the enroller to the endpoint.
+	ClientID     string
+	ClientSecret string
+	// CA verifies the endpoint certificate, with the system CAs if empty.
+	CA string
+	// CacheTTL is how long an active token is trusted without asking the
+	// endpoint again, and never beyond its expiration.
+	CacheTTL time.Duration
+	// RequireIssuer rejects the responses without the optional iss member.
+	RequireIssuer bool
+}
+
+// Introspector validates opaque access tokens with an introspection
+// endpoint, caching the active ones.
+type Introspector struct {
+	cfg    IntrospectionConfig
+	auth   Auth
+	client *http.Client
+	logger log.Logger
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]cachedToken
+}
+
+type cachedToken struct {
+	claims  *KeycloakClaims
+	expires time.Time
+}
+
+// NewIntrospector returns an Introspector for the endpoint in cfg. The
+// claims in its responses are located and checked as those of the JWTs
+// verified by auth.
+func NewIntrospector(cfg IntrospectionConfig, auth Auth, logger log.Logger) (*Introspector, error) {
+	var caCertPool *x509.CertPool
+	if cfg.CA != "" {
+		var err error
+		if caCertPool, err = crypto.CreateCAPool(cfg.CA); err != nil {
+			return nil, err
+		}
+	}
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: caCertPool,
+			},
+		},
+	}
+	return &Introspector{cfg: cfg, auth: auth, client: client, logger: logger, cache: make(map[[sha256.Size]byte]cachedToken)}, nil
+}
+
+// NewParser returns a middleware that stores in the context, under
+// jwt.JWTClaimsContextKey, the claims of the opaque token in it, as
+// jwt.NewParser does with a JWT. Tokens that are JWTs are passed to
+// jwtParser instead.
+func (i *Introspector) NewParser(jwtParser endpoint.Middleware) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		parseJWT := jwtParser(next)
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			token, ok := ctx.Value(jwt.JWTTokenContextKey).(string)
+			if !ok {
+				return nil, jwt.ErrTokenContextMissing
+			}
+			if strings.Count(token, ".") == 2 {
+				return parseJWT(ctx, request)
+			}
+			claims, err := i.Introspect(ctx, token)
+			if err != nil {
+				return nil, err
+			}
+			return next(context.WithValue(ctx, jwt.JWTClaimsContextKey, claims), request)
+		}
+	}
+}
+
+// Introspect returns the claims of token if it is active and they are
+// valid. The username defaults to the username member of the response,
+// and the authorized party to its client_id.
+func (i *Introspector) Introspect(ctx context.Context, token string) (*KeycloakClaims, error) {
+	key := sha256.Sum256([]byte(token))
+	i.mu.Lock()
+	cached, ok := i.cache[key]
+	i.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.claims, nil
+	}
+
+	claims, err := i.introspect(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	expires := time.Now().Add(i.cfg.CacheTTL)
+	if claims.ExpiresAt != 0 && time.Unix(claims.ExpiresAt, 0).Before(expires) {
+		expires = time.Unix(claims.ExpiresAt, 0)
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if len(i.cache) >= maxCachedTokens {
+		i.purge()
+	}
+	i.cache[key] = cachedToken{claims: claims, expires: expires}
+	return claims, nil
+}
+
+func (i *Introspector) introspect(ctx context.Context, token string) (*KeycloakClaims, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequest(http.MethodPost, i.cfg.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if i.cfg.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(i.cfg.ClientID), url.QueryEscape(i.cfg.ClientSecret))
+	}
+	r, err := i.client.Do(req)
+	if err != nil {
+		level.Error(i.logger).Log("err", err, "msg", "Could not reach token introspection endpoint")
+		return nil, ErrIntrospection
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		level.Error(i.logger).Log("err", ErrIntrospection, "msg", "Token introspection endpoint answered "+r.Status)
+		return nil, ErrIntrospection
+	}
+	var response struct {
+		Active   bool   `json:"active"`
+		Username string `json:"username"`
+		ClientID string `json:"client_id"`
+	}
+	var data json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		level.Error(i.logger).Log("err", err, "msg", "Could not decode token introspection response")
+		return nil, ErrIntrospection
+	}
+	if err := json.Unmarshal(data, &response); err != nil {
+		level.Error(i.logger).Log("err", err, "msg", "Could not decode token introspection response")
+		return nil, ErrIntrospection
+	}
+	if !response.Active {
+		return nil, ErrInactiveToken
+	}
+	claims := i.auth.KeycloakClaimsFactory().(*KeycloakClaims)
+	if err := json.Unmarshal(data, claims); err != nil {
+		level.Error(i.logger).Log("err", err, "msg", "Could not decode token introspection response")
+		return nil, ErrIntrospection
+	}
+	if claims.PreferredUsername == "" {
+		claims.PreferredUsername = response.Username
+	}
+	if claims.AuthorizedParty == "" {
+		claims.AuthorizedParty = response.ClientID
+	}
+	claims.optionalIssuer = !i.cfg.RequireIssuer
+	if err := claims.Valid(); err != nil {
+		return nil, validationError(err)
+	}
+	return claims, nil
+}
+
+// validationError returns the error of jwt.NewParser for the token times
+// that are not valid, so that they are reported alike for both kinds of
+// token.
+func validationError(err error) error {
+	ve, ok := err.(*stdjwt.ValidationError)
+	switch {
+	case !ok:
+		return err
+	case ve.Errors&stdjwt.ValidationErrorExpired != 0:
+		return jwt.ErrTokenExpired
+	case ve.Errors&stdjwt.ValidationErrorNotValidYet != 0:
+		return jwt.ErrTokenNotActive
+	default:
+		return jwt.ErrTokenInvalid
+	}
+}
+
+// purge removes the expired tokens from the cache, and empties it if they
+// are all unexpired.
+func (i *Introspector) purge() {
+	now := time.Now()
+	for key, cached := range i.cache {
+		if !now.Before(cached.expires) {
+			delete(i.cache, key)
+		}
+	}
+	if len(i.cache) >= maxCachedTokens {
+		i.cache = make(map[[sha256.Size]byte]cachedToken)
+	}
+}
@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/auth/jwt"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+)
+
+// introspection serves a token introspection endpoint for the client
+// enroller, answering with the response of each token.
+type introspection struct {
+	*httptest.Server
+	mu        sync.Mutex
+	responses map[string]string
+	requests  int
+}
+
+func newIntrospection(responses map[string]string) *introspection {
+	i := &introspection{responses: responses}
+	i.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i.mu.Lock()
+		defer i.mu.Unlock()
+		i.requests++
+		if id, secret, ok := r.BasicAuth(); !ok || id != "enroller" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		response, ok := i.responses[r.PostFormValue("token")]
+		if !ok {
+			response = `{"active": false}`
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(response))
+	}))
+	return i
+}
+
+func (i *introspection) count() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.requests
+}
+
+// testAuth returns the token verification of the introspection tests,
+// which only checks the claims.
+func testAuth(cfg Config) Auth {
+	cfg.Issuer = "https://issuer.test"
+	return &auth{cfg: cfg, issuer: cfg.Issuer}
+}
+
+func TestIntrospect(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	server := newIntrospection(map[string]string{
+		"device":      fmt.Sprintf(`{"active": true, "iss": "https://issuer.test", "aud": "enroller", "username": "dms01", "client_id": "dms", "exp": %d}`, exp),
+		"admin":       fmt.Sprintf(`{"active": true, "iss": "https://issuer.test", "aud": ["enroller"], "username": "admin-client", "client_id": "admin-cli", "roles": ["admin"], "exp": %d}`, exp),
+		"issuer":      fmt.Sprintf(`{"active": true, "iss": "https://other.test", "aud": "enroller", "username": "dms01", "client_id": "dms", "exp": %d}`, exp),
+		"audience":    fmt.Sprintf(`{"active": true, "iss": "https://issuer.test", "aud": "other", "username": "dms01", "client_id": "dms", "exp": %d}`, exp),
+		"client":      fmt.Sprintf(`{"active": true, "iss": "https://issuer.test", "aud": "enroller", "username": "dms01", "client_id": "other", "exp": %d}`, exp),
+		"azp":         fmt.Sprintf(`{"active": true, "iss": "https://issuer.test", "aud": "enroller", "username": "dms01", "azp": "other", "client_id": "dms", "exp": %d}`, exp),
+		"expired":     fmt.Sprintf(`{"active": true, "iss": "https://issuer.test", "aud": "enroller", "username": "dms01", "client_id": "dms", "exp": %d}`, time.Now().Add(-time.Hour).Unix()),
+		"without-exp": `{"active": true, "iss": "https://issuer.test", "aud": "enroller", "username": "dms01", "client_id": "dms"}`,
+		"without-iss": fmt.Sprintf(`{"active": true, "aud": "enroller", "username": "dms01", "client_id": "dms", "exp": %d}`, exp),
+		"revoked":     `{"active": false, "username": "dms02"}`,
+		"invalid":     `not json`,
+	})
+	defer server.Close()
+	a := testAuth(Config{Audience: "enroller", AuthorizedParties: []string{"dms", "admin-cli"}, Claims: ClaimPaths{Roles: "roles"}})
+
+	testCases := []struct {
+		name     string
+		secret   string
+		token    string
+		issuer   bool
+		username string
+		client   string
+		admin    bool
+		ret      error
+	}{
+		{"Active token", "secret", "device", false, "dms01", "dms", false, nil},
+		{"Active token with roles", "secret", "admin", false, "admin-client", "admin-cli", true, nil},
+		{"Wrong issuer", "secret", "issuer", false, "", "", false, ErrIssuer},
+		{"Wrong audience", "secret", "audience", false, "", "", false, ErrAudience},
+		{"Wrong client", "secret", "client", false, "", "", false, ErrAuthorizedParty},
+		{"Wrong authorized party", "secret", "azp", false, "", "", false, ErrAuthorizedParty},
+		{"Expired token", "secret", "expired", false, "", "", false, jwt.ErrTokenExpired},
+		{"Token without issuer", "secret", "without-iss", false, "dms01", "dms", false, nil},
+		{"Token without required issuer", "secret", "without-iss", true, "", "", false, ErrIssuer},
+		{"Token without expiration", "secret", "without-exp", false, "", "", false, jwt.ErrTokenExpired},
+		{"Inactive token", "secret", "revoked", false, "", "", false, ErrInactiveToken},
+		{"Unknown token", "secret", "unknown", false, "", "", false, ErrInactiveToken},
+		{"Invalid response", "secret", "invalid", false, "", "", false, ErrIntrospection},
+		{"Wrong client secret", "other", "device", false, "", "", false, ErrIntrospection},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			i, err := NewIntrospector(IntrospectionConfig{
+				URL:           server.URL,
+				ClientID:      "enroller",
+				ClientSecret:  tc.secret,
+				CacheTTL:      time.Minute,
+				RequireIssuer: tc.issuer,
+			}, a, log.NewNopLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims, err := i.Introspect(context.Background(), tc.token)
+			if err != tc.ret {
+				t.Fatalf("Got result is %v; want %v", err, tc.ret)
+			}
+			if err != nil {
+				return
+			}
+			if claims.PreferredUsername != tc.username || claims.AuthorizedParty != tc.client || claims.HasRole("admin") != tc.admin {
+				t.Errorf("Got username %q, client %q, admin %t; want %q, %q, %t", claims.PreferredUsername, claims.AuthorizedParty, claims.HasRole("admin"), tc.username, tc.client, tc.admin)
+			}
+		})
+	}
+}
+
+func TestIntrospectionCache(t *testing.T) {
+	server := newIntrospection(map[string]string{
+		"device":   fmt.Sprintf(`{"active": true, "iss": "https://issuer.test", "username": "dms01", "exp": %d}`, time.Now().Add(time.Hour).Unix()),
+		"expiring": fmt.Sprintf(`{"active": true, "iss": "https://issuer.test", "username": "dms02", "exp": %d}`, time.Now().Add(-time.Second).Unix()),
+	})
+	defer server.Close()
+	i, err := NewIntrospector(IntrospectionConfig{URL: server.URL, ClientID: "enroller", ClientSecret: "secret", CacheTTL: time.Minute}, testAuth(Config{}), log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		token    string
+		requests int
+	}{
+		{"First use", "device", 1},
+		{"Cached token", "device", 1},
+		{"Inactive token", "revoked", 2},
+		{"Inactive token is not cached", "revoked", 3},
+		{"Expired token", "expiring", 4},
+		{"Expired token is not cached", "expiring", 5},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			i.Introspect(context.Background(), tc.token)
+			if requests := server.count(); requests != tc.requests {
+				t.Errorf("Got result is %d requests; want %d", requests, tc.requests)
+			}
+		})
+	}
+}
+
+func TestIntrospectionParser(t *testing.T) {
+	server := newIntrospection(map[string]string{
+		"device": fmt.Sprintf(`{"active": true, "iss": "https://issuer.test", "username": "dms01", "exp": %d}`, time.Now().Add(time.Hour).Unix()),
+	})
+	defer server.Close()
+	i, err := NewIntrospector(IntrospectionConfig{URL: server.URL, ClientID: "enroller", ClientSecret: "secret", CacheTTL: time.Minute}, testAuth(Config{}), log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwtParser := func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			return next(context.WithValue(ctx, jwt.JWTClaimsContextKey, &KeycloakClaims{PreferredUsername: "jwt-user"}), request)
+		}
+	}
+	username := func(ctx context.Context, request interface{}) (interface{}, error) {
+		return ctx.Value(jwt.JWTClaimsContextKey).(*KeycloakClaims).PreferredUsername, nil
+	}
+	e := i.NewParser(jwtParser)(username)
+
+	testCases := []struct {
+		name     string
+		ctx      context.Context
+		username interface{}
+		ret      error
+	}{
+		{"Opaque token", context.WithValue(context.Background(), jwt.JWTTokenContextKey, "device"), "dms01", nil},
+		{"JWT", context.WithValue(context.Background(), jwt.JWTTokenContextKey, "header.payload.signature"), "jwt-user", nil},
+		{"Inactive token", context.WithValue(context.Background(), jwt.JWTTokenContextKey, "revoked"), nil, ErrInactiveToken},
+		{"Missing token", context.Background(), nil, jwt.ErrTokenContextMissing},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			username, err := e(tc.ctx, nil)
+			if err != tc.ret || username != tc.username {
+				t.Errorf("Got result is %v, %v; want %v, %v", username, err, tc.username, tc.ret)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// minRefreshInterval limits how often the keys are fetched for tokens
+// signed with an unknown key, so that made up key IDs cannot flood the
+// identity provider.
+const minRefreshInterval = 10 * time.Second
+
+var (
+	errJWKSStatus  = errors.New("unexpected JWKS response status")
+	errRSAExponent = errors.New("invalid RSA exponent")
+)
+
+// jwk is a key of a JSON Web Key Set, RFC 7517. Only RSA signing keys are
+// used.
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// keySet caches the keys of a JWKS endpoint by key ID. The cached keys
+// are kept while the endpoint cannot be reached.
+type keySet struct {
+	url    string
+	client *http.Client
+	logger log.Logger
+	// discover finds the JWKS endpoint when url is empty.
+	discover func() (string, error)
+
+	mu      sync.RWMutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+
+	// refreshMu makes concurrent requests with an unknown key wait for a
+	// single refresh.
+	refreshMu sync.Mutex
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func newKeySet(url string, client *http.Client, logger log.Logger) *keySet {
+	return &keySet{url: url, client: client, logger: logger, keys: make(map[string]*rsa.PublicKey)}
+}
+
+// get returns the key with ID kid, refreshing the keys if it is not cached
+// yet, as when the identity provider rotates its keys. A token without key
+// ID can only be verified when there is a single key.
+func (s *keySet) get(kid string) (*rsa.PublicKey, error) {
+	if key, ok := s.lookup(kid); ok {
+		return key, nil
+	}
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	if key, ok := s.lookup(kid); ok {
+		return key, nil
+	}
+	s.mu.RLock()
+	fetched := s.fetched
+	s.mu.RUnlock()
+	if time.Since(fetched) < minRefreshInterval {
+		return nil, ErrUnknownKey
+	}
+	if err := s.refresh(); err != nil {
+		return nil, ErrUnknownKey
+	}
+	if key, ok := s.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+func (s *keySet) lookup(kid string) (*rsa.PublicKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+// refresh fetches the keys and replaces the cached ones, so that retired
+// keys are no longer accepted. A failed fetch keeps the cached keys.
+func (s *keySet) refresh() error {
+	s.mu.Lock()
+	s.fetched = time.Now()
+	s.mu.Unlock()
+	keys, err := s.fetch()
+	if err != nil {
+		level.Error(s.logger).Log("err", err, "msg", "Could not fetch token signing keys")
+		return err
+	}
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *keySet) fetch() (map[string]*rsa.PublicKey, error) {
+	if s.url == "" {
+		url, err := s.discover()
+		if err != nil {
+			return nil, err
+		}
+		s.url = url
+	}
+	r, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return nil, errJWKSStatus
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		key, err := parseRSAKey(k)
+		if err != nil {
+			level.Warn(s.logger).Log("err", err, "msg", "Could not parse token signing key "+k.Kid)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func parseRSAKey(k jwk) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	exponent := new(big.Int).SetBytes(e)
+	if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 || exponent.Int64() < 3 {
+		return nil, errRSAExponent
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+}
+
+// run refreshes the keys every interval until close is called.
+func (s *keySet) run(interval time.Duration) {
+	s.stop = make(chan struct{})
+	s.stopped = make(chan struct{})
+	go func() {
+		defer close(s.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				s.refreshMu.Lock()
+				s.refresh()
+				s.refreshMu.Unlock()
+			}
+		}
+	}()
+}
+
+func (s *keySet) close() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.stopped
+}
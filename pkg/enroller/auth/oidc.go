@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// DiscoveryPath is the path of the OpenID Connect discovery document under
+// the issuer URL.
+const DiscoveryPath = "/.well-known/openid-configuration"
+
+var (
+	errDiscoveryStatus = errors.New("unexpected OpenID Connect discovery response status")
+	errDiscoveryIssuer = errors.New("OpenID Connect discovery document is for another issuer")
+	errNoJWKSURI       = errors.New("OpenID Connect discovery document has no jwks_uri")
+)
+
+// discover returns the JWKS endpoint in the discovery document of the
+// provider at issuerURL, which must be the one issuing the tokens of
+// issuer.
+func discover(client *http.Client, issuerURL string, issuer string) (string, error) {
+	r, err := client.Get(strings.TrimSuffix(issuerURL, "/") + DiscoveryPath)
+	if err != nil {
+		return "", err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return "", errDiscoveryStatus
+	}
+	var doc struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+		return "", err
+	}
+	if doc.Issuer != issuer {
+		return "", errDiscoveryIssuer
+	}
+	if doc.JWKSURI == "" {
+		return "", errNoJWKSURI
+	}
+	return doc.JWKSURI, nil
+}
+
+// ClaimPaths locate the username, roles and groups of the user in the
+// token claims. Each path is a list of claim names separated by dots, as
+// in "realm_access.roles". Empty paths are not read.
+type ClaimPaths struct {
+	Username string
+	Roles    string
+	Groups   string
+	// GroupRoles map the groups read at Groups to the role they grant.
+	// Groups grant no role otherwise.
+	GroupRoles map[string]string
+}
+
+// lookup returns the value at path in claims.
+func lookup(claims map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = claims
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// lookupStrings returns the string or list of strings at path in claims.
+func lookupStrings(claims map[string]interface{}, path string) []string {
+	value, _ := lookup(claims, path)
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var values []string
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
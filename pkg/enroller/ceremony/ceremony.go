@@ -0,0 +1,115 @@
+// Package ceremony creates the keys and certificates of the enroller CAs in
+// a key ceremony, and keeps a transcript of its steps.
+package ceremony
+
+import (
+	stdcrypto "crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/crypto"
+)
+
+// RootTemplate returns the certificate of a self-signed root CA, valid from
+// now for validity, that can be followed by pathLen intermediate CAs, or by
+// any number of them if pathLen is negative.
+func RootTemplate(subject pkix.Name, validity time.Duration, pathLen int) (*x509.Certificate, error) {
+	return caTemplate(subject, time.Now().Add(validity), pathLen)
+}
+
+// IntermediateTemplate returns the certificate of an intermediate CA for
+// csr, issued by issuer. It is valid from now for validity and does not
+// outlive issuer.
+func IntermediateTemplate(csr *x509.CertificateRequest, issuer *x509.Certificate, validity time.Duration, pathLen int) (*x509.Certificate, error) {
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	notAfter := time.Now().Add(validity)
+	if issuer.NotAfter.Before(notAfter) {
+		notAfter = issuer.NotAfter
+	}
+	return caTemplate(csr.Subject, notAfter, pathLen)
+}
+
+func caTemplate(subject pkix.Name, notAfter time.Time, pathLen int) (*x509.Certificate, error) {
+	serial, err := crypto.GenerateSerial()
+	if err != nil {
+		return nil, err
+	}
+	if pathLen < 0 {
+		pathLen = -1
+	}
+	return &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             time.Now().UTC(),
+		NotAfter:              notAfter.UTC(),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            pathLen,
+		MaxPathLenZero:        pathLen == 0,
+	}, nil
+}
+
+// Sign signs template for pub with the key of issuer, returning the DER
+// certificate. The subject key identifier is derived from pub and the
+// signature algorithm from the issuer key.
+func Sign(template *x509.Certificate, pub stdcrypto.PublicKey, issuer *x509.Certificate, key stdcrypto.Signer) ([]byte, error) {
+	alg, err := crypto.SignatureAlgorithm(key.Public(), 0)
+	if err != nil {
+		return nil, err
+	}
+	template.SignatureAlgorithm = alg
+	return x509.CreateCertificate(rand.Reader, template, issuer, pub, key)
+}
+
+// NewCSR returns the DER CSR of subject for key, to be signed by a root
+// CA.
+func NewCSR(subject pkix.Name, key stdcrypto.Signer) ([]byte, error) {
+	alg, err := crypto.SignatureAlgorithm(key.Public(), 0)
+	if err != nil {
+		return nil, err
+	}
+	return x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: subject, SignatureAlgorithm: alg}, key)
+}
+
+// Fingerprint returns the SHA-256 fingerprint of der in the usual colon
+// separated hexadecimal form.
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
+
+// PublicKeyFingerprint returns the fingerprint of the PKIX encoding of pub.
+func PublicKeyFingerprint(pub stdcrypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	return Fingerprint(der), nil
+}
+
+// WriteFile writes data to a new file at path. An existing file is never
+// overwritten, so that a CA key is not lost by running a ceremony twice.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
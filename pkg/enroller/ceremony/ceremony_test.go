@@ -0,0 +1,99 @@
+package ceremony
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/crypto"
+)
+
+func TestRootAndIntermediate(t *testing.T) {
+	rootSpec, _ := crypto.ParseKeySpec("p384")
+	rootKey, err := crypto.GenerateKey(rootSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template, err := RootTemplate(pkix.Name{CommonName: "Root CA"}, 20*365*24*time.Hour, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := Sign(template, rootKey.Public(), template, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crypto.CheckCA(root, rootKey); err != nil {
+		t.Errorf("Got result is %s; want a valid root CA", err)
+	}
+	if root.MaxPathLen != 1 || len(root.SubjectKeyId) == 0 || root.KeyUsage&x509.KeyUsageCRLSign == 0 {
+		t.Errorf("Got path length %d, key ID %x, key usage %d; want CA extensions", root.MaxPathLen, root.SubjectKeyId, root.KeyUsage)
+	}
+
+	intermediateSpec, _ := crypto.ParseKeySpec("rsa2048")
+	intermediateKey, err := crypto.GenerateKey(intermediateSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrDER, err := NewCSR(pkix.Name{CommonName: "Enroller CA"}, intermediateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, _ := x509.ParseCertificateRequest(csrDER)
+	template, err = IntermediateTemplate(csr, root, 30*365*24*time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err = Sign(template, csr.PublicKey, root, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediate, _ := x509.ParseCertificate(der)
+	if err := crypto.CheckCA(intermediate, intermediateKey); err != nil {
+		t.Errorf("Got result is %s; want a valid intermediate CA", err)
+	}
+	if !intermediate.MaxPathLenZero || intermediate.NotAfter.After(root.NotAfter) {
+		t.Errorf("Got path length zero %t until %s; want zero until %s at most", intermediate.MaxPathLenZero, intermediate.NotAfter, root.NotAfter)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	if _, err := intermediate.Verify(x509.VerifyOptions{Roots: roots}); err != nil {
+		t.Errorf("Got result is %s; want intermediate chained to root", err)
+	}
+}
+
+func TestTranscript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enroller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ceremony.txt")
+
+	transcript, err := NewTranscript(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transcript.Record("key generated: %s", "p384")
+	if err := transcript.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if !strings.HasSuffix(string(data), "  key generated: p384\n") {
+		t.Errorf("Got transcript %q; want the recorded step", data)
+	}
+	if _, err := NewTranscript(path); !os.IsExist(err) {
+		t.Errorf("Got result is %v; want existing file error", err)
+	}
+	if err := WriteFile(path, []byte("key"), 0600); !os.IsExist(err) {
+		t.Errorf("Got result is %v; want existing file error", err)
+	}
+}
@@ -0,0 +1,52 @@
+package ceremony
+
+import (
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	errNoCustodian        = errors.New("empty custodian name")
+	errDuplicateCustodian = errors.New("custodian listed twice")
+	errCustodianName      = errors.New("custodian names can not contain path separators")
+)
+
+// ParseCustodians returns the custodians in the comma separated list s,
+// who receive one unseal share each.
+func ParseCustodians(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	custodians := strings.Split(s, ",")
+	seen := make(map[string]bool)
+	for i, custodian := range custodians {
+		custodian = strings.TrimSpace(custodian)
+		switch {
+		case custodian == "":
+			return nil, errNoCustodian
+		case seen[custodian]:
+			return nil, errDuplicateCustodian
+		case strings.ContainsAny(custodian, `/\`) || custodian == "." || custodian == "..":
+			return nil, errCustodianName
+		}
+		seen[custodian] = true
+		custodians[i] = custodian
+	}
+	return custodians, nil
+}
+
+// SharePath returns the file in dir that the unseal share of custodian is
+// written to.
+func SharePath(dir string, custodian string) string {
+	return filepath.Join(dir, custodian+".share")
+}
+
+// WriteShare writes share, base64 encoded as it is submitted to unseal a
+// CA, to a new file only readable by its owner, to be handed to custodian
+// alone.
+func WriteShare(dir string, custodian string, share []byte) (string, error) {
+	path := SharePath(dir, custodian)
+	return path, WriteFile(path, []byte(base64.StdEncoding.EncodeToString(share)+"\n"), 0600)
+}
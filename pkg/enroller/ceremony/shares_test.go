@@ -0,0 +1,65 @@
+package ceremony
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseCustodians(t *testing.T) {
+	testCases := []struct {
+		name       string
+		list       string
+		custodians []string
+		ret        error
+	}{
+		{"No custodians", "", nil, nil},
+		{"Custodians", "alice, bob,carol", []string{"alice", "bob", "carol"}, nil},
+		{"Empty custodian", "alice,,bob", nil, errNoCustodian},
+		{"Duplicate custodian", "alice,bob,alice", nil, errDuplicateCustodian},
+		{"Custodian with path", "alice,../bob", nil, errCustodianName},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			custodians, err := ParseCustodians(tc.list)
+			if err != tc.ret || strings.Join(custodians, ",") != strings.Join(tc.custodians, ",") {
+				t.Errorf("Got result is %v, %v; want %v, %v", custodians, err, tc.custodians, tc.ret)
+			}
+		})
+	}
+}
+
+func TestWriteShare(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enroller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	share := []byte{1, 2, 3, 4}
+	path, err := WriteShare(dir, "alice", share)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(dir, "alice.share") {
+		t.Errorf("Got path %s; want alice.share in %s", path, dir)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Got mode %v; want 0600", info.Mode().Perm())
+	}
+	data, _ := ioutil.ReadFile(path)
+	if string(data) != base64.StdEncoding.EncodeToString(share)+"\n" {
+		t.Errorf("Got share file %q; want the base64 share", data)
+	}
+	if _, err := WriteShare(dir, "alice", []byte{5}); !os.IsExist(err) {
+		t.Errorf("Got result is %v; want existing file error", err)
+	}
+}
@@ -0,0 +1,43 @@
+package ceremony
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Transcript records the steps of a ceremony in a file, one line each
+// starting with the time it was done.
+type Transcript struct {
+	f   *os.File
+	err error
+}
+
+// NewTranscript creates the transcript file at path. An existing file is
+// not overwritten.
+func NewTranscript(path string) (*Transcript, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Transcript{f: f}, nil
+}
+
+// Record adds a step to the transcript. Write errors are returned by
+// Close.
+func (t *Transcript) Record(format string, args ...interface{}) {
+	if t.err != nil {
+		return
+	}
+	_, t.err = fmt.Fprintf(t.f, "%s  %s\n", time.Now().UTC().Format(time.RFC3339), fmt.Sprintf(format, args...))
+}
+
+// Close closes the transcript file, returning the first error found
+// writing it.
+func (t *Transcript) Close() error {
+	err := t.f.Close()
+	if t.err != nil {
+		return t.err
+	}
+	return err
+}
@@ -1,22 +1,57 @@
 package configs
 
-import "github.com/kelseyhightower/envconfig"
+import (
+	"time"
+
+	"github.com/lamassuiot/enroller/pkg/database"
+
+	"github.com/kelseyhightower/envconfig"
+)
 
 type Config struct {
 	Port string
 
+	Driver     string `default:"postgres"`
+	SQLitePath string `default:"enroller.db"`
+
 	PostgresUser     string
 	PostgresDB       string
 	PostgresPassword string
 	PostgresHostname string
 	PostgresPort     string
 
+	PostgresSSLMode         string `default:"disable"`
+	PostgresSSLCert         string
+	PostgresSSLKey          string
+	PostgresSSLRootCert     string
+	PostgresMaxOpenConns    int           `default:"10"`
+	PostgresMaxIdleConns    int           `default:"2"`
+	PostgresConnMaxLifetime time.Duration `default:"30m"`
+	PostgresConnectTimeout  time.Duration `default:"2m"`
+
 	ConsulProtocol string
 	ConsulHost     string
 	ConsulPort     string
 	ConsulCA       string
 
-	HomePath string
+	HomePath  string
+	FileStore string `default:"filesystem"`
+
+	S3Endpoint    string
+	S3Region      string `default:"us-east-1"`
+	S3Bucket      string
+	S3Prefix      string
+	S3AccessKey   string
+	S3SecretKey   string
+	S3SSE         string
+	S3SSEKMSKeyID string
+	S3CA          string
+	S3MaxRetries  int `default:"3"`
+
+	OperationTimeout time.Duration `default:"5m"`
+	// OperationRecoveryInterval is how often the interrupted operations are
+	// looked for after startup, never if zero.
+	OperationRecoveryInterval time.Duration `default:"1m"`
 
 	EnrollerUIHost     string
 	EnrollerUIPort     string
@@ -27,16 +62,128 @@ type Config struct {
 	KeycloakProtocol string
 	KeycloakRealm    string
 	KeycloakCA       string
+	// KeycloakIssuer overrides the iss claim expected in the tokens, by
+	// default the realm URL.
+	KeycloakIssuer            string
+	KeycloakAudience          string
+	KeycloakAuthorizedParties []string
+	KeycloakLeeway            time.Duration `default:"30s"`
+	KeycloakJWKSRefresh       time.Duration `default:"5m"`
+
+	// OIDCIssuer is the issuer URL of an OpenID Connect provider used
+	// instead of Keycloak. The OIDC*Claim paths locate the user in its
+	// tokens.
+	OIDCIssuer        string
+	OIDCCA            string
+	OIDCUsernameClaim string
+	OIDCRolesClaim    string
+	OIDCGroupsClaim   string
+	OIDCGroupRoles    map[string]string
+
+	// IntrospectionURL is the OAuth 2.0 token introspection endpoint that
+	// validates the opaque access tokens that are not JWTs.
+	IntrospectionURL          string
+	IntrospectionClientID     string
+	IntrospectionClientSecret string
+	IntrospectionCA           string
+	IntrospectionCacheTTL     time.Duration `default:"1m"`
+	// IntrospectionRequireIssuer rejects the responses without iss.
+	IntrospectionRequireIssuer bool
 
-	CACertFile string
-	CAKeyFile  string
+	// CAs are the names of the issuing CAs configured, besides the default
+	// one, with their own <prefix>_CA_<NAME>_ variables.
+	CAs []string
+	// DefaultCA is the CA used when a CSR is approved without choosing one.
+	DefaultCA string `default:"default"`
+
+	// CAConfig is the issuing CA named "default".
+	CAConfig
 
 	CertFile string
 	KeyFile  string
+}
+
+// CAConfig configures the secret engine of an issuing CA.
+type CAConfig struct {
+	SecretEngine string `default:"file"`
+
+	CACertFile      string
+	CAKeyFile       string
+	CAKeyPassphrase string
+	CAHash          string
+	// CAReloadInterval is how often the CA files are checked for changes,
+	// zero to reload them only on SIGHUP.
+	CAReloadInterval time.Duration `default:"1m"`
+
+	PKCS11Module     string
+	PKCS11TokenLabel string
+	PKCS11Slot       uint
+	PKCS11PIN        string
+	PKCS11KeyLabel   string
+	PKCS11Sessions   int `default:"4"`
+
+	VaultAddress      string
+	VaultCA           string
+	VaultPKIMount     string `default:"pki"`
+	VaultRoles        map[string]string
+	VaultTTL          string
+	VaultAuthMethod   string `default:"approle"`
+	VaultAuthMount    string
+	VaultRoleID       string
+	VaultSecretID     string
+	VaultSecretIDFile string
+	VaultK8sRole      string
+	VaultK8sTokenFile string `default:"/var/run/secrets/kubernetes.io/serviceaccount/token"`
+
+	// RemoteSignerAddress is the host:port of the signer holding the CA
+	// key. RemoteSignerCA verifies its certificate, and RemoteSignerCert
+	// and RemoteSignerKey authenticate the enroller to it.
+	RemoteSignerAddress string
+	RemoteSignerCA      string
+	RemoteSignerCert    string
+	RemoteSignerKey     string
+
+	// CAChainFile holds the issuers of the CA certificate, up to the root.
+	CAChainFile string
+
+	// CASuccessor is the name of the CA that replaces this one at
+	// CARolloverAt.
+	CASuccessor  string
+	CARolloverAt time.Time
 
 	OCSPServer string
+	CRLServer  string
+}
+
+// Postgres returns the Postgres connection settings.
+func (c Config) Postgres() database.PostgresConfig {
+	return database.PostgresConfig{
+		Host:        c.PostgresHostname,
+		Port:        c.PostgresPort,
+		DB:          c.PostgresDB,
+		User:        c.PostgresUser,
+		Password:    c.PostgresPassword,
+		SSLMode:     c.PostgresSSLMode,
+		SSLCert:     c.PostgresSSLCert,
+		SSLKey:      c.PostgresSSLKey,
+		SSLRootCert: c.PostgresSSLRootCert,
+	}
+}
+
+// DatabaseOptions returns the database connection pool settings.
+func (c Config) DatabaseOptions() database.Options {
+	return database.Options{
+		MaxOpenConns:    c.PostgresMaxOpenConns,
+		MaxIdleConns:    c.PostgresMaxIdleConns,
+		ConnMaxLifetime: c.PostgresConnMaxLifetime,
+		ConnectTimeout:  c.PostgresConnectTimeout,
+	}
 }
 
+// DefaultCAName is the name of the CA configured with the CAConfig of
+// Config.
+const DefaultCAName = "default"
+
 func NewConfig(prefix string) (error, Config) {
 	var cfg Config
 	err := envconfig.Process(prefix, &cfg)
@@ -45,3 +192,14 @@ func NewConfig(prefix string) (error, Config) {
 	}
 	return nil, cfg
 }
+
+// NewCAConfig reads the configuration of the issuing CA named name from the
+// <prefix>_CA_<NAME>_ variables.
+func NewCAConfig(prefix string, name string) (error, CAConfig) {
+	var cfg CAConfig
+	err := envconfig.Process(prefix+"_ca_"+name, &cfg)
+	if err != nil {
+		return err, CAConfig{}
+	}
+	return nil, cfg
+}
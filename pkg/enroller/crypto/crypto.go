@@ -1,11 +1,23 @@
 package crypto
 
 import (
+	"bytes"
+	stdcrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/youmark/pkcs8"
 )
 
 const (
@@ -14,6 +26,25 @@ const (
 	PublicKeyFooter  = "-----END PUBLIC KEY-----"
 	CertPEMBlockType = "CERTIFICATE"
 	KeyPEMBlockType  = "RSA PRIVATE KEY"
+
+	PKCS8PEMBlockType          = "PRIVATE KEY"
+	EncryptedPKCS8PEMBlockType = "ENCRYPTED PRIVATE KEY"
+	ECKeyPEMBlockType          = "EC PRIVATE KEY"
+
+	// SerialBits is the amount of CSPRNG output used for certificate serial
+	// numbers, above the 64 bits required by the CA/Browser Forum.
+	SerialBits = 127
+)
+
+var (
+	ErrUnsupportedKey  = errors.New("unsupported private key type")
+	ErrUnsupportedHash = errors.New("unsupported signature hash")
+	// ErrPassphraseRequired is returned for encrypted keys when no
+	// passphrase is given.
+	ErrPassphraseRequired = errors.New("private key is encrypted and no passphrase was given")
+	ErrKeyMismatch        = errors.New("private key does not match the certificate")
+	ErrNotCA              = errors.New("certificate cannot sign certificates")
+	ErrExpired            = errors.New("certificate is not valid now")
 )
 
 func ParseKeycloakPublicKey(data []byte) (*rsa.PublicKey, error) {
@@ -49,6 +80,235 @@ func CheckPEMBlock(pemBlock *pem.Block, blockType string) error {
 	return nil
 }
 
+// ParsePrivateKey parses a PKCS#1 RSA key, a SEC1 EC key or a PKCS#8 RSA,
+// ECDSA or Ed25519 key.
+func ParsePrivateKey(pemBlock *pem.Block) (stdcrypto.Signer, error) {
+	if pemBlock == nil {
+		return nil, errors.New("cannot find the next PEM formatted block")
+	}
+	if len(pemBlock.Headers) != 0 {
+		return nil, errors.New("unmatched type of headers")
+	}
+	switch pemBlock.Type {
+	case KeyPEMBlockType:
+		return x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
+	case ECKeyPEMBlockType:
+		return x509.ParseECPrivateKey(pemBlock.Bytes)
+	case PKCS8PEMBlockType:
+		key, err := x509.ParsePKCS8PrivateKey(pemBlock.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return signer(key)
+	}
+	return nil, ErrUnsupportedKey
+}
+
+// DecryptPrivateKey parses a PKCS#8 key encrypted with passphrase, using
+// PBES2. Unencrypted keys are parsed as in ParsePrivateKey.
+func DecryptPrivateKey(pemBlock *pem.Block, passphrase []byte) (stdcrypto.Signer, error) {
+	if pemBlock == nil || pemBlock.Type != EncryptedPKCS8PEMBlockType {
+		return ParsePrivateKey(pemBlock)
+	}
+	if len(passphrase) == 0 {
+		return nil, ErrPassphraseRequired
+	}
+	key, _, err := pkcs8.ParsePrivateKey(pemBlock.Bytes, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return signer(key)
+}
+
+func signer(key interface{}) (stdcrypto.Signer, error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, ErrUnsupportedKey
+}
+
+// KeySpec is the type and size of a key to generate.
+type KeySpec struct {
+	// RSABits is the modulus size of RSA keys, zero for ECDSA keys.
+	RSABits int
+	Curve   elliptic.Curve
+}
+
+// ParseKeySpec parses the name of a key type: rsa2048, rsa3072, rsa4096,
+// p256, p384 or p521.
+func ParseKeySpec(name string) (KeySpec, error) {
+	switch strings.ToLower(name) {
+	case "rsa2048":
+		return KeySpec{RSABits: 2048}, nil
+	case "rsa3072":
+		return KeySpec{RSABits: 3072}, nil
+	case "rsa4096":
+		return KeySpec{RSABits: 4096}, nil
+	case "p256":
+		return KeySpec{Curve: elliptic.P256()}, nil
+	case "p384":
+		return KeySpec{Curve: elliptic.P384()}, nil
+	case "p521":
+		return KeySpec{Curve: elliptic.P521()}, nil
+	}
+	return KeySpec{}, ErrUnsupportedKey
+}
+
+// GenerateKey generates a key of the given spec.
+func GenerateKey(spec KeySpec) (stdcrypto.Signer, error) {
+	if spec.RSABits > 0 {
+		return rsa.GenerateKey(rand.Reader, spec.RSABits)
+	}
+	if spec.Curve == nil {
+		return nil, ErrUnsupportedKey
+	}
+	return ecdsa.GenerateKey(spec.Curve, rand.Reader)
+}
+
+// MarshalPrivateKey encodes key as a PKCS#8 PEM block, encrypted with
+// passphrase using PBES2 unless passphrase is empty.
+func MarshalPrivateKey(key stdcrypto.Signer, passphrase []byte) (*pem.Block, error) {
+	if len(passphrase) == 0 {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: PKCS8PEMBlockType, Bytes: der}, nil
+	}
+	der, err := pkcs8.MarshalPrivateKey(key, passphrase, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: EncryptedPKCS8PEMBlockType, Bytes: der}, nil
+}
+
+// ParseHash parses the name of the hash used to sign certificates: sha256,
+// sha384 or sha512. An empty name returns zero, which selects the default
+// hash of the CA key.
+func ParseHash(name string) (stdcrypto.Hash, error) {
+	switch strings.ToLower(name) {
+	case "":
+		return 0, nil
+	case "sha256":
+		return stdcrypto.SHA256, nil
+	case "sha384":
+		return stdcrypto.SHA384, nil
+	case "sha512":
+		return stdcrypto.SHA512, nil
+	}
+	return 0, ErrUnsupportedHash
+}
+
+// SignatureAlgorithm returns the algorithm of the certificates signed by a
+// CA key pub with hash. A zero hash selects SHA-256 for RSA keys and the
+// hash matching the curve size for ECDSA keys. Ed25519 signatures have no
+// separate hash, so hash is ignored for Ed25519 keys.
+func SignatureAlgorithm(pub stdcrypto.PublicKey, hash stdcrypto.Hash) (x509.SignatureAlgorithm, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		switch hash {
+		case 0, stdcrypto.SHA256:
+			return x509.SHA256WithRSA, nil
+		case stdcrypto.SHA384:
+			return x509.SHA384WithRSA, nil
+		case stdcrypto.SHA512:
+			return x509.SHA512WithRSA, nil
+		}
+		return x509.UnknownSignatureAlgorithm, ErrUnsupportedHash
+	case *ecdsa.PublicKey:
+		if hash == 0 {
+			switch pub.Curve {
+			case elliptic.P384():
+				hash = stdcrypto.SHA384
+			case elliptic.P521():
+				hash = stdcrypto.SHA512
+			default:
+				hash = stdcrypto.SHA256
+			}
+		}
+		switch hash {
+		case stdcrypto.SHA256:
+			return x509.ECDSAWithSHA256, nil
+		case stdcrypto.SHA384:
+			return x509.ECDSAWithSHA384, nil
+		case stdcrypto.SHA512:
+			return x509.ECDSAWithSHA512, nil
+		}
+		return x509.UnknownSignatureAlgorithm, ErrUnsupportedHash
+	case ed25519.PublicKey:
+		return x509.PureEd25519, nil
+	}
+	return x509.UnknownSignatureAlgorithm, ErrUnsupportedKey
+}
+
+// LoadCert reads the PEM certificate in the file at path.
+func LoadCert(path string) (*x509.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pemBlock, _ := pem.Decode(certPEM)
+	err = CheckPEMBlock(pemBlock, CertPEMBlockType)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(pemBlock.Bytes)
+}
+
+// LoadCerts reads the PEM certificates in the file at path, such as a CA
+// chain.
+func LoadCerts(path string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var pemBlock *pem.Block
+		pemBlock, data = pem.Decode(data)
+		if pemBlock == nil {
+			break
+		}
+		if err := CheckPEMBlock(pemBlock, CertPEMBlockType); err != nil {
+			return nil, err
+		}
+		cert, err := x509.ParseCertificate(pemBlock.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// CheckCA verifies that key is the key of cert and that cert is a CA
+// certificate, valid now, that can sign certificates.
+func CheckCA(cert *x509.Certificate, key stdcrypto.Signer) error {
+	certPub, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return err
+	}
+	keyPub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(certPub, keyPub) {
+		return ErrKeyMismatch
+	}
+	if !cert.BasicConstraintsValid || !cert.IsCA || (cert.KeyUsage != 0 && cert.KeyUsage&x509.KeyUsageCertSign == 0) {
+		return ErrNotCA
+	}
+	if now := time.Now(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return ErrExpired
+	}
+	return nil
+}
+
 func CreateCAPool(CAPath string) (*x509.CertPool, error) {
 	caCert, err := ioutil.ReadFile(CAPath)
 	if err != nil {
@@ -58,3 +318,57 @@ func CreateCAPool(CAPath string) (*x509.CertPool, error) {
 	caCertPool.AppendCertsFromPEM(caCert)
 	return caCertPool, nil
 }
+
+func GenerateSerial() (*big.Int, error) {
+	max := new(big.Int).Lsh(big.NewInt(1), SerialBits)
+	for {
+		serial, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return nil, err
+		}
+		if serial.Sign() > 0 {
+			return serial, nil
+		}
+	}
+}
+
+// MakeDN formats the certificate subject as an OpenSSL style distinguished
+// name, the format used in the certificates database.
+func MakeDN(cert *x509.Certificate) string {
+	var dn bytes.Buffer
+
+	if len(cert.Subject.Country) > 0 && len(cert.Subject.Country[0]) > 0 {
+		dn.WriteString("/C=" + cert.Subject.Country[0])
+	}
+	if len(cert.Subject.Province) > 0 && len(cert.Subject.Province[0]) > 0 {
+		dn.WriteString("/ST=" + cert.Subject.Province[0])
+	}
+	if len(cert.Subject.Locality) > 0 && len(cert.Subject.Locality[0]) > 0 {
+		dn.WriteString("/L=" + cert.Subject.Locality[0])
+	}
+	if len(cert.Subject.Organization) > 0 && len(cert.Subject.Organization[0]) > 0 {
+		dn.WriteString("/O=" + cert.Subject.Organization[0])
+	}
+	if len(cert.Subject.OrganizationalUnit) > 0 && len(cert.Subject.OrganizationalUnit[0]) > 0 {
+		dn.WriteString("/OU=" + cert.Subject.OrganizationalUnit[0])
+	}
+	if len(cert.Subject.CommonName) > 0 {
+		dn.WriteString("/CN=" + cert.Subject.CommonName)
+	}
+	if len(cert.EmailAddresses) > 0 {
+		dn.WriteString("/emailAddress=" + cert.EmailAddresses[0])
+	}
+	return dn.String()
+}
+
+// ParseOpenSSLTime parses the UTCTime used by the OpenSSL CA database.
+func ParseOpenSSLTime(s string) (time.Time, error) {
+	return time.Parse("060102150405Z", s)
+}
+
+// MakeOpenSSLTime formats t as the UTCTime used by the OpenSSL CA database.
+func MakeOpenSSLTime(t time.Time) string {
+	y := (int(t.Year()) % 100)
+	validDate := fmt.Sprintf("%02d%02d%02d%02d%02d%02dZ", y, t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second())
+	return validDate
+}
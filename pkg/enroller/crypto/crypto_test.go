@@ -1,6 +1,18 @@
 package crypto
 
-import "testing"
+import (
+	stdcrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"reflect"
+	"testing"
+)
 
 const keycloakPublicKey = "MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAyHjb/vc9eAzk7/gzmoP1oqoLRPm9vhWBrfVnoxH4AE4u7g5lkBAg60Pct9MWlT8ag/eoV4TR23Hb6J7FXhuGXRyvmneLdRzI07iUSSrIUuZgB9Mg3mck9cIXoHDILx4MwxnBVRFcU5O5F0ieh8qRWWWbxLkRV8Ts7XjDUi1rfdZ0TLRBAt5XksQl64kK6MhZN7I+lS+CgoAZesLXYe5rv7GJ0Pb1sEnAIFzLFWcNKoCnjbqcpYhM8T92o2tz60MiI7xy1yQYmrz99uMeU0+khkzEIzssNOQy+oCMZ1PMK5MA5aTXbZrtOXoAdwAX5acPmp5bttiIL1eMc2K5ebSruQIDAQAB"
 const csrData = "-----BEGIN CERTIFICATE REQUEST-----\nMIICoDCCAYgCAQAwWzELMAkGA1UEBhMCRVMxETAPBgNVBAgMCEdpcHV6a29hMREw\nDwYDVQQHDAhBcnJhc2F0ZTEQMA4GA1UECgwHRVhBTVBMRTEUMBIGA1UEAwwLRVhB\nTVBMRS5DT00wggEiMA0GCSqGSIb3DQEBAQUAA4IBDwAwggEKAoIBAQCXcJ/Vi2nr\nEKINfjpKWILMl07PuchVSfFsGN497nXTRdfyCfzUUVBgJ0gfYr/RsYzyR/iANOQs\n4gjfvXDESN7m7z3arL5DFA3PlMuGrtJChQbA4JlhcuOR0BaHsleUxkmUx1asrm9c\nM8wS6SQVwGjhFlA1CuWIY+c3WZOw0evQO3VDjGz3/RpFL0mDfpIink0rx4F/A0XI\nVeq2yxcIGRYStST3jEFyLjU375i7hOsbCcXY4sH9crh2XognywYFMkawbvyPHDJD\nYnS4GjSH04ItNz22UFI5E0a3rUNMXIekeyDbU1Qb7jfc2u1lLxhpsJ4rLb42VTop\nNVsI7ti5+Zn7AgMBAAGgADANBgkqhkiG9w0BAQsFAAOCAQEAQVY7FdWQCiZE727B\nbHqFggWzB+OxpwladrYY1kIztDYYZNM84rP77oLg2Mw/IWCTowCNV3uIeyJ/fr4d\nPNYiJE1jnPug1TXn0qWPNxIHXbGhtbmOIcYl189cSbAyfDhWh9AU5lmX3y+O6gFs\nrc+QJeKVAnv+7lvh+LwhAXN2F5tALn++HPP2+YqH+/SnSx0iIA0yJCcUPBLJczgB\n0yk0iJKZDZp7Y3RqkljKEpHdKH0SmLMmIJg+nrm8DNzjlVQ2xpSUaeGMvSg5cEcP\nYGPaj9PQmt5BkXmkWq5PAB+C5j5fsgvljrOIW2Mdip2zDj/tXCYNy0gfcV1SAcMB\n/D4Vvg==\n-----END CERTIFICATE REQUEST-----"
@@ -34,3 +46,145 @@ func TestCreateCAPool(t *testing.T) {
 		t.Error("Crypto does not return a CA pool")
 	}
 }
+
+func TestGenerateSerial(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		serial, err := GenerateSerial()
+		if err != nil {
+			t.Fatalf("Crypto returned an error: %s", err)
+		}
+		if serial.Sign() <= 0 {
+			t.Errorf("Got serial %s; want a positive serial", serial)
+		}
+		if len(serial.Bytes()) > 16 {
+			t.Errorf("Got serial of %d bytes; want at most 16", len(serial.Bytes()))
+		}
+		if seen[serial.String()] {
+			t.Errorf("Got repeated serial %s", serial)
+		}
+		seen[serial.String()] = true
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	pkcs8 := func(key interface{}) []byte {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der
+	}
+	sec1, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name  string
+		block *pem.Block
+		key   stdcrypto.Signer
+		ret   error
+	}{
+		{"PKCS#1 RSA", &pem.Block{Type: KeyPEMBlockType, Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}, rsaKey, nil},
+		{"PKCS#8 RSA", &pem.Block{Type: PKCS8PEMBlockType, Bytes: pkcs8(rsaKey)}, rsaKey, nil},
+		{"SEC1 ECDSA", &pem.Block{Type: ECKeyPEMBlockType, Bytes: sec1}, ecKey, nil},
+		{"PKCS#8 ECDSA", &pem.Block{Type: PKCS8PEMBlockType, Bytes: pkcs8(ecKey)}, ecKey, nil},
+		{"PKCS#8 Ed25519", &pem.Block{Type: PKCS8PEMBlockType, Bytes: pkcs8(edKey)}, edKey, nil},
+		{"Unknown block type", &pem.Block{Type: "DSA PRIVATE KEY", Bytes: sec1}, nil, ErrUnsupportedKey},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			key, err := ParsePrivateKey(tc.block)
+			if tc.ret != err {
+				t.Errorf("Got result is %s; want %s", err, tc.ret)
+			}
+			if tc.key != nil && (key == nil || !reflect.DeepEqual(key.Public(), tc.key.Public())) {
+				t.Error("Crypto does not return the encoded key")
+			}
+		})
+	}
+	if _, err := ParsePrivateKey(nil); err == nil {
+		t.Error("Crypto parsed a missing PEM block")
+	}
+}
+
+func TestSignatureAlgorithm(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p256Key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	edKey, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	testCases := []struct {
+		name string
+		pub  stdcrypto.PublicKey
+		hash string
+		alg  x509.SignatureAlgorithm
+		ret  error
+	}{
+		{"RSA default", &rsaKey.PublicKey, "", x509.SHA256WithRSA, nil},
+		{"RSA SHA-512", &rsaKey.PublicKey, "sha512", x509.SHA512WithRSA, nil},
+		{"P-256 default", &p256Key.PublicKey, "", x509.ECDSAWithSHA256, nil},
+		{"P-384 default", &p384Key.PublicKey, "", x509.ECDSAWithSHA384, nil},
+		{"P-256 SHA-384", &p256Key.PublicKey, "SHA384", x509.ECDSAWithSHA384, nil},
+		{"Ed25519 ignores hash", edKey, "sha512", x509.PureEd25519, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			hash, err := ParseHash(tc.hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			alg, err := SignatureAlgorithm(tc.pub, hash)
+			if tc.ret != err {
+				t.Errorf("Got result is %s; want %s", err, tc.ret)
+			}
+			if alg != tc.alg {
+				t.Errorf("Got algorithm %s; want %s", alg, tc.alg)
+			}
+		})
+	}
+	if _, err := ParseHash("md5"); err != ErrUnsupportedHash {
+		t.Errorf("Got result is %v; want %s", err, ErrUnsupportedHash)
+	}
+}
+
+func TestGenerateKey(t *testing.T) {
+	testCases := []struct {
+		name string
+		spec string
+		ret  error
+	}{
+		{"RSA", "rsa2048", nil},
+		{"P-384", "P384", nil},
+		{"Unknown key type", "dsa1024", ErrUnsupportedKey},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			spec, err := ParseKeySpec(tc.spec)
+			if tc.ret != err {
+				t.Errorf("Got result is %v; want %v", err, tc.ret)
+			}
+			if err != nil {
+				return
+			}
+			key, err := GenerateKey(spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, passphrase := range [][]byte{nil, []byte("secret")} {
+				block, err := MarshalPrivateKey(key, passphrase)
+				if err != nil {
+					t.Fatal(err)
+				}
+				parsed, err := DecryptPrivateKey(block, passphrase)
+				if err != nil || !reflect.DeepEqual(parsed.Public(), key.Public()) {
+					t.Errorf("Got key %v, %v; want the marshaled key", parsed, err)
+				}
+			}
+		})
+	}
+}
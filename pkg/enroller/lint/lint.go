@@ -0,0 +1,239 @@
+package lint
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"strings"
+)
+
+type Severity int
+
+const (
+	Warning Severity = iota
+	Error
+)
+
+func (s Severity) String() string {
+	if s == Error {
+		return "error"
+	}
+	return "warning"
+}
+
+type Finding struct {
+	Rule     string
+	Severity Severity
+	Message  string
+}
+
+func (f Finding) String() string {
+	return f.Severity.String() + " " + f.Rule + ": " + f.Message
+}
+
+type Findings []Finding
+
+func (fs Findings) Errors() Findings {
+	var errs Findings
+	for _, f := range fs {
+		if f.Severity == Error {
+			errs = append(errs, f)
+		}
+	}
+	return errs
+}
+
+func (fs Findings) HasErrors() bool {
+	return len(fs.Errors()) > 0
+}
+
+func (fs Findings) String() string {
+	s := make([]string, len(fs))
+	for i, f := range fs {
+		s[i] = f.String()
+	}
+	return strings.Join(s, "; ")
+}
+
+const maxSerialOctets = 20
+
+var (
+	oidExtSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+	emptyRDNSequence     = []byte{0x30, 0x00}
+)
+
+// Certificate checks the TBSCertificate of crt, issued by issuer, against
+// the RFC 5280 structural rules enforced before a certificate is persisted,
+// and that its signature verifies with the issuer key.
+func Certificate(crt *x509.Certificate, issuer *x509.Certificate) Findings {
+	fs := TBSCertificate(crt, issuer)
+	if issuer != nil && signatureMatchesKey(crt.SignatureAlgorithm, issuer.PublicKey) {
+		if err := crt.CheckSignatureFrom(issuer); err != nil {
+			fs = append(fs, Finding{Rule: "e_signature", Severity: Error, Message: fmt.Sprintf("signature does not verify with the CA key: %s", err)})
+		}
+	}
+	return fs
+}
+
+// TBSCertificate checks the TBSCertificate of crt, to be issued by issuer,
+// as Certificate does but without verifying its signature, so that a draft
+// of the certificate signed with another key can be checked before the CA
+// key signs it.
+func TBSCertificate(crt *x509.Certificate, issuer *x509.Certificate) Findings {
+	var fs Findings
+	add := func(rule string, severity Severity, format string, a ...interface{}) {
+		fs = append(fs, Finding{Rule: rule, Severity: severity, Message: fmt.Sprintf(format, a...)})
+	}
+
+	if crt.Version != 3 {
+		add("e_version", Error, "certificate version is %d, want 3", crt.Version)
+	}
+
+	if crt.SerialNumber == nil || crt.SerialNumber.Sign() <= 0 {
+		add("e_serial_positive", Error, "serial number must be a positive non-zero integer")
+	} else if serialOctets(crt) > maxSerialOctets {
+		add("e_serial_length", Error, "serial number is encoded in %d octets, maximum is %d", serialOctets(crt), maxSerialOctets)
+	}
+
+	if !crt.NotBefore.Before(crt.NotAfter) {
+		add("e_validity_order", Error, "notBefore %s is not before notAfter %s", crt.NotBefore, crt.NotAfter)
+	}
+
+	if issuer != nil {
+		if !bytes.Equal(crt.RawIssuer, issuer.RawSubject) {
+			add("e_issuer_dn", Error, "issuer name does not match the CA subject")
+		}
+		if crt.NotBefore.Before(issuer.NotBefore) || crt.NotAfter.After(issuer.NotAfter) {
+			add("w_validity_issuer", Warning, "validity period exceeds the CA validity period")
+		}
+		if !signatureMatchesKey(crt.SignatureAlgorithm, issuer.PublicKey) {
+			add("e_signature_algorithm", Error, "signature algorithm %s cannot be produced by a %s CA key", crt.SignatureAlgorithm, keyType(issuer.PublicKey))
+		}
+	}
+
+	lintSubjectAndSAN(crt, add)
+	lintKeyUsage(crt, add)
+
+	return fs
+}
+
+func serialOctets(crt *x509.Certificate) int {
+	b := crt.SerialNumber.Bytes()
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		return len(b) + 1
+	}
+	return len(b)
+}
+
+func lintSubjectAndSAN(crt *x509.Certificate, add func(string, Severity, string, ...interface{})) {
+	var hasSAN, sanCritical bool
+	for _, ext := range crt.Extensions {
+		if ext.Id.Equal(oidExtSubjectAltName) {
+			hasSAN, sanCritical = true, ext.Critical
+		}
+	}
+	sanEmpty := len(crt.DNSNames)+len(crt.EmailAddresses)+len(crt.IPAddresses)+len(crt.URIs) == 0
+	emptySubject := len(crt.RawSubject) == 0 || bytes.Equal(crt.RawSubject, emptyRDNSequence)
+
+	switch {
+	case emptySubject && !hasSAN:
+		add("e_subject_or_san", Error, "subject is empty and there is no subjectAltName extension")
+	case emptySubject && !sanCritical:
+		add("e_san_critical", Error, "subjectAltName must be critical when the subject is empty")
+	case hasSAN && sanEmpty:
+		add("e_san_empty", Error, "subjectAltName extension does not contain any name")
+	}
+}
+
+func lintKeyUsage(crt *x509.Certificate, add func(string, Severity, string, ...interface{})) {
+	ku := crt.KeyUsage
+	if ku == 0 {
+		add("w_key_usage_missing", Warning, "keyUsage extension is missing")
+	}
+
+	if crt.BasicConstraintsValid && crt.IsCA {
+		if ku != 0 && ku&x509.KeyUsageCertSign == 0 {
+			add("e_ca_key_usage", Error, "CA certificate does not assert keyCertSign")
+		}
+	} else if ku&x509.KeyUsageCertSign != 0 {
+		add("e_ca_key_usage", Error, "keyCertSign asserted in a non CA certificate")
+	}
+
+	switch pub := crt.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if ku&(x509.KeyUsageKeyAgreement|x509.KeyUsageEncipherOnly|x509.KeyUsageDecipherOnly) != 0 {
+			add("e_key_usage_key_type", Error, "keyAgreement asserted for an RSA key")
+		}
+		if pub.N.BitLen() < 2048 {
+			add("w_rsa_key_size", Warning, "RSA key size is %d bits, at least 2048 recommended", pub.N.BitLen())
+		}
+	case *ecdsa.PublicKey:
+		if ku&(x509.KeyUsageKeyEncipherment|x509.KeyUsageDataEncipherment) != 0 {
+			add("e_key_usage_key_type", Error, "key or data encipherment asserted for an ECDSA key")
+		}
+	case ed25519.PublicKey:
+		allowed := x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment | x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		if ku&^allowed != 0 {
+			add("e_key_usage_key_type", Error, "only signature key usages can be asserted for an Ed25519 key")
+		}
+	default:
+		add("e_key_type", Error, "unsupported subject public key type %T", crt.PublicKey)
+	}
+
+	if ku == 0 {
+		return
+	}
+	for _, eku := range crt.ExtKeyUsage {
+		var want x509.KeyUsage
+		switch eku {
+		case x509.ExtKeyUsageServerAuth:
+			want = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageKeyAgreement
+		case x509.ExtKeyUsageClientAuth:
+			want = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement
+		case x509.ExtKeyUsageCodeSigning, x509.ExtKeyUsageTimeStamping, x509.ExtKeyUsageOCSPSigning:
+			want = x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment
+		case x509.ExtKeyUsageEmailProtection:
+			want = x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment | x509.KeyUsageKeyEncipherment | x509.KeyUsageKeyAgreement
+		default:
+			continue
+		}
+		if ku&want == 0 {
+			add("e_ext_key_usage_consistency", Error, "extended key usage %d is not consistent with the asserted key usages", eku)
+		}
+	}
+}
+
+func signatureMatchesKey(alg x509.SignatureAlgorithm, pub interface{}) bool {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		switch alg {
+		case x509.SHA256WithRSA, x509.SHA384WithRSA, x509.SHA512WithRSA,
+			x509.SHA256WithRSAPSS, x509.SHA384WithRSAPSS, x509.SHA512WithRSAPSS:
+			return true
+		}
+	case *ecdsa.PublicKey:
+		switch alg {
+		case x509.ECDSAWithSHA256, x509.ECDSAWithSHA384, x509.ECDSAWithSHA512:
+			return true
+		}
+	case ed25519.PublicKey:
+		return alg == x509.PureEd25519
+	}
+	return false
+}
+
+func keyType(pub interface{}) string {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return "RSA"
+	case *ecdsa.PublicKey:
+		return "ECDSA"
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return fmt.Sprintf("%T", pub)
+}
@@ -0,0 +1,160 @@
+package lint
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestCertificate(t *testing.T) {
+	caCert, caKey := testCA(t)
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Could not generate leaf key")
+	}
+
+	testCases := []struct {
+		name   string
+		modify func(tmpl *x509.Certificate)
+		rule   string
+	}{
+		{"Valid certificate", func(tmpl *x509.Certificate) {}, ""},
+		{"Zero serial", func(tmpl *x509.Certificate) { tmpl.SerialNumber = big.NewInt(0) }, "e_serial_positive"},
+		{"Serial longer than 20 octets", func(tmpl *x509.Certificate) {
+			tmpl.SerialNumber = new(big.Int).Lsh(big.NewInt(1), 159)
+		}, "e_serial_length"},
+		{"NotAfter before NotBefore", func(tmpl *x509.Certificate) {
+			tmpl.NotAfter = tmpl.NotBefore.Add(-time.Hour)
+		}, "e_validity_order"},
+		{"Empty subject without SAN", func(tmpl *x509.Certificate) { tmpl.Subject = pkix.Name{} }, "e_subject_or_san"},
+		{"Key encipherment for ECDSA key", func(tmpl *x509.Certificate) {
+			tmpl.KeyUsage |= x509.KeyUsageKeyEncipherment
+		}, "e_key_usage_key_type"},
+		{"Client auth without signature key usage", func(tmpl *x509.Certificate) {
+			tmpl.KeyUsage = x509.KeyUsageCRLSign
+		}, "e_ext_key_usage_consistency"},
+		{"Cert sign in end entity certificate", func(tmpl *x509.Certificate) {
+			tmpl.KeyUsage |= x509.KeyUsageCertSign
+		}, "e_ca_key_usage"},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			tmpl := &x509.Certificate{
+				SerialNumber: big.NewInt(10),
+				Subject:      pkix.Name{CommonName: "test.com"},
+				NotBefore:    time.Now().Add(-time.Minute),
+				NotAfter:     time.Now().Add(time.Hour),
+				KeyUsage:     x509.KeyUsageDigitalSignature,
+				ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			}
+			tc.modify(tmpl)
+			crt := createCert(t, tmpl, caCert, leafKey.Public(), caKey)
+
+			findings := Certificate(crt, caCert)
+			if tc.rule == "" {
+				if findings.HasErrors() {
+					t.Errorf("Got errors %s; want none", findings.Errors())
+				}
+				return
+			}
+			if !containsRule(findings.Errors(), tc.rule) {
+				t.Errorf("Got errors %s; want %s", findings.Errors(), tc.rule)
+			}
+		})
+	}
+}
+
+func TestCertificateWrongIssuer(t *testing.T) {
+	caCert, caKey := testCA(t)
+	otherCA, _ := testCA(t)
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Could not generate leaf key")
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(10),
+		Subject:      pkix.Name{CommonName: "test.com"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	crt := createCert(t, tmpl, caCert, leafKey.Public(), caKey)
+
+	findings := Certificate(crt, otherCA)
+	if !containsRule(findings.Errors(), "e_signature") {
+		t.Errorf("Got errors %s; want e_signature", findings.Errors())
+	}
+}
+
+func TestTBSCertificate(t *testing.T) {
+	caCert, _ := testCA(t)
+	draftKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Could not generate draft key")
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(10),
+		Subject:      pkix.Name{CommonName: "test.com"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	// The draft is issued by the CA but signed with another key.
+	issuer := *caCert
+	issuer.PublicKey = nil
+	draft := createCert(t, tmpl, &issuer, draftKey.Public(), draftKey)
+
+	if findings := TBSCertificate(draft, caCert); findings.HasErrors() {
+		t.Errorf("Got errors %s; want none", findings.Errors())
+	}
+	if findings := Certificate(draft, caCert); !containsRule(findings.Errors(), "e_signature") {
+		t.Errorf("Got errors %s; want e_signature", findings.Errors())
+	}
+}
+
+func testCA(t *testing.T) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Could not generate CA key")
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	return createCert(t, tmpl, tmpl, key.Public(), key), key
+}
+
+func createCert(t *testing.T, tmpl *x509.Certificate, parent *x509.Certificate, pub crypto.PublicKey, key crypto.Signer) *x509.Certificate {
+	t.Helper()
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, key)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %s", err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Could not parse certificate: %s", err)
+	}
+	return crt
+}
+
+func containsRule(findings Findings, rule string) bool {
+	for _, f := range findings {
+		if f.Rule == rule {
+			return true
+		}
+	}
+	return false
+}
@@ -1,11 +1,18 @@
 package certs
 
-import "math/big"
+import (
+	"math/big"
+	"strconv"
+)
 
 type CRT struct {
-	ID             int
-	Status         string
-	Serial         *big.Int
+	ID     int
+	Status string
+	Serial *big.Int
+	Issuer string
+	// CA is the name of the issuing CA, empty for certificates issued
+	// before several CAs could be configured.
+	CA             string
 	ExpirationDate string
 	RevocationDate string
 	CertPath       string
@@ -15,3 +22,9 @@ type CRT struct {
 type CRTs struct {
 	CRTs []CRT `json:"-"`
 }
+
+// FilePath returns the path where the certificate of the CSR with the given
+// ID is stored under homePath.
+func FilePath(homePath string, id int) string {
+	return homePath + "/" + strconv.Itoa(id) + ".crt"
+}
@@ -1,32 +1,35 @@
 package db
 
 import (
+	"context"
 	"database/sql"
-	"errors"
 	"fmt"
 	"strconv"
 
+	"github.com/lamassuiot/enroller/pkg/database"
+	"github.com/lamassuiot/enroller/pkg/enroller/crypto"
 	"github.com/lamassuiot/enroller/pkg/enroller/models/certs"
 	"github.com/lamassuiot/enroller/pkg/enroller/models/certs/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/lib/pq"
 
 	"math/big"
 )
 
-func NewDB(driverName string, dataSourceName string, logger log.Logger) (store.DB, error) {
-	db, err := sql.Open(driverName, dataSourceName)
+const (
+	uniqueViolation = "23505"
+	serialAttempts  = 5
+)
+
+func NewDB(ctx context.Context, driverName string, dataSourceName string, opts database.Options, logger log.Logger) (store.DB, error) {
+	db, err := database.Open(ctx, driverName, dataSourceName, opts, logger)
 	if err != nil {
 		level.Error(logger).Log("err", err, "msg", "Could not open connection with signed certificates database")
-		return nil, err
+		return nil, storeerr.Classify(err)
 	}
-	err = checkDBAlive(db)
-	for err != nil {
-		level.Warn(logger).Log("msg", "Trying to connect to CSRs DB")
-		err = checkDBAlive(db)
-	}
-
 	return &DB{db, logger}, nil
 }
 
@@ -35,99 +38,205 @@ type DB struct {
 	logger log.Logger
 }
 
-func checkDBAlive(db *sql.DB) error {
-	sqlStatement := `
-	SELECT WHERE 1=0`
-	_, err := db.Query(sqlStatement)
-	return err
-}
-
-func (db *DB) Insert(crt certs.CRT) error {
+func (db *DB) Insert(ctx context.Context, crt certs.CRT) error {
 	sqlStatement := `
 
-	INSERT INTO ca_store(id, status, expirationDate, revocationDate, serial, dn, certPath)
-	VALUES($1, $2, $3, $4, $5, $6, $7)
+	INSERT INTO ca_store(id, csrId, status, expirationDate, revocationDate, serial, dn, certPath, issuer, ca)
+	VALUES($1, (SELECT id FROM csr_store WHERE id = $1), $2, $3, $4, $5, $6, $7, $8, $9)
 	RETURNING serial;
 	`
 	serialHex := fmt.Sprintf("%x", crt.Serial)
 	var serial string
 
-	err := db.QueryRow(sqlStatement, crt.ID, crt.Status, crt.ExpirationDate, crt.RevocationDate, serialHex, crt.DN, crt.CertPath).Scan(&serial)
+	err := db.QueryRowContext(ctx, sqlStatement, crt.ID, crt.Status, crt.ExpirationDate, crt.RevocationDate, serialHex, crt.DN, crt.CertPath, crt.Issuer, crt.CA).Scan(&serial)
 	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == uniqueViolation {
+			level.Warn(db.logger).Log("err", err, "msg", "Serial "+serialHex+" already in use for issuer "+crt.Issuer)
+			return storeerr.Conflict(store.ErrDuplicateSerial)
+		}
 		level.Error(db.logger).Log("err", err, "msg", "Could not insert certificate with ID "+strconv.Itoa(crt.ID)+" in database")
-		return err
+		return storeerr.Classify(err)
 	}
 	level.Info(db.logger).Log("msg", "Certificate with ID "+strconv.Itoa(crt.ID)+" inserted in database")
 	return nil
 }
 
-func (db *DB) Serial() (*big.Int, error) {
-	var serial string
+func (db *DB) SelectAll(ctx context.Context) ([]certs.CRT, error) {
+	sqlStatement := `
+	SELECT id, status, expirationDate, revocationDate, serial, dn, certPath, issuer, COALESCE(ca, '')
+	FROM ca_store;
+	`
+	rows, err := db.QueryContext(ctx, sqlStatement)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not obtain certificates from database")
+		return nil, storeerr.Classify(err)
+	}
+	defer rows.Close()
+	crts := make([]certs.CRT, 0)
+
+	for rows.Next() {
+		var crt certs.CRT
+		var serial string
+		err := rows.Scan(&crt.ID, &crt.Status, &crt.ExpirationDate, &crt.RevocationDate, &serial, &crt.DN, &crt.CertPath, &crt.Issuer, &crt.CA)
+		if err != nil {
+			level.Error(db.logger).Log("err", err, "msg", "Unable to read database certificate row")
+			return nil, storeerr.Classify(err)
+		}
+		crt.Serial, _ = new(big.Int).SetString(serial, 16)
+		crts = append(crts, crt)
+	}
+	if err = rows.Err(); err != nil {
+		level.Error(db.logger).Log("err", err)
+		return nil, storeerr.Classify(err)
+	}
+	level.Info(db.logger).Log("msg", strconv.Itoa(len(crts))+" certificates read from database")
+	return crts, nil
+}
 
+func (db *DB) SelectByID(ctx context.Context, id int) (certs.CRT, error) {
 	sqlStatement := `
-	SELECT serial
+	SELECT id, status, expirationDate, revocationDate, serial, dn, certPath, issuer, COALESCE(ca, '')
 	FROM ca_store
-	ORDER BY serial DESC
-	LIMIT 1;
+	WHERE id = $1;
 	`
-	row := db.QueryRow(sqlStatement)
-	err := row.Scan(&serial)
-
+	var crt certs.CRT
+	var serial string
+	err := db.QueryRowContext(ctx, sqlStatement, id).Scan(&crt.ID, &crt.Status, &crt.ExpirationDate, &crt.RevocationDate, &serial, &crt.DN, &crt.CertPath, &crt.Issuer, &crt.CA)
 	if err != nil {
-		return big.NewInt(2), nil
+		level.Error(db.logger).Log("err", err, "msg", "Could not obtain certificate with ID "+strconv.Itoa(id)+" from database")
+		return certs.CRT{}, storeerr.Classify(err)
 	}
+	crt.Serial, _ = new(big.Int).SetString(serial, 16)
+	level.Info(db.logger).Log("msg", "Certificate with ID "+strconv.Itoa(id)+" obtained from database")
+	return crt, nil
+}
 
-	s, _ := new(big.Int).SetString(serial, 16)
-	s = s.Add(s, big.NewInt(1))
-	return s, nil
+func (db *DB) Serial(ctx context.Context, issuer string) (*big.Int, error) {
+	sqlStatement := `
+	SELECT EXISTS(
+		SELECT 1
+		FROM ca_store
+		WHERE issuer = $1 AND serial = $2
+	);
+	`
+	for i := 0; i < serialAttempts; i++ {
+		serial, err := crypto.GenerateSerial()
+		if err != nil {
+			level.Error(db.logger).Log("err", err, "msg", "Could not generate random serial")
+			return nil, storeerr.Classify(err)
+		}
+		var exists bool
+		err = db.QueryRowContext(ctx, sqlStatement, issuer, fmt.Sprintf("%x", serial)).Scan(&exists)
+		if err != nil {
+			level.Error(db.logger).Log("err", err, "msg", "Could not check serial uniqueness in database")
+			return nil, storeerr.Classify(err)
+		}
+		if !exists {
+			return serial, nil
+		}
+		level.Warn(db.logger).Log("msg", "Random serial collision for issuer "+issuer+", retrying")
+	}
+	return nil, storeerr.Conflict(store.ErrDuplicateSerial)
 }
 
-func (db *DB) Revoke(id int, revocationDate string) error {
+func (db *DB) Revoke(ctx context.Context, id int, revocationDate string) error {
 	sqlStatement := `
 	UPDATE ca_store
 	SET status = 'R', revocationDate = $1
 	WHERE id = $2;
 	`
 
-	res, err := db.Exec(sqlStatement, revocationDate, id)
+	res, err := db.ExecContext(ctx, sqlStatement, revocationDate, id)
 	if err != nil {
 		level.Error(db.logger).Log("err", err, "msg", "Could not revoke certificate with ID "+strconv.Itoa(id)+" in database")
-		return err
+		return storeerr.Classify(err)
 	}
 
 	rowsAffected, err := res.RowsAffected()
 	if err != nil {
 		level.Error(db.logger).Log("err", err, "msg", "Could not revoke certificate with ID "+strconv.Itoa(id)+" in database")
-		return err
+		return storeerr.Classify(err)
+	}
+
+	if rowsAffected <= 0 {
+		err = sql.ErrNoRows
+		level.Error(db.logger).Log("err", err)
+		return storeerr.Classify(err)
+	}
+	return nil
+}
+
+func (db *DB) Unrevoke(ctx context.Context, id int) error {
+	sqlStatement := `
+	UPDATE ca_store
+	SET status = 'V', revocationDate = ''
+	WHERE id = $1;
+	`
+
+	res, err := db.ExecContext(ctx, sqlStatement, id)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not unrevoke certificate with ID "+strconv.Itoa(id)+" in database")
+		return storeerr.Classify(err)
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not unrevoke certificate with ID "+strconv.Itoa(id)+" in database")
+		return storeerr.Classify(err)
 	}
 
 	if rowsAffected <= 0 {
-		err = errors.New("No rows have been updated in database")
+		err = sql.ErrNoRows
+		level.Error(db.logger).Log("err", err)
+		return storeerr.Classify(err)
+	}
+	return nil
+}
+
+func (db *DB) UpdateCertPath(ctx context.Context, id int, certPath string) error {
+	sqlStatement := `
+	UPDATE ca_store
+	SET certPath = $1
+	WHERE id = $2;
+	`
+	res, err := db.ExecContext(ctx, sqlStatement, certPath, id)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not update certificate with ID "+strconv.Itoa(id)+" file path to "+certPath)
+		return storeerr.Classify(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not update certificate with ID "+strconv.Itoa(id)+" file path to "+certPath)
+		return storeerr.Classify(err)
+	}
+	if count <= 0 {
+		err = sql.ErrNoRows
 		level.Error(db.logger).Log("err", err)
-		return err
+		return storeerr.Classify(err)
 	}
+	level.Info(db.logger).Log("msg", "Certificate with ID "+strconv.Itoa(id)+" file path updated to "+certPath)
 	return nil
 }
 
-func (db *DB) Delete(id int) error {
+func (db *DB) Delete(ctx context.Context, id int) error {
 	sqlStatement := `
 	DELETE FROM ca_store
 	WHERE id = $1;
 	`
-	res, err := db.Exec(sqlStatement, id)
+	res, err := db.ExecContext(ctx, sqlStatement, id)
 	if err != nil {
 		level.Error(db.logger).Log("err", err, "msg", "Could not delete certificate with ID "+strconv.Itoa(id)+" from database")
-		return err
+		return storeerr.Classify(err)
 	}
 	count, err := res.RowsAffected()
 	if err != nil {
 		level.Error(db.logger).Log("err", err, "msg", "Could not delete certificate with ID "+strconv.Itoa(id)+" from database")
-		return err
+		return storeerr.Classify(err)
 	}
 	if count <= 0 {
-		err = errors.New("No rows have been updated in database")
+		err = sql.ErrNoRows
 		level.Error(db.logger).Log("err", err)
-		return err
+		return storeerr.Classify(err)
 	}
 	return nil
 }
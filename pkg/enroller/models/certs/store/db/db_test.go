@@ -0,0 +1,38 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/configs"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/certs/store/storetest"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/migrations"
+	"github.com/lamassuiot/enroller/pkg/migrate"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestDB(t *testing.T) {
+	err, cfg := configs.NewConfig("enrollertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.PostgresHostname == "" {
+		t.Skip("ENROLLERTEST_POSTGRESHOSTNAME not set")
+	}
+	connStr := cfg.Postgres().DataSourceName()
+	sqlDB, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlDB.Close()
+	if _, err := migrate.NewMigrator(sqlDB, "postgres", migrations.Postgres, log.NewNopLogger()).Up(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDB(context.Background(), "postgres", connStr, cfg.DatabaseOptions(), log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storetest.TestDB(t, db, func(t *testing.T) int { return storetest.RandomID() })
+}
@@ -0,0 +1,133 @@
+package dbfile
+
+import (
+	"context"
+	"database/sql"
+	"encoding/pem"
+	"os"
+	"strconv"
+
+	"github.com/lamassuiot/enroller/pkg/database"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/certs/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	_ "github.com/lib/pq"
+)
+
+// File keeps the DER bytes of each certificate in the certData column of
+// its ca_store row instead of in the file system, so that no shared volume
+// is needed. Certificates are returned PEM encoded and missing data is
+// reported as os.ErrNotExist, like the file system store does.
+type File struct {
+	*sql.DB
+	logger log.Logger
+}
+
+func NewFile(ctx context.Context, driverName string, dataSourceName string, opts database.Options, logger log.Logger) (store.File, error) {
+	db, err := database.Open(ctx, driverName, dataSourceName, opts, logger)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not open connection with certificates data database")
+		return nil, storeerr.Classify(err)
+	}
+	return &File{db, logger}, nil
+}
+
+func (f *File) Insert(ctx context.Context, id int, data []byte) error {
+	sqlStatement := `
+	UPDATE ca_store
+	SET certData = $1
+	WHERE id = $2 AND certData IS NULL;
+	`
+	res, err := f.ExecContext(ctx, sqlStatement, data, id)
+	if err != nil {
+		level.Error(f.logger).Log("err", err, "msg", "Could not insert certificate with ID "+strconv.Itoa(id)+" data in database")
+		return storeerr.Classify(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		level.Error(f.logger).Log("err", err, "msg", "Could not insert certificate with ID "+strconv.Itoa(id)+" data in database")
+		return storeerr.Classify(err)
+	}
+	if count <= 0 {
+		err = &os.PathError{Op: "insert", Path: "ca_store/" + strconv.Itoa(id), Err: os.ErrExist}
+		level.Error(f.logger).Log("err", err, "msg", "Certificate with ID "+strconv.Itoa(id)+" does not exist or already has data")
+		return storeerr.Classify(err)
+	}
+	level.Info(f.logger).Log("msg", "Certificate with ID "+strconv.Itoa(id)+" data inserted in database")
+	return nil
+}
+
+func (f *File) SelectByID(ctx context.Context, id int) ([]byte, error) {
+	sqlStatement := `
+	SELECT certData
+	FROM ca_store
+	WHERE id = $1 AND certData IS NOT NULL;
+	`
+	var der []byte
+	err := f.QueryRowContext(ctx, sqlStatement, id).Scan(&der)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = &os.PathError{Op: "select", Path: "ca_store/" + strconv.Itoa(id), Err: os.ErrNotExist}
+		}
+		level.Error(f.logger).Log("err", err, "msg", "Could not obtain certificate with ID "+strconv.Itoa(id)+" data from database")
+		return nil, storeerr.Classify(err)
+	}
+	level.Info(f.logger).Log("msg", "Certificate with ID "+strconv.Itoa(id)+" data obtained from database")
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+func (f *File) SelectIDs(ctx context.Context) ([]int, error) {
+	sqlStatement := `
+	SELECT id
+	FROM ca_store
+	WHERE certData IS NOT NULL;
+	`
+	rows, err := f.QueryContext(ctx, sqlStatement)
+	if err != nil {
+		level.Error(f.logger).Log("err", err, "msg", "Could not list certificates data in database")
+		return nil, storeerr.Classify(err)
+	}
+	defer rows.Close()
+	ids := make([]int, 0)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			level.Error(f.logger).Log("err", err, "msg", "Unable to read database certificate ID")
+			return nil, storeerr.Classify(err)
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		level.Error(f.logger).Log("err", err)
+		return nil, storeerr.Classify(err)
+	}
+	return ids, nil
+}
+
+func (f *File) Delete(ctx context.Context, id int) error {
+	sqlStatement := `
+	UPDATE ca_store
+	SET certData = NULL
+	WHERE id = $1 AND certData IS NOT NULL;
+	`
+	res, err := f.ExecContext(ctx, sqlStatement, id)
+	if err != nil {
+		level.Error(f.logger).Log("err", err, "msg", "Could not delete certificate with ID "+strconv.Itoa(id)+" data from database")
+		return storeerr.Classify(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		level.Error(f.logger).Log("err", err, "msg", "Could not delete certificate with ID "+strconv.Itoa(id)+" data from database")
+		return storeerr.Classify(err)
+	}
+	if count <= 0 {
+		err = &os.PathError{Op: "delete", Path: "ca_store/" + strconv.Itoa(id), Err: os.ErrNotExist}
+		level.Error(f.logger).Log("err", err, "msg", "Could not delete certificate with ID "+strconv.Itoa(id)+" data from database")
+		return storeerr.Classify(err)
+	}
+	level.Info(f.logger).Log("msg", "Certificate with ID "+strconv.Itoa(id)+" data deleted from database")
+	return nil
+}
@@ -0,0 +1,53 @@
+package dbfile
+
+import (
+	"context"
+	"database/sql"
+	"math/big"
+	"testing"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/configs"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/certs"
+	certsdb "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store/db"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/certs/store/storetest"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/migrations"
+	"github.com/lamassuiot/enroller/pkg/migrate"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestFile(t *testing.T) {
+	err, cfg := configs.NewConfig("enrollertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.PostgresHostname == "" {
+		t.Skip("ENROLLERTEST_POSTGRESHOSTNAME not set")
+	}
+	connStr := cfg.Postgres().DataSourceName()
+	sqlDB, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlDB.Close()
+	if _, err := migrate.NewMigrator(sqlDB, "postgres", migrations.Postgres, log.NewNopLogger()).Up(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	db, err := certsdb.NewDB(ctx, "postgres", connStr, cfg.DatabaseOptions(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFile(ctx, "postgres", connStr, cfg.DatabaseOptions(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := storetest.RandomID()
+	err = db.Insert(ctx, certs.CRT{ID: id, Status: "V", Serial: big.NewInt(int64(id)), Issuer: "CN=storetest", DN: "/CN=storetest.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Delete(ctx, id)
+	storetest.TestFile(t, f, id)
+}
@@ -1,16 +1,19 @@
 package file
 
 import (
+	"context"
 	"encoding/pem"
 	"io/ioutil"
 	"os"
 
 	"github.com/lamassuiot/enroller/pkg/enroller/models/certs/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 
 	"strconv"
+	"strings"
 )
 
 type File struct {
@@ -26,12 +29,12 @@ const (
 	certPerm = 0444
 )
 
-func (f *File) Insert(id int, data []byte) error {
+func (f *File) Insert(ctx context.Context, id int, data []byte) error {
 	name := f.dirPath + "/" + strconv.Itoa(id) + ".crt"
 	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, certPerm)
 	if err != nil {
 		level.Error(f.logger).Log("err", err.Error, "msg", "Could not insert certificate with ID "+strconv.Itoa(id)+" in filesystem")
-		return err
+		return storeerr.Classify(err)
 	}
 	defer file.Close()
 
@@ -44,23 +47,45 @@ func (f *File) Insert(id int, data []byte) error {
 	return nil
 }
 
-func (f *File) SelectByID(id int) ([]byte, error) {
+func (f *File) SelectByID(ctx context.Context, id int) ([]byte, error) {
 	name := f.dirPath + "/" + strconv.Itoa(id) + ".crt"
 	data, err := ioutil.ReadFile(name)
 	if err != nil {
 		level.Error(f.logger).Log("err", err.Error, "msg", "Could not obtain certificate with ID "+strconv.Itoa(id)+" from filesystem")
-		return nil, err
+		return nil, storeerr.Classify(err)
 	}
 	level.Info(f.logger).Log("msg", "Certificate with ID "+strconv.Itoa(id)+" obtained from file system")
 	return data, nil
 }
 
-func (f *File) Delete(id int) error {
+func (f *File) SelectIDs(ctx context.Context) ([]int, error) {
+	entries, err := ioutil.ReadDir(f.dirPath)
+	if err != nil {
+		level.Error(f.logger).Log("err", err, "msg", "Could not list certificate files in filesystem")
+		return nil, storeerr.Classify(err)
+	}
+	ids := make([]int, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".crt") {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(name, ".crt"))
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	level.Info(f.logger).Log("msg", strconv.Itoa(len(ids))+" certificate files found in file system")
+	return ids, nil
+}
+
+func (f *File) Delete(ctx context.Context, id int) error {
 	name := f.dirPath + "/" + strconv.Itoa(id) + ".crt"
 	err := os.Remove(name)
 	if err != nil {
 		level.Error(f.logger).Log("err", err.Error, "msg", "Could not delete certificate with ID "+strconv.Itoa(id)+" from filesystem")
-		return err
+		return storeerr.Classify(err)
 	}
 	level.Info(f.logger).Log("msg", "Certificate with ID "+strconv.Itoa(id)+" deleted from file system")
 	return nil
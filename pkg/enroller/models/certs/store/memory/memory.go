@@ -0,0 +1,202 @@
+// Package memory implements the certificate stores in memory, for tests and
+// for embedding the enroller service without a database or file system.
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/crypto"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/certs"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/certs/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
+)
+
+const serialAttempts = 5
+
+var errDuplicateID = errors.New("certificate ID already in use")
+
+// DB keeps certificates in a map keyed by ID. Missing certificates are
+// reported as sql.ErrNoRows and serials are unique per issuer, like in the
+// database store.
+type DB struct {
+	mu    sync.Mutex
+	certs map[int]certs.CRT
+}
+
+func NewDB() store.DB {
+	return &DB{certs: make(map[int]certs.CRT)}
+}
+
+func (db *DB) Insert(ctx context.Context, crt certs.CRT) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.certs[crt.ID]; ok {
+		return storeerr.Conflict(errDuplicateID)
+	}
+	if db.serialInUse(crt.Issuer, crt.Serial) {
+		return storeerr.Conflict(store.ErrDuplicateSerial)
+	}
+	if crt.Serial != nil {
+		crt.Serial = new(big.Int).Set(crt.Serial)
+	}
+	db.certs[crt.ID] = crt
+	return nil
+}
+
+func (db *DB) SelectAll(ctx context.Context) ([]certs.CRT, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	crts := make([]certs.CRT, 0, len(db.certs))
+	for _, crt := range db.certs {
+		crts = append(crts, copyCRT(crt))
+	}
+	sort.Slice(crts, func(i, j int) bool { return crts[i].ID < crts[j].ID })
+	return crts, nil
+}
+
+func (db *DB) SelectByID(ctx context.Context, id int) (certs.CRT, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	crt, ok := db.certs[id]
+	if !ok {
+		return certs.CRT{}, storeerr.NotFound(sql.ErrNoRows)
+	}
+	return copyCRT(crt), nil
+}
+
+func (db *DB) Serial(ctx context.Context, issuer string) (*big.Int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for i := 0; i < serialAttempts; i++ {
+		serial, err := crypto.GenerateSerial()
+		if err != nil {
+			return nil, err
+		}
+		if !db.serialInUse(issuer, serial) {
+			return serial, nil
+		}
+	}
+	return nil, storeerr.Conflict(store.ErrDuplicateSerial)
+}
+
+func (db *DB) Revoke(ctx context.Context, id int, revocationDate string) error {
+	return db.update(id, func(crt *certs.CRT) {
+		crt.Status = "R"
+		crt.RevocationDate = revocationDate
+	})
+}
+
+func (db *DB) Unrevoke(ctx context.Context, id int) error {
+	return db.update(id, func(crt *certs.CRT) {
+		crt.Status = "V"
+		crt.RevocationDate = ""
+	})
+}
+
+func (db *DB) UpdateCertPath(ctx context.Context, id int, certPath string) error {
+	return db.update(id, func(crt *certs.CRT) {
+		crt.CertPath = certPath
+	})
+}
+
+func (db *DB) Delete(ctx context.Context, id int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.certs[id]; !ok {
+		return storeerr.NotFound(sql.ErrNoRows)
+	}
+	delete(db.certs, id)
+	return nil
+}
+
+func (db *DB) update(id int, fn func(crt *certs.CRT)) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	crt, ok := db.certs[id]
+	if !ok {
+		return storeerr.NotFound(sql.ErrNoRows)
+	}
+	fn(&crt)
+	db.certs[id] = crt
+	return nil
+}
+
+func (db *DB) serialInUse(issuer string, serial *big.Int) bool {
+	if serial == nil {
+		return false
+	}
+	for _, crt := range db.certs {
+		if crt.Issuer == issuer && crt.Serial != nil && crt.Serial.Cmp(serial) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func copyCRT(crt certs.CRT) certs.CRT {
+	if crt.Serial != nil {
+		crt.Serial = new(big.Int).Set(crt.Serial)
+	}
+	return crt
+}
+
+// File keeps the DER bytes of each certificate in a map and returns them
+// PEM encoded. Missing certificates are reported as os.ErrNotExist and
+// already stored ones as os.ErrExist, like the file system store.
+type File struct {
+	mu   sync.Mutex
+	data map[int][]byte
+}
+
+func NewFile() store.File {
+	return &File{data: make(map[int][]byte)}
+}
+
+func (f *File) Insert(ctx context.Context, id int, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.data[id]; ok {
+		return storeerr.Conflict(&os.PathError{Op: "insert", Path: strconv.Itoa(id) + ".crt", Err: os.ErrExist})
+	}
+	f.data[id] = append([]byte(nil), data...)
+	return nil
+}
+
+func (f *File) SelectByID(ctx context.Context, id int) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	der, ok := f.data[id]
+	if !ok {
+		return nil, storeerr.NotFound(&os.PathError{Op: "select", Path: strconv.Itoa(id) + ".crt", Err: os.ErrNotExist})
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+func (f *File) SelectIDs(ctx context.Context) ([]int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := make([]int, 0, len(f.data))
+	for id := range f.data {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func (f *File) Delete(ctx context.Context, id int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.data[id]; !ok {
+		return storeerr.NotFound(&os.PathError{Op: "delete", Path: strconv.Itoa(id) + ".crt", Err: os.ErrNotExist})
+	}
+	delete(f.data, id)
+	return nil
+}
@@ -0,0 +1,15 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/models/certs/store/storetest"
+)
+
+func TestDB(t *testing.T) {
+	storetest.TestDB(t, NewDB(), func(t *testing.T) int { return storetest.RandomID() })
+}
+
+func TestFile(t *testing.T) {
+	storetest.TestFile(t, NewFile(), 1)
+}
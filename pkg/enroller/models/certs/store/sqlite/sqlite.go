@@ -0,0 +1,204 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"strconv"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/crypto"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/certs"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/certs/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+const serialAttempts = 5
+
+// DB stores certificates in a SQLite database, for single node
+// deployments. The table is created by the enroller migrations.
+type DB struct {
+	*sql.DB
+	logger log.Logger
+}
+
+func NewDB(dataSourceName string, logger log.Logger) (store.DB, error) {
+	db, err := sql.Open("sqlite", dataSourceName)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not open signed certificates SQLite database")
+		return nil, storeerr.Classify(err)
+	}
+	return &DB{db, logger}, nil
+}
+
+func (db *DB) Insert(ctx context.Context, crt certs.CRT) error {
+	sqlStatement := `
+	INSERT INTO ca_store(id, csrId, status, expirationDate, revocationDate, serial, dn, certPath, issuer, ca)
+	VALUES($1, (SELECT id FROM csr_store WHERE id = $1), $2, $3, $4, $5, $6, $7, $8, $9);
+	`
+	serialHex := fmt.Sprintf("%x", crt.Serial)
+	_, err := db.ExecContext(ctx, sqlStatement, crt.ID, crt.Status, crt.ExpirationDate, crt.RevocationDate, serialHex, crt.DN, crt.CertPath, crt.Issuer, crt.CA)
+	if err != nil {
+		if sqliteErr, ok := err.(*sqlite.Error); ok && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE {
+			level.Warn(db.logger).Log("err", err, "msg", "Serial "+serialHex+" already in use for issuer "+crt.Issuer)
+			return storeerr.Conflict(store.ErrDuplicateSerial)
+		}
+		level.Error(db.logger).Log("err", err, "msg", "Could not insert certificate with ID "+strconv.Itoa(crt.ID)+" in database")
+		return storeerr.Classify(err)
+	}
+	level.Info(db.logger).Log("msg", "Certificate with ID "+strconv.Itoa(crt.ID)+" inserted in database")
+	return nil
+}
+
+func (db *DB) SelectAll(ctx context.Context) ([]certs.CRT, error) {
+	sqlStatement := `
+	SELECT id, status, expirationDate, revocationDate, serial, dn, certPath, issuer, COALESCE(ca, '')
+	FROM ca_store
+	ORDER BY id;
+	`
+	rows, err := db.QueryContext(ctx, sqlStatement)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not obtain certificates from database")
+		return nil, storeerr.Classify(err)
+	}
+	defer rows.Close()
+	crts := make([]certs.CRT, 0)
+
+	for rows.Next() {
+		var crt certs.CRT
+		var serial string
+		err := rows.Scan(&crt.ID, &crt.Status, &crt.ExpirationDate, &crt.RevocationDate, &serial, &crt.DN, &crt.CertPath, &crt.Issuer, &crt.CA)
+		if err != nil {
+			level.Error(db.logger).Log("err", err, "msg", "Unable to read database certificate row")
+			return nil, storeerr.Classify(err)
+		}
+		crt.Serial, _ = new(big.Int).SetString(serial, 16)
+		crts = append(crts, crt)
+	}
+	if err = rows.Err(); err != nil {
+		level.Error(db.logger).Log("err", err)
+		return nil, storeerr.Classify(err)
+	}
+	level.Info(db.logger).Log("msg", strconv.Itoa(len(crts))+" certificates read from database")
+	return crts, nil
+}
+
+func (db *DB) SelectByID(ctx context.Context, id int) (certs.CRT, error) {
+	sqlStatement := `
+	SELECT id, status, expirationDate, revocationDate, serial, dn, certPath, issuer, COALESCE(ca, '')
+	FROM ca_store
+	WHERE id = $1;
+	`
+	var crt certs.CRT
+	var serial string
+	err := db.QueryRowContext(ctx, sqlStatement, id).Scan(&crt.ID, &crt.Status, &crt.ExpirationDate, &crt.RevocationDate, &serial, &crt.DN, &crt.CertPath, &crt.Issuer, &crt.CA)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not obtain certificate with ID "+strconv.Itoa(id)+" from database")
+		return certs.CRT{}, storeerr.Classify(err)
+	}
+	crt.Serial, _ = new(big.Int).SetString(serial, 16)
+	level.Info(db.logger).Log("msg", "Certificate with ID "+strconv.Itoa(id)+" obtained from database")
+	return crt, nil
+}
+
+func (db *DB) Serial(ctx context.Context, issuer string) (*big.Int, error) {
+	sqlStatement := `
+	SELECT EXISTS(
+		SELECT 1
+		FROM ca_store
+		WHERE issuer = $1 AND serial = $2
+	);
+	`
+	for i := 0; i < serialAttempts; i++ {
+		serial, err := crypto.GenerateSerial()
+		if err != nil {
+			level.Error(db.logger).Log("err", err, "msg", "Could not generate random serial")
+			return nil, storeerr.Classify(err)
+		}
+		var exists bool
+		err = db.QueryRowContext(ctx, sqlStatement, issuer, fmt.Sprintf("%x", serial)).Scan(&exists)
+		if err != nil {
+			level.Error(db.logger).Log("err", err, "msg", "Could not check serial uniqueness in database")
+			return nil, storeerr.Classify(err)
+		}
+		if !exists {
+			return serial, nil
+		}
+		level.Warn(db.logger).Log("msg", "Random serial collision for issuer "+issuer+", retrying")
+	}
+	return nil, storeerr.Conflict(store.ErrDuplicateSerial)
+}
+
+func (db *DB) Revoke(ctx context.Context, id int, revocationDate string) error {
+	err := db.exec(ctx, `
+	UPDATE ca_store
+	SET status = 'R', revocationDate = $1
+	WHERE id = $2;
+	`, revocationDate, id)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not revoke certificate with ID "+strconv.Itoa(id)+" in database")
+		return storeerr.Classify(err)
+	}
+	return nil
+}
+
+func (db *DB) Unrevoke(ctx context.Context, id int) error {
+	err := db.exec(ctx, `
+	UPDATE ca_store
+	SET status = 'V', revocationDate = ''
+	WHERE id = $1;
+	`, id)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not unrevoke certificate with ID "+strconv.Itoa(id)+" in database")
+		return storeerr.Classify(err)
+	}
+	return nil
+}
+
+func (db *DB) UpdateCertPath(ctx context.Context, id int, certPath string) error {
+	err := db.exec(ctx, `
+	UPDATE ca_store
+	SET certPath = $1
+	WHERE id = $2;
+	`, certPath, id)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not update certificate with ID "+strconv.Itoa(id)+" file path to "+certPath)
+		return storeerr.Classify(err)
+	}
+	level.Info(db.logger).Log("msg", "Certificate with ID "+strconv.Itoa(id)+" file path updated to "+certPath)
+	return nil
+}
+
+func (db *DB) Delete(ctx context.Context, id int) error {
+	err := db.exec(ctx, `
+	DELETE FROM ca_store
+	WHERE id = $1;
+	`, id)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not delete certificate with ID "+strconv.Itoa(id)+" from database")
+		return storeerr.Classify(err)
+	}
+	return nil
+}
+
+// exec runs sqlStatement and returns sql.ErrNoRows if no row was affected.
+func (db *DB) exec(ctx context.Context, sqlStatement string, args ...interface{}) error {
+	res, err := db.ExecContext(ctx, sqlStatement, args...)
+	if err != nil {
+		return storeerr.Classify(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return storeerr.Classify(err)
+	}
+	if count <= 0 {
+		return storeerr.NotFound(sql.ErrNoRows)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package sqlite
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/models/certs/store/storetest"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/migrations"
+	"github.com/lamassuiot/enroller/pkg/migrate"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enroller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := NewDB("file:"+dir+"/enroller.db?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)", log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrate.NewMigrator(db.(*DB).DB, "sqlite", migrations.SQLite, log.NewNopLogger()).Up(); err != nil {
+		t.Fatal(err)
+	}
+	storetest.TestDB(t, db, func(t *testing.T) int { return storetest.RandomID() })
+}
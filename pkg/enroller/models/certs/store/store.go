@@ -1,20 +1,38 @@
 package store
 
 import (
+	"context"
+	"errors"
 	"math/big"
 
 	"github.com/lamassuiot/enroller/pkg/enroller/models/certs"
 )
 
+// ErrDuplicateSerial is returned by Insert, as a storeerr conflict, when
+// the issuer already has a certificate with the same serial number.
+var ErrDuplicateSerial = errors.New("serial number already in use for the issuer")
+
+// DB stores the issued certificate records. Errors are classified with the
+// storeerr package.
 type DB interface {
-	Insert(crt certs.CRT) error
-	Serial() (*big.Int, error)
-	Revoke(id int, revocationDate string) error
-	Delete(id int) error
+	Insert(ctx context.Context, crt certs.CRT) error
+	SelectAll(ctx context.Context) ([]certs.CRT, error)
+	SelectByID(ctx context.Context, id int) (certs.CRT, error)
+	Serial(ctx context.Context, issuer string) (*big.Int, error)
+	Revoke(ctx context.Context, id int, revocationDate string) error
+	// Unrevoke makes a revoked certificate valid again, undoing a
+	// revocation that was not committed.
+	Unrevoke(ctx context.Context, id int) error
+	UpdateCertPath(ctx context.Context, id int, certPath string) error
+	Delete(ctx context.Context, id int) error
 }
 
+// File stores the issued certificates. Insert takes DER and SelectByID
+// returns PEM. Missing certificates are not found and inserting an
+// existing one is a conflict.
 type File interface {
-	Insert(id int, data []byte) error
-	SelectByID(id int) ([]byte, error)
-	Delete(id int) error
+	Insert(ctx context.Context, id int, data []byte) error
+	SelectByID(ctx context.Context, id int) ([]byte, error)
+	SelectIDs(ctx context.Context) ([]int, error)
+	Delete(ctx context.Context, id int) error
 }
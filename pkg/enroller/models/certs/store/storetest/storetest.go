@@ -0,0 +1,233 @@
+// Package storetest contains the conformance tests that every certificate
+// store implementation must pass. The tests only rely on the certificates
+// they create, so they can be run against shared databases and directories.
+package storetest
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/models/certs"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/certs/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
+)
+
+// missingID is an ID no store is expected to have.
+const missingID = 2147483000
+
+var ctx = context.Background()
+
+var random = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// RandomID returns an ID, below missingID, that is unlikely to be in use.
+func RandomID() int {
+	return missingID - 1 - random.Intn(1000000)
+}
+
+func testCRT(id int, issuer string) certs.CRT {
+	return certs.CRT{
+		ID:             id,
+		Status:         "V",
+		Serial:         new(big.Int).SetInt64(random.Int63()),
+		Issuer:         issuer,
+		CA:             "default",
+		ExpirationDate: "301231235959Z",
+		CertPath:       "/tmp/certs/" + strconv.Itoa(id) + ".crt",
+		DN:             "/C=ES/O=Test/CN=test.com",
+	}
+}
+
+func uniqueIssuer() string {
+	return "CN=storetest-" + strconv.FormatInt(random.Int63(), 36)
+}
+
+func isDuplicateSerial(err error) bool {
+	return storeerr.IsConflict(err) && errors.Is(err, store.ErrDuplicateSerial)
+}
+
+func equal(a certs.CRT, b certs.CRT) bool {
+	if (a.Serial == nil) != (b.Serial == nil) || (a.Serial != nil && a.Serial.Cmp(b.Serial) != 0) {
+		return false
+	}
+	a.Serial, b.Serial = nil, nil
+	return a == b
+}
+
+// TestDB checks that db behaves as the certificate database store: missing
+// certificates are reported as not found errors and serials are unique per
+// issuer. newID returns the ID of each certificate to insert, so stores
+// that reference CSRs can create them first.
+func TestDB(t *testing.T, db store.DB, newID func(t *testing.T) int) {
+	t.Run("Insert and select", func(t *testing.T) {
+		crt := testCRT(newID(t), uniqueIssuer())
+		if err := db.Insert(ctx, crt); err != nil {
+			t.Fatalf("Insert: %s", err)
+		}
+		defer db.Delete(ctx, crt.ID)
+
+		got, err := db.SelectByID(ctx, crt.ID)
+		if err != nil {
+			t.Fatalf("SelectByID: %s", err)
+		}
+		if !equal(got, crt) {
+			t.Errorf("SelectByID = %+v, want %+v", got, crt)
+		}
+		all, err := db.SelectAll(ctx)
+		if err != nil {
+			t.Fatalf("SelectAll: %s", err)
+		}
+		found := false
+		for _, c := range all {
+			found = found || c.ID == crt.ID
+		}
+		if !found {
+			t.Errorf("SelectAll does not return certificate %d", crt.ID)
+		}
+		if _, err := db.SelectByID(ctx, missingID); !storeerr.IsNotFound(err) {
+			t.Errorf("SelectByID of missing certificate returned %v, want a not found error", err)
+		}
+	})
+
+	t.Run("Serials", func(t *testing.T) {
+		issuer := uniqueIssuer()
+		crt := testCRT(newID(t), issuer)
+		if err := db.Insert(ctx, crt); err != nil {
+			t.Fatalf("Insert: %s", err)
+		}
+		defer db.Delete(ctx, crt.ID)
+
+		duplicate := testCRT(newID(t), issuer)
+		duplicate.Serial = crt.Serial
+		if err := db.Insert(ctx, duplicate); !isDuplicateSerial(err) {
+			db.Delete(ctx, duplicate.ID)
+			t.Errorf("Insert of duplicate serial returned %v, want store.ErrDuplicateSerial as a conflict", err)
+		}
+		otherIssuer := testCRT(newID(t), uniqueIssuer())
+		otherIssuer.Serial = crt.Serial
+		if err := db.Insert(ctx, otherIssuer); err != nil {
+			t.Errorf("Insert of same serial for another issuer: %s", err)
+		}
+		defer db.Delete(ctx, otherIssuer.ID)
+
+		serial, err := db.Serial(ctx, issuer)
+		if err != nil {
+			t.Fatalf("Serial: %s", err)
+		}
+		if serial.Sign() <= 0 {
+			t.Errorf("Serial = %s, want a positive number", serial)
+		}
+		if serial.Cmp(crt.Serial) == 0 {
+			t.Errorf("Serial returned serial %s already in use", serial)
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		crt := testCRT(newID(t), uniqueIssuer())
+		if err := db.Insert(ctx, crt); err != nil {
+			t.Fatalf("Insert: %s", err)
+		}
+		defer db.Delete(ctx, crt.ID)
+
+		if err := db.Revoke(ctx, crt.ID, "210101000000Z"); err != nil {
+			t.Errorf("Revoke: %s", err)
+		}
+		if err := db.UpdateCertPath(ctx, crt.ID, "/tmp/certs/other.crt"); err != nil {
+			t.Errorf("UpdateCertPath: %s", err)
+		}
+		got, err := db.SelectByID(ctx, crt.ID)
+		if err != nil {
+			t.Fatalf("SelectByID: %s", err)
+		}
+		if got.Status != "R" || got.RevocationDate != "210101000000Z" || got.CertPath != "/tmp/certs/other.crt" {
+			t.Errorf("SelectByID after updates = %+v", got)
+		}
+		if err := db.Unrevoke(ctx, crt.ID); err != nil {
+			t.Errorf("Unrevoke: %s", err)
+		}
+		got, err = db.SelectByID(ctx, crt.ID)
+		if err != nil {
+			t.Fatalf("SelectByID: %s", err)
+		}
+		if got.Status != "V" || got.RevocationDate != "" {
+			t.Errorf("SelectByID after Unrevoke = %+v", got)
+		}
+		if err := db.Revoke(ctx, missingID, "210101000000Z"); !storeerr.IsNotFound(err) {
+			t.Errorf("Revoke of missing certificate returned %v, want a not found error", err)
+		}
+		if err := db.Unrevoke(ctx, missingID); !storeerr.IsNotFound(err) {
+			t.Errorf("Unrevoke of missing certificate returned %v, want a not found error", err)
+		}
+		if err := db.UpdateCertPath(ctx, missingID, "/tmp/certs/other.crt"); !storeerr.IsNotFound(err) {
+			t.Errorf("UpdateCertPath of missing certificate returned %v, want a not found error", err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		crt := testCRT(newID(t), uniqueIssuer())
+		if err := db.Insert(ctx, crt); err != nil {
+			t.Fatalf("Insert: %s", err)
+		}
+		if err := db.Delete(ctx, crt.ID); err != nil {
+			t.Fatalf("Delete: %s", err)
+		}
+		if _, err := db.SelectByID(ctx, crt.ID); !storeerr.IsNotFound(err) {
+			t.Errorf("SelectByID of deleted certificate returned %v, want a not found error", err)
+		}
+		if err := db.Delete(ctx, crt.ID); !storeerr.IsNotFound(err) {
+			t.Errorf("Delete of deleted certificate returned %v, want a not found error", err)
+		}
+	})
+}
+
+// TestFile checks that f behaves as the certificate file store: DER data is
+// returned PEM encoded, inserting an existing certificate fails with a
+// conflict error and missing certificates are reported as not found
+// errors. No data must be stored for id yet.
+func TestFile(t *testing.T, f store.File, id int) {
+	der := []byte("storetest certificate " + strconv.Itoa(id))
+
+	if err := f.Insert(ctx, id, der); err != nil {
+		t.Fatalf("Insert: %s", err)
+	}
+	defer f.Delete(ctx, id)
+
+	data, err := f.SelectByID(ctx, id)
+	if err != nil {
+		t.Fatalf("SelectByID: %s", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" || string(block.Bytes) != string(der) {
+		t.Errorf("SelectByID = %q, want the inserted data PEM encoded", data)
+	}
+	if err := f.Insert(ctx, id, []byte("other")); !storeerr.IsConflict(err) {
+		t.Errorf("Insert of existing certificate returned %v, want a conflict error", err)
+	}
+
+	stored, err := f.SelectIDs(ctx)
+	if err != nil {
+		t.Fatalf("SelectIDs: %s", err)
+	}
+	found := false
+	for _, storedID := range stored {
+		found = found || storedID == id
+	}
+	if !found {
+		t.Errorf("SelectIDs does not return certificate %d", id)
+	}
+
+	if err := f.Delete(ctx, id); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	if _, err := f.SelectByID(ctx, id); !storeerr.IsNotFound(err) {
+		t.Errorf("SelectByID of deleted certificate returned %v, want a not found error", err)
+	}
+	if err := f.Delete(ctx, id); !storeerr.IsNotFound(err) {
+		t.Errorf("Delete of deleted certificate returned %v, want a not found error", err)
+	}
+}
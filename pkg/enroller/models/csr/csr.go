@@ -1,5 +1,7 @@
 package csr
 
+import "strconv"
+
 type CSR struct {
 	Id                     int    `json:"id"`
 	CountryName            string `json:"c"`
@@ -11,6 +13,7 @@ type CSR struct {
 	EmailAddress           string `json:"mail,omitempty"`
 	Status                 string `json:"status"`
 	CsrFilePath            string `json:"csrpath,omitempty"`
+	OperationID            int    `json:"-"`
 }
 
 type CSRs struct {
@@ -23,3 +26,9 @@ const (
 	DeniedStatus   = "DENIED"
 	RevokedStatus  = "REVOKED"
 )
+
+// FilePath returns the path where the CSR with the given ID is stored under
+// homePath.
+func FilePath(homePath string, id int) string {
+	return homePath + "/" + strconv.Itoa(id) + ".csr"
+}
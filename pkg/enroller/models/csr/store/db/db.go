@@ -1,12 +1,14 @@
 package db
 
 import (
+	"context"
 	"database/sql"
-	"errors"
 	"strconv"
 
+	"github.com/lamassuiot/enroller/pkg/database"
 	"github.com/lamassuiot/enroller/pkg/enroller/models/csr"
 	"github.com/lamassuiot/enroller/pkg/enroller/models/csr/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -14,17 +16,11 @@ import (
 	_ "github.com/lib/pq"
 )
 
-func NewDB(driverName string, dataSourceName string, logger log.Logger) (store.DB, error) {
-	db, err := sql.Open(driverName, dataSourceName)
+func NewDB(ctx context.Context, driverName string, dataSourceName string, opts database.Options, logger log.Logger) (store.DB, error) {
+	db, err := database.Open(ctx, driverName, dataSourceName, opts, logger)
 	if err != nil {
 		return nil, err
 	}
-	err = checkDBAlive(db)
-	for err != nil {
-		level.Warn(logger).Log("msg", "Trying to connect to CSRs DB")
-		err = checkDBAlive(db)
-	}
-
 	return &DB{db, logger}, nil
 }
 
@@ -33,101 +29,50 @@ type DB struct {
 	logger log.Logger
 }
 
-func checkDBAlive(db *sql.DB) error {
-	sqlStatement := `
-	SELECT WHERE 1=0`
-	_, err := db.Query(sqlStatement)
-	return err
-}
-
-func (db *DB) Insert(c csr.CSR) (int, error) {
+func (db *DB) Insert(ctx context.Context, c csr.CSR) (int, error) {
 	id := 0
 	sqlStatement := `
-	INSERT INTO csr_store(c, st, l, o, ou, email, cn, status, csrPath)
-	VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	INSERT INTO csr_store(c, st, l, o, ou, email, cn, status, csrPath, operationId)
+	VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 	RETURNING id;
 	`
-	err := db.QueryRow(sqlStatement, c.CountryName, c.StateOrProvinceName, c.LocalityName, c.OrganizationName, c.OrganizationalUnitName, c.EmailAddress, c.CommonName, c.Status, c.CsrFilePath).Scan(&id)
+	err := db.QueryRowContext(ctx, sqlStatement, c.CountryName, c.StateOrProvinceName, c.LocalityName, c.OrganizationName, c.OrganizationalUnitName, c.EmailAddress, c.CommonName, c.Status, c.CsrFilePath, c.OperationID).Scan(&id)
 	if err != nil {
 		level.Error(db.logger).Log("err", err, "msg", "Could not insert CSR with CN "+c.CommonName+" in database")
-		return -1, err
+		return -1, storeerr.Classify(err)
 	}
 	level.Info(db.logger).Log("msg", "CSR with ID "+strconv.Itoa(id)+" inserted in database")
 	return id, nil
 }
 
-func (db *DB) SelectAll() csr.CSRs {
-	sqlStatement := `
-	SELECT * 
+func (db *DB) SelectAll(ctx context.Context) (csr.CSRs, error) {
+	return db.selectCSRs(ctx, `
+	SELECT id, c, st, l, o, ou, cn, email, status, csrPath
 	FROM csr_store;
-	`
-	rows, err := db.Query(sqlStatement)
-	if err != nil {
-		level.Error(db.logger).Log("err", err, "msg", "Could not obtain CSRs from database or the database is empty")
-		return csr.CSRs{CSRs: []csr.CSR{}}
-	}
-	defer rows.Close()
-	csrs := make([]csr.CSR, 0)
-
-	for rows.Next() {
-		var c csr.CSR
-		err := rows.Scan(&c.Id, &c.CountryName, &c.StateOrProvinceName, &c.LocalityName, &c.OrganizationName, &c.OrganizationalUnitName, &c.CommonName, &c.EmailAddress, &c.Status, &c.CsrFilePath)
-		if err != nil {
-			level.Error(db.logger).Log("err", err, "msg", "Unable to read database CSR row")
-			return csr.CSRs{CSRs: []csr.CSR{}}
-		}
-		level.Info(db.logger).Log("msg", "CSR with ID "+strconv.Itoa(c.Id)+" read from database")
-		csrs = append(csrs, c)
-	}
-	if err = rows.Err(); err != nil {
-		level.Error(db.logger).Log("err", err)
-		return csr.CSRs{CSRs: []csr.CSR{}}
-	}
-	level.Info(db.logger).Log("msg", strconv.Itoa(len(csrs))+" CSRs read from database")
-	return csr.CSRs{CSRs: csrs}
+	`)
 }
 
-func (db *DB) SelectAllByCN(cn string) csr.CSRs {
-	sqlStatement := `
-	SELECT * 
+func (db *DB) SelectAllByCN(ctx context.Context, cn string) (csr.CSRs, error) {
+	return db.selectCSRs(ctx, `
+	SELECT id, c, st, l, o, ou, cn, email, status, csrPath
 	FROM csr_store
 	WHERE cn = $1;
-	`
-	rows, err := db.Query(sqlStatement, cn)
-	if err != nil {
-		level.Error(db.logger).Log("err", err.Error, "msg", "Could not obtain CSR from database for CN "+cn+" or the database is empty")
-		return csr.CSRs{CSRs: []csr.CSR{}}
-	}
-	defer rows.Close()
-	csrs := make([]csr.CSR, 0)
+	`, cn)
+}
 
-	for rows.Next() {
-		var c csr.CSR
-		err := rows.Scan(&c.Id, &c.CountryName, &c.StateOrProvinceName, &c.LocalityName, &c.OrganizationName, &c.OrganizationalUnitName, &c.CommonName, &c.EmailAddress, &c.Status, &c.CsrFilePath)
-		if err != nil {
-			level.Error(db.logger).Log("err", err, "msg", "Unable to read database CSR for CN "+cn)
-			return csr.CSRs{CSRs: []csr.CSR{}}
-		}
-		level.Info(db.logger).Log("msg", "CSR with ID "+strconv.Itoa(c.Id)+" read from database")
-		csrs = append(csrs, c)
-	}
-	if err = rows.Err(); err != nil {
-		level.Error(db.logger).Log("err", err)
-		return csr.CSRs{CSRs: []csr.CSR{}}
-	}
-	level.Info(db.logger).Log("msg", strconv.Itoa(len(csrs))+" CSRs read from database for CN "+cn)
-	return csr.CSRs{CSRs: csrs}
+func (db *DB) SelectByStatus(ctx context.Context, status string) (csr.CSRs, error) {
+	return db.selectCSRs(ctx, `
+	SELECT id, c, st, l, o, ou, cn, email, status, csrPath
+	FROM csr_store
+	WHERE status = $1;
+	`, status)
 }
 
-func (db *DB) SelectByStatus(status string) csr.CSRs {
-	sqlStatement := `
-	SELECT * 
-	FROM csr_store;
-	`
-	rows, err := db.Query(sqlStatement)
+func (db *DB) selectCSRs(ctx context.Context, sqlStatement string, args ...interface{}) (csr.CSRs, error) {
+	rows, err := db.QueryContext(ctx, sqlStatement, args...)
 	if err != nil {
-		level.Error(db.logger).Log("err", err, "msg", "Could not obtain CSR from database with status "+status)
-		return csr.CSRs{CSRs: []csr.CSR{}}
+		level.Error(db.logger).Log("err", err, "msg", "Could not obtain CSRs from database")
+		return csr.CSRs{}, storeerr.Classify(err)
 	}
 	defer rows.Close()
 	csrs := make([]csr.CSR, 0)
@@ -136,106 +81,180 @@ func (db *DB) SelectByStatus(status string) csr.CSRs {
 		var c csr.CSR
 		err := rows.Scan(&c.Id, &c.CountryName, &c.StateOrProvinceName, &c.LocalityName, &c.OrganizationName, &c.OrganizationalUnitName, &c.CommonName, &c.EmailAddress, &c.Status, &c.CsrFilePath)
 		if err != nil {
-			level.Error(db.logger).Log("err", err, "msg", "Unable to read database CSR with status "+status)
-			return csr.CSRs{CSRs: []csr.CSR{}}
+			level.Error(db.logger).Log("err", err, "msg", "Unable to read database CSR row")
+			return csr.CSRs{}, storeerr.Classify(err)
 		}
-		level.Info(db.logger).Log("msg", "CSR with ID "+strconv.Itoa(c.Id)+" read from database")
 		csrs = append(csrs, c)
 	}
 	if err = rows.Err(); err != nil {
 		level.Error(db.logger).Log("err", err)
-		return csr.CSRs{CSRs: []csr.CSR{}}
+		return csr.CSRs{}, storeerr.Classify(err)
 	}
-	level.Info(db.logger).Log("msg", strconv.Itoa(len(csrs))+" CSRs read from database with status "+status)
-	return csr.CSRs{CSRs: csrs}
+	level.Info(db.logger).Log("msg", strconv.Itoa(len(csrs))+" CSRs read from database")
+	return csr.CSRs{CSRs: csrs}, nil
 }
 
-func (db *DB) SelectByID(id int) (csr.CSR, error) {
+func (db *DB) SelectByID(ctx context.Context, id int) (csr.CSR, error) {
 	sqlStatement := `
-	SELECT *
+	SELECT id, c, st, l, o, ou, cn, email, status, csrPath
 	FROM csr_store
 	WHERE id = $1;
 	`
-	row := db.QueryRow(sqlStatement, id)
+	row := db.QueryRowContext(ctx, sqlStatement, id)
 	var c csr.CSR
 	err := row.Scan(&c.Id, &c.CountryName, &c.StateOrProvinceName, &c.LocalityName, &c.OrganizationName, &c.OrganizationalUnitName, &c.CommonName, &c.EmailAddress, &c.Status, &c.CsrFilePath)
 	if err != nil {
 		level.Error(db.logger).Log("err", err, "msg", "Could not obtain CSR with ID "+strconv.Itoa(id)+" from database")
-		return csr.CSR{}, err
+		return csr.CSR{}, storeerr.Classify(err)
 	}
 	level.Info(db.logger).Log("msg", "CSR with ID "+strconv.Itoa(id)+" obtained from database")
 	return c, nil
 }
 
-func (db *DB) UpdateByID(id int, c csr.CSR) (csr.CSR, error) {
+func (db *DB) SelectByOperation(ctx context.Context, operationID int) (csr.CSR, error) {
+	sqlStatement := `
+	SELECT id, c, st, l, o, ou, cn, email, status, csrPath, operationId
+	FROM csr_store
+	WHERE operationId = $1;
+	`
+	var c csr.CSR
+	err := db.QueryRowContext(ctx, sqlStatement, operationID).Scan(&c.Id, &c.CountryName, &c.StateOrProvinceName, &c.LocalityName, &c.OrganizationName, &c.OrganizationalUnitName, &c.CommonName, &c.EmailAddress, &c.Status, &c.CsrFilePath, &c.OperationID)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not obtain CSR of operation "+strconv.Itoa(operationID)+" from database")
+		return csr.CSR{}, storeerr.Classify(err)
+	}
+	return c, nil
+}
+
+func (db *DB) UpdateByID(ctx context.Context, id int, c csr.CSR) (csr.CSR, error) {
 	sqlStatement := `
 	UPDATE csr_store
 	SET status = $1
 	WHERE id = $2;
 	`
-	res, err := db.Exec(sqlStatement, c.Status, id)
-	if err != nil {
-		level.Error(db.logger).Log("err", err, "msg", "Could not update CSR with ID "+strconv.Itoa(id)+" status to "+c.Status)
-		return csr.CSR{}, err
-	}
-	count, err := res.RowsAffected()
+	err := db.exec(ctx, sqlStatement, c.Status, id)
 	if err != nil {
 		level.Error(db.logger).Log("err", err, "msg", "Could not update CSR with ID "+strconv.Itoa(id)+" status to "+c.Status)
 		return csr.CSR{}, err
 	}
-	if count <= 0 {
-		err = errors.New("No rows have been updated in database")
-		level.Error(db.logger).Log("err", err)
-		return csr.CSR{}, err
-	}
-	level.Info(db.logger).Log("msg", "CSR with ID "+strconv.Itoa(id)+" status updated to"+c.Status)
+	level.Info(db.logger).Log("msg", "CSR with ID "+strconv.Itoa(id)+" status updated to "+c.Status)
 	return csr.CSR{}, nil
 }
 
-func (db *DB) UpdateFilePath(c csr.CSR) error {
+// UpdateStatus changes the CSR status only if it is still from, so
+// concurrent updates on different replicas cannot both succeed.
+func (db *DB) UpdateStatus(ctx context.Context, id int, from string, to string) error {
 	sqlStatement := `
 	UPDATE csr_store
-	SET csrPath = $1
-	WHERE id = $2;
+	SET status = $1
+	WHERE id = $2 AND status = $3;
 	`
-	res, err := db.Exec(sqlStatement, c.CsrFilePath, c.Id)
+	err := db.exec(ctx, sqlStatement, to, id, from)
+	if storeerr.IsNotFound(err) {
+		if _, err = db.SelectByID(ctx, id); err != nil {
+			return err
+		}
+		level.Warn(db.logger).Log("msg", "CSR with ID "+strconv.Itoa(id)+" is no longer in status "+from)
+		return storeerr.Conflict(store.ErrStatusConflict)
+	}
 	if err != nil {
-		level.Error(db.logger).Log("err", err, "msg", "Could not updated CSR with ID "+strconv.Itoa(c.Id)+" file path to "+c.CsrFilePath)
+		level.Error(db.logger).Log("err", err, "msg", "Could not update CSR with ID "+strconv.Itoa(id)+" status to "+to)
 		return err
 	}
-	count, err := res.RowsAffected()
+	level.Info(db.logger).Log("msg", "CSR with ID "+strconv.Itoa(id)+" status updated from "+from+" to "+to)
+	return nil
+}
+
+// Transition locks the CSR row, checks that its status is from, runs fn and
+// sets the status to to in the same transaction. Other replicas block on
+// the row lock until the transaction ends and then see the new status. The
+// lock still lets fn insert rows that reference the CSR.
+func (db *DB) Transition(ctx context.Context, id int, from string, to string, fn func() error) error {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		level.Error(db.logger).Log("err", err, "msg", "Could not updated CSR with ID "+strconv.Itoa(c.Id)+" file path to "+c.CsrFilePath)
+		level.Error(db.logger).Log("err", err, "msg", "Could not start transaction for CSR with ID "+strconv.Itoa(id))
+		return storeerr.Classify(err)
+	}
+	var status string
+	err = tx.QueryRowContext(ctx, `
+	SELECT status
+	FROM csr_store
+	WHERE id = $1
+	FOR NO KEY UPDATE;
+	`, id).Scan(&status)
+	if err != nil {
+		tx.Rollback()
+		level.Error(db.logger).Log("err", err, "msg", "Could not lock CSR with ID "+strconv.Itoa(id))
+		return storeerr.Classify(err)
+	}
+	if status != from {
+		tx.Rollback()
+		level.Warn(db.logger).Log("msg", "CSR with ID "+strconv.Itoa(id)+" is in status "+status+", expected "+from)
+		return storeerr.Conflict(store.ErrStatusConflict)
+	}
+	if err = fn(); err != nil {
+		tx.Rollback()
 		return err
 	}
-	if count <= 0 {
-		err = errors.New("No rows have been updated in database")
-		level.Error(db.logger).Log("err", err)
+	_, err = tx.ExecContext(ctx, `
+	UPDATE csr_store
+	SET status = $1
+	WHERE id = $2;
+	`, to, id)
+	if err != nil {
+		tx.Rollback()
+		level.Error(db.logger).Log("err", err, "msg", "Could not update CSR with ID "+strconv.Itoa(id)+" status to "+to)
+		return storeerr.Classify(err)
+	}
+	if err = tx.Commit(); err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not commit CSR with ID "+strconv.Itoa(id)+" status change to "+to)
+		return storeerr.Classify(err)
+	}
+	level.Info(db.logger).Log("msg", "CSR with ID "+strconv.Itoa(id)+" status updated from "+from+" to "+to)
+	return nil
+}
+
+func (db *DB) UpdateFilePath(ctx context.Context, c csr.CSR) error {
+	sqlStatement := `
+	UPDATE csr_store
+	SET csrPath = $1
+	WHERE id = $2;
+	`
+	err := db.exec(ctx, sqlStatement, c.CsrFilePath, c.Id)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not updated CSR with ID "+strconv.Itoa(c.Id)+" file path to "+c.CsrFilePath)
 		return err
 	}
 	level.Info(db.logger).Log("msg", "CSR with ID "+strconv.Itoa(c.Id)+" file path updated to "+c.CsrFilePath)
 	return nil
 }
 
-func (db *DB) Delete(id int) error {
+func (db *DB) Delete(ctx context.Context, id int) error {
 	sqlStatement := `
 	DELETE FROM csr_store
 	WHERE id = $1;
 	`
-	res, err := db.Exec(sqlStatement, id)
+	err := db.exec(ctx, sqlStatement, id)
 	if err != nil {
 		level.Error(db.logger).Log("err", err, "msg", "Could not delete CSR with ID "+strconv.Itoa(id)+" from database")
 		return err
 	}
+	return nil
+}
+
+// exec runs sqlStatement and returns a not found error if no row was
+// affected.
+func (db *DB) exec(ctx context.Context, sqlStatement string, args ...interface{}) error {
+	res, err := db.ExecContext(ctx, sqlStatement, args...)
+	if err != nil {
+		return storeerr.Classify(err)
+	}
 	count, err := res.RowsAffected()
 	if err != nil {
-		level.Error(db.logger).Log("err", err, "msg", "Could not delete CSR with ID "+strconv.Itoa(id)+" from database")
-		return err
+		return storeerr.Classify(err)
 	}
 	if count <= 0 {
-		err = errors.New("No rows have been updated in database")
-		level.Error(db.logger).Log("err", err)
-		return err
+		return storeerr.NotFound(sql.ErrNoRows)
 	}
 	return nil
 }
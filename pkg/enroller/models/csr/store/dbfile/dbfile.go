@@ -0,0 +1,132 @@
+package dbfile
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strconv"
+
+	"github.com/lamassuiot/enroller/pkg/database"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/csr/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	_ "github.com/lib/pq"
+)
+
+// File keeps the PKCS#10 bytes of each CSR in the csrData column of its
+// csr_store row instead of in the file system, so that no shared volume is
+// needed. Missing data is reported as os.ErrNotExist, like the file system
+// store does.
+type File struct {
+	*sql.DB
+	logger log.Logger
+}
+
+func NewFile(ctx context.Context, driverName string, dataSourceName string, opts database.Options, logger log.Logger) (store.File, error) {
+	db, err := database.Open(ctx, driverName, dataSourceName, opts, logger)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not open connection with CSRs data database")
+		return nil, storeerr.Classify(err)
+	}
+	return &File{db, logger}, nil
+}
+
+func (f *File) Insert(ctx context.Context, id int, data []byte) error {
+	sqlStatement := `
+	UPDATE csr_store
+	SET csrData = $1
+	WHERE id = $2 AND csrData IS NULL;
+	`
+	res, err := f.ExecContext(ctx, sqlStatement, data, id)
+	if err != nil {
+		level.Error(f.logger).Log("err", err, "msg", "Could not insert CSR with ID "+strconv.Itoa(id)+" data in database")
+		return storeerr.Classify(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		level.Error(f.logger).Log("err", err, "msg", "Could not insert CSR with ID "+strconv.Itoa(id)+" data in database")
+		return storeerr.Classify(err)
+	}
+	if count <= 0 {
+		err = &os.PathError{Op: "insert", Path: "csr_store/" + strconv.Itoa(id), Err: os.ErrExist}
+		level.Error(f.logger).Log("err", err, "msg", "CSR with ID "+strconv.Itoa(id)+" does not exist or already has data")
+		return storeerr.Classify(err)
+	}
+	level.Info(f.logger).Log("msg", "CSR with ID "+strconv.Itoa(id)+" data inserted in database")
+	return nil
+}
+
+func (f *File) SelectByID(ctx context.Context, id int) ([]byte, error) {
+	sqlStatement := `
+	SELECT csrData
+	FROM csr_store
+	WHERE id = $1 AND csrData IS NOT NULL;
+	`
+	var data []byte
+	err := f.QueryRowContext(ctx, sqlStatement, id).Scan(&data)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = &os.PathError{Op: "select", Path: "csr_store/" + strconv.Itoa(id), Err: os.ErrNotExist}
+		}
+		level.Error(f.logger).Log("err", err, "msg", "Could not obtain CSR with ID "+strconv.Itoa(id)+" data from database")
+		return nil, storeerr.Classify(err)
+	}
+	level.Info(f.logger).Log("msg", "CSR with ID "+strconv.Itoa(id)+" data obtained from database")
+	return data, nil
+}
+
+func (f *File) SelectIDs(ctx context.Context) ([]int, error) {
+	sqlStatement := `
+	SELECT id
+	FROM csr_store
+	WHERE csrData IS NOT NULL;
+	`
+	rows, err := f.QueryContext(ctx, sqlStatement)
+	if err != nil {
+		level.Error(f.logger).Log("err", err, "msg", "Could not list CSRs data in database")
+		return nil, storeerr.Classify(err)
+	}
+	defer rows.Close()
+	ids := make([]int, 0)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			level.Error(f.logger).Log("err", err, "msg", "Unable to read database CSR ID")
+			return nil, storeerr.Classify(err)
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		level.Error(f.logger).Log("err", err)
+		return nil, storeerr.Classify(err)
+	}
+	return ids, nil
+}
+
+func (f *File) Delete(ctx context.Context, id int) error {
+	sqlStatement := `
+	UPDATE csr_store
+	SET csrData = NULL
+	WHERE id = $1 AND csrData IS NOT NULL;
+	`
+	res, err := f.ExecContext(ctx, sqlStatement, id)
+	if err != nil {
+		level.Error(f.logger).Log("err", err, "msg", "Could not delete CSR with ID "+strconv.Itoa(id)+" data from database")
+		return storeerr.Classify(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		level.Error(f.logger).Log("err", err, "msg", "Could not delete CSR with ID "+strconv.Itoa(id)+" data from database")
+		return storeerr.Classify(err)
+	}
+	if count <= 0 {
+		err = &os.PathError{Op: "delete", Path: "csr_store/" + strconv.Itoa(id), Err: os.ErrNotExist}
+		level.Error(f.logger).Log("err", err, "msg", "Could not delete CSR with ID "+strconv.Itoa(id)+" data from database")
+		return storeerr.Classify(err)
+	}
+	level.Info(f.logger).Log("msg", "CSR with ID "+strconv.Itoa(id)+" data deleted from database")
+	return nil
+}
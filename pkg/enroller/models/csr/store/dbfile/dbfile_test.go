@@ -0,0 +1,51 @@
+package dbfile
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/configs"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/csr"
+	csrdb "github.com/lamassuiot/enroller/pkg/enroller/models/csr/store/db"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/csr/store/storetest"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/migrations"
+	"github.com/lamassuiot/enroller/pkg/migrate"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestFile(t *testing.T) {
+	err, cfg := configs.NewConfig("enrollertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.PostgresHostname == "" {
+		t.Skip("ENROLLERTEST_POSTGRESHOSTNAME not set")
+	}
+	connStr := cfg.Postgres().DataSourceName()
+	sqlDB, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlDB.Close()
+	if _, err := migrate.NewMigrator(sqlDB, "postgres", migrations.Postgres, log.NewNopLogger()).Up(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+	db, err := csrdb.NewDB(ctx, "postgres", connStr, cfg.DatabaseOptions(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFile(ctx, "postgres", connStr, cfg.DatabaseOptions(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := db.Insert(ctx, csr.CSR{CommonName: "storetest.com", Status: csr.PendingStatus})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Delete(ctx, id)
+	storetest.TestFile(t, f, id)
+}
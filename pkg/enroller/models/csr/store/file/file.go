@@ -1,11 +1,14 @@
 package files
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/lamassuiot/enroller/pkg/enroller/models/csr/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -24,41 +27,63 @@ const (
 	csrPerm = 0444
 )
 
-func (f *File) Insert(id int, data []byte) error {
+func (f *File) Insert(ctx context.Context, id int, data []byte) error {
 	name := f.dirPath + "/" + strconv.Itoa(id) + ".csr"
 	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, csrPerm)
 	if err != nil {
 		level.Error(f.logger).Log("err", err, "msg", "Could not insert CSR with ID "+strconv.Itoa(id)+" in filesystem")
-		return err
+		return storeerr.Classify(err)
 	}
 	defer file.Close()
 
 	if _, err := file.Write(data); err != nil {
 		level.Error(f.logger).Log("err", err, "msg", "Error encoding bytas as CSR")
 		os.Remove(name)
-		return err
+		return storeerr.Classify(err)
 	}
 	level.Info(f.logger).Log("msg", "CSR with ID "+strconv.Itoa(id)+" inserted in file system")
 	return nil
 }
 
-func (f *File) SelectByID(id int) ([]byte, error) {
+func (f *File) SelectByID(ctx context.Context, id int) ([]byte, error) {
 	name := f.dirPath + "/" + strconv.Itoa(id) + ".csr"
 	data, err := ioutil.ReadFile(name)
 	if err != nil {
 		level.Error(f.logger).Log("err", err, "msg", "Could not obtain CSR with ID "+strconv.Itoa(id)+" from filesystem")
-		return nil, err
+		return nil, storeerr.Classify(err)
 	}
 	level.Info(f.logger).Log("msg", "CSR with ID "+strconv.Itoa(id)+" obtained from file system")
 	return data, nil
 }
 
-func (f *File) Delete(id int) error {
+func (f *File) SelectIDs(ctx context.Context) ([]int, error) {
+	entries, err := ioutil.ReadDir(f.dirPath)
+	if err != nil {
+		level.Error(f.logger).Log("err", err, "msg", "Could not list CSR files in filesystem")
+		return nil, storeerr.Classify(err)
+	}
+	ids := make([]int, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".csr") {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(name, ".csr"))
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	level.Info(f.logger).Log("msg", strconv.Itoa(len(ids))+" CSR files found in file system")
+	return ids, nil
+}
+
+func (f *File) Delete(ctx context.Context, id int) error {
 	name := f.dirPath + "/" + strconv.Itoa(id) + ".csr"
 	err := os.Remove(name)
 	if err != nil {
 		level.Error(f.logger).Log("err", err, "msg", "Could not delete CSR with ID "+strconv.Itoa(id)+" from filesystem")
-		return err
+		return storeerr.Classify(err)
 	}
 	level.Info(f.logger).Log("msg", "CSR with ID "+strconv.Itoa(id)+" deleted from file system")
 	return nil
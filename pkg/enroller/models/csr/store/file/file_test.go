@@ -0,0 +1,20 @@
+package files
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/models/csr/store/storetest"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enroller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storetest.TestFile(t, NewFile(dir, log.NewNopLogger()), 1)
+}
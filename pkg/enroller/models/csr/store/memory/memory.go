@@ -0,0 +1,232 @@
+// Package memory implements the CSR stores in memory, for tests and for
+// embedding the enroller service without a database or file system.
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/models/csr"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/csr/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
+)
+
+// DB keeps CSRs in a map. Like the database store it assigns increasing IDs
+// on Insert and reports missing CSRs as sql.ErrNoRows. Every CSR has a lock
+// that Transition holds while its function runs, as the row lock does.
+type DB struct {
+	mu     sync.Mutex
+	lastID int
+	csrs   map[int]csr.CSR
+	locks  map[int]*sync.Mutex
+}
+
+func NewDB() store.DB {
+	return &DB{csrs: make(map[int]csr.CSR), locks: make(map[int]*sync.Mutex)}
+}
+
+func (db *DB) Insert(ctx context.Context, c csr.CSR) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.lastID++
+	c.Id = db.lastID
+	db.csrs[c.Id] = c
+	db.locks[c.Id] = &sync.Mutex{}
+	return c.Id, nil
+}
+
+func (db *DB) SelectAll(ctx context.Context) (csr.CSRs, error) {
+	return db.filter(func(c csr.CSR) bool { return true })
+}
+
+func (db *DB) SelectAllByCN(ctx context.Context, cn string) (csr.CSRs, error) {
+	return db.filter(func(c csr.CSR) bool { return c.CommonName == cn })
+}
+
+func (db *DB) SelectByStatus(ctx context.Context, status string) (csr.CSRs, error) {
+	return db.filter(func(c csr.CSR) bool { return c.Status == status })
+}
+
+func (db *DB) filter(match func(c csr.CSR) bool) (csr.CSRs, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	csrs := make([]csr.CSR, 0)
+	for _, c := range db.csrs {
+		if match(c) {
+			csrs = append(csrs, c)
+		}
+	}
+	sort.Slice(csrs, func(i, j int) bool { return csrs[i].Id < csrs[j].Id })
+	return csr.CSRs{CSRs: csrs}, nil
+}
+
+func (db *DB) SelectByID(ctx context.Context, id int) (csr.CSR, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	c, ok := db.csrs[id]
+	if !ok {
+		return csr.CSR{}, storeerr.NotFound(sql.ErrNoRows)
+	}
+	return c, nil
+}
+
+func (db *DB) SelectByOperation(ctx context.Context, operationID int) (csr.CSR, error) {
+	csrs, _ := db.filter(func(c csr.CSR) bool { return c.OperationID == operationID })
+	if len(csrs.CSRs) == 0 {
+		return csr.CSR{}, storeerr.NotFound(sql.ErrNoRows)
+	}
+	return csrs.CSRs[0], nil
+}
+
+func (db *DB) UpdateByID(ctx context.Context, id int, c csr.CSR) (csr.CSR, error) {
+	err := db.update(id, func(stored *csr.CSR) error {
+		stored.Status = c.Status
+		return nil
+	})
+	return csr.CSR{}, err
+}
+
+func (db *DB) UpdateStatus(ctx context.Context, id int, from string, to string) error {
+	return db.update(id, func(stored *csr.CSR) error {
+		if stored.Status != from {
+			return storeerr.Conflict(store.ErrStatusConflict)
+		}
+		stored.Status = to
+		return nil
+	})
+}
+
+func (db *DB) Transition(ctx context.Context, id int, from string, to string, fn func() error) error {
+	lock, err := db.lock(id)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	c, err := db.SelectByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if c.Status != from {
+		return storeerr.Conflict(store.ErrStatusConflict)
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	return db.set(id, func(stored *csr.CSR) error {
+		stored.Status = to
+		return nil
+	})
+}
+
+func (db *DB) UpdateFilePath(ctx context.Context, c csr.CSR) error {
+	return db.update(c.Id, func(stored *csr.CSR) error {
+		stored.CsrFilePath = c.CsrFilePath
+		return nil
+	})
+}
+
+func (db *DB) Delete(ctx context.Context, id int) error {
+	lock, err := db.lock(id)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.csrs[id]; !ok {
+		return storeerr.NotFound(sql.ErrNoRows)
+	}
+	delete(db.csrs, id)
+	return nil
+}
+
+// update waits for a running Transition on the CSR and then changes it.
+func (db *DB) update(id int, fn func(c *csr.CSR) error) error {
+	lock, err := db.lock(id)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	return db.set(id, fn)
+}
+
+func (db *DB) set(id int, fn func(c *csr.CSR) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	c, ok := db.csrs[id]
+	if !ok {
+		return storeerr.NotFound(sql.ErrNoRows)
+	}
+	if err := fn(&c); err != nil {
+		return err
+	}
+	db.csrs[id] = c
+	return nil
+}
+
+func (db *DB) lock(id int) (*sync.Mutex, error) {
+	db.mu.Lock()
+	lock, ok := db.locks[id]
+	db.mu.Unlock()
+	if !ok {
+		return nil, storeerr.NotFound(sql.ErrNoRows)
+	}
+	lock.Lock()
+	return lock, nil
+}
+
+// File keeps CSR data in a map and reports missing CSRs as os.ErrNotExist
+// and already stored ones as os.ErrExist, like the file system store.
+type File struct {
+	mu   sync.Mutex
+	data map[int][]byte
+}
+
+func NewFile() store.File {
+	return &File{data: make(map[int][]byte)}
+}
+
+func (f *File) Insert(ctx context.Context, id int, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.data[id]; ok {
+		return storeerr.Conflict(&os.PathError{Op: "insert", Path: strconv.Itoa(id) + ".csr", Err: os.ErrExist})
+	}
+	f.data[id] = append([]byte(nil), data...)
+	return nil
+}
+
+func (f *File) SelectByID(ctx context.Context, id int) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.data[id]
+	if !ok {
+		return nil, storeerr.NotFound(&os.PathError{Op: "select", Path: strconv.Itoa(id) + ".csr", Err: os.ErrNotExist})
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (f *File) SelectIDs(ctx context.Context) ([]int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := make([]int, 0, len(f.data))
+	for id := range f.data {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func (f *File) Delete(ctx context.Context, id int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.data[id]; !ok {
+		return storeerr.NotFound(&os.PathError{Op: "delete", Path: strconv.Itoa(id) + ".csr", Err: os.ErrNotExist})
+	}
+	delete(f.data, id)
+	return nil
+}
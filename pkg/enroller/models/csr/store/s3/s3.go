@@ -0,0 +1,82 @@
+package s3
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/models/csr/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
+	"github.com/lamassuiot/enroller/pkg/enroller/objectstore"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// File keeps each CSR as an object named csrs/<id>.csr in an S3 compatible
+// bucket, under the prefix configured in the client.
+type File struct {
+	client *objectstore.Client
+	logger log.Logger
+}
+
+func NewFile(client *objectstore.Client, logger log.Logger) store.File {
+	return &File{client: client, logger: logger}
+}
+
+const (
+	dir = "csrs/"
+	ext = ".csr"
+)
+
+func (f *File) Insert(ctx context.Context, id int, data []byte) error {
+	err := f.client.Put(ctx, dir+strconv.Itoa(id)+ext, data, true)
+	if err != nil {
+		level.Error(f.logger).Log("err", err, "msg", "Could not insert CSR with ID "+strconv.Itoa(id)+" in object store")
+		return storeerr.Classify(err)
+	}
+	level.Info(f.logger).Log("msg", "CSR with ID "+strconv.Itoa(id)+" inserted in object store")
+	return nil
+}
+
+func (f *File) SelectByID(ctx context.Context, id int) ([]byte, error) {
+	data, err := f.client.Get(ctx, dir+strconv.Itoa(id)+ext)
+	if err != nil {
+		level.Error(f.logger).Log("err", err, "msg", "Could not obtain CSR with ID "+strconv.Itoa(id)+" from object store")
+		return nil, storeerr.Classify(err)
+	}
+	level.Info(f.logger).Log("msg", "CSR with ID "+strconv.Itoa(id)+" obtained from object store")
+	return data, nil
+}
+
+func (f *File) SelectIDs(ctx context.Context) ([]int, error) {
+	keys, err := f.client.List(ctx, dir)
+	if err != nil {
+		level.Error(f.logger).Log("err", err, "msg", "Could not list CSR objects in object store")
+		return nil, storeerr.Classify(err)
+	}
+	ids := make([]int, 0)
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, dir)
+		if strings.Contains(name, "/") || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(name, ext))
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	level.Info(f.logger).Log("msg", strconv.Itoa(len(ids))+" CSR objects found in object store")
+	return ids, nil
+}
+
+func (f *File) Delete(ctx context.Context, id int) error {
+	err := f.client.Delete(ctx, dir+strconv.Itoa(id)+ext)
+	if err != nil {
+		level.Error(f.logger).Log("err", err, "msg", "Could not delete CSR with ID "+strconv.Itoa(id)+" from object store")
+		return storeerr.Classify(err)
+	}
+	level.Info(f.logger).Log("msg", "CSR with ID "+strconv.Itoa(id)+" deleted from object store")
+	return nil
+}
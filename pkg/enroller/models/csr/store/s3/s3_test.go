@@ -0,0 +1,27 @@
+package s3
+
+import (
+	"testing"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/models/csr/store/storetest"
+	"github.com/lamassuiot/enroller/pkg/enroller/objectstore"
+	"github.com/lamassuiot/enroller/pkg/enroller/objectstore/objectstoretest"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestFile(t *testing.T) {
+	server := objectstoretest.NewServer("enroller", "access")
+	defer server.Close()
+	client, err := objectstore.NewClient(objectstore.Config{
+		Endpoint:  server.URL,
+		Bucket:    "enroller",
+		Prefix:    "lamassu/",
+		AccessKey: "access",
+		SecretKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storetest.TestFile(t, NewFile(client, log.NewNopLogger()), 1)
+}
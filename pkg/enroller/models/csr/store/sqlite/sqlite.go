@@ -0,0 +1,249 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"sync"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/models/csr"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/csr/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	_ "modernc.org/sqlite"
+)
+
+// DB stores CSRs in a SQLite database, for single node deployments. SQLite
+// has no row locks, so Transition holds an in-process lock per CSR.
+type DB struct {
+	*sql.DB
+	logger log.Logger
+
+	mu    sync.Mutex
+	locks map[int]*sync.Mutex
+}
+
+func NewDB(dataSourceName string, logger log.Logger) (store.DB, error) {
+	db, err := sql.Open("sqlite", dataSourceName)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not open CSRs SQLite database")
+		return nil, storeerr.Classify(err)
+	}
+	return &DB{DB: db, logger: logger, locks: make(map[int]*sync.Mutex)}, nil
+}
+
+func (db *DB) Insert(ctx context.Context, c csr.CSR) (int, error) {
+	id := 0
+	sqlStatement := `
+	INSERT INTO csr_store(c, st, l, o, ou, email, cn, status, csrPath, operationId)
+	VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	RETURNING id;
+	`
+	err := db.QueryRowContext(ctx, sqlStatement, c.CountryName, c.StateOrProvinceName, c.LocalityName, c.OrganizationName, c.OrganizationalUnitName, c.EmailAddress, c.CommonName, c.Status, c.CsrFilePath, c.OperationID).Scan(&id)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not insert CSR with CN "+c.CommonName+" in database")
+		return -1, storeerr.Classify(err)
+	}
+	level.Info(db.logger).Log("msg", "CSR with ID "+strconv.Itoa(id)+" inserted in database")
+	return id, nil
+}
+
+func (db *DB) SelectAll(ctx context.Context) (csr.CSRs, error) {
+	return db.selectCSRs(ctx, `
+	SELECT id, c, st, l, o, ou, cn, email, status, csrPath
+	FROM csr_store
+	ORDER BY id;
+	`)
+}
+
+func (db *DB) SelectAllByCN(ctx context.Context, cn string) (csr.CSRs, error) {
+	return db.selectCSRs(ctx, `
+	SELECT id, c, st, l, o, ou, cn, email, status, csrPath
+	FROM csr_store
+	WHERE cn = $1
+	ORDER BY id;
+	`, cn)
+}
+
+func (db *DB) SelectByStatus(ctx context.Context, status string) (csr.CSRs, error) {
+	return db.selectCSRs(ctx, `
+	SELECT id, c, st, l, o, ou, cn, email, status, csrPath
+	FROM csr_store
+	WHERE status = $1
+	ORDER BY id;
+	`, status)
+}
+
+func (db *DB) selectCSRs(ctx context.Context, sqlStatement string, args ...interface{}) (csr.CSRs, error) {
+	rows, err := db.QueryContext(ctx, sqlStatement, args...)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not obtain CSRs from database")
+		return csr.CSRs{}, storeerr.Classify(err)
+	}
+	defer rows.Close()
+	csrs := make([]csr.CSR, 0)
+
+	for rows.Next() {
+		var c csr.CSR
+		err := rows.Scan(&c.Id, &c.CountryName, &c.StateOrProvinceName, &c.LocalityName, &c.OrganizationName, &c.OrganizationalUnitName, &c.CommonName, &c.EmailAddress, &c.Status, &c.CsrFilePath)
+		if err != nil {
+			level.Error(db.logger).Log("err", err, "msg", "Unable to read database CSR row")
+			return csr.CSRs{}, storeerr.Classify(err)
+		}
+		csrs = append(csrs, c)
+	}
+	if err = rows.Err(); err != nil {
+		level.Error(db.logger).Log("err", err)
+		return csr.CSRs{}, storeerr.Classify(err)
+	}
+	level.Info(db.logger).Log("msg", strconv.Itoa(len(csrs))+" CSRs read from database")
+	return csr.CSRs{CSRs: csrs}, nil
+}
+
+func (db *DB) SelectByID(ctx context.Context, id int) (csr.CSR, error) {
+	sqlStatement := `
+	SELECT id, c, st, l, o, ou, cn, email, status, csrPath
+	FROM csr_store
+	WHERE id = $1;
+	`
+	var c csr.CSR
+	err := db.QueryRowContext(ctx, sqlStatement, id).Scan(&c.Id, &c.CountryName, &c.StateOrProvinceName, &c.LocalityName, &c.OrganizationName, &c.OrganizationalUnitName, &c.CommonName, &c.EmailAddress, &c.Status, &c.CsrFilePath)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not obtain CSR with ID "+strconv.Itoa(id)+" from database")
+		return csr.CSR{}, storeerr.Classify(err)
+	}
+	level.Info(db.logger).Log("msg", "CSR with ID "+strconv.Itoa(id)+" obtained from database")
+	return c, nil
+}
+
+func (db *DB) SelectByOperation(ctx context.Context, operationID int) (csr.CSR, error) {
+	sqlStatement := `
+	SELECT id, c, st, l, o, ou, cn, email, status, csrPath, operationId
+	FROM csr_store
+	WHERE operationId = $1;
+	`
+	var c csr.CSR
+	err := db.QueryRowContext(ctx, sqlStatement, operationID).Scan(&c.Id, &c.CountryName, &c.StateOrProvinceName, &c.LocalityName, &c.OrganizationName, &c.OrganizationalUnitName, &c.CommonName, &c.EmailAddress, &c.Status, &c.CsrFilePath, &c.OperationID)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not obtain CSR of operation "+strconv.Itoa(operationID)+" from database")
+		return csr.CSR{}, storeerr.Classify(err)
+	}
+	return c, nil
+}
+
+func (db *DB) UpdateByID(ctx context.Context, id int, c csr.CSR) (csr.CSR, error) {
+	defer db.lock(id).Unlock()
+	err := db.exec(ctx, `
+	UPDATE csr_store
+	SET status = $1
+	WHERE id = $2;
+	`, c.Status, id)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not update CSR with ID "+strconv.Itoa(id)+" status to "+c.Status)
+		return csr.CSR{}, storeerr.Classify(err)
+	}
+	level.Info(db.logger).Log("msg", "CSR with ID "+strconv.Itoa(id)+" status updated to "+c.Status)
+	return csr.CSR{}, nil
+}
+
+func (db *DB) UpdateStatus(ctx context.Context, id int, from string, to string) error {
+	defer db.lock(id).Unlock()
+	return db.updateStatus(ctx, id, from, to)
+}
+
+func (db *DB) updateStatus(ctx context.Context, id int, from string, to string) error {
+	err := db.exec(ctx, `
+	UPDATE csr_store
+	SET status = $1
+	WHERE id = $2 AND status = $3;
+	`, to, id, from)
+	if storeerr.IsNotFound(err) {
+		if _, err = db.SelectByID(ctx, id); err != nil {
+			return err
+		}
+		level.Warn(db.logger).Log("msg", "CSR with ID "+strconv.Itoa(id)+" is no longer in status "+from)
+		return storeerr.Conflict(store.ErrStatusConflict)
+	}
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not update CSR with ID "+strconv.Itoa(id)+" status to "+to)
+		return storeerr.Classify(err)
+	}
+	level.Info(db.logger).Log("msg", "CSR with ID "+strconv.Itoa(id)+" status updated from "+from+" to "+to)
+	return nil
+}
+
+func (db *DB) Transition(ctx context.Context, id int, from string, to string, fn func() error) error {
+	defer db.lock(id).Unlock()
+	c, err := db.SelectByID(ctx, id)
+	if err != nil {
+		return storeerr.Classify(err)
+	}
+	if c.Status != from {
+		level.Warn(db.logger).Log("msg", "CSR with ID "+strconv.Itoa(id)+" is in status "+c.Status+", expected "+from)
+		return storeerr.Conflict(store.ErrStatusConflict)
+	}
+	if err = fn(); err != nil {
+		return err
+	}
+	return db.updateStatus(ctx, id, from, to)
+}
+
+func (db *DB) UpdateFilePath(ctx context.Context, c csr.CSR) error {
+	defer db.lock(c.Id).Unlock()
+	err := db.exec(ctx, `
+	UPDATE csr_store
+	SET csrPath = $1
+	WHERE id = $2;
+	`, c.CsrFilePath, c.Id)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not update CSR with ID "+strconv.Itoa(c.Id)+" file path to "+c.CsrFilePath)
+		return storeerr.Classify(err)
+	}
+	level.Info(db.logger).Log("msg", "CSR with ID "+strconv.Itoa(c.Id)+" file path updated to "+c.CsrFilePath)
+	return nil
+}
+
+func (db *DB) Delete(ctx context.Context, id int) error {
+	defer db.lock(id).Unlock()
+	err := db.exec(ctx, `
+	DELETE FROM csr_store
+	WHERE id = $1;
+	`, id)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not delete CSR with ID "+strconv.Itoa(id)+" from database")
+		return storeerr.Classify(err)
+	}
+	return nil
+}
+
+// exec runs sqlStatement and returns sql.ErrNoRows if no row was affected.
+func (db *DB) exec(ctx context.Context, sqlStatement string, args ...interface{}) error {
+	res, err := db.ExecContext(ctx, sqlStatement, args...)
+	if err != nil {
+		return storeerr.Classify(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return storeerr.Classify(err)
+	}
+	if count <= 0 {
+		return storeerr.NotFound(sql.ErrNoRows)
+	}
+	return nil
+}
+
+// lock acquires the in-process lock of the CSR with the given ID.
+func (db *DB) lock(id int) *sync.Mutex {
+	db.mu.Lock()
+	lock, ok := db.locks[id]
+	if !ok {
+		lock = &sync.Mutex{}
+		db.locks[id] = lock
+	}
+	db.mu.Unlock()
+	lock.Lock()
+	return lock
+}
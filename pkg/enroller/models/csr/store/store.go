@@ -1,20 +1,40 @@
 package store
 
-import "github.com/lamassuiot/enroller/pkg/enroller/models/csr"
+import (
+	"context"
+	"errors"
 
+	"github.com/lamassuiot/enroller/pkg/enroller/models/csr"
+)
+
+// ErrStatusConflict is returned, as a storeerr conflict, when a CSR is not
+// in the status a transition expects, usually because another request
+// changed it first.
+var ErrStatusConflict = errors.New("CSR status does not match the expected status")
+
+// DB stores the CSR records. Errors are classified with the storeerr
+// package: missing CSRs are not found, status conflicts are conflicts and
+// unreachable databases are unavailable. SelectByOperation finds the CSR
+// inserted with the given OperationID.
 type DB interface {
-	Insert(c csr.CSR) (int, error)
-	SelectAll() csr.CSRs
-	SelectAllByCN(cn string) csr.CSRs
-	SelectByStatus(status string) csr.CSRs
-	SelectByID(id int) (csr.CSR, error)
-	UpdateByID(id int, c csr.CSR) (csr.CSR, error)
-	UpdateFilePath(c csr.CSR) error
-	Delete(id int) error
+	Insert(ctx context.Context, c csr.CSR) (int, error)
+	SelectAll(ctx context.Context) (csr.CSRs, error)
+	SelectAllByCN(ctx context.Context, cn string) (csr.CSRs, error)
+	SelectByStatus(ctx context.Context, status string) (csr.CSRs, error)
+	SelectByID(ctx context.Context, id int) (csr.CSR, error)
+	SelectByOperation(ctx context.Context, operationID int) (csr.CSR, error)
+	UpdateByID(ctx context.Context, id int, c csr.CSR) (csr.CSR, error)
+	UpdateStatus(ctx context.Context, id int, from string, to string) error
+	Transition(ctx context.Context, id int, from string, to string, fn func() error) error
+	UpdateFilePath(ctx context.Context, c csr.CSR) error
+	Delete(ctx context.Context, id int) error
 }
 
+// File stores the PKCS#10 bytes of the CSRs. Missing data is not found and
+// inserting data for a CSR that already has it is a conflict.
 type File interface {
-	Insert(id int, data []byte) error
-	SelectByID(id int) ([]byte, error)
-	Delete(id int) error
+	Insert(ctx context.Context, id int, data []byte) error
+	SelectByID(ctx context.Context, id int) ([]byte, error)
+	SelectIDs(ctx context.Context) ([]int, error)
+	Delete(ctx context.Context, id int) error
 }
@@ -0,0 +1,332 @@
+// Package storetest contains the conformance tests that every CSR store
+// implementation must pass. The tests only rely on the CSRs they create, so
+// they can be run against shared databases and directories.
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/models/csr"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/csr/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
+)
+
+// missingID is an ID no store is expected to have.
+const missingID = 2147483000
+
+// RandomID returns an ID, below missingID, that is unlikely to be in use.
+func RandomID() int {
+	return missingID - 1 - random.Intn(1000000)
+}
+
+var random = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+var ctx = context.Background()
+
+func testCSR(cn string, status string) csr.CSR {
+	return csr.CSR{
+		CountryName:            "ES",
+		StateOrProvinceName:    "Gipuzkoa",
+		LocalityName:           "Arrasate",
+		OrganizationName:       "Test",
+		OrganizationalUnitName: "Enroller",
+		CommonName:             cn,
+		EmailAddress:           "test@test.com",
+		Status:                 status,
+	}
+}
+
+func uniqueCN() string {
+	return "storetest-" + strconv.FormatInt(random.Int63(), 36) + ".com"
+}
+
+func insert(t *testing.T, db store.DB, c csr.CSR) int {
+	t.Helper()
+	id, err := db.Insert(ctx, c)
+	if err != nil {
+		t.Fatalf("Insert: %s", err)
+	}
+	return id
+}
+
+func cleanup(db store.DB, ids ...int) {
+	for _, id := range ids {
+		db.Delete(ctx, id)
+	}
+}
+
+func ids(t *testing.T, csrs csr.CSRs, err error) map[int]csr.CSR {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("Select: %s", err)
+	}
+	m := make(map[int]csr.CSR)
+	for _, c := range csrs.CSRs {
+		m[c.Id] = c
+	}
+	return m
+}
+
+// isStatusConflict reports whether err is a conflict caused by the CSR
+// status.
+func isStatusConflict(err error) bool {
+	return storeerr.IsConflict(err) && errors.Is(err, store.ErrStatusConflict)
+}
+
+// TestDB checks that db behaves as the CSR database store: IDs are assigned
+// on Insert, missing CSRs are reported as not found and status changes fail
+// with a store.ErrStatusConflict conflict when the CSR is in another status.
+func TestDB(t *testing.T, db store.DB) {
+	t.Run("Insert and select", func(t *testing.T) {
+		c := testCSR(uniqueCN(), csr.PendingStatus)
+		c.CsrFilePath = "/tmp/csrs/1.csr"
+		id := insert(t, db, c)
+		other := insert(t, db, testCSR(uniqueCN(), csr.PendingStatus))
+		defer cleanup(db, id, other)
+
+		if id == other {
+			t.Fatalf("Insert returned ID %d twice", id)
+		}
+		got, err := db.SelectByID(ctx, id)
+		if err != nil {
+			t.Fatalf("SelectByID: %s", err)
+		}
+		c.Id = id
+		if got != c {
+			t.Errorf("SelectByID = %+v, want %+v", got, c)
+		}
+		all, err := db.SelectAll(ctx)
+		if _, ok := ids(t, all, err)[id]; !ok {
+			t.Errorf("SelectAll does not return CSR %d", id)
+		}
+		if _, err := db.SelectByID(ctx, missingID); !storeerr.IsNotFound(err) {
+			t.Errorf("SelectByID of missing CSR returned %v, want a not found error", err)
+		}
+	})
+
+	t.Run("Select by CN and status", func(t *testing.T) {
+		cn := uniqueCN()
+		pending := insert(t, db, testCSR(cn, csr.PendingStatus))
+		denied := insert(t, db, testCSR(cn, csr.DeniedStatus))
+		other := insert(t, db, testCSR(uniqueCN(), csr.PendingStatus))
+		defer cleanup(db, pending, denied, other)
+
+		byCN, err := db.SelectAllByCN(ctx, cn)
+		byCNIDs := ids(t, byCN, err)
+		if len(byCNIDs) != 2 {
+			t.Errorf("SelectAllByCN returned %d CSRs, want 2", len(byCNIDs))
+		}
+		if _, ok := byCNIDs[other]; ok {
+			t.Errorf("SelectAllByCN returned CSR %d with another CN", other)
+		}
+		byStatus, err := db.SelectByStatus(ctx, csr.PendingStatus)
+		byStatusIDs := ids(t, byStatus, err)
+		if _, ok := byStatusIDs[pending]; !ok {
+			t.Errorf("SelectByStatus does not return pending CSR %d", pending)
+		}
+		for id, c := range byStatusIDs {
+			if c.Status != csr.PendingStatus {
+				t.Errorf("SelectByStatus returned CSR %d with status %s", id, c.Status)
+			}
+		}
+	})
+
+	t.Run("Select by operation", func(t *testing.T) {
+		operationID := RandomID()
+		c := testCSR(uniqueCN(), csr.PendingStatus)
+		c.OperationID = operationID
+		id := insert(t, db, c)
+		other := insert(t, db, testCSR(uniqueCN(), csr.PendingStatus))
+		defer cleanup(db, id, other)
+
+		got, err := db.SelectByOperation(ctx, operationID)
+		if err != nil {
+			t.Fatalf("SelectByOperation: %s", err)
+		}
+		if got.Id != id {
+			t.Errorf("SelectByOperation returned CSR %d, want %d", got.Id, id)
+		}
+		if _, err := db.SelectByOperation(ctx, missingID); !storeerr.IsNotFound(err) {
+			t.Errorf("SelectByOperation of missing operation returned %v, want a not found error", err)
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		id := insert(t, db, testCSR(uniqueCN(), csr.PendingStatus))
+		defer cleanup(db, id)
+
+		if _, err := db.UpdateByID(ctx, id, csr.CSR{Status: csr.DeniedStatus}); err != nil {
+			t.Errorf("UpdateByID: %s", err)
+		}
+		c := testCSR("", "")
+		c.Id = id
+		c.CsrFilePath = "/tmp/csrs/2.csr"
+		if err := db.UpdateFilePath(ctx, c); err != nil {
+			t.Errorf("UpdateFilePath: %s", err)
+		}
+		got, err := db.SelectByID(ctx, id)
+		if err != nil {
+			t.Fatalf("SelectByID: %s", err)
+		}
+		if got.Status != csr.DeniedStatus || got.CsrFilePath != c.CsrFilePath {
+			t.Errorf("SelectByID after updates = %+v", got)
+		}
+
+		if _, err := db.UpdateByID(ctx, missingID, csr.CSR{Status: csr.DeniedStatus}); !storeerr.IsNotFound(err) {
+			t.Errorf("UpdateByID of missing CSR returned %v, want a not found error", err)
+		}
+		c.Id = missingID
+		if err := db.UpdateFilePath(ctx, c); !storeerr.IsNotFound(err) {
+			t.Errorf("UpdateFilePath of missing CSR returned %v, want a not found error", err)
+		}
+	})
+
+	t.Run("Update status", func(t *testing.T) {
+		id := insert(t, db, testCSR(uniqueCN(), csr.PendingStatus))
+		defer cleanup(db, id)
+
+		if err := db.UpdateStatus(ctx, id, csr.PendingStatus, csr.DeniedStatus); err != nil {
+			t.Errorf("UpdateStatus: %s", err)
+		}
+		if err := db.UpdateStatus(ctx, id, csr.PendingStatus, csr.ApprobedStatus); !isStatusConflict(err) {
+			t.Errorf("UpdateStatus from wrong status returned %v, want a status conflict", err)
+		}
+		if got, _ := db.SelectByID(ctx, id); got.Status != csr.DeniedStatus {
+			t.Errorf("status = %s, want %s", got.Status, csr.DeniedStatus)
+		}
+		if err := db.UpdateStatus(ctx, missingID, csr.PendingStatus, csr.DeniedStatus); !storeerr.IsNotFound(err) {
+			t.Errorf("UpdateStatus of missing CSR returned %v, want a not found error", err)
+		}
+	})
+
+	t.Run("Transition", func(t *testing.T) {
+		id := insert(t, db, testCSR(uniqueCN(), csr.PendingStatus))
+		defer cleanup(db, id)
+
+		errFn := errors.New("transition failed")
+		if err := db.Transition(ctx, id, csr.PendingStatus, csr.ApprobedStatus, func() error { return errFn }); err != errFn {
+			t.Errorf("Transition returned %v, want the function error", err)
+		}
+		if got, _ := db.SelectByID(ctx, id); got.Status != csr.PendingStatus {
+			t.Errorf("status after failed transition = %s, want %s", got.Status, csr.PendingStatus)
+		}
+
+		called := false
+		if err := db.Transition(ctx, id, csr.PendingStatus, csr.ApprobedStatus, func() error { called = true; return nil }); err != nil {
+			t.Errorf("Transition: %s", err)
+		}
+		if !called {
+			t.Error("Transition did not run the function")
+		}
+		if got, _ := db.SelectByID(ctx, id); got.Status != csr.ApprobedStatus {
+			t.Errorf("status after transition = %s, want %s", got.Status, csr.ApprobedStatus)
+		}
+
+		called = false
+		if err := db.Transition(ctx, id, csr.PendingStatus, csr.ApprobedStatus, func() error { called = true; return nil }); !isStatusConflict(err) {
+			t.Errorf("Transition from wrong status returned %v, want a status conflict", err)
+		}
+		if called {
+			t.Error("Transition from wrong status ran the function")
+		}
+		if err := db.Transition(ctx, missingID, csr.PendingStatus, csr.ApprobedStatus, func() error { return nil }); !storeerr.IsNotFound(err) {
+			t.Errorf("Transition of missing CSR returned %v, want a not found error", err)
+		}
+	})
+
+	t.Run("Concurrent transitions", func(t *testing.T) {
+		id := insert(t, db, testCSR(uniqueCN(), csr.PendingStatus))
+		defer cleanup(db, id)
+
+		const n = 5
+		errs := make(chan error, n)
+		for i := 0; i < n; i++ {
+			go func() {
+				errs <- db.Transition(ctx, id, csr.PendingStatus, csr.ApprobedStatus, func() error {
+					time.Sleep(10 * time.Millisecond)
+					return nil
+				})
+			}()
+		}
+		succeeded := 0
+		for i := 0; i < n; i++ {
+			err := <-errs
+			switch {
+			case err == nil:
+				succeeded++
+			case !isStatusConflict(err):
+				t.Errorf("Transition: %s", err)
+			}
+		}
+		if succeeded != 1 {
+			t.Errorf("%d concurrent transitions succeeded, want 1", succeeded)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		id := insert(t, db, testCSR(uniqueCN(), csr.PendingStatus))
+		if err := db.Delete(ctx, id); err != nil {
+			t.Fatalf("Delete: %s", err)
+		}
+		if _, err := db.SelectByID(ctx, id); !storeerr.IsNotFound(err) {
+			t.Errorf("SelectByID of deleted CSR returned %v, want a not found error", err)
+		}
+		if err := db.Delete(ctx, id); !storeerr.IsNotFound(err) {
+			t.Errorf("Delete of deleted CSR returned %v, want a not found error", err)
+		}
+	})
+}
+
+// TestFile checks that f behaves as the CSR file store: data is returned as
+// inserted, inserting an existing CSR is a conflict and missing CSRs are
+// not found. No data must be stored for id yet.
+func TestFile(t *testing.T, f store.File, id int) {
+	data := []byte("-----BEGIN CERTIFICATE REQUEST-----\nstoretest\n-----END CERTIFICATE REQUEST-----\n")
+
+	if err := f.Insert(ctx, id, data); err != nil {
+		t.Fatalf("Insert: %s", err)
+	}
+	defer f.Delete(ctx, id)
+
+	got, err := f.SelectByID(ctx, id)
+	if err != nil {
+		t.Fatalf("SelectByID: %s", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("SelectByID = %q, want %q", got, data)
+	}
+	if err := f.Insert(ctx, id, []byte("other")); !storeerr.IsConflict(err) {
+		t.Errorf("Insert of existing CSR returned %v, want a conflict", err)
+	}
+	if got, _ := f.SelectByID(ctx, id); !bytes.Equal(got, data) {
+		t.Error("Insert of existing CSR overwrote its data")
+	}
+
+	stored, err := f.SelectIDs(ctx)
+	if err != nil {
+		t.Fatalf("SelectIDs: %s", err)
+	}
+	found := false
+	for _, storedID := range stored {
+		found = found || storedID == id
+	}
+	if !found {
+		t.Errorf("SelectIDs does not return CSR %d", id)
+	}
+
+	if err := f.Delete(ctx, id); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	if _, err := f.SelectByID(ctx, id); !storeerr.IsNotFound(err) {
+		t.Errorf("SelectByID of deleted CSR returned %v, want a not found error", err)
+	}
+	if err := f.Delete(ctx, id); !storeerr.IsNotFound(err) {
+		t.Errorf("Delete of deleted CSR returned %v, want a not found error", err)
+	}
+}
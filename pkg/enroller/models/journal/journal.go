@@ -0,0 +1,22 @@
+package journal
+
+import "time"
+
+// Operation is an entry of the journal of multi-store operations. An entry
+// exists while the operation is in progress and is removed once it has
+// been fully committed or rolled back. The replica running the operation
+// refreshes its Heartbeat until then.
+type Operation struct {
+	ID        int
+	Kind      string
+	CSRID     int
+	Created   time.Time
+	Heartbeat time.Time
+}
+
+const (
+	PostCSR    = "POST_CSR"
+	ApprobeCSR = "APPROBE_CSR"
+	DeleteCSR  = "DELETE_CSR"
+	RevokeCert = "REVOKE_CERT"
+)
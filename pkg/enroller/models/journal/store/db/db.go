@@ -0,0 +1,149 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+
+	"github.com/lamassuiot/enroller/pkg/database"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/journal"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/journal/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	_ "github.com/lib/pq"
+)
+
+func NewDB(ctx context.Context, driverName string, dataSourceName string, opts database.Options, logger log.Logger) (store.DB, error) {
+	db, err := database.Open(ctx, driverName, dataSourceName, opts, logger)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not open connection with operations journal database")
+		return nil, storeerr.Classify(err)
+	}
+	return &DB{db, logger}, nil
+}
+
+type DB struct {
+	*sql.DB
+	logger log.Logger
+}
+
+func (db *DB) Insert(ctx context.Context, op journal.Operation) (int, error) {
+	id := 0
+	sqlStatement := `
+	INSERT INTO operation_log(kind, csrId)
+	VALUES($1, $2)
+	RETURNING id;
+	`
+	err := db.QueryRowContext(ctx, sqlStatement, op.Kind, op.CSRID).Scan(&id)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not insert "+op.Kind+" operation in journal")
+		return -1, storeerr.Classify(err)
+	}
+	level.Info(db.logger).Log("msg", op.Kind+" operation with ID "+strconv.Itoa(id)+" inserted in journal")
+	return id, nil
+}
+
+func (db *DB) UpdateCSRID(ctx context.Context, id int, csrID int) error {
+	sqlStatement := `
+	UPDATE operation_log
+	SET csrId = $1
+	WHERE id = $2;
+	`
+	res, err := db.ExecContext(ctx, sqlStatement, csrID, id)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not update operation with ID "+strconv.Itoa(id)+" CSR ID to "+strconv.Itoa(csrID))
+		return storeerr.Classify(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not update operation with ID "+strconv.Itoa(id)+" CSR ID to "+strconv.Itoa(csrID))
+		return storeerr.Classify(err)
+	}
+	if count <= 0 {
+		err = sql.ErrNoRows
+		level.Error(db.logger).Log("err", err)
+		return storeerr.Classify(err)
+	}
+	return nil
+}
+
+func (db *DB) Heartbeat(ctx context.Context, id int) error {
+	sqlStatement := `
+	UPDATE operation_log
+	SET heartbeat = now()
+	WHERE id = $1;
+	`
+	res, err := db.ExecContext(ctx, sqlStatement, id)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not refresh heartbeat of operation with ID "+strconv.Itoa(id))
+		return storeerr.Classify(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not refresh heartbeat of operation with ID "+strconv.Itoa(id))
+		return storeerr.Classify(err)
+	}
+	if count <= 0 {
+		err = sql.ErrNoRows
+		level.Error(db.logger).Log("err", err)
+		return storeerr.Classify(err)
+	}
+	return nil
+}
+
+func (db *DB) SelectAll(ctx context.Context) ([]journal.Operation, error) {
+	sqlStatement := `
+	SELECT id, kind, csrId, created, heartbeat
+	FROM operation_log
+	ORDER BY id;
+	`
+	rows, err := db.QueryContext(ctx, sqlStatement)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not obtain operations from journal")
+		return nil, storeerr.Classify(err)
+	}
+	defer rows.Close()
+	ops := make([]journal.Operation, 0)
+
+	for rows.Next() {
+		var op journal.Operation
+		err := rows.Scan(&op.ID, &op.Kind, &op.CSRID, &op.Created, &op.Heartbeat)
+		if err != nil {
+			level.Error(db.logger).Log("err", err, "msg", "Unable to read journal operation row")
+			return nil, storeerr.Classify(err)
+		}
+		ops = append(ops, op)
+	}
+	if err = rows.Err(); err != nil {
+		level.Error(db.logger).Log("err", err)
+		return nil, storeerr.Classify(err)
+	}
+	level.Info(db.logger).Log("msg", strconv.Itoa(len(ops))+" operations read from journal")
+	return ops, nil
+}
+
+func (db *DB) Delete(ctx context.Context, id int) error {
+	sqlStatement := `
+	DELETE FROM operation_log
+	WHERE id = $1;
+	`
+	res, err := db.ExecContext(ctx, sqlStatement, id)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not delete operation with ID "+strconv.Itoa(id)+" from journal")
+		return storeerr.Classify(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not delete operation with ID "+strconv.Itoa(id)+" from journal")
+		return storeerr.Classify(err)
+	}
+	if count <= 0 {
+		err = sql.ErrNoRows
+		level.Error(db.logger).Log("err", err)
+		return storeerr.Classify(err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+// Package memory implements the operations journal in memory, for tests and
+// for embedding the enroller service without a database.
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/models/journal"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/journal/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
+)
+
+type DB struct {
+	mu     sync.Mutex
+	lastID int
+	ops    map[int]journal.Operation
+}
+
+func NewDB() store.DB {
+	return &DB{ops: make(map[int]journal.Operation)}
+}
+
+func (db *DB) Insert(ctx context.Context, op journal.Operation) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.lastID++
+	op.ID = db.lastID
+	op.Created = time.Now()
+	op.Heartbeat = op.Created
+	db.ops[op.ID] = op
+	return op.ID, nil
+}
+
+func (db *DB) UpdateCSRID(ctx context.Context, id int, csrID int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	op, ok := db.ops[id]
+	if !ok {
+		return storeerr.NotFound(sql.ErrNoRows)
+	}
+	op.CSRID = csrID
+	db.ops[id] = op
+	return nil
+}
+
+func (db *DB) Heartbeat(ctx context.Context, id int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	op, ok := db.ops[id]
+	if !ok {
+		return storeerr.NotFound(sql.ErrNoRows)
+	}
+	op.Heartbeat = time.Now()
+	db.ops[id] = op
+	return nil
+}
+
+func (db *DB) SelectAll(ctx context.Context) ([]journal.Operation, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	ops := make([]journal.Operation, 0, len(db.ops))
+	for _, op := range db.ops {
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].ID < ops[j].ID })
+	return ops, nil
+}
+
+func (db *DB) Delete(ctx context.Context, id int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.ops[id]; !ok {
+		return storeerr.NotFound(sql.ErrNoRows)
+	}
+	delete(db.ops, id)
+	return nil
+}
@@ -0,0 +1,61 @@
+package sqlite
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/models/journal"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/migrations"
+	"github.com/lamassuiot/enroller/pkg/migrate"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enroller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := NewDB("file:"+dir+"/enroller.db?_pragma=foreign_keys(1)", log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrate.NewMigrator(db.(*DB).DB, "sqlite", migrations.SQLite, log.NewNopLogger()).Up(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	id, err := db.Insert(ctx, journal.Operation{Kind: journal.PostCSR})
+	if err != nil {
+		t.Fatalf("Insert: %s", err)
+	}
+	if err := db.UpdateCSRID(ctx, id, 7); err != nil {
+		t.Fatalf("UpdateCSRID: %s", err)
+	}
+	if err := db.Heartbeat(ctx, id); err != nil {
+		t.Fatalf("Heartbeat: %s", err)
+	}
+	ops, err := db.SelectAll(ctx)
+	if err != nil {
+		t.Fatalf("SelectAll: %s", err)
+	}
+	if len(ops) != 1 || ops[0].ID != id || ops[0].Kind != journal.PostCSR || ops[0].CSRID != 7 {
+		t.Fatalf("SelectAll = %+v", ops)
+	}
+	if age := time.Since(ops[0].Created); age < 0 || age > time.Minute {
+		t.Errorf("operation created %s ago", age)
+	}
+	if ops[0].Heartbeat.Before(ops[0].Created) {
+		t.Errorf("operation heartbeat %s before its creation %s", ops[0].Heartbeat, ops[0].Created)
+	}
+	if err := db.Delete(ctx, id); err != nil {
+		t.Errorf("Delete: %s", err)
+	}
+	if err := db.Delete(ctx, id); err == nil {
+		t.Error("Delete of deleted operation succeeded")
+	}
+}
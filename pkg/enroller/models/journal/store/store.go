@@ -0,0 +1,17 @@
+package store
+
+import (
+	"context"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/models/journal"
+)
+
+// DB stores the operations journal. Errors are classified with the
+// storeerr package.
+type DB interface {
+	Insert(ctx context.Context, op journal.Operation) (int, error)
+	UpdateCSRID(ctx context.Context, id int, csrID int) error
+	Heartbeat(ctx context.Context, id int) error
+	SelectAll(ctx context.Context) ([]journal.Operation, error)
+	Delete(ctx context.Context, id int) error
+}
@@ -0,0 +1,238 @@
+// Package migrations holds the enroller database schema for each supported
+// driver, as migrations to be applied with the migrate package.
+//
+// The first migration creates the tables as they were before migrations
+// existed and only adds what is missing, so existing installations are
+// adopted without changes before the following migrations run.
+package migrations
+
+import (
+	"errors"
+
+	"github.com/lamassuiot/enroller/pkg/migrate"
+)
+
+// ForDriver returns the migrations for the named database driver.
+func ForDriver(driver string) ([]migrate.Migration, error) {
+	switch driver {
+	case "postgres":
+		return Postgres, nil
+	case "sqlite":
+		return SQLite, nil
+	default:
+		return nil, errors.New("no migrations for database driver " + driver)
+	}
+}
+
+var Postgres = []migrate.Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up: `
+		CREATE TABLE IF NOT EXISTS csr_store (
+			id SERIAL,
+			c TEXT,
+			st TEXT,
+			l TEXT,
+			o TEXT,
+			ou TEXT,
+			cn TEXT,
+			email TEXT,
+			status TEXT,
+			csrPath TEXT
+		);
+		ALTER TABLE csr_store ADD COLUMN IF NOT EXISTS csrData BYTEA;
+
+		CREATE TABLE IF NOT EXISTS ca_store (
+			id INTEGER,
+			status CHAR(1),
+			expirationDate TEXT,
+			revocationDate TEXT,
+			serial TEXT,
+			dn TEXT,
+			certPath TEXT
+		);
+		ALTER TABLE ca_store ADD COLUMN IF NOT EXISTS issuer TEXT;
+		ALTER TABLE ca_store ADD COLUMN IF NOT EXISTS certData BYTEA;
+		CREATE UNIQUE INDEX IF NOT EXISTS ca_store_issuer_serial_key ON ca_store (issuer, serial);
+
+		CREATE TABLE IF NOT EXISTS operation_log (
+			id SERIAL,
+			kind TEXT,
+			csrId INTEGER,
+			created TIMESTAMP WITH TIME ZONE DEFAULT now()
+		);
+		`,
+		Down: `
+		DROP TABLE IF EXISTS operation_log;
+		DROP TABLE IF EXISTS ca_store;
+		DROP TABLE IF EXISTS csr_store;
+		`,
+	},
+	{
+		// Certificates keep their ID, which is the ID of the CSR they were
+		// issued for, and get a csrId reference to it. The reference is
+		// cleared rather than cascaded when the CSR is deleted, so revoked
+		// certificates stay in the CRL.
+		Version: 2,
+		Name:    "keys and indexes",
+		Up: `
+		ALTER TABLE csr_store ADD CONSTRAINT csr_store_pkey PRIMARY KEY (id);
+		ALTER TABLE csr_store ALTER COLUMN status SET NOT NULL;
+		CREATE INDEX csr_store_status_idx ON csr_store (status);
+		CREATE INDEX csr_store_cn_idx ON csr_store (cn);
+
+		ALTER TABLE ca_store ADD CONSTRAINT ca_store_pkey PRIMARY KEY (id);
+		ALTER TABLE ca_store ALTER COLUMN status SET NOT NULL;
+		ALTER TABLE ca_store ALTER COLUMN serial SET NOT NULL;
+		ALTER TABLE ca_store ADD COLUMN csrId INTEGER;
+		UPDATE ca_store SET csrId = id WHERE id IN (SELECT id FROM csr_store);
+		ALTER TABLE ca_store ADD CONSTRAINT ca_store_csrid_fkey FOREIGN KEY (csrId) REFERENCES csr_store (id) ON DELETE SET NULL;
+		CREATE INDEX ca_store_csrid_idx ON ca_store (csrId);
+
+		ALTER TABLE operation_log ADD CONSTRAINT operation_log_pkey PRIMARY KEY (id);
+		ALTER TABLE operation_log ALTER COLUMN kind SET NOT NULL;
+		`,
+		Down: `
+		ALTER TABLE operation_log ALTER COLUMN kind DROP NOT NULL;
+		ALTER TABLE operation_log DROP CONSTRAINT operation_log_pkey;
+
+		ALTER TABLE ca_store DROP COLUMN csrId;
+		ALTER TABLE ca_store ALTER COLUMN serial DROP NOT NULL;
+		ALTER TABLE ca_store ALTER COLUMN status DROP NOT NULL;
+		ALTER TABLE ca_store DROP CONSTRAINT ca_store_pkey;
+
+		DROP INDEX csr_store_cn_idx;
+		DROP INDEX csr_store_status_idx;
+		ALTER TABLE csr_store ALTER COLUMN status DROP NOT NULL;
+		ALTER TABLE csr_store DROP CONSTRAINT csr_store_pkey;
+		`,
+	},
+	{
+		// Certificates issued before several CAs could be configured
+		// keep an empty CA.
+		Version: 3,
+		Name:    "issuing CA",
+		Up:      `ALTER TABLE ca_store ADD COLUMN ca TEXT;`,
+		Down:    `ALTER TABLE ca_store DROP COLUMN ca;`,
+	},
+	{
+		// CSRs record the journal operation that inserted them, so that
+		// Recover finds the row even if the operation was interrupted
+		// before getting its ID.
+		Version: 4,
+		Name:    "CSR operation",
+		Up:      `ALTER TABLE csr_store ADD COLUMN operationId INTEGER;`,
+		Down:    `ALTER TABLE csr_store DROP COLUMN operationId;`,
+	},
+	{
+		Version: 5,
+		Name:    "operation heartbeat",
+		Up:      `ALTER TABLE operation_log ADD COLUMN heartbeat TIMESTAMP WITH TIME ZONE DEFAULT now();`,
+		Down:    `ALTER TABLE operation_log DROP COLUMN heartbeat;`,
+	},
+}
+
+var SQLite = []migrate.Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up: `
+		CREATE TABLE IF NOT EXISTS csr_store (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			c TEXT,
+			st TEXT,
+			l TEXT,
+			o TEXT,
+			ou TEXT,
+			cn TEXT,
+			email TEXT,
+			status TEXT,
+			csrPath TEXT,
+			csrData BLOB
+		);
+
+		CREATE TABLE IF NOT EXISTS ca_store (
+			id INTEGER PRIMARY KEY,
+			status CHAR(1),
+			expirationDate TEXT,
+			revocationDate TEXT,
+			serial TEXT,
+			dn TEXT,
+			certPath TEXT,
+			issuer TEXT,
+			certData BLOB,
+			UNIQUE (issuer, serial)
+		);
+
+		CREATE TABLE IF NOT EXISTS operation_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			kind TEXT,
+			csrId INTEGER,
+			created TIMESTAMP
+		);
+		`,
+		Down: `
+		DROP TABLE IF EXISTS operation_log;
+		DROP TABLE IF EXISTS ca_store;
+		DROP TABLE IF EXISTS csr_store;
+		`,
+	},
+	{
+		// SQLite can not drop a column with a foreign key, so Down rebuilds
+		// ca_store without it.
+		Version: 2,
+		Name:    "keys and indexes",
+		Up: `
+		CREATE INDEX csr_store_status_idx ON csr_store (status);
+		CREATE INDEX csr_store_cn_idx ON csr_store (cn);
+
+		ALTER TABLE ca_store ADD COLUMN csrId INTEGER REFERENCES csr_store (id) ON DELETE SET NULL;
+		UPDATE ca_store SET csrId = id WHERE id IN (SELECT id FROM csr_store);
+		CREATE INDEX ca_store_csrid_idx ON ca_store (csrId);
+		`,
+		Down: `
+		CREATE TABLE ca_store_old (
+			id INTEGER PRIMARY KEY,
+			status CHAR(1),
+			expirationDate TEXT,
+			revocationDate TEXT,
+			serial TEXT,
+			dn TEXT,
+			certPath TEXT,
+			issuer TEXT,
+			certData BLOB,
+			UNIQUE (issuer, serial)
+		);
+		INSERT INTO ca_store_old
+		SELECT id, status, expirationDate, revocationDate, serial, dn, certPath, issuer, certData
+		FROM ca_store;
+		DROP TABLE ca_store;
+		ALTER TABLE ca_store_old RENAME TO ca_store;
+
+		DROP INDEX csr_store_cn_idx;
+		DROP INDEX csr_store_status_idx;
+		`,
+	},
+	{
+		Version: 3,
+		Name:    "issuing CA",
+		Up:      `ALTER TABLE ca_store ADD COLUMN ca TEXT;`,
+		Down:    `ALTER TABLE ca_store DROP COLUMN ca;`,
+	},
+	{
+		Version: 4,
+		Name:    "CSR operation",
+		Up:      `ALTER TABLE csr_store ADD COLUMN operationId INTEGER;`,
+		Down:    `ALTER TABLE csr_store DROP COLUMN operationId;`,
+	},
+	{
+		Version: 5,
+		Name:    "operation heartbeat",
+		Up: `
+		ALTER TABLE operation_log ADD COLUMN heartbeat TIMESTAMP;
+		UPDATE operation_log SET heartbeat = created;
+		`,
+		Down: `ALTER TABLE operation_log DROP COLUMN heartbeat;`,
+	},
+}
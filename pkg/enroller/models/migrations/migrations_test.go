@@ -0,0 +1,70 @@
+package migrations
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/lamassuiot/enroller/pkg/migrate"
+
+	"github.com/go-kit/kit/log"
+
+	_ "modernc.org/sqlite"
+)
+
+// TestSQLite adopts a database created before migrations existed, checks
+// the keys added on top of it and reverts them without losing data.
+func TestSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enroller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := sql.Open("sqlite", "file:"+dir+"/enroller.db?_pragma=foreign_keys(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(SQLite[0].Up); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+	INSERT INTO csr_store(id, cn, status) VALUES(1, 'a', 'REVOKED'), (2, 'b', 'APPROBED');
+	INSERT INTO ca_store(id, status, serial, issuer) VALUES(1, 'R', '01', 'CA'), (2, 'V', '02', 'CA'), (3, 'V', '03', 'CA');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := migrate.NewMigrator(db, "sqlite", SQLite, log.NewNopLogger())
+	if _, err := m.Up(); err != nil {
+		t.Fatalf("Up: %s", err)
+	}
+	var linked int
+	if err := db.QueryRow(`SELECT count(*) FROM ca_store WHERE csrId = id;`).Scan(&linked); err != nil || linked != 2 {
+		t.Fatalf("certificates linked to their CSR = %d, %v", linked, err)
+	}
+	if _, err := db.Exec(`INSERT INTO ca_store(id, csrId, status, serial, issuer) VALUES(4, 4, 'V', '04', 'CA');`); err == nil {
+		t.Error("certificate referencing a missing CSR inserted")
+	}
+	if _, err := db.Exec(`DELETE FROM csr_store WHERE id = 1;`); err != nil {
+		t.Fatal(err)
+	}
+	var csrID sql.NullInt64
+	if err := db.QueryRow(`SELECT csrId FROM ca_store WHERE id = 1;`).Scan(&csrID); err != nil || csrID.Valid {
+		t.Fatalf("revoked certificate csrId = %v, %v", csrID, err)
+	}
+
+	if _, err := m.Down(1); err != nil {
+		t.Fatalf("Down: %s", err)
+	}
+	var certs int
+	if err := db.QueryRow(`SELECT count(*) FROM ca_store;`).Scan(&certs); err != nil || certs != 3 {
+		t.Fatalf("certificates after Down = %d, %v", certs, err)
+	}
+	if _, err := m.Up(); err != nil {
+		t.Fatalf("Up after Down: %s", err)
+	}
+}
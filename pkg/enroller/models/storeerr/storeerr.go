@@ -0,0 +1,83 @@
+// Package storeerr classifies the errors returned by the stores, so that
+// callers can tell a missing record or a conflicting write from a store
+// that can not be reached without knowing the backend.
+package storeerr
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"os"
+)
+
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrConflict    = errors.New("conflict")
+	ErrUnavailable = errors.New("store unavailable")
+)
+
+// Error is a store error of a given kind. errors.Is reports true for both
+// the kind and the backend error it wraps.
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+func NotFound(err error) error {
+	return &Error{Kind: ErrNotFound, Err: err}
+}
+
+func Conflict(err error) error {
+	return &Error{Kind: ErrConflict, Err: err}
+}
+
+func Unavailable(err error) error {
+	return &Error{Kind: ErrUnavailable, Err: err}
+}
+
+// Classify wraps err with its kind when it can be told from the error
+// alone: missing rows and files are not found, existing files are
+// conflicts, and cancelled requests and connection failures mean the
+// store is unavailable. Other errors are returned unchanged.
+func Classify(err error) error {
+	var storeErr *Error
+	var netErr net.Error
+	switch {
+	case err == nil || errors.As(err, &storeErr):
+		return err
+	case errors.Is(err, sql.ErrNoRows), errors.Is(err, os.ErrNotExist):
+		return NotFound(err)
+	case errors.Is(err, os.ErrExist):
+		return Conflict(err)
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, driver.ErrBadConn), errors.Is(err, sql.ErrConnDone), errors.As(err, &netErr):
+		return Unavailable(err)
+	}
+	return err
+}
+
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+func IsConflict(err error) bool {
+	return errors.Is(err, ErrConflict)
+}
+
+func IsUnavailable(err error) bool {
+	return errors.Is(err, ErrUnavailable)
+}
@@ -0,0 +1,37 @@
+package storeerr
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	backend := errors.New("syntax error")
+	for _, tc := range []struct {
+		err  error
+		kind error
+	}{
+		{sql.ErrNoRows, ErrNotFound},
+		{&os.PathError{Op: "open", Path: "1.csr", Err: os.ErrNotExist}, ErrNotFound},
+		{&os.PathError{Op: "open", Path: "1.csr", Err: os.ErrExist}, ErrConflict},
+		{fmt.Errorf("query: %w", context.DeadlineExceeded), ErrUnavailable},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, ErrUnavailable},
+		{Conflict(backend), ErrConflict},
+		{backend, nil},
+	} {
+		err := Classify(tc.err)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("Classify(%v) = %v, does not wrap the original error", tc.err, err)
+		}
+		for _, kind := range []error{ErrNotFound, ErrConflict, ErrUnavailable} {
+			if got := errors.Is(err, kind); got != (kind == tc.kind) {
+				t.Errorf("errors.Is(Classify(%v), %v) = %t", tc.err, kind, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/crypto"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
+)
+
+// Config holds the settings of an S3 compatible object store. Objects are
+// addressed path style (endpoint/bucket/key), which is what MinIO and most
+// on premises stores expect.
+type Config struct {
+	Endpoint     string
+	Region       string
+	Bucket       string
+	Prefix       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+
+	// SSE is sent as x-amz-server-side-encryption ("AES256" or "aws:kms")
+	// when not empty, along with SSEKMSKeyID for "aws:kms".
+	SSE         string
+	SSEKMSKeyID string
+
+	// CA is an optional PEM file used to trust the endpoint certificate.
+	CA string
+
+	MaxRetries int
+	RetryDelay time.Duration
+}
+
+// Client is a minimal S3 client supporting the operations the file stores
+// need. Missing objects are reported as os.ErrNotExist and existing ones on
+// exclusive puts as os.ErrExist, so stores behave like the file system.
+type Client struct {
+	cfg      Config
+	endpoint *url.URL
+	http     *http.Client
+	now      func() time.Time
+}
+
+var errRetryable = errors.New("retryable object store error")
+
+func NewClient(cfg Config) (*Client, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid object store endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("object store bucket is not configured")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.RetryDelay == 0 {
+		cfg.RetryDelay = 100 * time.Millisecond
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.CA != "" {
+		pool, err := crypto.CreateCAPool(cfg.CA)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &Client{
+		cfg:      cfg,
+		endpoint: endpoint,
+		http:     &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		now:      time.Now,
+	}, nil
+}
+
+// Put stores data under key. If exclusive is set the object must not exist
+// yet, which is checked by the store with a conditional write.
+func (c *Client) Put(ctx context.Context, key string, data []byte, exclusive bool) error {
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	if exclusive {
+		header.Set("If-None-Match", "*")
+	}
+	if c.cfg.SSE != "" {
+		header.Set("X-Amz-Server-Side-Encryption", c.cfg.SSE)
+		if c.cfg.SSEKMSKeyID != "" {
+			header.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", c.cfg.SSEKMSKeyID)
+		}
+	}
+	resp, body, err := c.do(ctx, http.MethodPut, c.cfg.Prefix+key, nil, header, data)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		return &os.PathError{Op: "put", Path: key, Err: os.ErrExist}
+	}
+	return responseError(resp, body)
+}
+
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, body, err := c.do(ctx, http.MethodGet, c.cfg.Prefix+key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return body, nil
+	case http.StatusNotFound:
+		return nil, &os.PathError{Op: "get", Path: key, Err: os.ErrNotExist}
+	}
+	return nil, responseError(resp, body)
+}
+
+// Delete removes the object stored under key. S3 deletes succeed for
+// missing objects, so their existence is checked first.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	resp, body, err := c.do(ctx, http.MethodHead, c.cfg.Prefix+key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return &os.PathError{Op: "delete", Path: key, Err: os.ErrNotExist}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp, body)
+	}
+	resp, body, err = c.do(ctx, http.MethodDelete, c.cfg.Prefix+key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return responseError(resp, body)
+	}
+	return nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List returns the keys, without the configured prefix, of the objects
+// whose key starts with prefix.
+func (c *Client) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", c.cfg.Prefix+prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, body, err := c.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, responseError(resp, body)
+		}
+		var result listBucketResult
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, err
+		}
+		for _, object := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(object.Key, c.cfg.Prefix))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// do sends a signed request, retrying with exponential backoff on network
+// errors, throttling and server errors. Once the retries are exhausted the
+// error is reported as the store being unavailable.
+func (c *Client) do(ctx context.Context, method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, []byte, error) {
+	var err error
+	delay := c.cfg.RetryDelay
+	for attempt := 0; ; attempt++ {
+		var resp *http.Response
+		var data []byte
+		resp, data, err = c.send(ctx, method, key, query, header, body)
+		if err == nil {
+			return resp, data, nil
+		}
+		if !errors.Is(err, errRetryable) {
+			return nil, nil, err
+		}
+		if attempt >= c.cfg.MaxRetries {
+			return nil, nil, storeerr.Unavailable(err)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, storeerr.Unavailable(ctx.Err())
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+func (c *Client) send(ctx context.Context, method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, []byte, error) {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.cfg.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = ""
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	c.sign(req, body)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", errRetryable, err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", errRetryable, err)
+	}
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return nil, nil, fmt.Errorf("%w: %s", errRetryable, responseError(resp, data))
+	}
+	return resp, data, nil
+}
+
+const (
+	amzDateFormat = "20060102T150405Z"
+	signAlgorithm = "AWS4-HMAC-SHA256"
+)
+
+// sign adds an AWS Signature Version 4 Authorization header to req.
+func (c *Client) sign(req *http.Request, body []byte) {
+	now := c.now().UTC()
+	amzDate := now.Format(amzDateFormat)
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.cfg.SessionToken)
+	}
+
+	scope := now.Format("20060102") + "/" + c.cfg.Region + "/s3/aws4_request"
+	signedHeaders, canonicalHeaders := canonicalHeaders(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	stringToSign := strings.Join([]string{signAlgorithm, amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.cfg.SecretKey), now.Format("20060102"))
+	key = hmacSHA256(key, c.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", signAlgorithm+" Credential="+c.cfg.AccessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func canonicalHeaders(req *http.Request) (string, string) {
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + headers[name] + "\n")
+	}
+	return strings.Join(names, ";"), canonical.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	params := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range query[key] {
+			params = append(params, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// uriEncode encodes s as required by Signature Version 4, leaving '/'
+// unencoded in paths.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z') || (ch >= '0' && ch <= '9') ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' || (ch == '/' && !encodeSlash) {
+			b.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", ch)
+	}
+	return b.String()
+}
+
+func responseError(resp *http.Response, body []byte) error {
+	var s3Err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+		return fmt.Errorf("object store returned %s: %s: %s", resp.Status, s3Err.Code, s3Err.Message)
+	}
+	return fmt.Errorf("object store returned %s", resp.Status)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,243 @@
+package reconcile
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"sort"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/crypto"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/certs"
+	certstore "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store"
+	csrmodel "github.com/lamassuiot/enroller/pkg/enroller/models/csr"
+	csrstore "github.com/lamassuiot/enroller/pkg/enroller/models/csr/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	CSRRowWithoutFile  = "csr_row_without_file"
+	CSRFileWithoutRow  = "csr_file_without_row"
+	CSRPathMismatch    = "csr_path_mismatch"
+	CertRowWithoutFile = "cert_row_without_file"
+	CertFileWithoutRow = "cert_file_without_row"
+	CertPathMismatch   = "cert_path_mismatch"
+	CertInvalidFile    = "cert_invalid_file"
+	CertDataMismatch   = "cert_data_mismatch"
+)
+
+// Issue is an inconsistency between the database rows and the stored files
+// of a CSR or certificate.
+type Issue struct {
+	Kind       string
+	ID         int
+	Detail     string
+	Repairable bool
+}
+
+func (i Issue) String() string {
+	return fmt.Sprintf("%s id=%d %s", i.Kind, i.ID, i.Detail)
+}
+
+type Reconciler struct {
+	csrDBStore     csrstore.DB
+	csrFileStore   csrstore.File
+	certsDBStore   certstore.DB
+	certsFileStore certstore.File
+	homePath       string
+	checkPaths     bool
+	logger         log.Logger
+}
+
+// NewReconciler returns a Reconciler of the given stores. The file paths
+// recorded in the rows are only checked against homePath when checkPaths is
+// set, as they only locate the files of the filesystem file stores.
+func NewReconciler(csrDBStore csrstore.DB, csrFileStore csrstore.File, certsDBStore certstore.DB, certsFileStore certstore.File, homePath string, checkPaths bool, logger log.Logger) *Reconciler {
+	return &Reconciler{
+		csrDBStore:     csrDBStore,
+		csrFileStore:   csrFileStore,
+		certsDBStore:   certsDBStore,
+		certsFileStore: certsFileStore,
+		homePath:       homePath,
+		checkPaths:     checkPaths,
+		logger:         logger,
+	}
+}
+
+// Scan compares the csr_store and ca_store rows with the files kept in the
+// file stores and returns every inconsistency found, ordered by ID.
+func (r *Reconciler) Scan(ctx context.Context) ([]Issue, error) {
+	csrIssues, err := r.scanCSRs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	certIssues, err := r.scanCerts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	issues := append(csrIssues, certIssues...)
+	sort.SliceStable(issues, func(i, j int) bool { return issues[i].ID < issues[j].ID })
+	return issues, nil
+}
+
+func (r *Reconciler) scanCSRs(ctx context.Context) ([]Issue, error) {
+	var issues []Issue
+	rows, err := r.csrDBStore.SelectAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fileIDs, err := r.csrFileStore.SelectIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	files := toSet(fileIDs)
+
+	for _, c := range rows.CSRs {
+		if !files[c.Id] {
+			issues = append(issues, Issue{
+				Kind:       CSRRowWithoutFile,
+				ID:         c.Id,
+				Detail:     "status=" + c.Status,
+				Repairable: c.Status == csrmodel.PendingStatus,
+			})
+		}
+		delete(files, c.Id)
+		if path := csrmodel.FilePath(r.homePath, c.Id); r.checkPaths && c.CsrFilePath != path {
+			issues = append(issues, Issue{Kind: CSRPathMismatch, ID: c.Id, Detail: "csrPath=" + c.CsrFilePath + " want " + path, Repairable: true})
+		}
+	}
+	for id := range files {
+		issues = append(issues, Issue{Kind: CSRFileWithoutRow, ID: id, Repairable: true})
+	}
+	return issues, nil
+}
+
+func (r *Reconciler) scanCerts(ctx context.Context) ([]Issue, error) {
+	var issues []Issue
+	rows, err := r.certsDBStore.SelectAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fileIDs, err := r.certsFileStore.SelectIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	files := toSet(fileIDs)
+
+	for _, crt := range rows {
+		if path := certs.FilePath(r.homePath, crt.ID); r.checkPaths && crt.CertPath != path {
+			issues = append(issues, Issue{Kind: CertPathMismatch, ID: crt.ID, Detail: "certPath=" + crt.CertPath + " want " + path, Repairable: true})
+		}
+		if !files[crt.ID] {
+			issues = append(issues, Issue{Kind: CertRowWithoutFile, ID: crt.ID, Detail: fmt.Sprintf("serial=%x", crt.Serial)})
+			continue
+		}
+		delete(files, crt.ID)
+		cert, err := r.readCert(ctx, crt.ID)
+		if err != nil {
+			issues = append(issues, Issue{Kind: CertInvalidFile, ID: crt.ID, Detail: err.Error()})
+			continue
+		}
+		if detail := compareCert(crt, cert); detail != "" {
+			issues = append(issues, Issue{Kind: CertDataMismatch, ID: crt.ID, Detail: detail})
+		}
+	}
+	for id := range files {
+		issue := Issue{Kind: CertFileWithoutRow, ID: id, Repairable: true}
+		if _, err := r.readCert(ctx, id); err != nil {
+			issue.Detail = err.Error()
+			issue.Repairable = false
+		}
+		issues = append(issues, issue)
+	}
+	return issues, nil
+}
+
+// Repair fixes the repairable issues: pending CSRs without file and orphan
+// CSR files are removed, orphan certificate files get their row rebuilt from
+// the certificate and wrong paths are updated. It returns the issues it
+// could not repair.
+func (r *Reconciler) Repair(ctx context.Context, issues []Issue) []Issue {
+	var left []Issue
+	for _, issue := range issues {
+		if !issue.Repairable {
+			left = append(left, issue)
+			continue
+		}
+		if err := r.repair(ctx, issue); err != nil {
+			level.Error(r.logger).Log("err", err, "msg", "Could not repair "+issue.String())
+			left = append(left, issue)
+			continue
+		}
+		level.Info(r.logger).Log("msg", "Repaired "+issue.String())
+	}
+	return left
+}
+
+func (r *Reconciler) repair(ctx context.Context, issue Issue) error {
+	switch issue.Kind {
+	case CSRRowWithoutFile:
+		return r.csrDBStore.Delete(ctx, issue.ID)
+	case CSRFileWithoutRow:
+		return r.csrFileStore.Delete(ctx, issue.ID)
+	case CSRPathMismatch:
+		return r.csrDBStore.UpdateFilePath(ctx, csrmodel.CSR{Id: issue.ID, CsrFilePath: csrmodel.FilePath(r.homePath, issue.ID)})
+	case CertPathMismatch:
+		return r.certsDBStore.UpdateCertPath(ctx, issue.ID, certs.FilePath(r.homePath, issue.ID))
+	case CertFileWithoutRow:
+		cert, err := r.readCert(ctx, issue.ID)
+		if err != nil {
+			return err
+		}
+		return r.certsDBStore.Insert(ctx, certs.CRT{
+			ID:             issue.ID,
+			Status:         "V",
+			Serial:         cert.SerialNumber,
+			Issuer:         cert.Issuer.String(),
+			ExpirationDate: crypto.MakeOpenSSLTime(cert.NotAfter),
+			CertPath:       certs.FilePath(r.homePath, issue.ID),
+			DN:             crypto.MakeDN(cert),
+		})
+	}
+	return fmt.Errorf("issue %s cannot be repaired", issue.Kind)
+}
+
+func (r *Reconciler) readCert(ctx context.Context, id int) (*x509.Certificate, error) {
+	data, err := r.certsFileStore.SelectByID(ctx, id)
+	if err != nil {
+		if storeerr.IsNotFound(err) {
+			return nil, fmt.Errorf("certificate file does not exist")
+		}
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	err = crypto.CheckPEMBlock(block, crypto.CertPEMBlockType)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func compareCert(crt certs.CRT, cert *x509.Certificate) string {
+	if crt.Serial == nil || crt.Serial.Cmp(cert.SerialNumber) != 0 {
+		return fmt.Sprintf("serial=%x file serial=%x", crt.Serial, cert.SerialNumber)
+	}
+	if dn := crypto.MakeDN(cert); crt.DN != dn {
+		return "dn=" + crt.DN + " file dn=" + dn
+	}
+	if crt.Issuer != "" && crt.Issuer != cert.Issuer.String() {
+		return "issuer=" + crt.Issuer + " file issuer=" + cert.Issuer.String()
+	}
+	return ""
+}
+
+func toSet(ids []int) map[int]bool {
+	set := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
@@ -0,0 +1,194 @@
+package reconcile
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/crypto"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/certs"
+	certstore "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store"
+	certsfile "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store/file"
+	csrmodel "github.com/lamassuiot/enroller/pkg/enroller/models/csr"
+	csrstore "github.com/lamassuiot/enroller/pkg/enroller/models/csr/store"
+	csrfile "github.com/lamassuiot/enroller/pkg/enroller/models/csr/store/file"
+
+	"github.com/go-kit/kit/log"
+)
+
+type fakeCSRDB struct {
+	csrstore.DB
+	csrs map[int]csrmodel.CSR
+}
+
+func (db *fakeCSRDB) SelectAll(ctx context.Context) (csrmodel.CSRs, error) {
+	var csrs []csrmodel.CSR
+	for _, c := range db.csrs {
+		csrs = append(csrs, c)
+	}
+	return csrmodel.CSRs{CSRs: csrs}, nil
+}
+
+func (db *fakeCSRDB) UpdateFilePath(ctx context.Context, c csrmodel.CSR) error {
+	prev := db.csrs[c.Id]
+	prev.CsrFilePath = c.CsrFilePath
+	db.csrs[c.Id] = prev
+	return nil
+}
+
+func (db *fakeCSRDB) Delete(ctx context.Context, id int) error {
+	delete(db.csrs, id)
+	return nil
+}
+
+type fakeCertDB struct {
+	certstore.DB
+	crts map[int]certs.CRT
+}
+
+func (db *fakeCertDB) SelectAll(ctx context.Context) ([]certs.CRT, error) {
+	var crts []certs.CRT
+	for _, crt := range db.crts {
+		crts = append(crts, crt)
+	}
+	return crts, nil
+}
+
+func (db *fakeCertDB) Insert(ctx context.Context, crt certs.CRT) error {
+	if _, ok := db.crts[crt.ID]; ok {
+		return errors.New("duplicate certificate")
+	}
+	db.crts[crt.ID] = crt
+	return nil
+}
+
+func (db *fakeCertDB) UpdateCertPath(ctx context.Context, id int, certPath string) error {
+	crt := db.crts[id]
+	crt.CertPath = certPath
+	db.crts[id] = crt
+	return nil
+}
+
+func TestScanAndRepair(t *testing.T) {
+	ctx := context.Background()
+	homePath := t.TempDir()
+	logger := log.NewJSONLogger(&bytes.Buffer{})
+	csrFiles := csrfile.NewFile(homePath, logger)
+	certFiles := certsfile.NewFile(homePath, logger)
+	csrDB := &fakeCSRDB{csrs: map[int]csrmodel.CSR{
+		1: {Id: 1, Status: csrmodel.ApprobedStatus, CommonName: "ok.com", CsrFilePath: csrmodel.FilePath(homePath, 1)},
+		2: {Id: 2, Status: csrmodel.PendingStatus, CsrFilePath: csrmodel.FilePath(homePath, 2)},
+		4: {Id: 4, Status: csrmodel.DeniedStatus, CsrFilePath: "/old/4.csr"},
+	}}
+
+	okCert := testCert(t, "ok.com", 10)
+	orphanCert := testCert(t, "orphan.com", 11)
+	certDB := &fakeCertDB{crts: map[int]certs.CRT{
+		1: {ID: 1, Status: "V", Serial: okCert.SerialNumber, DN: crypto.MakeDN(okCert), Issuer: okCert.Issuer.String(), CertPath: "/old/ok.com.a.crt"},
+		5: {ID: 5, Status: "V", Serial: big.NewInt(12), DN: "/CN=lost.com", CertPath: certs.FilePath(homePath, 5)},
+	}}
+
+	for _, id := range []int{1, 3, 4} {
+		if err := csrFiles.Insert(ctx, id, []byte("csr")); err != nil {
+			t.Fatal("Could not insert CSR in file system")
+		}
+	}
+	if err := certFiles.Insert(ctx, 1, okCert.Raw); err != nil {
+		t.Fatal("Could not insert certificate in file system")
+	}
+	if err := certFiles.Insert(ctx, 6, orphanCert.Raw); err != nil {
+		t.Fatal("Could not insert certificate in file system")
+	}
+
+	r := NewReconciler(csrDB, csrFiles, certDB, certFiles, homePath, true, logger)
+	issues, err := r.Scan(ctx)
+	if err != nil {
+		t.Fatalf("Scan returned an error: %s", err)
+	}
+	want := []string{CertPathMismatch, CSRRowWithoutFile, CSRFileWithoutRow, CSRPathMismatch, CertRowWithoutFile, CertFileWithoutRow}
+	if len(issues) != len(want) {
+		t.Fatalf("Got issues %v; want kinds %v", issues, want)
+	}
+	for i, kind := range want {
+		if issues[i].Kind != kind {
+			t.Errorf("Got issue %s; want %s", issues[i], kind)
+		}
+	}
+
+	left := r.Repair(ctx, issues)
+	if len(left) != 1 || left[0].Kind != CertRowWithoutFile {
+		t.Errorf("Got unrepaired issues %v; want only %s", left, CertRowWithoutFile)
+	}
+	issues, err = r.Scan(ctx)
+	if err != nil {
+		t.Fatalf("Scan returned an error: %s", err)
+	}
+	if len(issues) != 1 {
+		t.Errorf("Got issues %v after repair; want 1", issues)
+	}
+	if crt, ok := certDB.crts[6]; !ok || crt.Serial.Cmp(orphanCert.SerialNumber) != 0 {
+		t.Error("Certificate row was not rebuilt from the orphan certificate file")
+	}
+}
+
+func testCert(t *testing.T, cn string, serial int64) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Could not generate key")
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal("Could not create certificate")
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("Could not parse certificate")
+	}
+	return crt
+}
+
+func TestScanWithoutPaths(t *testing.T) {
+	ctx := context.Background()
+	homePath := t.TempDir()
+	logger := log.NewJSONLogger(&bytes.Buffer{})
+	csrFiles := csrfile.NewFile(homePath, logger)
+	certFiles := certsfile.NewFile(homePath, logger)
+	// The paths of the rows do not locate the files of other file stores.
+	crt := testCert(t, "ok.com", 10)
+	csrDB := &fakeCSRDB{csrs: map[int]csrmodel.CSR{
+		1: {Id: 1, Status: csrmodel.ApprobedStatus, CommonName: "ok.com", CsrFilePath: "/other/1.csr"},
+	}}
+	certDB := &fakeCertDB{crts: map[int]certs.CRT{
+		1: {ID: 1, Status: "V", Serial: crt.SerialNumber, DN: crypto.MakeDN(crt), Issuer: crt.Issuer.String(), CertPath: "/other/1.crt"},
+	}}
+	if err := csrFiles.Insert(ctx, 1, []byte("csr")); err != nil {
+		t.Fatal("Could not insert CSR in file system")
+	}
+	if err := certFiles.Insert(ctx, 1, crt.Raw); err != nil {
+		t.Fatal("Could not insert certificate in file system")
+	}
+
+	r := NewReconciler(csrDB, csrFiles, certDB, certFiles, homePath, false, logger)
+	issues, err := r.Scan(ctx)
+	if err != nil {
+		t.Fatalf("Scan returned an error: %s", err)
+	}
+	if len(issues) != 0 {
+		t.Errorf("Got issues %v; want none", issues)
+	}
+}
@@ -0,0 +1,174 @@
+package secrets
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"time"
+)
+
+var (
+	// ErrUnknownCA is returned when the CA selected for a CSR is not
+	// configured.
+	ErrUnknownCA = errors.New("unknown issuing CA")
+
+	// ErrCrossSignNotSupported is returned when the secret engine of a CA
+	// can not cross-sign another CA certificate.
+	ErrCrossSignNotSupported = errors.New("secret engine cannot cross-sign CA certificates")
+
+	errDuplicateCA      = errors.New("issuing CA configured twice")
+	errSuccessorLoop    = errors.New("CA succession loops back to a replaced CA")
+	errNoRolloverTime   = errors.New("CA successor configured without a rollover time")
+	errUnknownSuccessor = errors.New("CA successor is not configured")
+	errSuccessorInvalid = errors.New("CA successor certificate is not valid at the rollover time")
+)
+
+// CA is an issuing CA: the secret engine that signs with its key and the
+// certificates that chain its certificate to a root.
+type CA struct {
+	Name    string
+	Secrets Secrets
+	// Chain holds the issuers of the CA certificate, up to the root.
+	Chain []*x509.Certificate
+	// Successor is the CA that issues the certificates requested from this
+	// one from RolloverAt on. This CA is kept so that the certificates it
+	// already issued can still be checked and revoked.
+	Successor  string
+	RolloverAt time.Time
+}
+
+// CrossSigner is implemented by the secret engines that can issue a CA
+// certificate, to cross-sign the certificate of a successor CA so that it
+// is trusted by the devices that only trust the current one.
+type CrossSigner interface {
+	CrossSign(ctx context.Context, cert *x509.Certificate) ([]byte, error)
+}
+
+// CrossTemplate returns the certificate issued to cross-sign the CA
+// certificate cert by issuer. It keeps the subject, key and constraints of
+// cert and does not outlive issuer.
+func CrossTemplate(cert *x509.Certificate, serial *big.Int, issuer *x509.Certificate) *x509.Certificate {
+	notAfter := cert.NotAfter
+	if issuer.NotAfter.Before(notAfter) {
+		notAfter = issuer.NotAfter
+	}
+	return &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               cert.Subject,
+		SubjectKeyId:          cert.SubjectKeyId,
+		NotBefore:             time.Now().Add(-600 * time.Second).UTC(),
+		NotAfter:              notAfter.UTC(),
+		KeyUsage:              cert.KeyUsage,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            cert.MaxPathLen,
+		MaxPathLenZero:        cert.MaxPathLenZero,
+	}
+}
+
+// CAs are the issuing CAs, by name. One of them is used when a CSR is
+// approved without choosing one.
+type CAs struct {
+	cas         []*CA
+	byName      map[string]*CA
+	defaultName string
+}
+
+// NewCAs returns the issuing CAs, with the one named defaultName used by
+// default. The successors of the CAs must be among them.
+func NewCAs(defaultName string, cas ...*CA) (*CAs, error) {
+	c := &CAs{byName: make(map[string]*CA), defaultName: defaultName}
+	for _, ca := range cas {
+		if _, ok := c.byName[ca.Name]; ok {
+			return nil, errDuplicateCA
+		}
+		c.byName[ca.Name] = ca
+		c.cas = append(c.cas, ca)
+	}
+	if _, ok := c.byName[defaultName]; !ok {
+		return nil, ErrUnknownCA
+	}
+	for _, ca := range cas {
+		seen := map[string]bool{}
+		for next := ca; next.Successor != ""; next = c.byName[next.Successor] {
+			if next.RolloverAt.IsZero() {
+				return nil, errNoRolloverTime
+			}
+			if _, ok := c.byName[next.Successor]; !ok {
+				return nil, errUnknownSuccessor
+			}
+			if seen[next.Name] {
+				return nil, errSuccessorLoop
+			}
+			seen[next.Name] = true
+		}
+		if ca.Successor != "" {
+			successorCert, err := c.byName[ca.Successor].Secrets.GetCACert()
+			if err != nil {
+				return nil, err
+			}
+			if ca.RolloverAt.Before(successorCert.NotBefore) || !ca.RolloverAt.Before(successorCert.NotAfter) {
+				return nil, errSuccessorInvalid
+			}
+		}
+	}
+	return c, nil
+}
+
+// Get returns the CA that issues the certificates requested from the CA
+// named name, or from the default CA if name is empty. That is the CA
+// itself, or its latest successor once their rollover time has passed.
+func (c *CAs) Get(name string) (*CA, error) {
+	return c.GetAt(name, time.Now())
+}
+
+// GetAt is like Get at time t.
+func (c *CAs) GetAt(name string, t time.Time) (*CA, error) {
+	ca, err := c.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	for ca.Successor != "" && !t.Before(ca.RolloverAt) {
+		ca = c.byName[ca.Successor]
+	}
+	return ca, nil
+}
+
+// Lookup returns the CA named name, or the default CA if name is empty,
+// whether it was replaced by a successor or not.
+func (c *CAs) Lookup(name string) (*CA, error) {
+	if name == "" {
+		name = c.defaultName
+	}
+	ca, ok := c.byName[name]
+	if !ok {
+		return nil, ErrUnknownCA
+	}
+	return ca, nil
+}
+
+// List returns the CAs in the order they were configured.
+func (c *CAs) List() []*CA {
+	return c.cas
+}
+
+// Default returns the name of the default CA.
+func (c *CAs) Default() string {
+	return c.defaultName
+}
+
+type caKey struct{}
+
+// WithCA returns a context that makes the enroller issue the certificate
+// with the named CA. An empty name selects the default CA.
+func WithCA(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, caKey{}, name)
+}
+
+// CAName returns the name of the CA selected in ctx, empty for the default
+// CA.
+func CAName(ctx context.Context) string {
+	name, _ := ctx.Value(caKey{}).(string)
+	return name
+}
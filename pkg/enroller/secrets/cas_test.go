@@ -0,0 +1,88 @@
+package secrets
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type testSecrets struct {
+	cert *x509.Certificate
+}
+
+func (s testSecrets) SignCSR(ctx context.Context, csr *x509.CertificateRequest) ([]byte, error) {
+	return nil, nil
+}
+
+func (s testSecrets) GetCACert() (*x509.Certificate, error) {
+	return s.cert, nil
+}
+
+func testCA(name string, successor string, rolloverAt time.Time) *CA {
+	cert := &x509.Certificate{NotBefore: time.Now().AddDate(-1, 0, 0), NotAfter: time.Now().AddDate(1, 0, 0)}
+	return &CA{Name: name, Secrets: testSecrets{cert}, Successor: successor, RolloverAt: rolloverAt}
+}
+
+func TestNewCAs(t *testing.T) {
+	rollover := time.Now()
+	testCases := []struct {
+		name string
+		cas  []*CA
+		ret  error
+	}{
+		{"Single CA", []*CA{testCA("default", "", time.Time{})}, nil},
+		{"Successor", []*CA{testCA("default", "next", rollover), testCA("next", "", time.Time{})}, nil},
+		{"Unknown default", []*CA{testCA("other", "", time.Time{})}, ErrUnknownCA},
+		{"Duplicate CA", []*CA{testCA("default", "", time.Time{}), testCA("default", "", time.Time{})}, errDuplicateCA},
+		{"Unknown successor", []*CA{testCA("default", "next", rollover)}, errUnknownSuccessor},
+		{"No rollover time", []*CA{testCA("default", "next", time.Time{}), testCA("next", "", time.Time{})}, errNoRolloverTime},
+		{"Successor loop", []*CA{testCA("default", "next", rollover), testCA("next", "default", rollover)}, errSuccessorLoop},
+		{"Successor expired at rollover", []*CA{testCA("default", "next", rollover.AddDate(2, 0, 0)), testCA("next", "", time.Time{})}, errSuccessorInvalid},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			_, err := NewCAs("default", tc.cas...)
+			if tc.ret != err {
+				t.Errorf("Got result is %v; want %v", err, tc.ret)
+			}
+		})
+	}
+}
+
+func TestGetAt(t *testing.T) {
+	rollover := time.Now().Add(time.Hour)
+	cas, err := NewCAs("default", testCA("default", "next", rollover), testCA("next", "", time.Time{}), testCA("other", "", time.Time{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name string
+		ca   string
+		at   time.Time
+		want string
+	}{
+		{"Default CA before rollover", "", rollover.Add(-time.Second), "default"},
+		{"Default CA at rollover", "", rollover, "next"},
+		{"Replaced CA after rollover", "default", rollover.Add(time.Second), "next"},
+		{"CA without successor", "other", rollover.Add(time.Second), "other"},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			ca, err := cas.GetAt(tc.ca, tc.at)
+			if err != nil {
+				t.Fatalf("Got result is %s; want nil", err)
+			}
+			if ca.Name != tc.want {
+				t.Errorf("Got CA %s; want %s", ca.Name, tc.want)
+			}
+		})
+	}
+	if ca, _ := cas.Lookup("default"); ca.Name != "default" {
+		t.Errorf("Got CA %s; want default", ca.Name)
+	}
+	if _, err := cas.GetAt("unknown", rollover); err != ErrUnknownCA {
+		t.Errorf("Got result is %v; want %s", err, ErrUnknownCA)
+	}
+}
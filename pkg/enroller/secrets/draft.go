@@ -0,0 +1,74 @@
+package secrets
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+
+	enrollercrypto "github.com/lamassuiot/enroller/pkg/enroller/crypto"
+	"github.com/lamassuiot/enroller/pkg/enroller/lint"
+)
+
+// ErrLint is matched by the LintError returned by SignCSR when the
+// certificate it would issue does not pass the pre-issuance checks.
+var ErrLint = errors.New("certificate does not pass pre-issuance checks")
+
+// LintError is returned by SignCSR, before the CA key signs anything, when
+// the certificate does not pass the pre-issuance checks.
+type LintError struct {
+	Findings lint.Findings
+}
+
+func (e *LintError) Error() string {
+	return ErrLint.Error() + ": " + e.Findings.String()
+}
+
+// Is makes errors.Is match ErrLint.
+func (e *LintError) Is(target error) bool {
+	return target == ErrLint
+}
+
+// NewDraftKey returns a key of the type of pub to sign certificate drafts.
+// Only its type matters, as the signature algorithm of the drafts is part
+// of their TBS certificate. The engines generate it once per CA key, as
+// generating an RSA key for every CSR would be slow.
+func NewDraftKey(pub crypto.PublicKey) (crypto.Signer, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case *ecdsa.PublicKey:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case ed25519.PublicKey:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, enrollercrypto.ErrUnsupportedKey
+}
+
+// Draft returns the certificate for pub that caCert would issue with
+// template, signed with draftKey instead of the CA key, once it passes the
+// pre-issuance checks. Its TBS certificate is the one the CA key signs
+// afterwards with the same template.
+func Draft(template *x509.Certificate, caCert *x509.Certificate, pub crypto.PublicKey, draftKey crypto.Signer) (*x509.Certificate, error) {
+	// The draft is issued by a copy of the CA certificate without its key,
+	// which the draft key does not match.
+	issuer := *caCert
+	issuer.PublicKey = nil
+	der, err := x509.CreateCertificate(rand.Reader, template, &issuer, pub, draftKey)
+	if err != nil {
+		return nil, err
+	}
+	draft, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	if findings := lint.TBSCertificate(draft, caCert); findings.HasErrors() {
+		return nil, &LintError{Findings: findings.Errors()}
+	}
+	return draft, nil
+}
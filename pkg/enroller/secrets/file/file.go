@@ -1,12 +1,15 @@
 package file
 
 import (
+	"bytes"
+	"context"
+	stdcrypto "crypto"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"sync"
 	"time"
 
 	"github.com/lamassuiot/enroller/pkg/enroller/crypto"
@@ -18,90 +21,198 @@ import (
 )
 
 type File struct {
-	CACert       string
-	CAKey        string
-	OCSPServer   string
+	CACert string
+	CAKey  string
+	// CAKeyPassphrase decrypts CAKey when it is an encrypted PKCS#8 key.
+	CAKeyPassphrase []byte
+	OCSPServer      string
+	CRLServer       string
+	// Hash is the hash of the certificate signatures, zero for the default
+	// of the CA key type.
+	Hash         stdcrypto.Hash
 	certsDBStore certstore.DB
 	logger       log.Logger
+
+	// mu guards ca, which is replaced as a whole on reload.
+	mu sync.RWMutex
+	ca *ca
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// ca is the CA material loaded from the files.
+type ca struct {
+	certPEM            []byte
+	keyPEM             []byte
+	cert               *x509.Certificate
+	key                stdcrypto.Signer
+	signatureAlgorithm x509.SignatureAlgorithm
+	// draftKey signs the drafts checked before the CA key signs.
+	draftKey stdcrypto.Signer
 }
 
-func NewFile(CACert string, CAKey string, OCSPServer string, certsDBStore certstore.DB, logger log.Logger) secrets.Secrets {
-	return &File{CACert: CACert, CAKey: CAKey, OCSPServer: OCSPServer, certsDBStore: certsDBStore, logger: logger}
+// NewFile loads the CA certificate and key, so that missing or broken files
+// are reported at startup.
+func NewFile(CACert string, CAKey string, CAKeyPassphrase []byte, OCSPServer string, CRLServer string, hash stdcrypto.Hash, certsDBStore certstore.DB, logger log.Logger) (*File, error) {
+	f := &File{CACert: CACert, CAKey: CAKey, CAKeyPassphrase: CAKeyPassphrase, OCSPServer: OCSPServer, CRLServer: CRLServer, Hash: hash, certsDBStore: certsDBStore, logger: logger}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
 }
 
-func (f *File) SignCSR(csr *x509.CertificateRequest) ([]byte, error) {
-	caCert, err := loadCACert(f.CACert)
+// Reload reads the CA certificate and key files again and starts signing
+// with them if they changed. A certificate and key that do not make a
+// usable CA are rejected and the previous ones are kept.
+func (f *File) Reload() error {
+	certPEM, err := ioutil.ReadFile(f.CACert)
+	if err != nil {
+		level.Error(f.logger).Log("err", err, "msg", "Could not read CA certificate")
+		return err
+	}
+	keyPEM, err := ioutil.ReadFile(f.CAKey)
+	if err != nil {
+		level.Error(f.logger).Log("err", err, "msg", "Could not read CA key")
+		return err
+	}
+	f.mu.RLock()
+	current := f.ca
+	f.mu.RUnlock()
+	if current != nil && bytes.Equal(current.certPEM, certPEM) && bytes.Equal(current.keyPEM, keyPEM) {
+		return nil
+	}
+	ca, err := f.load(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.ca = ca
+	f.mu.Unlock()
+	level.Info(f.logger).Log("msg", "CA certificate and key loaded", "subject", ca.cert.Subject.String(), "not_after", ca.cert.NotAfter)
+	return nil
+}
+
+func (f *File) load(certPEM []byte, keyPEM []byte) (*ca, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if err := crypto.CheckPEMBlock(certBlock, crypto.CertPEMBlockType); err != nil {
+		level.Error(f.logger).Log("err", err, "msg", "Could not load CA certificate")
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
 	if err != nil {
 		level.Error(f.logger).Log("err", err, "msg", "Could not load CA certificate")
 		return nil, err
 	}
-	level.Info(f.logger).Log("msg", "CA certificate loaded")
-	caKey, err := loadCAKey(f.CAKey)
+	keyBlock, _ := pem.Decode(keyPEM)
+	key, err := crypto.DecryptPrivateKey(keyBlock, f.CAKeyPassphrase)
 	if err != nil {
 		level.Error(f.logger).Log("err", err, "msg", "Could not load CA key")
 		return nil, err
 	}
-	level.Info(f.logger).Log("msg", "CA key loaded")
-	serial, err := f.certsDBStore.Serial()
+	if err := crypto.CheckCA(cert, key); err != nil {
+		level.Error(f.logger).Log("err", err, "msg", "CA certificate and key cannot be used to sign certificates")
+		return nil, err
+	}
+	signatureAlgorithm, err := crypto.SignatureAlgorithm(key.Public(), f.Hash)
 	if err != nil {
-		level.Error(f.logger).Log("err", err, "msg", "Could not get serial from database")
+		level.Error(f.logger).Log("err", err, "msg", "Could not choose signature algorithm for CA key")
 		return nil, err
 	}
-	level.Info(f.logger).Log("msg", "Serial obtained from database")
-	template := &x509.Certificate{
-		SerialNumber: serial,
-		Subject:      csr.Subject,
-		NotBefore:    time.Now().Add(-600).UTC(),
-		NotAfter:     time.Now().AddDate(0, 0, 365).UTC(),
-		KeyUsage:     x509.KeyUsageDigitalSignature,
-		OCSPServer:   []string{f.OCSPServer},
-		ExtKeyUsage: []x509.ExtKeyUsage{
-			x509.ExtKeyUsageClientAuth,
-		},
-		SignatureAlgorithm: csr.SignatureAlgorithm,
-	}
-
-	cert, err := x509.CreateCertificate(rand.Reader, template, caCert, csr.PublicKey, caKey)
+	draftKey, err := secrets.NewDraftKey(key.Public())
 	if err != nil {
-
-		f.logger.Log("err", err, "msg", "Could not create signed certificate")
+		level.Error(f.logger).Log("err", err, "msg", "Could not generate certificate draft key")
 		return nil, err
 	}
-	level.Info(f.logger).Log("msg", "CSR with serial "+fmt.Sprintf("%x", serial)+" signed by Enroller CA")
-	return cert, nil
+	return &ca{certPEM: certPEM, keyPEM: keyPEM, cert: cert, key: key, signatureAlgorithm: signatureAlgorithm, draftKey: draftKey}, nil
+}
 
+// Watch reloads the CA files every interval until Close is called, so that
+// rotated files, such as an updated Kubernetes secret, are picked up.
+func (f *File) Watch(interval time.Duration) {
+	f.stop = make(chan struct{})
+	f.stopped = make(chan struct{})
+	go func() {
+		defer close(f.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-f.stop:
+				return
+			case <-ticker.C:
+				f.Reload()
+			}
+		}
+	}()
 }
 
-func loadCACert(CACert string) (*x509.Certificate, error) {
-	certPEM, err := ioutil.ReadFile(CACert)
+// Close stops watching the CA files.
+func (f *File) Close() {
+	if f.stop == nil {
+		return
+	}
+	close(f.stop)
+	<-f.stopped
+}
+
+// SignCSR signs csr with the CA key file. Only the default profile is
+// supported.
+func (f *File) SignCSR(ctx context.Context, csr *x509.CertificateRequest) ([]byte, error) {
+	if profile := secrets.Profile(ctx); profile != secrets.DefaultProfile {
+		level.Error(f.logger).Log("err", secrets.ErrUnknownProfile, "msg", "Profile "+profile+" is not supported by the file secret engine")
+		return nil, secrets.ErrUnknownProfile
+	}
+	f.mu.RLock()
+	ca := f.ca
+	f.mu.RUnlock()
+	serial, err := f.certsDBStore.Serial(ctx, ca.cert.Subject.String())
 	if err != nil {
+		level.Error(f.logger).Log("err", err, "msg", "Could not get serial from database")
 		return nil, err
 	}
-	pemBlock, _ := pem.Decode(certPEM)
-	err = crypto.CheckPEMBlock(pemBlock, crypto.CertPEMBlockType)
-	if err != nil {
+	level.Info(f.logger).Log("msg", "Serial obtained from database")
+	template := secrets.Template(csr, serial, f.OCSPServer, f.CRLServer)
+	template.SignatureAlgorithm = ca.signatureAlgorithm
+	if _, err := secrets.Draft(template, ca.cert, csr.PublicKey, ca.draftKey); err != nil {
+		level.Error(f.logger).Log("err", err, "msg", "Certificate draft not signed by Enroller CA")
 		return nil, err
 	}
-	cert, err := x509.ParseCertificate(pemBlock.Bytes)
+
+	cert, err := x509.CreateCertificate(rand.Reader, template, ca.cert, csr.PublicKey, ca.key)
 	if err != nil {
+
+		f.logger.Log("err", err, "msg", "Could not create signed certificate")
 		return nil, err
 	}
+	level.Info(f.logger).Log("msg", "CSR with serial "+fmt.Sprintf("%x", serial)+" signed by Enroller CA")
 	return cert, nil
+
 }
 
-func loadCAKey(CAKey string) (*rsa.PrivateKey, error) {
-	keyPEM, err := ioutil.ReadFile(CAKey)
-	if err != nil {
-		return nil, err
-	}
-	pemBlock, _ := pem.Decode(keyPEM)
-	err = crypto.CheckPEMBlock(pemBlock, crypto.KeyPEMBlockType)
+// CrossSign signs the CA certificate cert with the CA key file.
+func (f *File) CrossSign(ctx context.Context, cert *x509.Certificate) ([]byte, error) {
+	f.mu.RLock()
+	ca := f.ca
+	f.mu.RUnlock()
+	serial, err := f.certsDBStore.Serial(ctx, ca.cert.Subject.String())
 	if err != nil {
+		level.Error(f.logger).Log("err", err, "msg", "Could not get serial from database")
 		return nil, err
 	}
-	key, err := x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
+	template := secrets.CrossTemplate(cert, serial, ca.cert)
+	template.SignatureAlgorithm = ca.signatureAlgorithm
+	crossCert, err := x509.CreateCertificate(rand.Reader, template, ca.cert, cert.PublicKey, ca.key)
 	if err != nil {
+		level.Error(f.logger).Log("err", err, "msg", "Could not create cross-signed certificate")
 		return nil, err
 	}
-	return key, nil
+	level.Info(f.logger).Log("msg", "CA certificate "+cert.Subject.String()+" cross-signed by Enroller CA")
+	return crossCert, nil
+}
+
+func (f *File) GetCACert() (*x509.Certificate, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.ca.cert, nil
 }
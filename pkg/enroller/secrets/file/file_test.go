@@ -0,0 +1,371 @@
+package file
+
+import (
+	"context"
+	stdcrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/crypto"
+	"github.com/lamassuiot/enroller/pkg/enroller/lint"
+	certsmemory "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store/memory"
+	"github.com/lamassuiot/enroller/pkg/enroller/secrets"
+
+	"github.com/go-kit/kit/log"
+	"github.com/youmark/pkcs8"
+)
+
+// writeCA writes a CA certificate for key, issued by a root with rootKey,
+// and key encoded as a blockType PEM block.
+func writeCA(t *testing.T, dir string, key stdcrypto.Signer, blockType string, rootKey stdcrypto.Signer) (string, string) {
+	root := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Root CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(2, 0, 0),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "Enroller CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(2, 0, 0),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, root, key.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keyDER []byte
+	switch blockType {
+	case crypto.KeyPEMBlockType:
+		keyDER = x509.MarshalPKCS1PrivateKey(key.(*rsa.PrivateKey))
+	case crypto.ECKeyPEMBlockType:
+		keyDER, err = x509.MarshalECPrivateKey(key.(*ecdsa.PrivateKey))
+	default:
+		keyDER, err = x509.MarshalPKCS8PrivateKey(key)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "ca.crt")
+	keyFile := filepath.Join(dir, "ca.key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: crypto.CertPEMBlockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func testCSR(t *testing.T, key stdcrypto.Signer) *x509.CertificateRequest {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "device.test.com"}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+func TestSignCSR(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p256Key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	testCases := []struct {
+		name      string
+		key       stdcrypto.Signer
+		blockType string
+		rootKey   stdcrypto.Signer
+		hash      stdcrypto.Hash
+		alg       x509.SignatureAlgorithm
+	}{
+		{"PKCS#1 RSA CA", rsaKey, crypto.KeyPEMBlockType, rsaKey, 0, x509.SHA256WithRSA},
+		{"PKCS#8 RSA CA with SHA-384", rsaKey, crypto.PKCS8PEMBlockType, rsaKey, stdcrypto.SHA384, x509.SHA384WithRSA},
+		{"SEC1 P-256 CA under RSA root", p256Key, crypto.ECKeyPEMBlockType, rsaKey, 0, x509.ECDSAWithSHA256},
+		{"PKCS#8 P-384 CA", p384Key, crypto.PKCS8PEMBlockType, p384Key, 0, x509.ECDSAWithSHA384},
+		{"PKCS#8 Ed25519 CA under P-256 root", edKey, crypto.PKCS8PEMBlockType, p256Key, 0, x509.PureEd25519},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "enroller")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			certFile, keyFile := writeCA(t, dir, tc.key, tc.blockType, tc.rootKey)
+			secrets, err := NewFile(certFile, keyFile, nil, "http://ocsp.test.com", "", tc.hash, certsmemory.NewDB(), log.NewNopLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			caCert, err := secrets.GetCACert()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Device keys of any type are signed by the CA key.
+			for _, deviceKey := range []stdcrypto.Signer{rsaKey, p256Key, edKey} {
+				der, err := secrets.SignCSR(context.Background(), testCSR(t, deviceKey))
+				if err != nil {
+					t.Fatalf("SignCSR returned an error: %s", err)
+				}
+				crt, err := x509.ParseCertificate(der)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if crt.SignatureAlgorithm != tc.alg {
+					t.Errorf("Got signature algorithm %s; want %s", crt.SignatureAlgorithm, tc.alg)
+				}
+				if findings := lint.Certificate(crt, caCert); findings.HasErrors() {
+					t.Errorf("Certificate does not pass checks: %s", findings.Errors())
+				}
+			}
+		})
+	}
+}
+
+// countingSigner counts the signatures of the CA key.
+type countingSigner struct {
+	stdcrypto.Signer
+	signatures int
+}
+
+func (s *countingSigner) Sign(rand io.Reader, digest []byte, opts stdcrypto.SignerOpts) ([]byte, error) {
+	s.signatures++
+	return s.Signer.Sign(rand, digest, opts)
+}
+
+func TestSignCSRLint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enroller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	certFile, keyFile := writeCA(t, dir, key, crypto.PKCS8PEMBlockType, key)
+	f, err := NewFile(certFile, keyFile, nil, "http://ocsp.test.com", "", 0, certsmemory.NewDB(), log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKey := &countingSigner{Signer: f.ca.key}
+	f.ca.key = caKey
+
+	deviceKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, deviceKey)
+	csr, _ := x509.ParseCertificateRequest(der)
+
+	// A CSR without subject or SAN gives a certificate that does not pass
+	// the checks, which the CA key never signs.
+	_, err = f.SignCSR(context.Background(), csr)
+	if !errors.Is(err, secrets.ErrLint) {
+		t.Errorf("Got result is %v; want %s", err, secrets.ErrLint)
+	}
+	if caKey.signatures != 0 {
+		t.Errorf("Got %d signatures of the CA key; want none", caKey.signatures)
+	}
+	if _, err := f.SignCSR(context.Background(), testCSR(t, deviceKey)); err != nil {
+		t.Fatalf("SignCSR returned an error: %s", err)
+	}
+	if caKey.signatures != 1 {
+		t.Errorf("Got %d signatures of the CA key; want 1", caKey.signatures)
+	}
+}
+
+func TestNewFileUnsupportedKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enroller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	certFile, keyFile := writeCA(t, dir, key, crypto.PKCS8PEMBlockType, key)
+	// A PKCS#8 key in a block of another type is rejected.
+	data, _ := ioutil.ReadFile(keyFile)
+	block, _ := pem.Decode(data)
+	block.Type = "DSA PRIVATE KEY"
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600)
+
+	if _, err := NewFile(certFile, keyFile, nil, "http://ocsp.test.com", "", 0, certsmemory.NewDB(), log.NewNopLogger()); err != crypto.ErrUnsupportedKey {
+		t.Errorf("Got result is %v; want %s", err, crypto.ErrUnsupportedKey)
+	}
+}
+
+func TestNewFileEncryptedKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enroller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	certFile, keyFile := writeCA(t, dir, key, crypto.PKCS8PEMBlockType, key)
+	der, err := pkcs8.MarshalPrivateKey(key, []byte("passphrase"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: crypto.EncryptedPKCS8PEMBlockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name       string
+		passphrase []byte
+		ok         bool
+	}{
+		{"right passphrase", []byte("passphrase"), true},
+		{"wrong passphrase", []byte("wrong"), false},
+		{"no passphrase", nil, false},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			secrets, err := NewFile(certFile, keyFile, tc.passphrase, "http://ocsp.test.com", "", 0, certsmemory.NewDB(), log.NewNopLogger())
+			if tc.ok && err != nil {
+				t.Fatalf("NewFile returned an error: %s", err)
+			}
+			if !tc.ok && err == nil {
+				t.Error("NewFile did not return an error")
+			}
+			if tc.ok {
+				if _, err := secrets.SignCSR(context.Background(), testCSR(t, key)); err != nil {
+					t.Errorf("SignCSR returned an error: %s", err)
+				}
+			}
+			if tc.passphrase == nil && err != crypto.ErrPassphraseRequired {
+				t.Errorf("Got result is %v; want %s", err, crypto.ErrPassphraseRequired)
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enroller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	certFile, keyFile := writeCA(t, dir, oldKey, crypto.PKCS8PEMBlockType, oldKey)
+	secrets, err := NewFile(certFile, keyFile, nil, "http://ocsp.test.com", "", 0, certsmemory.NewDB(), log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldCert, _ := secrets.GetCACert()
+
+	// A key that does not match the certificate is rejected and the
+	// previous CA is kept.
+	keyDER, _ := x509.MarshalPKCS8PrivateKey(newKey)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: crypto.PKCS8PEMBlockType, Bytes: keyDER}), 0600)
+	if err := secrets.Reload(); err != crypto.ErrKeyMismatch {
+		t.Errorf("Got result is %v; want %s", err, crypto.ErrKeyMismatch)
+	}
+	if caCert, _ := secrets.GetCACert(); caCert != oldCert {
+		t.Error("CA certificate changed after a rejected reload")
+	}
+
+	writeCA(t, dir, newKey, crypto.PKCS8PEMBlockType, oldKey)
+	if err := secrets.Reload(); err != nil {
+		t.Fatalf("Reload returned an error: %s", err)
+	}
+	der, err := secrets.SignCSR(context.Background(), testCSR(t, oldKey))
+	if err != nil {
+		t.Fatalf("SignCSR returned an error: %s", err)
+	}
+	crt, _ := x509.ParseCertificate(der)
+	if crt.SignatureAlgorithm != x509.ECDSAWithSHA384 {
+		t.Errorf("Got signature algorithm %s; want %s", crt.SignatureAlgorithm, x509.ECDSAWithSHA384)
+	}
+}
+
+func TestNewFileNotCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enroller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Not a CA"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	_, keyFile := writeCA(t, dir, key, crypto.PKCS8PEMBlockType, key)
+	certFile := filepath.Join(dir, "leaf.crt")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: crypto.CertPEMBlockType, Bytes: der}), 0600)
+	if _, err := NewFile(certFile, keyFile, nil, "http://ocsp.test.com", "", 0, certsmemory.NewDB(), log.NewNopLogger()); err != crypto.ErrNotCA {
+		t.Errorf("Got result is %v; want %s", err, crypto.ErrNotCA)
+	}
+}
+
+func TestCrossSign(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enroller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	certFile, keyFile := writeCA(t, dir, oldKey, crypto.PKCS8PEMBlockType, oldKey)
+	secrets, err := NewFile(certFile, keyFile, nil, "http://ocsp.test.com", "", 0, certsmemory.NewDB(), log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldCert, _ := secrets.GetCACert()
+
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(3),
+		Subject:               pkix.Name{CommonName: "Enroller CA 2"},
+		SubjectKeyId:          []byte{1, 2, 3, 4},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(5, 0, 0),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, newKey.Public(), newKey)
+	newCert, _ := x509.ParseCertificate(der)
+
+	der, err = secrets.CrossSign(context.Background(), newCert)
+	if err != nil {
+		t.Fatalf("CrossSign returned an error: %s", err)
+	}
+	cross, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cross.CheckSignatureFrom(oldCert); err != nil {
+		t.Errorf("Cross-signed certificate not signed by the current CA: %s", err)
+	}
+	if cross.Subject.String() != newCert.Subject.String() || !cross.PublicKey.(*ecdsa.PublicKey).Equal(newKey.Public()) {
+		t.Errorf("Got cross-signed certificate for %s; want %s with its key", cross.Subject, newCert.Subject)
+	}
+	if !cross.IsCA || cross.NotAfter.After(oldCert.NotAfter) {
+		t.Errorf("Got CA %t until %s; want a CA certificate ending before %s", cross.IsCA, cross.NotAfter, oldCert.NotAfter)
+	}
+}
@@ -0,0 +1,95 @@
+// Package passphrase reads the passphrase of an encrypted CA key from the
+// source configured for it, so that the key file can be stored encrypted.
+package passphrase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Source prefixes.
+const (
+	EnvSource    = "env:"
+	FileSource   = "file:"
+	VaultSource  = "vault:"
+	PromptSource = "prompt"
+)
+
+var (
+	ErrUnknownSource = errors.New("unknown passphrase source")
+	ErrEmpty         = errors.New("passphrase is empty")
+	errNoKV          = errors.New("no Vault KV reader for passphrase source")
+	errNotTerminal   = errors.New("passphrase prompt needs a terminal")
+)
+
+// KV reads a field of a secret in a Vault KV secrets engine.
+type KV interface {
+	ReadKV(ctx context.Context, path string, field string) (string, error)
+}
+
+// Read returns the passphrase from source, which is one of:
+//
+//	env:NAME          the NAME environment variable
+//	file:PATH         the contents of the file at PATH, such as a mounted secret
+//	vault:PATH#FIELD  the FIELD of the Vault KV secret at PATH, read with kv
+//	prompt            typed on the terminal the enroller was started from
+//
+// Trailing newlines are removed. An empty source returns no passphrase.
+func Read(ctx context.Context, source string, kv KV) ([]byte, error) {
+	var passphrase string
+	switch {
+	case source == "":
+		return nil, nil
+	case strings.HasPrefix(source, EnvSource):
+		passphrase = os.Getenv(strings.TrimPrefix(source, EnvSource))
+	case strings.HasPrefix(source, FileSource):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(source, FileSource))
+		if err != nil {
+			return nil, err
+		}
+		passphrase = string(data)
+	case strings.HasPrefix(source, VaultSource):
+		if kv == nil {
+			return nil, errNoKV
+		}
+		path := strings.TrimPrefix(source, VaultSource)
+		field := "passphrase"
+		if i := strings.LastIndex(path, "#"); i >= 0 {
+			path, field = path[:i], path[i+1:]
+		}
+		var err error
+		if passphrase, err = kv.ReadKV(ctx, path, field); err != nil {
+			return nil, err
+		}
+	case source == PromptSource:
+		data, err := prompt()
+		if err != nil {
+			return nil, err
+		}
+		passphrase = string(data)
+	default:
+		return nil, ErrUnknownSource
+	}
+	passphrase = strings.TrimRight(passphrase, "\r\n")
+	if passphrase == "" {
+		return nil, ErrEmpty
+	}
+	return []byte(passphrase), nil
+}
+
+// prompt asks for the passphrase on the terminal without echoing it.
+var prompt = func() ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, errNotTerminal
+	}
+	fmt.Fprint(os.Stderr, "CA key passphrase: ")
+	defer fmt.Fprintln(os.Stderr)
+	return terminal.ReadPassword(fd)
+}
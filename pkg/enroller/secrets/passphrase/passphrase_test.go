@@ -0,0 +1,70 @@
+package passphrase
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testKV map[string]string
+
+func (kv testKV) ReadKV(ctx context.Context, path string, field string) (string, error) {
+	value, ok := kv[path+"#"+field]
+	if !ok {
+		return "", errors.New("not found")
+	}
+	return value, nil
+}
+
+func TestRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enroller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "passphrase")
+	if err := ioutil.WriteFile(file, []byte("from file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty")
+	if err := ioutil.WriteFile(empty, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("ENROLLER_TEST_PASSPHRASE", "from env")
+	defer os.Unsetenv("ENROLLER_TEST_PASSPHRASE")
+	kv := testKV{"secret/data/enroller#passphrase": "from vault", "secret/data/enroller#ca": "from vault field"}
+	prompt = func() ([]byte, error) { return []byte("from prompt"), nil }
+
+	testCases := []struct {
+		name   string
+		source string
+		kv     KV
+		want   string
+		err    error
+	}{
+		{"no source", "", nil, "", nil},
+		{"environment variable", "env:ENROLLER_TEST_PASSPHRASE", nil, "from env", nil},
+		{"unset environment variable", "env:ENROLLER_TEST_UNSET", nil, "", ErrEmpty},
+		{"file", "file:" + file, nil, "from file", nil},
+		{"empty file", "file:" + empty, nil, "", ErrEmpty},
+		{"Vault KV", "vault:secret/data/enroller", kv, "from vault", nil},
+		{"Vault KV field", "vault:secret/data/enroller#ca", kv, "from vault field", nil},
+		{"Vault KV without reader", "vault:secret/data/enroller", nil, "", errNoKV},
+		{"prompt", "prompt", nil, "from prompt", nil},
+		{"unknown source", "ENROLLER_TEST_PASSPHRASE", nil, "", ErrUnknownSource},
+	}
+	for _, tc := range testCases {
+		t.Run("Testing "+tc.name, func(t *testing.T) {
+			got, err := Read(context.Background(), tc.source, tc.kv)
+			if err != tc.err {
+				t.Fatalf("Got error %v; want %v", err, tc.err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("Got passphrase %q; want %q", got, tc.want)
+			}
+		})
+	}
+}
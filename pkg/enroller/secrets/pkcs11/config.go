@@ -0,0 +1,31 @@
+// Package pkcs11 implements secrets.Secrets with a CA key held in a PKCS#11
+// token. It needs cgo, without it NewHSM returns ErrNoCGO.
+package pkcs11
+
+import (
+	"crypto"
+	"errors"
+)
+
+// Config selects the token and key used to sign.
+type Config struct {
+	// Module is the path of the PKCS#11 library of the token.
+	Module string
+	// TokenLabel selects the token by its label. Slot is used when empty.
+	TokenLabel string
+	Slot       uint
+	PIN        string
+	// KeyLabel is the label of the CA private key in the token.
+	KeyLabel   string
+	CACert     string
+	OCSPServer string
+	CRLServer  string
+	// Hash is the hash of the certificate signatures, zero for the default
+	// of the CA key type.
+	Hash crypto.Hash
+	// Sessions bounds the sessions opened with the token, and so how many
+	// CSRs are signed at the same time.
+	Sessions int
+}
+
+var ErrNoCGO = errors.New("PKCS#11 support is not available in builds without cgo")
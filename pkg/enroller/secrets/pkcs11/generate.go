@@ -0,0 +1,136 @@
+//go:build cgo
+// +build cgo
+
+package pkcs11
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+
+	enrollercrypto "github.com/lamassuiot/enroller/pkg/enroller/crypto"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	p11 "github.com/miekg/pkcs11"
+)
+
+var errInvalidPublicKey = errors.New("invalid public key read from PKCS#11 token")
+
+// Named curve OIDs of the EC key parameters, as in crypto/x509.
+var curveOIDs = map[elliptic.Curve]asn1.ObjectIdentifier{
+	elliptic.P256(): {1, 2, 840, 10045, 3, 1, 7},
+	elliptic.P384(): {1, 3, 132, 0, 34},
+	elliptic.P521(): {1, 3, 132, 0, 35},
+}
+
+// GenerateKey generates a non extractable CA key labelled cfg.KeyLabel in
+// the token. The returned function closes the connection with the token.
+func GenerateKey(cfg Config, spec enrollercrypto.KeySpec, logger log.Logger) (crypto.Signer, func(), error) {
+	h := &HSM{
+		cfg:    cfg,
+		logger: logger,
+		sem:    make(chan struct{}, 1),
+		idle:   make(chan *session, 1),
+	}
+	pub, err := h.generate(spec)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not generate CA key in PKCS#11 token")
+		h.Close()
+		return nil, nil, err
+	}
+	level.Info(logger).Log("msg", "CA key "+cfg.KeyLabel+" generated in PKCS#11 token")
+	return &signer{h: h, ctx: context.Background(), pub: pub}, h.Close, nil
+}
+
+func (h *HSM) generate(spec enrollercrypto.KeySpec) (crypto.PublicKey, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.connect(); err != nil {
+		return nil, err
+	}
+	handle, err := h.login(p11.CKF_SERIAL_SESSION | p11.CKF_RW_SESSION)
+	if err != nil {
+		return nil, err
+	}
+	defer h.ctx.CloseSession(handle)
+	if _, err := h.findKey(handle); err != errKeyNotFound {
+		if err == nil {
+			err = errKeyExists
+		}
+		return nil, err
+	}
+
+	pubTemplate := []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_TOKEN, true),
+		p11.NewAttribute(p11.CKA_VERIFY, true),
+		p11.NewAttribute(p11.CKA_LABEL, h.cfg.KeyLabel),
+	}
+	privTemplate := []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_TOKEN, true),
+		p11.NewAttribute(p11.CKA_PRIVATE, true),
+		p11.NewAttribute(p11.CKA_SENSITIVE, true),
+		p11.NewAttribute(p11.CKA_EXTRACTABLE, false),
+		p11.NewAttribute(p11.CKA_SIGN, true),
+		p11.NewAttribute(p11.CKA_LABEL, h.cfg.KeyLabel),
+	}
+	var mechanism uint
+	if spec.RSABits > 0 {
+		mechanism = p11.CKM_RSA_PKCS_KEY_PAIR_GEN
+		pubTemplate = append(pubTemplate,
+			p11.NewAttribute(p11.CKA_MODULUS_BITS, spec.RSABits),
+			p11.NewAttribute(p11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}))
+	} else {
+		oid, ok := curveOIDs[spec.Curve]
+		if !ok {
+			return nil, errUnsupportedKey
+		}
+		params, err := asn1.Marshal(oid)
+		if err != nil {
+			return nil, err
+		}
+		mechanism = p11.CKM_EC_KEY_PAIR_GEN
+		pubTemplate = append(pubTemplate, p11.NewAttribute(p11.CKA_EC_PARAMS, params))
+	}
+	pub, _, err := h.ctx.GenerateKeyPair(handle, []*p11.Mechanism{p11.NewMechanism(mechanism, nil)}, pubTemplate, privTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return h.publicKey(handle, pub, spec)
+}
+
+// publicKey reads the generated public key pub from the token.
+func (h *HSM) publicKey(handle p11.SessionHandle, pub p11.ObjectHandle, spec enrollercrypto.KeySpec) (crypto.PublicKey, error) {
+	if spec.RSABits > 0 {
+		attrs, err := h.ctx.GetAttributeValue(handle, pub, []*p11.Attribute{
+			p11.NewAttribute(p11.CKA_MODULUS, nil),
+			p11.NewAttribute(p11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attrs[0].Value),
+			E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
+		}, nil
+	}
+	attrs, err := h.ctx.GetAttributeValue(handle, pub, []*p11.Attribute{p11.NewAttribute(p11.CKA_EC_POINT, nil)})
+	if err != nil {
+		return nil, err
+	}
+	// The point is an uncompressed point wrapped in a DER OCTET STRING.
+	var point []byte
+	if _, err := asn1.Unmarshal(attrs[0].Value, &point); err != nil {
+		return nil, err
+	}
+	x, y := elliptic.Unmarshal(spec.Curve, point)
+	if x == nil {
+		return nil, errInvalidPublicKey
+	}
+	return &ecdsa.PublicKey{Curve: spec.Curve, X: x, Y: y}, nil
+}
@@ -0,0 +1,43 @@
+//go:build !cgo
+// +build !cgo
+
+package pkcs11
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+
+	enrollercrypto "github.com/lamassuiot/enroller/pkg/enroller/crypto"
+	certstore "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store"
+
+	"github.com/go-kit/kit/log"
+)
+
+type HSM struct{}
+
+func NewHSM(cfg Config, certsDBStore certstore.DB, logger log.Logger) (*HSM, error) {
+	return nil, ErrNoCGO
+}
+
+func (h *HSM) SignCSR(ctx context.Context, csr *x509.CertificateRequest) ([]byte, error) {
+	return nil, ErrNoCGO
+}
+
+func (h *HSM) GetCACert() (*x509.Certificate, error) {
+	return nil, ErrNoCGO
+}
+
+func (h *HSM) CrossSign(ctx context.Context, cert *x509.Certificate) ([]byte, error) {
+	return nil, ErrNoCGO
+}
+
+func (h *HSM) Signer(ctx context.Context) crypto.Signer {
+	return nil
+}
+
+func (h *HSM) Close() {}
+
+func GenerateKey(cfg Config, spec enrollercrypto.KeySpec, logger log.Logger) (crypto.Signer, func(), error) {
+	return nil, nil, ErrNoCGO
+}
@@ -0,0 +1,433 @@
+//go:build cgo
+// +build cgo
+
+package pkcs11
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"sync"
+
+	enrollercrypto "github.com/lamassuiot/enroller/pkg/enroller/crypto"
+	certstore "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/secrets"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	p11 "github.com/miekg/pkcs11"
+)
+
+var (
+	errModule         = errors.New("could not load PKCS#11 module")
+	errTokenNotFound  = errors.New("PKCS#11 token not found")
+	errKeyNotFound    = errors.New("CA key not found in PKCS#11 token")
+	errKeyExists      = errors.New("a key with the CA key label already exists in PKCS#11 token")
+	errUnsupportedKey = errors.New("unsupported CA key type")
+	errUnsupportedAlg = errors.New("unsupported signature hash")
+	// errSessionClosed is returned for sessions of a connection that was
+	// closed after they were taken from the pool.
+	errSessionClosed = p11.Error(p11.CKR_SESSION_CLOSED)
+)
+
+// DigestInfo prefixes of PKCS #1 v1.5 signatures, as in crypto/rsa.
+var hashPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// HSM signs CSRs with a CA key in a PKCS#11 token. A removed token is found
+// again by its label on the next request.
+type HSM struct {
+	cfg          Config
+	caCert       *x509.Certificate
+	certsDBStore certstore.DB
+	logger       log.Logger
+	// draftKey signs the drafts checked before the CA key signs.
+	draftKey crypto.Signer
+
+	sem  chan struct{}
+	idle chan *session
+
+	// mu guards the connection. Signing holds it for reading so that the
+	// module is not finalized while a session is in use.
+	mu   sync.RWMutex
+	ctx  *p11.Ctx
+	slot uint
+}
+
+type session struct {
+	ctx    *p11.Ctx
+	handle p11.SessionHandle
+	key    p11.ObjectHandle
+}
+
+// NewHSM connects to the token and opens a first session, so that a wrong
+// module, token, PIN or key label is reported at startup.
+func NewHSM(cfg Config, certsDBStore certstore.DB, logger log.Logger) (*HSM, error) {
+	caCert, err := enrollercrypto.LoadCert(cfg.CACert)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not load CA certificate")
+		return nil, err
+	}
+	if _, err := enrollercrypto.SignatureAlgorithm(caCert.PublicKey, cfg.Hash); err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not choose signature algorithm for CA key")
+		return nil, err
+	}
+	draftKey, err := secrets.NewDraftKey(caCert.PublicKey)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not generate certificate draft key")
+		return nil, err
+	}
+	if cfg.Sessions <= 0 {
+		cfg.Sessions = 1
+	}
+	h := &HSM{
+		cfg:          cfg,
+		caCert:       caCert,
+		certsDBStore: certsDBStore,
+		logger:       logger,
+		draftKey:     draftKey,
+		sem:          make(chan struct{}, cfg.Sessions),
+		idle:         make(chan *session, cfg.Sessions),
+	}
+	s, err := h.get(context.Background())
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not open session with PKCS#11 token")
+		h.Close()
+		return nil, err
+	}
+	h.put(s, nil)
+	return h, nil
+}
+
+// Close closes the sessions and unloads the PKCS#11 module.
+func (h *HSM) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.disconnect()
+}
+
+// SignCSR signs csr with the CA key in the token. Only the default profile
+// is supported.
+func (h *HSM) SignCSR(ctx context.Context, csr *x509.CertificateRequest) ([]byte, error) {
+	if profile := secrets.Profile(ctx); profile != secrets.DefaultProfile {
+		level.Error(h.logger).Log("err", secrets.ErrUnknownProfile, "msg", "Profile "+profile+" is not supported by the PKCS#11 secret engine")
+		return nil, secrets.ErrUnknownProfile
+	}
+	serial, err := h.certsDBStore.Serial(ctx, h.caCert.Subject.String())
+	if err != nil {
+		level.Error(h.logger).Log("err", err, "msg", "Could not get serial from database")
+		return nil, err
+	}
+	template := secrets.Template(csr, serial, h.cfg.OCSPServer, h.cfg.CRLServer)
+	template.SignatureAlgorithm, _ = enrollercrypto.SignatureAlgorithm(h.caCert.PublicKey, h.cfg.Hash)
+	if _, err := secrets.Draft(template, h.caCert, csr.PublicKey, h.draftKey); err != nil {
+		level.Error(h.logger).Log("err", err, "msg", "Certificate draft not signed by PKCS#11 token")
+		return nil, err
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, h.caCert, csr.PublicKey, &signer{h: h, ctx: ctx, pub: h.caCert.PublicKey})
+	if err != nil {
+		level.Error(h.logger).Log("err", err, "msg", "Could not create signed certificate")
+		return nil, err
+	}
+	level.Info(h.logger).Log("msg", "CSR with serial "+fmt.Sprintf("%x", serial)+" signed by PKCS#11 token")
+	return cert, nil
+}
+
+func (h *HSM) GetCACert() (*x509.Certificate, error) {
+	return h.caCert, nil
+}
+
+// CrossSign signs the CA certificate cert with the CA key in the token.
+func (h *HSM) CrossSign(ctx context.Context, cert *x509.Certificate) ([]byte, error) {
+	serial, err := h.certsDBStore.Serial(ctx, h.caCert.Subject.String())
+	if err != nil {
+		level.Error(h.logger).Log("err", err, "msg", "Could not get serial from database")
+		return nil, err
+	}
+	template := secrets.CrossTemplate(cert, serial, h.caCert)
+	template.SignatureAlgorithm, _ = enrollercrypto.SignatureAlgorithm(h.caCert.PublicKey, h.cfg.Hash)
+	crossCert, err := x509.CreateCertificate(rand.Reader, template, h.caCert, cert.PublicKey, &signer{h: h, ctx: ctx, pub: h.caCert.PublicKey})
+	if err != nil {
+		level.Error(h.logger).Log("err", err, "msg", "Could not create cross-signed certificate")
+		return nil, err
+	}
+	level.Info(h.logger).Log("msg", "CA certificate "+cert.Subject.String()+" cross-signed by PKCS#11 token")
+	return crossCert, nil
+}
+
+// Signer returns the CA key in the token as a crypto.Signer that waits for
+// a pooled session until ctx is done.
+func (h *HSM) Signer(ctx context.Context) crypto.Signer {
+	return &signer{h: h, ctx: ctx, pub: h.caCert.PublicKey}
+}
+
+// signer is the crypto.Signer of the CA key used for one request.
+type signer struct {
+	h   *HSM
+	ctx context.Context
+	pub crypto.PublicKey
+}
+
+func (s *signer) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var mechanism uint
+	var data []byte
+	switch s.pub.(type) {
+	case *rsa.PublicKey:
+		prefix, ok := hashPrefixes[opts.HashFunc()]
+		if _, pss := opts.(*rsa.PSSOptions); pss || !ok {
+			return nil, errUnsupportedAlg
+		}
+		mechanism = p11.CKM_RSA_PKCS
+		data = append(append([]byte{}, prefix...), digest...)
+	case *ecdsa.PublicKey:
+		mechanism = p11.CKM_ECDSA
+		data = digest
+	default:
+		return nil, errUnsupportedKey
+	}
+	sig, err := s.h.sign(s.ctx, mechanism, data)
+	if err != nil || mechanism != p11.CKM_ECDSA {
+		return sig, err
+	}
+	// PKCS#11 returns the ECDSA r and s values concatenated, X.509 needs
+	// them DER encoded.
+	n := len(sig) / 2
+	return asn1.Marshal(struct{ R, S *big.Int }{new(big.Int).SetBytes(sig[:n]), new(big.Int).SetBytes(sig[n:])})
+}
+
+// sign signs data in a pooled session. If the token was lost it is signed
+// again once with a new connection.
+func (h *HSM) sign(ctx context.Context, mechanism uint, data []byte) ([]byte, error) {
+	sig, err := h.trySign(ctx, mechanism, data)
+	if isTokenLost(err) {
+		level.Warn(h.logger).Log("err", err, "msg", "Lost PKCS#11 token, reconnecting")
+		sig, err = h.trySign(ctx, mechanism, data)
+	}
+	if err != nil {
+		level.Error(h.logger).Log("err", err, "msg", "Could not sign with PKCS#11 token")
+	}
+	return sig, err
+}
+
+func (h *HSM) trySign(ctx context.Context, mechanism uint, data []byte) ([]byte, error) {
+	s, err := h.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := h.signWith(s, mechanism, data)
+	h.put(s, err)
+	return sig, err
+}
+
+func (h *HSM) signWith(s *session, mechanism uint, data []byte) ([]byte, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if s.ctx != h.ctx {
+		return nil, errSessionClosed
+	}
+	err := s.ctx.SignInit(s.handle, []*p11.Mechanism{p11.NewMechanism(mechanism, nil)}, s.key)
+	if err != nil {
+		return nil, err
+	}
+	return s.ctx.Sign(s.handle, data)
+}
+
+// get takes a session from the pool, opening a new one if none is idle. It
+// waits while Config.Sessions sessions are in use.
+func (h *HSM) get(ctx context.Context) (*session, error) {
+	select {
+	case h.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	for {
+		select {
+		case s := <-h.idle:
+			// Sessions of a closed connection are dropped.
+			if h.current(s) {
+				return s, nil
+			}
+		default:
+			s, err := h.open()
+			if err != nil {
+				<-h.sem
+				return nil, err
+			}
+			return s, nil
+		}
+	}
+}
+
+// put returns s to the pool after it was used with the given result. The
+// connection is closed instead if the token was lost.
+func (h *HSM) put(s *session, err error) {
+	defer func() { <-h.sem }()
+	if isTokenLost(err) {
+		h.mu.Lock()
+		if s.ctx == h.ctx {
+			h.disconnect()
+		}
+		h.mu.Unlock()
+		return
+	}
+	h.idle <- s
+}
+
+func (h *HSM) current(s *session) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return s.ctx == h.ctx
+}
+
+// open opens and logs in a session, connecting to the token first if
+// needed.
+func (h *HSM) open() (*session, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.ctx == nil {
+		if err := h.connect(); err != nil {
+			return nil, err
+		}
+	}
+	s, err := h.openSession()
+	if isTokenLost(err) {
+		h.disconnect()
+	}
+	return s, err
+}
+
+func (h *HSM) openSession() (*session, error) {
+	handle, err := h.login(p11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, err
+	}
+	key, err := h.findKey(handle)
+	if err != nil {
+		h.ctx.CloseSession(handle)
+		return nil, err
+	}
+	return &session{ctx: h.ctx, handle: handle, key: key}, nil
+}
+
+// login opens a session with flags and logs in.
+func (h *HSM) login(flags uint) (p11.SessionHandle, error) {
+	handle, err := h.ctx.OpenSession(h.slot, flags)
+	if err != nil {
+		return 0, err
+	}
+	// The login is shared by all the sessions of the module.
+	err = h.ctx.Login(handle, p11.CKU_USER, h.cfg.PIN)
+	if err != nil && err != p11.Error(p11.CKR_USER_ALREADY_LOGGED_IN) {
+		h.ctx.CloseSession(handle)
+		return 0, err
+	}
+	return handle, nil
+}
+
+func (h *HSM) findKey(handle p11.SessionHandle) (p11.ObjectHandle, error) {
+	template := []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_CLASS, p11.CKO_PRIVATE_KEY),
+		p11.NewAttribute(p11.CKA_LABEL, h.cfg.KeyLabel),
+	}
+	if err := h.ctx.FindObjectsInit(handle, template); err != nil {
+		return 0, err
+	}
+	keys, _, err := h.ctx.FindObjects(handle, 1)
+	h.ctx.FindObjectsFinal(handle)
+	if err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 {
+		return 0, errKeyNotFound
+	}
+	return keys[0], nil
+}
+
+// connect loads the module and finds the token. h.mu must be held.
+func (h *HSM) connect() error {
+	ctx := p11.New(h.cfg.Module)
+	if ctx == nil {
+		return errModule
+	}
+	err := ctx.Initialize()
+	if err != nil && err != p11.Error(p11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		ctx.Destroy()
+		return err
+	}
+	slot, err := h.findSlot(ctx)
+	if err != nil {
+		ctx.Finalize()
+		ctx.Destroy()
+		return err
+	}
+	h.ctx, h.slot = ctx, slot
+	level.Info(h.logger).Log("msg", "Connected to PKCS#11 token in slot "+strconv.FormatUint(uint64(slot), 10))
+	return nil
+}
+
+func (h *HSM) findSlot(ctx *p11.Ctx) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, err
+	}
+	for _, slot := range slots {
+		if h.cfg.TokenLabel == "" {
+			if slot == h.cfg.Slot {
+				return slot, nil
+			}
+			continue
+		}
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			return 0, err
+		}
+		if info.Label == h.cfg.TokenLabel {
+			return slot, nil
+		}
+	}
+	return 0, errTokenNotFound
+}
+
+// disconnect closes the sessions and unloads the module. h.mu must be held.
+func (h *HSM) disconnect() {
+	if h.ctx == nil {
+		return
+	}
+	h.ctx.CloseAllSessions(h.slot)
+	h.ctx.Finalize()
+	h.ctx.Destroy()
+	h.ctx = nil
+}
+
+// isTokenLost tells whether err means that the token, the session or the
+// login are gone and a new connection is needed.
+func isTokenLost(err error) bool {
+	var p11Err p11.Error
+	if !errors.As(err, &p11Err) {
+		return false
+	}
+	switch p11Err {
+	case p11.CKR_DEVICE_ERROR, p11.CKR_DEVICE_REMOVED, p11.CKR_TOKEN_NOT_PRESENT, p11.CKR_TOKEN_NOT_RECOGNIZED,
+		p11.CKR_SESSION_CLOSED, p11.CKR_SESSION_HANDLE_INVALID, p11.CKR_USER_NOT_LOGGED_IN,
+		p11.CKR_KEY_HANDLE_INVALID, p11.CKR_OBJECT_HANDLE_INVALID, p11.CKR_CRYPTOKI_NOT_INITIALIZED:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,315 @@
+//go:build cgo
+// +build cgo
+
+package pkcs11
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	enrollercrypto "github.com/lamassuiot/enroller/pkg/enroller/crypto"
+	certsmemory "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store/memory"
+	"github.com/lamassuiot/enroller/pkg/enroller/secrets"
+
+	"github.com/go-kit/kit/log"
+	p11 "github.com/miekg/pkcs11"
+)
+
+const (
+	tokenLabel = "enroller"
+	keyLabel   = "ca"
+	soPIN      = "12345678"
+	userPIN    = "87654321"
+)
+
+// softHSMModules are the usual install locations of SoftHSM 2. The
+// SOFTHSM2_MODULE environment variable takes precedence.
+var softHSMModules = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+	"/usr/local/opt/softhsm/lib/softhsm/libsofthsm2.so",
+}
+
+// setupSoftHSM creates a SoftHSM token with an RSA CA key and returns the
+// configuration to sign with it and a cleanup function.
+func setupSoftHSM(t *testing.T) (Config, func()) {
+	module := os.Getenv("SOFTHSM2_MODULE")
+	for _, m := range softHSMModules {
+		if module != "" {
+			break
+		}
+		if _, err := os.Stat(m); err == nil {
+			module = m
+		}
+	}
+	if module == "" {
+		t.Skip("SoftHSM 2 is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "enroller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	conf := filepath.Join(dir, "softhsm2.conf")
+	if err := os.Mkdir(filepath.Join(dir, "tokens"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(conf, []byte("directories.tokendir = "+filepath.Join(dir, "tokens")+"\nobjectstore.backend = file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("SOFTHSM2_CONF", conf)
+
+	ctx := p11.New(module)
+	if ctx == nil {
+		t.Fatal("could not load SoftHSM module")
+	}
+	defer ctx.Destroy()
+	if err := ctx.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Finalize()
+	slots, err := ctx.GetSlotList(false)
+	if err != nil || len(slots) == 0 {
+		t.Fatalf("no SoftHSM slots: %v", err)
+	}
+	if err := ctx.InitToken(slots[0], soPIN, tokenLabel); err != nil {
+		t.Fatal(err)
+	}
+	// SoftHSM moves an initialized token to a new slot.
+	h := &HSM{cfg: Config{TokenLabel: tokenLabel}}
+	slot, err := h.findSlot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh, err := ctx.OpenSession(slot, p11.CKF_SERIAL_SESSION|p11.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.CloseSession(sh)
+	if err := ctx.Login(sh, p11.CKU_SO, soPIN); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.InitPIN(sh, userPIN); err != nil {
+		t.Fatal(err)
+	}
+	ctx.Logout(sh)
+	if err := ctx.Login(sh, p11.CKU_USER, userPIN); err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Logout(sh)
+	pub, _, err := ctx.GenerateKeyPair(sh,
+		[]*p11.Mechanism{p11.NewMechanism(p11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)},
+		[]*p11.Attribute{
+			p11.NewAttribute(p11.CKA_TOKEN, true),
+			p11.NewAttribute(p11.CKA_VERIFY, true),
+			p11.NewAttribute(p11.CKA_MODULUS_BITS, 2048),
+			p11.NewAttribute(p11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+			p11.NewAttribute(p11.CKA_LABEL, keyLabel),
+		},
+		[]*p11.Attribute{
+			p11.NewAttribute(p11.CKA_TOKEN, true),
+			p11.NewAttribute(p11.CKA_PRIVATE, true),
+			p11.NewAttribute(p11.CKA_SENSITIVE, true),
+			p11.NewAttribute(p11.CKA_SIGN, true),
+			p11.NewAttribute(p11.CKA_LABEL, keyLabel),
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := ctx.GetAttributeValue(sh, pub, []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_MODULUS, nil),
+		p11.NewAttribute(p11.CKA_PUBLIC_EXPONENT, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKey := &rsa.PublicKey{
+		N: new(big.Int).SetBytes(attrs[0].Value),
+		E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
+	}
+
+	// The HSM only uses the public key and subject of the CA certificate,
+	// so it is signed with a throwaway key.
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Enroller HSM CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, caKey, signingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(caCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return Config{
+		Module:     module,
+		TokenLabel: tokenLabel,
+		PIN:        userPIN,
+		KeyLabel:   keyLabel,
+		CACert:     caCert,
+		OCSPServer: "http://ocsp.test.com",
+		Sessions:   2,
+	}, cleanup
+}
+
+func testCSR(t *testing.T) *x509.CertificateRequest {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "device.test.com"}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+func signAndVerify(t *testing.T, h *HSM) {
+	der, err := h.SignCSR(context.Background(), testCSR(t))
+	if err != nil {
+		t.Errorf("SignCSR: %s", err)
+		return
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	caCert, _ := h.GetCACert()
+	if err := crt.CheckSignatureFrom(caCert); err != nil {
+		t.Errorf("certificate is not signed by the CA key: %s", err)
+	}
+}
+
+func TestSignCSR(t *testing.T) {
+	cfg, cleanup := setupSoftHSM(t)
+	defer cleanup()
+
+	h, err := NewHSM(cfg, certsmemory.NewDB(), log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			signAndVerify(t, h)
+		}()
+	}
+	wg.Wait()
+
+	if _, err := h.SignCSR(secrets.WithProfile(context.Background(), "server"), testCSR(t)); err != secrets.ErrUnknownProfile {
+		t.Errorf("SignCSR with unknown profile returned %v, want %s", err, secrets.ErrUnknownProfile)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	cfg, cleanup := setupSoftHSM(t)
+	defer cleanup()
+
+	h, err := NewHSM(cfg, certsmemory.NewDB(), log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	signAndVerify(t, h)
+
+	// Closing the sessions behind the pool makes the token answer as if it
+	// had been removed and inserted again.
+	h.mu.Lock()
+	lost := h.ctx
+	h.ctx.CloseAllSessions(h.slot)
+	h.mu.Unlock()
+
+	signAndVerify(t, h)
+	if h.current(&session{ctx: lost}) {
+		t.Error("the connection was not replaced")
+	}
+}
+
+func TestNewHSMErrors(t *testing.T) {
+	cfg, cleanup := setupSoftHSM(t)
+	defer cleanup()
+
+	wrongPIN := cfg
+	wrongPIN.PIN = "00000000"
+	wrongKey := cfg
+	wrongKey.KeyLabel = "other"
+	wrongToken := cfg
+	wrongToken.TokenLabel = "other"
+	for name, c := range map[string]Config{"PIN": wrongPIN, "key label": wrongKey, "token label": wrongToken} {
+		if h, err := NewHSM(c, certsmemory.NewDB(), log.NewNopLogger()); err == nil {
+			h.Close()
+			t.Errorf("NewHSM succeeded with a wrong %s", name)
+		}
+	}
+}
+
+func TestGenerateKey(t *testing.T) {
+	cfg, cleanup := setupSoftHSM(t)
+	defer cleanup()
+
+	if _, _, err := GenerateKey(cfg, enrollercrypto.KeySpec{RSABits: 2048}, log.NewNopLogger()); err != errKeyExists {
+		t.Errorf("GenerateKey with an existing label returned %v, want %s", err, errKeyExists)
+	}
+
+	for _, spec := range []enrollercrypto.KeySpec{{RSABits: 2048}, {Curve: elliptic.P384()}} {
+		cfg.KeyLabel = "root" + strconv.Itoa(spec.RSABits)
+		key, closeKey, err := GenerateKey(cfg, spec, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "Root CA"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+		closeKey()
+		if err != nil {
+			t.Fatalf("self-signing with the generated key: %s", err)
+		}
+		root, _ := x509.ParseCertificate(der)
+		if err := root.CheckSignatureFrom(root); err != nil {
+			t.Errorf("certificate is not signed by the generated key: %s", err)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Package remote signs certificates with a CA key held by a signer daemon,
+// reached over gRPC with mutual TLS.
+package remote
+
+import (
+	"context"
+	stdcrypto "crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/crypto"
+	certstore "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store"
+	"github.com/lamassuiot/enroller/pkg/enroller/secrets"
+	"github.com/lamassuiot/enroller/pkg/signer"
+	"github.com/lamassuiot/enroller/pkg/signer/signerpb"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+var (
+	errNoCACert  = errors.New("signer returned no CA certificate")
+	errUnhealthy = errors.New("signer cannot sign")
+)
+
+// Config configures the connection to the signer.
+type Config struct {
+	// Address is the host:port of the signer.
+	Address string
+	// CA verifies the signer certificate. Cert and Key authenticate the
+	// enroller to the signer.
+	CA   string
+	Cert string
+	Key  string
+
+	OCSPServer string
+	CRLServer  string
+	// Hash is the hash of the certificate signatures, zero for the default
+	// of the CA key type.
+	Hash stdcrypto.Hash
+}
+
+// Remote is a secret engine that builds the certificates and has them
+// signed by the signer.
+type Remote struct {
+	cfg          Config
+	conn         *grpc.ClientConn
+	client       signerpb.SignerClient
+	caCert       *x509.Certificate
+	chain        []*x509.Certificate
+	certsDBStore certstore.DB
+	logger       log.Logger
+
+	signatureAlgorithm x509.SignatureAlgorithm
+	// draftKey signs the drafts sent to the signer.
+	draftKey stdcrypto.Signer
+}
+
+// NewRemote connects to the signer and gets its CA certificate, so that an
+// unreachable signer is reported at startup.
+func NewRemote(ctx context.Context, cfg Config, certsDBStore certstore.DB, logger log.Logger) (*Remote, error) {
+	tlsConfig, err := signer.ClientTLSConfig(cfg.Cert, cfg.Key, cfg.CA)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not load signer TLS configuration")
+		return nil, err
+	}
+	conn, err := grpc.DialContext(ctx, cfg.Address, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not connect to signer")
+		return nil, err
+	}
+	r := &Remote{cfg: cfg, conn: conn, client: signerpb.NewSignerClient(conn), certsDBStore: certsDBStore, logger: logger}
+	if err := r.load(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	level.Info(logger).Log("msg", "Connection established with signer", "address", cfg.Address, "subject", r.caCert.Subject.String())
+	return r, nil
+}
+
+func (r *Remote) load(ctx context.Context) error {
+	resp, err := r.client.GetCAChain(ctx, &signerpb.GetCAChainRequest{})
+	if err != nil {
+		level.Error(r.logger).Log("err", err, "msg", "Could not get CA chain from signer")
+		return err
+	}
+	if len(resp.Certificates) == 0 {
+		return errNoCACert
+	}
+	var certs []*x509.Certificate
+	for _, der := range resp.Certificates {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			level.Error(r.logger).Log("err", err, "msg", "Could not parse CA chain from signer")
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	r.caCert, r.chain = certs[0], certs[1:]
+	if r.signatureAlgorithm, err = crypto.SignatureAlgorithm(r.caCert.PublicKey, r.cfg.Hash); err != nil {
+		level.Error(r.logger).Log("err", err, "msg", "Could not choose signature algorithm for CA key")
+		return err
+	}
+	if r.draftKey, err = secrets.NewDraftKey(r.caCert.PublicKey); err != nil {
+		level.Error(r.logger).Log("err", err, "msg", "Could not generate certificate draft key")
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection to the signer.
+func (r *Remote) Close() {
+	r.conn.Close()
+}
+
+// SignCSR builds the certificate for csr and has the signer sign it. Only
+// the default profile is supported.
+func (r *Remote) SignCSR(ctx context.Context, csr *x509.CertificateRequest) ([]byte, error) {
+	if profile := secrets.Profile(ctx); profile != secrets.DefaultProfile {
+		level.Error(r.logger).Log("err", secrets.ErrUnknownProfile, "msg", "Profile "+profile+" is not supported by the remote secret engine")
+		return nil, secrets.ErrUnknownProfile
+	}
+	serial, err := r.certsDBStore.Serial(ctx, r.caCert.Subject.String())
+	if err != nil {
+		level.Error(r.logger).Log("err", err, "msg", "Could not get serial from database")
+		return nil, err
+	}
+	template := secrets.Template(csr, serial, r.cfg.OCSPServer, r.cfg.CRLServer)
+	template.SignatureAlgorithm = r.signatureAlgorithm
+
+	draft, err := secrets.Draft(template, r.caCert, csr.PublicKey, r.draftKey)
+	if err != nil {
+		level.Error(r.logger).Log("err", err, "msg", "Could not create certificate draft")
+		return nil, err
+	}
+	resp, err := r.client.Sign(ctx, &signerpb.SignRequest{TbsCertificate: draft.RawTBSCertificate})
+	if err != nil {
+		level.Error(r.logger).Log("err", err, "msg", "Could not sign certificate with signer")
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(resp.Certificate)
+	if err != nil {
+		level.Error(r.logger).Log("err", err, "msg", "Could not parse certificate signed by signer")
+		return nil, err
+	}
+	if err := cert.CheckSignatureFrom(r.caCert); err != nil {
+		level.Error(r.logger).Log("err", err, "msg", "Certificate signed by signer is not signed by the CA key")
+		return nil, err
+	}
+	level.Info(r.logger).Log("msg", "CSR with serial "+fmt.Sprintf("%x", serial)+" signed by remote signer")
+	return resp.Certificate, nil
+}
+
+// GetCACert returns the CA certificate of the signer.
+func (r *Remote) GetCACert() (*x509.Certificate, error) {
+	return r.caCert, nil
+}
+
+// Chain returns the issuers of the CA certificate sent by the signer.
+func (r *Remote) Chain() []*x509.Certificate {
+	return r.chain
+}
+
+// Health tells whether the signer is reachable and can sign.
+func (r *Remote) Health(ctx context.Context) error {
+	resp, err := r.client.Health(ctx, &signerpb.HealthRequest{})
+	if err != nil {
+		return err
+	}
+	if !resp.Healthy {
+		return errUnhealthy
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package remote
+
+import (
+	"context"
+	stdcrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/crypto"
+	"github.com/lamassuiot/enroller/pkg/enroller/lint"
+	certsmemory "github.com/lamassuiot/enroller/pkg/enroller/models/certs/store/memory"
+	"github.com/lamassuiot/enroller/pkg/signer"
+	"github.com/lamassuiot/enroller/pkg/signer/signerpb"
+
+	"github.com/go-kit/kit/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// issue returns a certificate for key issued by issuer with issuerKey, or
+// self-signed when issuer is nil.
+func issue(t *testing.T, template *x509.Certificate, key stdcrypto.Signer, issuer *x509.Certificate, issuerKey stdcrypto.Signer) *x509.Certificate {
+	template.SerialNumber, _ = crypto.GenerateSerial()
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().AddDate(2, 0, 0)
+	if issuer == nil {
+		issuer, issuerKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, key.Public(), issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func newCA(t *testing.T, name string, key stdcrypto.Signer) *x509.Certificate {
+	return issue(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, key, nil, nil)
+}
+
+// writeTLS writes a TLS certificate issued by ca with caKey and its key,
+// returning their paths.
+func writeTLS(t *testing.T, dir string, name string, ca *x509.Certificate, caKey stdcrypto.Signer) (string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cert := issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}, key, ca, caKey)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	writePEM(t, certFile, crypto.CertPEMBlockType, cert.Raw)
+	writePEM(t, keyFile, crypto.PKCS8PEMBlockType, keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, path string, blockType string, der []byte) {
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignCSR(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enroller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The signer and the enroller trust the same TLS CA.
+	tlsKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tlsCA := newCA(t, "TLS CA", tlsKey)
+	tlsCAFile := filepath.Join(dir, "tls-ca.crt")
+	writePEM(t, tlsCAFile, crypto.CertPEMBlockType, tlsCA.Raw)
+	serverCert, serverKey := writeTLS(t, dir, "signer", tlsCA, tlsKey)
+	clientCert, clientKey := writeTLS(t, dir, "enroller", tlsCA, tlsKey)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherCert, otherKeyFile := writeTLS(t, dir, "other", newCA(t, "Other TLS CA", otherKey), otherKey)
+
+	rootKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	root := newCA(t, "Root CA", rootKey)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+
+	testCases := []struct {
+		name       string
+		key        stdcrypto.Signer
+		clientCert string
+		clientKey  string
+		ok         bool
+	}{
+		{"RSA CA", rsaKey, clientCert, clientKey, true},
+		{"P-384 CA", p384Key, clientCert, clientKey, true},
+		{"Client certificate from other CA", p384Key, otherCert, otherKeyFile, false},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.name), func(t *testing.T) {
+			caCert := issue(t, &x509.Certificate{
+				Subject:               pkix.Name{CommonName: "Enroller CA"},
+				IsCA:                  true,
+				BasicConstraintsValid: true,
+				KeyUsage:              x509.KeyUsageCertSign,
+			}, tc.key, root, rootKey)
+			server, err := signer.NewServer(caCert, []*x509.Certificate{root}, tc.key, 0, log.NewNopLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tlsConfig, err := signer.ServerTLSConfig(serverCert, serverKey, tlsCAFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			grpcServer := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)))
+			signerpb.RegisterSignerServer(grpcServer, server)
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go grpcServer.Serve(listener)
+			defer grpcServer.Stop()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			remote, err := NewRemote(ctx, Config{
+				Address:    listener.Addr().String(),
+				CA:         tlsCAFile,
+				Cert:       tc.clientCert,
+				Key:        tc.clientKey,
+				OCSPServer: "http://ocsp.test.com",
+			}, certsmemory.NewDB(), log.NewNopLogger())
+			if !tc.ok {
+				if err == nil {
+					remote.Close()
+					t.Fatal("Got result is nil; want error for a client the signer does not trust")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer remote.Close()
+			if chain := remote.Chain(); len(chain) != 1 || !chain[0].Equal(root) {
+				t.Errorf("Got chain of %d certificates; want the root", len(chain))
+			}
+			if err := remote.Health(ctx); err != nil {
+				t.Errorf("Got result is %s; want healthy signer", err)
+			}
+
+			deviceKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			csrDER, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "device.test.com"}}, deviceKey)
+			csr, _ := x509.ParseCertificateRequest(csrDER)
+			der, err := remote.SignCSR(ctx, csr)
+			if err != nil {
+				t.Fatalf("SignCSR returned an error: %s", err)
+			}
+			crt, err := x509.ParseCertificate(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := crt.CheckSignatureFrom(caCert); err != nil {
+				t.Errorf("Got result is %s; want certificate signed by the CA key", err)
+			}
+			if findings := lint.Certificate(crt, caCert); findings.HasErrors() {
+				t.Errorf("Certificate does not pass checks: %s", findings.Errors())
+			}
+		})
+	}
+}
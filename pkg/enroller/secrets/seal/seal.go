@@ -0,0 +1,203 @@
+// Package seal keeps the secret engine of a CA sealed until the passphrase
+// of its key is rebuilt from Shamir secret shares submitted by different
+// custodians, so that no single person can unlock the CA key.
+package seal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/secrets"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/hashicorp/vault/shamir"
+)
+
+// Source is the prefix of the CA key passphrase source of sealed CAs,
+// followed by the number of shares needed to unseal them, as in
+// "shamir:3".
+const Source = "shamir:"
+
+// PassphraseSize is the size of the random passphrases split into shares.
+const PassphraseSize = 32
+
+var (
+	// ErrInvalidShares is returned when the submitted shares do not rebuild
+	// the CA key passphrase. They are discarded and must be submitted
+	// again.
+	ErrInvalidShares = errors.New("unseal shares do not rebuild the CA key passphrase")
+	// ErrSameCustodian is returned when a custodian submits a second share.
+	ErrSameCustodian = errors.New("custodian already submitted an unseal share")
+
+	errThreshold = errors.New("at least two unseal shares must be needed")
+)
+
+// ParseSource tells whether source is a Source and returns its threshold.
+func ParseSource(source string) (threshold int, ok bool, err error) {
+	if !strings.HasPrefix(source, Source) {
+		return 0, false, nil
+	}
+	threshold, err = strconv.Atoi(strings.TrimPrefix(source, Source))
+	if err != nil {
+		return 0, true, err
+	}
+	if threshold < 2 {
+		return 0, true, errThreshold
+	}
+	return threshold, true, nil
+}
+
+// NewPassphrase returns a random passphrase split into shares, of which
+// threshold rebuild it.
+func NewPassphrase(shares int, threshold int) ([]byte, [][]byte, error) {
+	if threshold < 2 {
+		return nil, nil, errThreshold
+	}
+	passphrase := make([]byte, PassphraseSize)
+	if _, err := rand.Read(passphrase); err != nil {
+		return nil, nil, err
+	}
+	parts, err := shamir.Split(passphrase, shares, threshold)
+	if err != nil {
+		return nil, nil, err
+	}
+	return passphrase, parts, nil
+}
+
+// Open loads the secret engine with the CA key decrypted with passphrase.
+// The returned function releases it.
+type Open func(passphrase []byte) (secrets.Secrets, func(), error)
+
+// Seal is a secret engine that refuses to sign until it is unsealed, and
+// then signs with the secret engine returned by its Open function.
+type Seal struct {
+	caCert    *x509.Certificate
+	threshold int
+	open      Open
+	logger    log.Logger
+
+	mu         sync.RWMutex
+	shares     [][]byte
+	custodians map[string]bool
+	secrets    secrets.Secrets
+	close      func()
+}
+
+// New returns a sealed secret engine for the CA certificate caCert, opened
+// when threshold shares are submitted.
+func New(caCert *x509.Certificate, threshold int, open Open, logger log.Logger) (*Seal, error) {
+	if threshold < 2 {
+		return nil, errThreshold
+	}
+	return &Seal{
+		caCert:     caCert,
+		threshold:  threshold,
+		open:       open,
+		logger:     logger,
+		custodians: make(map[string]bool),
+	}, nil
+}
+
+// Unseal adds the share of custodian and, once there are enough shares,
+// opens the secret engine with the passphrase they rebuild. Shares that do
+// not rebuild it are all discarded.
+func (s *Seal) Unseal(custodian string, share []byte) (secrets.SealStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.secrets != nil {
+		return s.status(), nil
+	}
+	if s.custodians[custodian] {
+		level.Warn(s.logger).Log("err", ErrSameCustodian, "msg", "Custodian "+custodian+" submitted a second unseal share")
+		return s.status(), ErrSameCustodian
+	}
+	s.shares = append(s.shares, share)
+	s.custodians[custodian] = true
+	level.Info(s.logger).Log("msg", fmt.Sprintf("Unseal share submitted by %s, %d of %d", custodian, len(s.shares), s.threshold))
+	if len(s.shares) < s.threshold {
+		return s.status(), nil
+	}
+
+	passphrase, err := shamir.Combine(s.shares)
+	s.shares, s.custodians = nil, make(map[string]bool)
+	if err != nil {
+		level.Error(s.logger).Log("err", err, "msg", "Could not combine unseal shares")
+		return s.status(), ErrInvalidShares
+	}
+	sec, closeSecrets, err := s.open(passphrase)
+	for i := range passphrase {
+		passphrase[i] = 0
+	}
+	if err != nil {
+		level.Error(s.logger).Log("err", err, "msg", "Could not open CA key with the passphrase rebuilt from unseal shares")
+		return s.status(), ErrInvalidShares
+	}
+	s.secrets, s.close = sec, closeSecrets
+	level.Info(s.logger).Log("msg", "CA key unsealed")
+	return s.status(), nil
+}
+
+// SealStatus returns whether the CA key is sealed and how many shares were
+// submitted.
+func (s *Seal) SealStatus() secrets.SealStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.status()
+}
+
+func (s *Seal) status() secrets.SealStatus {
+	return secrets.SealStatus{Sealed: s.secrets == nil, Threshold: s.threshold, Progress: len(s.shares)}
+}
+
+func (s *Seal) unsealed() secrets.Secrets {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.secrets
+}
+
+// SignCSR signs csr once the CA key is unsealed.
+func (s *Seal) SignCSR(ctx context.Context, csr *x509.CertificateRequest) ([]byte, error) {
+	sec := s.unsealed()
+	if sec == nil {
+		level.Error(s.logger).Log("err", secrets.ErrSealed, "msg", "Could not sign CSR")
+		return nil, secrets.ErrSealed
+	}
+	return sec.SignCSR(ctx, csr)
+}
+
+// GetCACert returns the CA certificate, which is available while sealed.
+func (s *Seal) GetCACert() (*x509.Certificate, error) {
+	if sec := s.unsealed(); sec != nil {
+		return sec.GetCACert()
+	}
+	return s.caCert, nil
+}
+
+// CrossSign cross-signs cert once the CA key is unsealed.
+func (s *Seal) CrossSign(ctx context.Context, cert *x509.Certificate) ([]byte, error) {
+	sec := s.unsealed()
+	if sec == nil {
+		return nil, secrets.ErrSealed
+	}
+	signer, ok := sec.(secrets.CrossSigner)
+	if !ok {
+		return nil, secrets.ErrCrossSignNotSupported
+	}
+	return signer.CrossSign(ctx, cert)
+}
+
+// Close releases the secret engine if it was unsealed.
+func (s *Seal) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.close != nil {
+		s.close()
+	}
+}
@@ -0,0 +1,106 @@
+package seal
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/secrets"
+
+	"github.com/go-kit/kit/log"
+)
+
+type testSecrets struct{}
+
+func (testSecrets) SignCSR(ctx context.Context, csr *x509.CertificateRequest) ([]byte, error) {
+	return []byte("certificate"), nil
+}
+
+func (testSecrets) GetCACert() (*x509.Certificate, error) {
+	return &x509.Certificate{}, nil
+}
+
+func newTestSeal(t *testing.T, threshold int) (*Seal, [][]byte) {
+	passphrase, shares, err := NewPassphrase(5, threshold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := func(p []byte) (secrets.Secrets, func(), error) {
+		if !bytes.Equal(p, passphrase) {
+			return nil, nil, errors.New("wrong passphrase")
+		}
+		return testSecrets{}, func() {}, nil
+	}
+	s, err := New(&x509.Certificate{}, threshold, open, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, shares
+}
+
+func TestUnseal(t *testing.T) {
+	s, shares := newTestSeal(t, 3)
+	if _, err := s.SignCSR(context.Background(), &x509.CertificateRequest{}); err != secrets.ErrSealed {
+		t.Errorf("Got result is %v; want %s", err, secrets.ErrSealed)
+	}
+	if _, err := s.GetCACert(); err != nil {
+		t.Errorf("Got result is %s; want CA certificate while sealed", err)
+	}
+
+	s.Unseal("alice", shares[0])
+	if _, err := s.Unseal("alice", shares[1]); err != ErrSameCustodian {
+		t.Errorf("Got result is %v; want %s", err, ErrSameCustodian)
+	}
+	s.Unseal("bob", shares[3])
+	if status := s.SealStatus(); !status.Sealed || status.Progress != 2 || status.Threshold != 3 {
+		t.Errorf("Got status %+v; want sealed with 2 of 3 shares", status)
+	}
+	status, err := s.Unseal("carol", shares[4])
+	if err != nil || status.Sealed {
+		t.Fatalf("Got status %+v, %v; want unsealed", status, err)
+	}
+	if _, err := s.SignCSR(context.Background(), &x509.CertificateRequest{}); err != nil {
+		t.Errorf("Got result is %s; want nil once unsealed", err)
+	}
+}
+
+func TestUnsealInvalidShares(t *testing.T) {
+	s, shares := newTestSeal(t, 2)
+	_, otherShares := newTestSeal(t, 2)
+	s.Unseal("alice", shares[0])
+	if _, err := s.Unseal("bob", otherShares[1]); err != ErrInvalidShares {
+		t.Errorf("Got result is %v; want %s", err, ErrInvalidShares)
+	}
+	// The shares are discarded, so the same custodians can start again.
+	if status := s.SealStatus(); !status.Sealed || status.Progress != 0 {
+		t.Errorf("Got status %+v; want sealed without shares", status)
+	}
+	s.Unseal("alice", shares[0])
+	if status, err := s.Unseal("bob", shares[1]); err != nil || status.Sealed {
+		t.Errorf("Got status %+v, %v; want unsealed", status, err)
+	}
+}
+
+func TestParseSource(t *testing.T) {
+	testCases := []struct {
+		source    string
+		threshold int
+		ok        bool
+		ret       error
+	}{
+		{"shamir:3", 3, true, nil},
+		{"shamir:1", 0, true, errThreshold},
+		{"env:PASSPHRASE", 0, false, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Testing %s", tc.source), func(t *testing.T) {
+			threshold, ok, err := ParseSource(tc.source)
+			if threshold != tc.threshold || ok != tc.ok || err != tc.ret {
+				t.Errorf("Got %d, %t, %v; want %d, %t, %v", threshold, ok, err, tc.threshold, tc.ok, tc.ret)
+			}
+		})
+	}
+}
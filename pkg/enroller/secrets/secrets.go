@@ -1,7 +1,79 @@
 package secrets
 
-import "crypto/x509"
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"time"
+)
 
 type Secrets interface {
-	SignCSR(csr *x509.CertificateRequest) ([]byte, error)
+	SignCSR(ctx context.Context, csr *x509.CertificateRequest) ([]byte, error)
+	GetCACert() (*x509.Certificate, error)
+}
+
+// DefaultProfile is the certificate profile used when a CSR is approved
+// without choosing one.
+const DefaultProfile = "default"
+
+// ErrUnknownProfile is returned by SignCSR when the profile in the context
+// is not configured.
+var ErrUnknownProfile = errors.New("unknown certificate profile")
+
+// ErrSealed is returned by SignCSR while the CA key is sealed.
+var ErrSealed = errors.New("CA key is sealed until enough custodians submit their unseal shares")
+
+// Unsealer is implemented by the secret engines that start sealed and only
+// sign once enough custodians submitted their share of the CA key
+// passphrase.
+type Unsealer interface {
+	// Unseal adds the share of custodian. Each custodian submits one share.
+	Unseal(custodian string, share []byte) (SealStatus, error)
+	SealStatus() SealStatus
+}
+
+// SealStatus tells whether a CA key is sealed, and how many of the
+// Threshold shares needed to unseal it were submitted.
+type SealStatus struct {
+	Sealed    bool
+	Threshold int
+	Progress  int
+}
+
+type profileKey struct{}
+
+// WithProfile returns a context that makes SignCSR issue the certificate
+// with the given profile. An empty profile selects DefaultProfile.
+func WithProfile(ctx context.Context, profile string) context.Context {
+	return context.WithValue(ctx, profileKey{}, profile)
+}
+
+// Profile returns the certificate profile selected in ctx.
+func Profile(ctx context.Context) string {
+	if profile, _ := ctx.Value(profileKey{}).(string); profile != "" {
+		return profile
+	}
+	return DefaultProfile
+}
+
+// Template returns the certificate issued for csr by the secret engines that
+// sign with a CA key of their own. The CRL distribution point is only added
+// when crlServer is set.
+func Template(csr *x509.CertificateRequest, serial *big.Int, ocspServer string, crlServer string) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      csr.Subject,
+		NotBefore:    time.Now().Add(-600 * time.Second).UTC(),
+		NotAfter:     time.Now().AddDate(0, 0, 365).UTC(),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		OCSPServer:   []string{ocspServer},
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageClientAuth,
+		},
+	}
+	if crlServer != "" {
+		template.CRLDistributionPoints = []string{crlServer}
+	}
+	return template
 }
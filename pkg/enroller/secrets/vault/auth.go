@@ -0,0 +1,101 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// KubernetesTokenFile is where Kubernetes mounts the service account token
+// of the pod.
+const KubernetesTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+var errNoToken = errors.New("vault login did not return a token")
+
+// Auth logs in to Vault and returns the secret holding the client token.
+type Auth interface {
+	Login(ctx context.Context, client *api.Client) (*api.Secret, error)
+}
+
+// AppRole logs in with the AppRole auth method. The secret ID is read from
+// SecretIDFile on every login when set, so that it can be rotated without
+// restarting the enroller.
+type AppRole struct {
+	Mount        string
+	RoleID       string
+	SecretID     string
+	SecretIDFile string
+}
+
+func (a AppRole) Login(ctx context.Context, client *api.Client) (*api.Secret, error) {
+	secretID := a.SecretID
+	if a.SecretIDFile != "" {
+		data, err := ioutil.ReadFile(a.SecretIDFile)
+		if err != nil {
+			return nil, err
+		}
+		secretID = strings.TrimSpace(string(data))
+	}
+	return login(ctx, client, mountOrDefault(a.Mount, "approle"), map[string]interface{}{
+		"role_id":   a.RoleID,
+		"secret_id": secretID,
+	})
+}
+
+// Kubernetes logs in with the Kubernetes auth method, using the service
+// account token of the pod.
+type Kubernetes struct {
+	Mount     string
+	Role      string
+	TokenFile string
+}
+
+func (k Kubernetes) Login(ctx context.Context, client *api.Client) (*api.Secret, error) {
+	tokenFile := k.TokenFile
+	if tokenFile == "" {
+		tokenFile = KubernetesTokenFile
+	}
+	jwt, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	return login(ctx, client, mountOrDefault(k.Mount, "kubernetes"), map[string]interface{}{
+		"role": k.Role,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	})
+}
+
+func login(ctx context.Context, client *api.Client, mount string, data map[string]interface{}) (*api.Secret, error) {
+	req := client.NewRequest(http.MethodPost, "/v1/auth/"+mount+"/login")
+	// Login requests must not carry the token being replaced.
+	req.ClientToken = ""
+	if err := req.SetJSONBody(data); err != nil {
+		return nil, err
+	}
+	resp, err := client.RawRequestWithContext(ctx, req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	secret, err := api.ParseSecret(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return nil, errNoToken
+	}
+	return secret, nil
+}
+
+func mountOrDefault(mount string, method string) string {
+	if mount == "" {
+		return method
+	}
+	return strings.Trim(mount, "/")
+}
@@ -0,0 +1,71 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+var (
+	errSecretNotFound = errors.New("vault KV secret not found")
+	errFieldNotFound  = errors.New("field not found in Vault KV secret")
+)
+
+// KV reads secrets from a Vault KV secrets engine. Its token is not
+// renewed, it is meant for the reads made at startup.
+type KV struct {
+	client *api.Client
+}
+
+// NewKV logs in to Vault with auth. Only the Address and CA of cfg are
+// used.
+func NewKV(ctx context.Context, cfg Config, auth Auth) (*KV, error) {
+	client, err := newClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, loginTimeout)
+	defer cancel()
+	secret, err := auth.Login(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	client.SetToken(secret.Auth.ClientToken)
+	return &KV{client: client}, nil
+}
+
+// ReadKV returns field of the secret at path. For version 2 engines path
+// is the data path of the secret, e.g. secret/data/enroller.
+func (kv *KV) ReadKV(ctx context.Context, path string, field string) (string, error) {
+	req := kv.client.NewRequest(http.MethodGet, "/v1/"+strings.Trim(path, "/"))
+	resp, err := kv.client.RawRequestWithContext(ctx, req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return "", errSecretNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	secret, err := api.ParseSecret(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if secret == nil || secret.Data == nil {
+		return "", errSecretNotFound
+	}
+	data := secret.Data
+	// Version 2 engines nest the secret data under "data".
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return "", errFieldNotFound
+	}
+	return value, nil
+}
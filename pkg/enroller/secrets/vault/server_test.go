@@ -0,0 +1,120 @@
+package vault
+
+import (
+	"context"
+	"crypto/x509"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/secrets"
+
+	"github.com/go-kit/kit/log"
+	"github.com/hashicorp/vault/api"
+)
+
+// TestServer runs against a real Vault server, such as one started with
+// "vault server -dev", at ENROLLERTEST_VAULTADDRESS with the root token in
+// ENROLLERTEST_VAULTTOKEN. It mounts its own PKI secrets engine and
+// AppRole auth method and removes them when done.
+func TestServer(t *testing.T) {
+	address, rootToken := os.Getenv("ENROLLERTEST_VAULTADDRESS"), os.Getenv("ENROLLERTEST_VAULTTOKEN")
+	if address == "" || rootToken == "" {
+		t.Skip("ENROLLERTEST_VAULTADDRESS or ENROLLERTEST_VAULTTOKEN not set")
+	}
+	vcfg := api.DefaultConfig()
+	vcfg.Address = address
+	root, err := api.NewClient(vcfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root.SetToken(rootToken)
+
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	pkiMount, authMount := "pki-"+suffix, "approle-"+suffix
+	if err := root.Sys().Mount(pkiMount, &api.MountInput{Type: "pki", Config: api.MountConfigInput{MaxLeaseTTL: "87600h"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer root.Sys().Unmount(pkiMount)
+	if err := root.Sys().EnableAuthWithOptions(authMount, &api.EnableAuthOptions{Type: "approle"}); err != nil {
+		t.Fatal(err)
+	}
+	defer root.Sys().DisableAuth(authMount)
+	policy := "enroller-" + suffix
+	defer root.Sys().DeletePolicy(policy)
+	writes := []struct {
+		path string
+		data map[string]interface{}
+	}{
+		{pkiMount + "/root/generate/internal", map[string]interface{}{"common_name": "Vault Test CA", "ttl": "8760h"}},
+		{pkiMount + "/roles/device", map[string]interface{}{"allow_any_name": true, "max_ttl": "24h"}},
+		{pkiMount + "/roles/server", map[string]interface{}{"allow_any_name": true, "max_ttl": "24h"}},
+		{"sys/policy/" + policy, map[string]interface{}{"policy": `path "` + pkiMount + `/sign/device" { capabilities = ["update"] }
+path "` + pkiMount + `/cert/ca" { capabilities = ["read"] }
+path "auth/token/lookup-self" { capabilities = ["read"] }`}},
+		{"auth/" + authMount + "/role/enroller", map[string]interface{}{"token_policies": policy, "token_ttl": "1h"}},
+	}
+	for _, w := range writes {
+		if _, err := root.Logical().Write(w.path, w.data); err != nil {
+			t.Fatalf("writing %s: %s", w.path, err)
+		}
+	}
+	roleID, err := root.Logical().Read("auth/" + authMount + "/role/enroller/role-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretID, err := root.Logical().Write("auth/"+authMount+"/role/enroller/secret-id", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{
+		Address:  address,
+		PKIMount: pkiMount,
+		Roles:    map[string]string{secrets.DefaultProfile: "device", "server": "server"},
+	}
+	auth := AppRole{Mount: authMount, RoleID: roleID.Data["role_id"].(string), SecretID: secretID.Data["secret_id"].(string)}
+	v, err := NewVault(context.Background(), cfg, auth, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	caCert, err := v.GetCACert()
+	if err != nil {
+		t.Fatalf("GetCACert: %s", err)
+	}
+	der, err := v.SignCSR(context.Background(), testCSR(t))
+	if err != nil {
+		t.Fatalf("SignCSR: %s", err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crt.CheckSignatureFrom(caCert); err != nil {
+		t.Errorf("certificate is not signed by the Vault CA: %s", err)
+	}
+
+	// The policy does not allow the server role, which must not replace
+	// the token.
+	token := v.client.Token()
+	if _, err := v.SignCSR(secrets.WithProfile(context.Background(), "server"), testCSR(t)); !isPermissionDenied(err) {
+		t.Errorf("SignCSR denied by policy returned %v, want permission denied", err)
+	}
+	if v.client.Token() != token {
+		t.Error("SignCSR denied by policy logged in again")
+	}
+
+	// A revoked token is replaced by logging in again.
+	if err := root.Auth().Token().RevokeTree(token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.SignCSR(context.Background(), testCSR(t)); err != nil {
+		t.Errorf("SignCSR after token revocation: %s", err)
+	}
+	if v.client.Token() == token {
+		t.Error("SignCSR after token revocation kept the revoked token")
+	}
+}
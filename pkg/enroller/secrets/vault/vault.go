@@ -0,0 +1,282 @@
+// Package vault implements secrets.Secrets with the PKI secrets engine of
+// HashiCorp Vault, so that the CA key never leaves Vault. CSRs are signed
+// with the sign endpoint of the role mapped to the certificate profile.
+package vault
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/crypto"
+	"github.com/lamassuiot/enroller/pkg/enroller/secrets"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/hashicorp/vault/api"
+)
+
+// Config holds the Vault server and PKI settings.
+type Config struct {
+	Address string
+	// CA is the file with the certificates that verify the Vault server.
+	CA       string
+	PKIMount string
+	// Roles maps each certificate profile to the PKI role that signs it.
+	Roles map[string]string
+	// TTL is the requested certificate lifetime, bounded by the role. The
+	// role default is used when empty.
+	TTL string
+}
+
+var (
+	errNoRoles       = errors.New("no Vault PKI roles configured")
+	errNoCertificate = errors.New("vault did not return a certificate")
+)
+
+// Login retries back off from minRetry up to maxRetry.
+var (
+	minRetry = time.Second
+	maxRetry = time.Minute
+)
+
+// loginTimeout bounds each login attempt.
+const loginTimeout = 30 * time.Second
+
+type Vault struct {
+	client *api.Client
+	cfg    Config
+	auth   Auth
+	logger log.Logger
+
+	mu     sync.Mutex
+	caCert *x509.Certificate
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// NewVault logs in to Vault and keeps the token valid in the background
+// until Close is called: it is renewed while Vault allows it and a new
+// login is made once it reaches its maximum TTL or can not be renewed.
+func NewVault(ctx context.Context, cfg Config, auth Auth, logger log.Logger) (*Vault, error) {
+	if len(cfg.Roles) == 0 {
+		return nil, errNoRoles
+	}
+	client, err := newClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cfg.PKIMount = mountOrDefault(cfg.PKIMount, "pki")
+
+	v := &Vault{
+		client:  client,
+		cfg:     cfg,
+		auth:    auth,
+		logger:  logger,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	secret, err := v.login(ctx)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not log in to Vault")
+		return nil, err
+	}
+	go v.keepLoggedIn(secret)
+	return v, nil
+}
+
+func newClient(cfg Config) (*api.Client, error) {
+	vcfg := api.DefaultConfig()
+	if vcfg.Error != nil {
+		return nil, vcfg.Error
+	}
+	vcfg.Address = cfg.Address
+	if cfg.CA != "" {
+		if err := vcfg.ConfigureTLS(&api.TLSConfig{CACert: cfg.CA}); err != nil {
+			return nil, err
+		}
+	}
+	client, err := api.NewClient(vcfg)
+	if err != nil {
+		return nil, err
+	}
+	// The token comes from the auth method, never from VAULT_TOKEN.
+	client.ClearToken()
+	return client, nil
+}
+
+// Close stops renewing the Vault token.
+func (v *Vault) Close() {
+	close(v.stop)
+	<-v.stopped
+}
+
+// SignCSR signs csr with the PKI role of the profile selected in ctx. If
+// the token was revoked it logs in again and retries once. Vault answers
+// both a revoked token and a policy denial with 403, so the token is looked
+// up before logging in again.
+func (v *Vault) SignCSR(ctx context.Context, csr *x509.CertificateRequest) ([]byte, error) {
+	profile := secrets.Profile(ctx)
+	role, ok := v.cfg.Roles[profile]
+	if !ok {
+		level.Error(v.logger).Log("err", secrets.ErrUnknownProfile, "msg", "Profile "+profile+" has no Vault PKI role")
+		return nil, secrets.ErrUnknownProfile
+	}
+	cert, err := v.sign(ctx, role, csr)
+	if isPermissionDenied(err) && v.tokenRevoked(ctx) {
+		level.Warn(v.logger).Log("err", err, "msg", "Vault token rejected, logging in again")
+		if _, err = v.login(ctx); err != nil {
+			level.Error(v.logger).Log("err", err, "msg", "Could not log in to Vault")
+			return nil, err
+		}
+		cert, err = v.sign(ctx, role, csr)
+	}
+	if err != nil {
+		level.Error(v.logger).Log("err", err, "msg", "Could not sign CSR with Vault PKI role "+role)
+		return nil, err
+	}
+	level.Info(v.logger).Log("msg", "CSR signed by Vault PKI role "+role+" for profile "+profile)
+	return cert, nil
+}
+
+func (v *Vault) sign(ctx context.Context, role string, csr *x509.CertificateRequest) ([]byte, error) {
+	body := map[string]interface{}{
+		"csr":    string(pem.EncodeToMemory(&pem.Block{Type: crypto.CSRPEMBlockType, Bytes: csr.Raw})),
+		"format": "pem",
+	}
+	if v.cfg.TTL != "" {
+		body["ttl"] = v.cfg.TTL
+	}
+	secret, err := v.request(ctx, http.MethodPost, "/v1/"+v.cfg.PKIMount+"/sign/"+role, body)
+	if err != nil {
+		return nil, err
+	}
+	return certificate(secret)
+}
+
+// tokenRevoked tells whether Vault rejects the token itself, rather than
+// the request made with it.
+func (v *Vault) tokenRevoked(ctx context.Context) bool {
+	_, err := v.request(ctx, http.MethodGet, "/v1/auth/token/lookup-self", nil)
+	return isPermissionDenied(err)
+}
+
+// GetCACert returns the CA certificate of the PKI mount. It is read from
+// Vault once and then cached.
+func (v *Vault) GetCACert() (*x509.Certificate, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.caCert != nil {
+		return v.caCert, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), loginTimeout)
+	defer cancel()
+	secret, err := v.request(ctx, http.MethodGet, "/v1/"+v.cfg.PKIMount+"/cert/ca", nil)
+	if err != nil {
+		level.Error(v.logger).Log("err", err, "msg", "Could not read CA certificate from Vault")
+		return nil, err
+	}
+	der, err := certificate(secret)
+	if err != nil {
+		return nil, err
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	v.caCert = caCert
+	return caCert, nil
+}
+
+func (v *Vault) request(ctx context.Context, method string, path string, body map[string]interface{}) (*api.Secret, error) {
+	req := v.client.NewRequest(method, path)
+	if body != nil {
+		if err := req.SetJSONBody(body); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := v.client.RawRequestWithContext(ctx, req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return api.ParseSecret(resp.Body)
+}
+
+// certificate returns the DER bytes of the PEM certificate in secret.
+func certificate(secret *api.Secret) ([]byte, error) {
+	if secret == nil {
+		return nil, errNoCertificate
+	}
+	data, _ := secret.Data["certificate"].(string)
+	block, _ := pem.Decode([]byte(data))
+	if err := crypto.CheckPEMBlock(block, crypto.CertPEMBlockType); err != nil {
+		return nil, errNoCertificate
+	}
+	return block.Bytes, nil
+}
+
+func (v *Vault) login(ctx context.Context) (*api.Secret, error) {
+	ctx, cancel := context.WithTimeout(ctx, loginTimeout)
+	defer cancel()
+	secret, err := v.auth.Login(ctx, v.client)
+	if err != nil {
+		return nil, err
+	}
+	v.client.SetToken(secret.Auth.ClientToken)
+	level.Info(v.logger).Log("msg", "Logged in to Vault")
+	return secret, nil
+}
+
+// keepLoggedIn renews the token of secret until it can not be renewed any
+// more and then logs in again, retrying with backoff while Vault is not
+// reachable.
+func (v *Vault) keepLoggedIn(secret *api.Secret) {
+	defer close(v.stopped)
+	for {
+		watcher, err := v.client.NewLifetimeWatcher(&api.LifetimeWatcherInput{Secret: secret})
+		if err != nil {
+			level.Error(v.logger).Log("err", err, "msg", "Could not watch Vault token")
+			return
+		}
+		go watcher.Start()
+		select {
+		case <-v.stop:
+			watcher.Stop()
+			return
+		case err := <-watcher.DoneCh():
+			if err != nil {
+				level.Warn(v.logger).Log("err", err, "msg", "Could not renew Vault token")
+			}
+		}
+
+		delay := minRetry
+		for {
+			secret, err = v.login(context.Background())
+			if err == nil {
+				break
+			}
+			level.Error(v.logger).Log("err", err, "msg", "Could not log in to Vault, retrying in "+delay.String())
+			select {
+			case <-v.stop:
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > maxRetry {
+				delay = maxRetry
+			}
+		}
+	}
+}
+
+func isPermissionDenied(err error) bool {
+	var respErr *api.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusForbidden
+}
@@ -0,0 +1,344 @@
+package vault
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/secrets"
+
+	"github.com/go-kit/kit/log"
+)
+
+// fakeVault answers the login, token renewal and PKI requests made by Vault
+// with a local CA.
+type fakeVault struct {
+	t      *testing.T
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	roles  map[string]bool
+	// denied are the roles the policy of the tokens does not allow.
+	denied map[string]bool
+	lease  int
+	// maxRenewals is how many times a token can be renewed, zero for no
+	// limit.
+	maxRenewals int
+
+	mu       sync.Mutex
+	tokens   map[string]int
+	logins   []map[string]string
+	renewals int
+	signed   []string
+}
+
+func newFakeVault(t *testing.T, roles ...string) *fakeVault {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Vault Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(der)
+	f := &fakeVault{t: t, caCert: caCert, caKey: key, roles: make(map[string]bool), denied: make(map[string]bool), lease: 3600, tokens: make(map[string]int)}
+	for _, role := range roles {
+		f.roles[role] = true
+	}
+	return f
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var body map[string]string
+	json.NewDecoder(r.Body).Decode(&body)
+
+	switch path := r.URL.Path; {
+	case path == "/v1/auth/approle/login" || path == "/v1/auth/kubernetes/login":
+		body["mount"] = strings.Split(path, "/")[3]
+		f.logins = append(f.logins, body)
+		token := "token-" + strconv.Itoa(len(f.logins))
+		f.tokens[token] = 0
+		f.write(w, map[string]interface{}{"auth": map[string]interface{}{"client_token": token, "lease_duration": f.lease, "renewable": true}})
+	case path == "/v1/auth/token/renew-self":
+		token := r.Header.Get("X-Vault-Token")
+		renewals, ok := f.tokens[token]
+		if !ok || f.maxRenewals > 0 && renewals >= f.maxRenewals {
+			f.deny(w)
+			return
+		}
+		f.tokens[token]++
+		f.renewals++
+		f.write(w, map[string]interface{}{"auth": map[string]interface{}{"client_token": token, "lease_duration": f.lease, "renewable": true}})
+	case path == "/v1/auth/token/lookup-self":
+		token := r.Header.Get("X-Vault-Token")
+		if _, ok := f.tokens[token]; !ok {
+			f.deny(w)
+			return
+		}
+		f.write(w, map[string]interface{}{"data": map[string]interface{}{"id": token}})
+	case path == "/v1/pki/cert/ca":
+		f.write(w, map[string]interface{}{"data": map[string]interface{}{"certificate": f.pem(f.caCert.Raw)}})
+	case strings.HasPrefix(path, "/v1/pki/sign/"):
+		if _, ok := f.tokens[r.Header.Get("X-Vault-Token")]; !ok {
+			f.deny(w)
+			return
+		}
+		role := strings.TrimPrefix(path, "/v1/pki/sign/")
+		if f.denied[role] {
+			f.deny(w)
+			return
+		}
+		if !f.roles[role] {
+			http.Error(w, `{"errors":["unknown role"]}`, http.StatusBadRequest)
+			return
+		}
+		block, _ := pem.Decode([]byte(body["csr"]))
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			http.Error(w, `{"errors":["invalid csr"]}`, http.StatusBadRequest)
+			return
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(len(f.signed) + 2)),
+			Subject:      csr.Subject,
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, f.caCert, csr.PublicKey, f.caKey)
+		if err != nil {
+			f.t.Error(err)
+		}
+		f.signed = append(f.signed, role)
+		f.write(w, map[string]interface{}{"data": map[string]interface{}{"certificate": f.pem(der)}})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeVault) write(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeVault) deny(w http.ResponseWriter) {
+	http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+}
+
+func (f *fakeVault) pem(der []byte) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func (f *fakeVault) revokeTokens() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tokens = make(map[string]int)
+}
+
+func (f *fakeVault) stats() (logins int, renewals int, signed []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.logins), f.renewals, append([]string(nil), f.signed...)
+}
+
+func testCSR(t *testing.T) *x509.CertificateRequest {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "device.test.com"}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+func TestSignCSR(t *testing.T) {
+	fake := newFakeVault(t, "device", "server")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	cfg := Config{Address: server.URL, Roles: map[string]string{secrets.DefaultProfile: "device", "server": "server"}}
+	v, err := NewVault(context.Background(), cfg, AppRole{RoleID: "role", SecretID: "secret"}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	caCert, err := v.GetCACert()
+	if err != nil {
+		t.Fatalf("GetCACert: %s", err)
+	}
+	for _, profile := range []string{"", "server"} {
+		der, err := v.SignCSR(secrets.WithProfile(context.Background(), profile), testCSR(t))
+		if err != nil {
+			t.Fatalf("SignCSR with profile %q: %s", profile, err)
+		}
+		crt, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := crt.CheckSignatureFrom(caCert); err != nil {
+			t.Errorf("certificate is not signed by the Vault CA: %s", err)
+		}
+	}
+	if _, err := v.SignCSR(secrets.WithProfile(context.Background(), "other"), testCSR(t)); err != secrets.ErrUnknownProfile {
+		t.Errorf("SignCSR with unknown profile returned %v, want %s", err, secrets.ErrUnknownProfile)
+	}
+
+	logins, _, signed := fake.stats()
+	if logins != 1 {
+		t.Errorf("%d logins, want 1", logins)
+	}
+	if strings.Join(signed, ",") != "device,server" {
+		t.Errorf("signed with roles %v, want [device server]", signed)
+	}
+	if login := fake.logins[0]; login["mount"] != "approle" || login["role_id"] != "role" || login["secret_id"] != "secret" {
+		t.Errorf("AppRole login sent %v", login)
+	}
+}
+
+func TestRevokedToken(t *testing.T) {
+	fake := newFakeVault(t, "device")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	cfg := Config{Address: server.URL, Roles: map[string]string{secrets.DefaultProfile: "device"}}
+	v, err := NewVault(context.Background(), cfg, AppRole{RoleID: "role", SecretID: "secret"}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	fake.revokeTokens()
+	if _, err := v.SignCSR(context.Background(), testCSR(t)); err != nil {
+		t.Fatalf("SignCSR after token revocation: %s", err)
+	}
+	if logins, _, _ := fake.stats(); logins != 2 {
+		t.Errorf("%d logins, want 2", logins)
+	}
+}
+
+func TestPolicyDenied(t *testing.T) {
+	fake := newFakeVault(t, "device")
+	fake.denied["device"] = true
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	cfg := Config{Address: server.URL, Roles: map[string]string{secrets.DefaultProfile: "device"}}
+	v, err := NewVault(context.Background(), cfg, AppRole{RoleID: "role", SecretID: "secret"}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := v.SignCSR(context.Background(), testCSR(t)); !isPermissionDenied(err) {
+			t.Errorf("SignCSR denied by policy returned %v, want permission denied", err)
+		}
+	}
+	// The token is still valid, so no new login is made.
+	if logins, _, _ := fake.stats(); logins != 1 {
+		t.Errorf("%d logins, want 1", logins)
+	}
+}
+
+func TestTokenRenewal(t *testing.T) {
+	fake := newFakeVault(t, "device")
+	fake.lease = 2
+	fake.maxRenewals = 2
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	minRetry = 10 * time.Millisecond
+	defer func() { minRetry = time.Second }()
+
+	cfg := Config{Address: server.URL, Roles: map[string]string{secrets.DefaultProfile: "device"}}
+	v, err := NewVault(context.Background(), cfg, AppRole{RoleID: "role", SecretID: "secret"}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	// Once the token can not be renewed any more the enroller logs in
+	// again.
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if logins, renewals, _ := fake.stats(); renewals > 0 && logins > 1 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	logins, renewals, _ := fake.stats()
+	t.Errorf("%d logins and %d renewals, want the token renewed and a new login", logins, renewals)
+}
+
+func TestKubernetesLogin(t *testing.T) {
+	fake := newFakeVault(t, "device")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "enroller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := dir + "/token"
+	if err := ioutil.WriteFile(tokenFile, []byte("service-account-jwt\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{Address: server.URL, Roles: map[string]string{secrets.DefaultProfile: "device"}}
+	v, err := NewVault(context.Background(), cfg, Kubernetes{Role: "enroller", TokenFile: tokenFile}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	if login := fake.logins[0]; login["mount"] != "kubernetes" || login["role"] != "enroller" || login["jwt"] != "service-account-jwt" {
+		t.Errorf("Kubernetes login sent %v", login)
+	}
+}
+
+func TestNewVaultLoginError(t *testing.T) {
+	fake := newFakeVault(t, "device")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	cfg := Config{Address: server.URL, Roles: map[string]string{secrets.DefaultProfile: "device"}}
+	if _, err := NewVault(context.Background(), cfg, Kubernetes{Role: "enroller", TokenFile: "/nonexistent/token"}, log.NewNopLogger()); err == nil {
+		t.Error("NewVault succeeded without a service account token")
+	}
+	if _, err := NewVault(context.Background(), Config{Address: server.URL}, AppRole{}, log.NewNopLogger()); err != errNoRoles {
+		t.Errorf("NewVault without roles returned %v, want %s", err, errNoRoles)
+	}
+}
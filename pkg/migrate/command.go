@@ -0,0 +1,63 @@
+package migrate
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+const usage = "usage: migrate up | down [-steps n] | status"
+
+// RunCommand implements the "migrate" command of the service binaries and
+// returns its exit code. "up" applies the pending migrations, "down"
+// reverts the last -steps applied ones and "status" lists every migration
+// and whether it is applied.
+func RunCommand(args []string, m *Migrator, logger log.Logger) int {
+	if len(args) == 0 {
+		fmt.Println(usage)
+		return 2
+	}
+	switch args[0] {
+	case "up":
+		n, err := m.Up()
+		if err != nil {
+			level.Error(logger).Log("err", err, "msg", "Could not apply database migrations")
+			return 1
+		}
+		fmt.Printf("%d migrations applied\n", n)
+	case "down":
+		fs := flag.NewFlagSet("migrate down", flag.ExitOnError)
+		steps := fs.Int("steps", 1, "number of migrations to revert")
+		fs.Parse(args[1:])
+		n, err := m.Down(*steps)
+		if err != nil {
+			level.Error(logger).Log("err", err, "msg", "Could not revert database migrations")
+			return 1
+		}
+		fmt.Printf("%d migrations reverted\n", n)
+	case "status":
+		statuses, err := m.Status()
+		if err != nil {
+			level.Error(logger).Log("err", err, "msg", "Could not read database migrations status")
+			return 1
+		}
+		for _, s := range statuses {
+			name := s.Name
+			if name == "" {
+				name = "(unknown to this release)"
+			}
+			applied := "pending"
+			if s.Applied {
+				applied = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-30s %s\n", s.Version, name, applied)
+		}
+	default:
+		fmt.Println(usage)
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,212 @@
+// Package migrate applies versioned schema migrations to a database and
+// records the applied versions in the schema_migrations table.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// Migration is a versioned schema change. Up applies it and Down reverts
+// it. Both may contain several statements and run in a transaction.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status reports whether a migration is applied to the database. Versions
+// applied by a newer release are reported with an empty Up and Down.
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// lockID identifies the Postgres advisory lock that keeps replicas starting
+// at the same time from applying migrations concurrently.
+const lockID = 7413862190
+
+type Migrator struct {
+	db         *sql.DB
+	driver     string
+	migrations []Migration
+	logger     log.Logger
+}
+
+func NewMigrator(db *sql.DB, driver string, migrations []Migration, logger log.Logger) *Migrator {
+	sorted := append([]Migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return &Migrator{db: db, driver: driver, migrations: sorted, logger: logger}
+}
+
+// Up applies every migration not applied yet, in version order, and returns
+// how many were applied. It stops at the first failing migration, whose
+// changes are rolled back.
+func (m *Migrator) Up() (int, error) {
+	count := 0
+	err := m.locked(func(conn *sql.Conn) error {
+		applied, err := m.applied(conn)
+		if err != nil {
+			return err
+		}
+		for version := range applied {
+			if m.find(version) == nil {
+				level.Warn(m.logger).Log("msg", "Database has migration "+strconv.Itoa(version)+" unknown to this release")
+			}
+		}
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			err := m.run(conn, migration.Up, `
+			INSERT INTO schema_migrations(version, name, applied)
+			VALUES($1, $2, $3);
+			`, migration.Version, migration.Name, time.Now().UTC())
+			if err != nil {
+				return fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+			}
+			level.Info(m.logger).Log("msg", "Migration "+strconv.Itoa(migration.Version)+" "+migration.Name+" applied")
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Down reverts the last steps applied migrations and returns how many were
+// reverted.
+func (m *Migrator) Down(steps int) (int, error) {
+	count := 0
+	err := m.locked(func(conn *sql.Conn) error {
+		applied, err := m.applied(conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && count < steps; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			err := m.run(conn, migration.Down, `
+			DELETE FROM schema_migrations
+			WHERE version = $1;
+			`, migration.Version)
+			if err != nil {
+				return fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+			}
+			level.Info(m.logger).Log("msg", "Migration "+strconv.Itoa(migration.Version)+" "+migration.Name+" reverted")
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Status returns every known or applied migration in version order.
+func (m *Migrator) Status() ([]Status, error) {
+	var statuses []Status
+	err := m.locked(func(conn *sql.Conn) error {
+		applied, err := m.applied(conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			at, ok := applied[migration.Version]
+			statuses = append(statuses, Status{Migration: migration, Applied: ok, AppliedAt: at})
+		}
+		for version, at := range applied {
+			if m.find(version) == nil {
+				statuses = append(statuses, Status{Migration: Migration{Version: version}, Applied: true, AppliedAt: at})
+			}
+		}
+		return nil
+	})
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, err
+}
+
+func (m *Migrator) find(version int) *Migration {
+	for i := range m.migrations {
+		if m.migrations[i].Version == version {
+			return &m.migrations[i]
+		}
+	}
+	return nil
+}
+
+// locked runs fn on a single connection, holding the migrations lock on
+// Postgres, after creating the schema_migrations table if needed.
+func (m *Migrator) locked(fn func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if m.driver == "postgres" {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1);`, lockID); err != nil {
+			return err
+		}
+		defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1);`, lockID)
+	}
+	_, err = conn.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied TIMESTAMP NOT NULL
+	);
+	`)
+	if err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func (m *Migrator) applied(conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(context.Background(), `
+	SELECT version, applied
+	FROM schema_migrations;
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// run executes the migration statements and the schema_migrations update
+// in the same transaction.
+func (m *Migrator) run(conn *sql.Conn, statements string, record string, args ...interface{}) error {
+	ctx := context.Background()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, statements); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
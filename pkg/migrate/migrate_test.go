@@ -0,0 +1,177 @@
+package migrate
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+
+	_ "modernc.org/sqlite"
+)
+
+var testMigrations = []Migration{
+	{
+		Version: 2,
+		Name:    "index",
+		Up:      `CREATE INDEX t_name_idx ON t (name);`,
+		Down:    `DROP INDEX t_name_idx;`,
+	},
+	{
+		Version: 1,
+		Name:    "table",
+		Up: `
+		CREATE TABLE t (id INTEGER PRIMARY KEY, name TEXT);
+		INSERT INTO t(name) VALUES('a');
+		`,
+		Down: `DROP TABLE t;`,
+	},
+}
+
+func openDB(t *testing.T) (*sql.DB, func()) {
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite", "file:"+dir+"/test.db")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func applied(t *testing.T, m *Migrator) []int {
+	statuses, err := m.Status()
+	if err != nil {
+		t.Fatalf("Status: %s", err)
+	}
+	var versions []int
+	for _, s := range statuses {
+		if s.Applied {
+			versions = append(versions, s.Version)
+		}
+	}
+	return versions
+}
+
+func TestUpDown(t *testing.T) {
+	db, closeDB := openDB(t)
+	defer closeDB()
+	m := NewMigrator(db, "sqlite", testMigrations, log.NewNopLogger())
+
+	if got := applied(t, m); len(got) != 0 {
+		t.Fatalf("applied before Up = %v", got)
+	}
+	n, err := m.Up()
+	if err != nil || n != 2 {
+		t.Fatalf("Up = %d, %v", n, err)
+	}
+	if got := applied(t, m); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Fatalf("applied after Up = %v", got)
+	}
+	n, err = m.Up()
+	if err != nil || n != 0 {
+		t.Fatalf("second Up = %d, %v", n, err)
+	}
+
+	n, err = m.Down(1)
+	if err != nil || n != 1 {
+		t.Fatalf("Down(1) = %d, %v", n, err)
+	}
+	if got := applied(t, m); len(got) != 1 || got[0] != 1 {
+		t.Fatalf("applied after Down(1) = %v", got)
+	}
+	var count int
+	if err := db.QueryRow(`SELECT count(*) FROM t;`).Scan(&count); err != nil || count != 1 {
+		t.Fatalf("rows after Down(1) = %d, %v", count, err)
+	}
+
+	n, err = m.Down(5)
+	if err != nil || n != 1 {
+		t.Fatalf("Down(5) = %d, %v", n, err)
+	}
+	if _, err := db.Exec(`SELECT * FROM t;`); err == nil {
+		t.Fatal("table still exists after reverting every migration")
+	}
+}
+
+func TestFailedMigration(t *testing.T) {
+	db, closeDB := openDB(t)
+	defer closeDB()
+	broken := append([]Migration{{
+		Version: 3,
+		Name:    "broken",
+		Up: `
+		CREATE TABLE u (id INTEGER);
+		INSERT INTO missing VALUES(1);
+		`,
+	}}, testMigrations...)
+	m := NewMigrator(db, "sqlite", broken, log.NewNopLogger())
+
+	n, err := m.Up()
+	if err == nil || n != 2 {
+		t.Fatalf("Up = %d, %v, want 2 and an error", n, err)
+	}
+	if got := applied(t, m); len(got) != 2 {
+		t.Fatalf("applied = %v", got)
+	}
+	if _, err := db.Exec(`SELECT * FROM u;`); err == nil {
+		t.Fatal("failed migration was not rolled back")
+	}
+}
+
+func TestUnknownVersion(t *testing.T) {
+	db, closeDB := openDB(t)
+	defer closeDB()
+	if _, err := NewMigrator(db, "sqlite", testMigrations, log.NewNopLogger()).Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	// An older release only knows the first migration.
+	m := NewMigrator(db, "sqlite", testMigrations[1:], log.NewNopLogger())
+	if n, err := m.Up(); err != nil || n != 0 {
+		t.Fatalf("Up = %d, %v", n, err)
+	}
+	statuses, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 || !statuses[1].Applied || statuses[1].Version != 2 || statuses[1].Name != "" {
+		t.Fatalf("Status = %+v", statuses)
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	db, closeDB := openDB(t)
+	defer closeDB()
+	m := NewMigrator(db, "sqlite", testMigrations, log.NewNopLogger())
+
+	testCases := []struct {
+		name    string
+		args    []string
+		code    int
+		applied int
+	}{
+		{"No subcommand", nil, 2, 0},
+		{"Unknown subcommand", []string{"redo"}, 2, 0},
+		{"Up", []string{"up"}, 0, 2},
+		{"Status", []string{"status"}, 0, 2},
+		{"Down", []string{"down"}, 0, 1},
+		{"Down with steps", []string{"down", "-steps", "5"}, 0, 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if code := RunCommand(tc.args, m, log.NewNopLogger()); code != tc.code {
+				t.Errorf("RunCommand(%v) = %d, want %d", tc.args, code, tc.code)
+			}
+			if got := applied(t, m); len(got) != tc.applied {
+				t.Errorf("applied after RunCommand(%v) = %v", tc.args, got)
+			}
+		})
+	}
+}
@@ -66,7 +66,7 @@ func MakePutRevokeSCEPCRTEndpoint(s Service) endpoint.Endpoint {
 type healthRequest struct{}
 
 type healthResponse struct {
-	Healthy bool  `json:"healthy,omitempty"`
+	Healthy bool  `json:"healthy"`
 	Err     error `json:"err,omitempty"`
 }
 
@@ -2,10 +2,12 @@ package api
 
 import (
 	"context"
-	"database/sql"
 	"errors"
 	"sync"
+	"time"
 
+	"github.com/lamassuiot/enroller/pkg/database"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
 	"github.com/lamassuiot/enroller/pkg/scep/crypto"
 	"github.com/lamassuiot/enroller/pkg/scep/models/db"
 )
@@ -31,40 +33,61 @@ var (
 	ErrGetCertificates = errors.New("unable to get certificates")
 	ErrRevokeCert      = errors.New("unable to revoke certificate")
 	ErrGetCert         = errors.New("unable to get certificate")
+	ErrUnavailable     = errors.New("storage is unavailable, retry later")
 )
 
+// healthTimeout bounds the database check of a health request.
+const healthTimeout = 5 * time.Second
+
 func NewSCEPService(scepDB db.DBSCEPStore) Service {
 	return &scepService{
 		scepDB: scepDB,
 	}
 }
 
+// Health reports whether the certificates database is reachable.
 func (s *scepService) Health(ctx context.Context) bool {
+	if p, ok := s.scepDB.(database.Pinger); ok {
+		ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+		defer cancel()
+		return p.PingContext(ctx) == nil
+	}
 	return true
 }
 
 func (s *scepService) GetSCEPCRTs(ctx context.Context) (crypto.CRTs, error) {
-	crts, err := s.scepDB.GetCRTs()
+	crts, err := s.scepDB.GetCRTs(ctx)
 	if err != nil {
-		return crypto.CRTs{}, ErrGetCertificates
+		return crypto.CRTs{}, storeError(err, ErrGetCertificates)
 	}
 	return crts, nil
 }
 
 func (s *scepService) RevokeSCEPCRT(ctx context.Context, dn string, serial string) error {
-	crt, err := s.scepDB.SelectCRT(dn, serial)
+	crt, err := s.scepDB.SelectCRT(ctx, dn, serial)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return ErrInvalidDNOrSerial
-		}
-		return ErrGetCert
+		return storeError(err, ErrGetCert)
 	}
 	if crt.Status == "R" {
 		return ErrInvalidRevokeOp
 	}
-	err = s.scepDB.RevokeCRT(dn, serial)
+	err = s.scepDB.RevokeCRT(ctx, dn, serial)
 	if err != nil {
-		return ErrRevokeCert
+		return storeError(err, ErrRevokeCert)
 	}
 	return nil
 }
+
+// storeError maps a store error to the service error returned to clients,
+// using fallback for errors other than missing certificates and an
+// unreachable database.
+func storeError(err error, fallback error) error {
+	switch {
+	case storeerr.IsNotFound(err):
+		return ErrInvalidDNOrSerial
+	case storeerr.IsUnavailable(err):
+		return ErrUnavailable
+	default:
+		return fallback
+	}
+}
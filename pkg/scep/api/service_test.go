@@ -1,18 +1,15 @@
 package api
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"math/big"
 	"testing"
 	"time"
 
-	"github.com/lamassuiot/enroller/pkg/scep/configs"
 	"github.com/lamassuiot/enroller/pkg/scep/crypto"
 	"github.com/lamassuiot/enroller/pkg/scep/models/db"
-
-	"github.com/go-kit/kit/log"
+	"github.com/lamassuiot/enroller/pkg/scep/models/db/memory"
 )
 
 type serviceSetUp struct {
@@ -25,7 +22,7 @@ func TestGetSCEPCRTs(t *testing.T) {
 	ctx := context.Background()
 
 	crt := testCRT()
-	err := stu.scepDB.InsertCRT(crt)
+	err := stu.scepDB.InsertCRT(ctx, crt)
 	if err != nil {
 		t.Fatal("Could not insert certificate in DB")
 	}
@@ -38,7 +35,7 @@ func TestGetSCEPCRTs(t *testing.T) {
 		t.Errorf("Not certificates returned from SCEP API")
 	}
 
-	err = stu.scepDB.Delete(crt.DN, crt.Serial)
+	err = stu.scepDB.Delete(ctx, crt.DN, crt.Serial)
 	if err != nil {
 		t.Fatal("Could not delete certificate from DB")
 	}
@@ -50,7 +47,7 @@ func TestRevokeSCEPCRT(t *testing.T) {
 	ctx := context.Background()
 
 	crt := testCRT()
-	err := stu.scepDB.InsertCRT(crt)
+	err := stu.scepDB.InsertCRT(ctx, crt)
 	if err != nil {
 		t.Fatal("Could not insert certificate in DB")
 	}
@@ -96,33 +93,14 @@ func TestRevokeSCEPCRT(t *testing.T) {
 		})
 	}
 
-	err = stu.scepDB.Delete(crt.DN, crt.Serial)
+	err = stu.scepDB.Delete(ctx, crt.DN, crt.Serial)
 	if err != nil {
 		t.Fatal("Could not delete certificate from DB")
 	}
 }
 
 func setup() *serviceSetUp {
-	buf := &bytes.Buffer{}
-	logger := log.NewJSONLogger(buf)
-	err, cfg := configs.NewConfig("sceptest")
-	if err != nil {
-		panic(err)
-	}
-	connStr := "dbname=" + cfg.PostgresDB + " user=" + cfg.PostgresUser + " password=" + cfg.PostgresPassword + " host=" + cfg.PostgresHostname + " port=" + cfg.PostgresPort + " sslmode=disable"
-	scepDB, err := setupSCEPDB(connStr, logger)
-	if err != nil {
-		panic(err)
-	}
-	return &serviceSetUp{scepDB}
-}
-
-func setupSCEPDB(connStr string, logger log.Logger) (db.DBSCEPStore, error) {
-	db, err := db.NewDB("postgres", connStr, logger)
-	if err != nil {
-		return nil, err
-	}
-	return db, nil
+	return &serviceSetUp{memory.NewDB()}
 }
 
 func testCRT() crypto.CRT {
@@ -38,7 +38,7 @@ func MakeHTTPHandler(s Service, logger log.Logger, auth auth.Auth, otTracer stdo
 	r.Methods("GET").Path("/v1/health").Handler(httptransport.NewServer(
 		e.HealthEndpoint,
 		decodeHealthRequest,
-		encodeResponse,
+		encodeHealthResponse,
 		append(options, httptransport.ServerBefore(opentracing.HTTPToContext(otTracer, "Health", logger)))...,
 	))
 
@@ -88,6 +88,17 @@ func decodePutRevokeSCEPCRTRequest(ctx context.Context, r *http.Request) (reques
 
 }
 
+// encodeHealthResponse answers 503 when the service is not healthy, so
+// that Consul health checks fail while the database is unreachable.
+func encodeHealthResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	resp := response.(healthResponse)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if !resp.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return json.NewEncoder(w).Encode(resp)
+}
+
 func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	if e, ok := response.(errorer); ok && e.error() != nil {
 		// Not a Go kit transport error, but a business-logic error.
@@ -112,6 +123,8 @@ func codeFrom(err error) int {
 		return http.StatusBadRequest
 	case ErrInvalidDNOrSerial:
 		return http.StatusNotFound
+	case ErrUnavailable:
+		return http.StatusServiceUnavailable
 	case jwt.ErrTokenExpired, jwt.ErrTokenInvalid, jwt.ErrTokenMalformed, jwt.ErrTokenNotActive, jwt.ErrTokenContextMissing, jwt.ErrUnexpectedSigningMethod:
 		return http.StatusUnauthorized
 	default:
@@ -1,16 +1,34 @@
 package configs
 
-import "github.com/kelseyhightower/envconfig"
+import (
+	"time"
+
+	"github.com/lamassuiot/enroller/pkg/database"
+
+	"github.com/kelseyhightower/envconfig"
+)
 
 type Config struct {
 	Port string
 
+	Driver     string `default:"postgres"`
+	SQLitePath string `default:"scep.db"`
+
 	PostgresUser     string
 	PostgresDB       string
 	PostgresPort     string
 	PostgresPassword string
 	PostgresHostname string
 
+	PostgresSSLMode         string `default:"disable"`
+	PostgresSSLCert         string
+	PostgresSSLKey          string
+	PostgresSSLRootCert     string
+	PostgresMaxOpenConns    int           `default:"10"`
+	PostgresMaxIdleConns    int           `default:"2"`
+	PostgresConnMaxLifetime time.Duration `default:"30m"`
+	PostgresConnectTimeout  time.Duration `default:"2m"`
+
 	ConsulProtocol string
 	ConsulHost     string
 	ConsulPort     string
@@ -30,6 +48,31 @@ type Config struct {
 	KeyFile  string
 }
 
+// Postgres returns the Postgres connection settings.
+func (c Config) Postgres() database.PostgresConfig {
+	return database.PostgresConfig{
+		Host:        c.PostgresHostname,
+		Port:        c.PostgresPort,
+		DB:          c.PostgresDB,
+		User:        c.PostgresUser,
+		Password:    c.PostgresPassword,
+		SSLMode:     c.PostgresSSLMode,
+		SSLCert:     c.PostgresSSLCert,
+		SSLKey:      c.PostgresSSLKey,
+		SSLRootCert: c.PostgresSSLRootCert,
+	}
+}
+
+// DatabaseOptions returns the database connection pool settings.
+func (c Config) DatabaseOptions() database.Options {
+	return database.Options{
+		MaxOpenConns:    c.PostgresMaxOpenConns,
+		MaxIdleConns:    c.PostgresMaxIdleConns,
+		ConnMaxLifetime: c.PostgresConnMaxLifetime,
+		ConnectTimeout:  c.PostgresConnectTimeout,
+	}
+}
+
 func NewConfig(prefix string) (error, Config) {
 	var cfg Config
 	err := envconfig.Process(prefix, &cfg)
@@ -1,13 +1,17 @@
 package db
 
 import (
+	"context"
+
 	"github.com/lamassuiot/enroller/pkg/scep/crypto"
 )
 
+// DBSCEPStore stores the certificates issued through SCEP. Errors are
+// classified with the enroller storeerr package.
 type DBSCEPStore interface {
-	InsertCRT(crypto.CRT) error
-	SelectCRT(dn string, serial string) (crypto.CRT, error)
-	GetCRTs() (crypto.CRTs, error)
-	RevokeCRT(dn string, serial string) error
-	Delete(dn string, serial string) error
+	InsertCRT(ctx context.Context, crt crypto.CRT) error
+	SelectCRT(ctx context.Context, dn string, serial string) (crypto.CRT, error)
+	GetCRTs(ctx context.Context) (crypto.CRTs, error)
+	RevokeCRT(ctx context.Context, dn string, serial string) error
+	Delete(ctx context.Context, dn string, serial string) error
 }
@@ -0,0 +1,39 @@
+package db_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/lamassuiot/enroller/pkg/migrate"
+	"github.com/lamassuiot/enroller/pkg/scep/configs"
+	"github.com/lamassuiot/enroller/pkg/scep/models/db"
+	"github.com/lamassuiot/enroller/pkg/scep/models/db/dbtest"
+	"github.com/lamassuiot/enroller/pkg/scep/models/migrations"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestDB(t *testing.T) {
+	err, cfg := configs.NewConfig("sceptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.PostgresHostname == "" {
+		t.Skip("SCEPTEST_POSTGRESHOSTNAME not set")
+	}
+	connStr := cfg.Postgres().DataSourceName()
+	sqlDB, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlDB.Close()
+	if _, err := migrate.NewMigrator(sqlDB, "postgres", migrations.Postgres, log.NewNopLogger()).Up(); err != nil {
+		t.Fatal(err)
+	}
+	scepDB, err := db.NewDB(context.Background(), "postgres", connStr, cfg.DatabaseOptions(), log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbtest.TestDB(t, scepDB)
+}
@@ -0,0 +1,112 @@
+// Package dbtest contains the conformance tests that every SCEP
+// certificates store implementation must pass. The tests only rely on the
+// certificates they create, so they can be run against shared databases.
+package dbtest
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
+	"github.com/lamassuiot/enroller/pkg/scep/crypto"
+	"github.com/lamassuiot/enroller/pkg/scep/models/db"
+)
+
+var ctx = context.Background()
+
+var random = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+func testCRT() crypto.CRT {
+	return crypto.CRT{
+		Status:         "V",
+		ExpirationDate: "301231235959Z",
+		Serial:         strconv.FormatInt(random.Int63(), 16),
+		DN:             "/C=ES/O=Test/CN=dbtest-" + strconv.FormatInt(random.Int63(), 36),
+		CRTPath:        "/tmp/scep/1.crt",
+		Key:            "RSA",
+		KeySize:        2048,
+	}
+}
+
+// equal compares everything but the serial, which the database store
+// returns in the hex encoded form it is stored with.
+func equal(a crypto.CRT, b crypto.CRT) bool {
+	a.Serial, b.Serial = "", ""
+	return a == b
+}
+
+// TestDB checks that store behaves as the SCEP database store: certificates
+// are found by DN and serial and missing ones are reported as not
+// found errors.
+func TestDB(t *testing.T, store db.DBSCEPStore) {
+	t.Run("Insert and select", func(t *testing.T) {
+		crt := testCRT()
+		if err := store.InsertCRT(ctx, crt); err != nil {
+			t.Fatalf("InsertCRT: %s", err)
+		}
+		defer store.Delete(ctx, crt.DN, crt.Serial)
+
+		got, err := store.SelectCRT(ctx, crt.DN, crt.Serial)
+		if err != nil {
+			t.Fatalf("SelectCRT: %s", err)
+		}
+		if !equal(got, crt) {
+			t.Errorf("SelectCRT = %+v, want %+v", got, crt)
+		}
+		crts, err := store.GetCRTs(ctx)
+		if err != nil {
+			t.Fatalf("GetCRTs: %s", err)
+		}
+		found := false
+		for _, c := range crts.CRTs {
+			found = found || equal(c, crt)
+		}
+		if !found {
+			t.Errorf("GetCRTs does not return certificate %s", crt.Serial)
+		}
+		if _, err := store.SelectCRT(ctx, crt.DN, "0"); !storeerr.IsNotFound(err) {
+			t.Errorf("SelectCRT of missing certificate returned %v, want a not found error", err)
+		}
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		crt := testCRT()
+		if err := store.InsertCRT(ctx, crt); err != nil {
+			t.Fatalf("InsertCRT: %s", err)
+		}
+		defer store.Delete(ctx, crt.DN, crt.Serial)
+
+		if err := store.RevokeCRT(ctx, crt.DN, crt.Serial); err != nil {
+			t.Fatalf("RevokeCRT: %s", err)
+		}
+		got, err := store.SelectCRT(ctx, crt.DN, crt.Serial)
+		if err != nil {
+			t.Fatalf("SelectCRT: %s", err)
+		}
+		if got.Status != "R" || got.RevocationDate == "" {
+			t.Errorf("SelectCRT after RevokeCRT = %+v", got)
+		}
+		if err := store.RevokeCRT(ctx, crt.DN, "0"); !storeerr.IsNotFound(err) {
+			t.Errorf("RevokeCRT of missing certificate returned %v, want a not found error", err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		crt := testCRT()
+		if err := store.InsertCRT(ctx, crt); err != nil {
+			t.Fatalf("InsertCRT: %s", err)
+		}
+		if err := store.Delete(ctx, crt.DN, crt.Serial); err != nil {
+			t.Fatalf("Delete: %s", err)
+		}
+		if _, err := store.SelectCRT(ctx, crt.DN, crt.Serial); !storeerr.IsNotFound(err) {
+			t.Errorf("SelectCRT of deleted certificate returned %v, want a not found error", err)
+		}
+		if err := store.Delete(ctx, crt.DN, crt.Serial); !storeerr.IsNotFound(err) {
+			t.Errorf("Delete of deleted certificate returned %v, want a not found error", err)
+		}
+	})
+}
@@ -0,0 +1,103 @@
+// Package memory implements the SCEP certificates store in memory, for
+// tests and for embedding the SCEP service without a database.
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
+	"github.com/lamassuiot/enroller/pkg/scep/crypto"
+	"github.com/lamassuiot/enroller/pkg/scep/models/db"
+)
+
+var errDuplicateCRT = errors.New("certificate with the same DN and serial already exists")
+
+type key struct {
+	dn     string
+	serial string
+}
+
+// DB keeps certificates in a map keyed by DN and serial. Missing
+// certificates are reported as sql.ErrNoRows, like in the database store.
+type DB struct {
+	mu   sync.Mutex
+	crts map[key]crypto.CRT
+}
+
+func NewDB() db.DBSCEPStore {
+	return &DB{crts: make(map[key]crypto.CRT)}
+}
+
+func (db *DB) InsertCRT(ctx context.Context, crt crypto.CRT) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	k := key{crt.DN, crt.Serial}
+	if _, ok := db.crts[k]; ok {
+		return storeerr.Conflict(errDuplicateCRT)
+	}
+	db.crts[k] = crt
+	return nil
+}
+
+func (db *DB) SelectCRT(ctx context.Context, dn string, serial string) (crypto.CRT, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	crt, ok := db.crts[key{dn, serial}]
+	if !ok {
+		return crypto.CRT{}, storeerr.NotFound(sql.ErrNoRows)
+	}
+	return crt, nil
+}
+
+func (db *DB) GetCRTs(ctx context.Context) (crypto.CRTs, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	crts := make([]crypto.CRT, 0, len(db.crts))
+	for _, crt := range db.crts {
+		crts = append(crts, crt)
+	}
+	sort.Slice(crts, func(i, j int) bool {
+		if crts[i].DN != crts[j].DN {
+			return crts[i].DN < crts[j].DN
+		}
+		return crts[i].Serial < crts[j].Serial
+	})
+	return crypto.CRTs{CRTs: crts}, nil
+}
+
+func (db *DB) RevokeCRT(ctx context.Context, dn string, serial string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	k := key{dn, serial}
+	crt, ok := db.crts[k]
+	if !ok {
+		return storeerr.NotFound(sql.ErrNoRows)
+	}
+	crt.Status = "R"
+	crt.RevocationDate = makeOpenSSLTime(time.Now())
+	db.crts[k] = crt
+	return nil
+}
+
+func (db *DB) Delete(ctx context.Context, dn string, serial string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	k := key{dn, serial}
+	if _, ok := db.crts[k]; !ok {
+		return storeerr.NotFound(sql.ErrNoRows)
+	}
+	delete(db.crts, k)
+	return nil
+}
+
+func makeOpenSSLTime(t time.Time) string {
+	y := (int(t.Year()) % 100)
+	validDate := fmt.Sprintf("%02d%02d%02d%02d%02d%02dZ", y, t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second())
+	return validDate
+}
@@ -0,0 +1,11 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/lamassuiot/enroller/pkg/scep/models/db/dbtest"
+)
+
+func TestDB(t *testing.T) {
+	dbtest.TestDB(t, NewDB())
+}
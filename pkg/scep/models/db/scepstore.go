@@ -1,12 +1,14 @@
 package db
 
 import (
+	"context"
 	"database/sql"
-	"errors"
 	"fmt"
 	"strconv"
 	"time"
 
+	"github.com/lamassuiot/enroller/pkg/database"
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
 	"github.com/lamassuiot/enroller/pkg/scep/crypto"
 
 	"github.com/go-kit/kit/log"
@@ -15,18 +17,12 @@ import (
 	_ "github.com/lib/pq"
 )
 
-func NewDB(driverName string, dataSourceName string, logger log.Logger) (*DB, error) {
-	db, err := sql.Open(driverName, dataSourceName)
+func NewDB(ctx context.Context, driverName string, dataSourceName string, opts database.Options, logger log.Logger) (*DB, error) {
+	db, err := database.Open(ctx, driverName, dataSourceName, opts, logger)
 	if err != nil {
 		level.Error(logger).Log("err", err, "msg", "Could not open connection with signed certificates database")
-		return nil, err
+		return nil, storeerr.Classify(err)
 	}
-	err = checkDBAlive(db)
-	for err != nil {
-		level.Warn(logger).Log("msg", "Trying to connect to CSRs DB")
-		err = checkDBAlive(db)
-	}
-
 	return &DB{db, logger}, nil
 }
 
@@ -35,14 +31,7 @@ type DB struct {
 	logger log.Logger
 }
 
-func checkDBAlive(db *sql.DB) error {
-	sqlStatement := `
-	SELECT WHERE 1=0`
-	_, err := db.Query(sqlStatement)
-	return err
-}
-
-func (db *DB) InsertCRT(crt crypto.CRT) error {
+func (db *DB) InsertCRT(ctx context.Context, crt crypto.CRT) error {
 	sqlStatement := `
 
 	INSERT INTO ca_store(status, expirationDate, revocationDate, serial, dn, certPath, key, keySize)
@@ -52,17 +41,17 @@ func (db *DB) InsertCRT(crt crypto.CRT) error {
 	serialHex := fmt.Sprintf("%x", crt.Serial)
 	var serial string
 
-	err := db.QueryRow(sqlStatement, crt.Status, crt.ExpirationDate, crt.RevocationDate, serialHex, crt.DN, crt.CRTPath, crt.Key, crt.KeySize).Scan(&serial)
+	err := db.QueryRowContext(ctx, sqlStatement, crt.Status, crt.ExpirationDate, crt.RevocationDate, serialHex, crt.DN, crt.CRTPath, crt.Key, crt.KeySize).Scan(&serial)
 	if err != nil {
 		level.Error(db.logger).Log("err", err, "msg", "Could not insert certificate with serial "+crt.Serial+" in database")
-		return err
+		return storeerr.Classify(err)
 	}
 	level.Info(db.logger).Log("msg", "Certificate with serial "+serial+" inserted in database")
 
 	return nil
 }
 
-func (db *DB) SelectCRT(dn string, serial string) (crypto.CRT, error) {
+func (db *DB) SelectCRT(ctx context.Context, dn string, serial string) (crypto.CRT, error) {
 	sqlStatement := `
 	SELECT *
 	FROM ca_store
@@ -70,28 +59,28 @@ func (db *DB) SelectCRT(dn string, serial string) (crypto.CRT, error) {
 	`
 	serialHex := fmt.Sprintf("%x", serial)
 
-	row := db.QueryRow(sqlStatement, dn, serialHex)
+	row := db.QueryRowContext(ctx, sqlStatement, dn, serialHex)
 	var crt crypto.CRT
 	err := row.Scan(&crt.Status, &crt.ExpirationDate, &crt.RevocationDate, &crt.Serial, &crt.DN, &crt.CRTPath, &crt.Key, &crt.KeySize)
 	if err != nil {
 		level.Error(db.logger).Log("err", err, "msg", "Could not obtain certificate with DN "+dn+" and serial "+serial+" from database")
-		return crypto.CRT{}, err
+		return crypto.CRT{}, storeerr.Classify(err)
 	}
 	level.Info(db.logger).Log("msg", "Certificate with DN "+dn+" and serial "+serial+" read from database")
 	return crt, nil
 }
 
-func (db *DB) GetCRTs() (crypto.CRTs, error) {
+func (db *DB) GetCRTs(ctx context.Context) (crypto.CRTs, error) {
 	sqlStatement := `
 	SELECT *
 	FROM ca_store;
 	`
 
-	rows, err := db.Query(sqlStatement)
+	rows, err := db.QueryContext(ctx, sqlStatement)
 
 	if err != nil {
 		level.Error(db.logger).Log("err", err, "msg", "Could not obtain certificates from database or the database is empty")
-		return crypto.CRTs{CRTs: []crypto.CRT{}}, err
+		return crypto.CRTs{CRTs: []crypto.CRT{}}, storeerr.Classify(err)
 	}
 
 	defer rows.Close()
@@ -102,7 +91,7 @@ func (db *DB) GetCRTs() (crypto.CRTs, error) {
 		err := rows.Scan(&crt.Status, &crt.ExpirationDate, &crt.RevocationDate, &crt.Serial, &crt.DN, &crt.CRTPath, &crt.Key, &crt.KeySize)
 		if err != nil {
 			level.Error(db.logger).Log("err", err, "msg", "Unable to read database certificate row")
-			return crypto.CRTs{CRTs: []crypto.CRT{}}, err
+			return crypto.CRTs{CRTs: []crypto.CRT{}}, storeerr.Classify(err)
 		}
 		level.Info(db.logger).Log("msg", "Certificate with serial "+crt.Serial+" read from database")
 		crts = append(crts, crt)
@@ -110,13 +99,13 @@ func (db *DB) GetCRTs() (crypto.CRTs, error) {
 
 	if err = rows.Err(); err != nil {
 		level.Error(db.logger).Log("err", err)
-		return crypto.CRTs{CRTs: []crypto.CRT{}}, err
+		return crypto.CRTs{CRTs: []crypto.CRT{}}, storeerr.Classify(err)
 	}
 	level.Info(db.logger).Log("msg", strconv.Itoa(len(crts))+" CSRs read from database")
 	return crypto.CRTs{CRTs: crts}, nil
 }
 
-func (db *DB) RevokeCRT(dn string, serial string) error {
+func (db *DB) RevokeCRT(ctx context.Context, dn string, serial string) error {
 	serialHex := fmt.Sprintf("%x", serial)
 
 	sqlStatement := `
@@ -124,46 +113,46 @@ func (db *DB) RevokeCRT(dn string, serial string) error {
 	SET status = 'R', revocationDate = $1
 	WHERE dn = $2 AND serial = $3;
 	`
-	res, err := db.Exec(sqlStatement, makeOpenSSLTime(time.Now()), dn, serialHex)
+	res, err := db.ExecContext(ctx, sqlStatement, makeOpenSSLTime(time.Now()), dn, serialHex)
 	if err != nil {
 		level.Error(db.logger).Log("err", err, "msg", "Could not revoke certificate with DN "+dn+" and serial "+serial+" in database")
-		return err
+		return storeerr.Classify(err)
 	}
 	count, err := res.RowsAffected()
 	if err != nil {
 		level.Error(db.logger).Log("err", err, "msg", "Could not revoke certificate with DN "+dn+" and serial "+serial+" in database")
-		return err
+		return storeerr.Classify(err)
 	}
 
 	if count <= 0 {
-		err = errors.New("No rows have been updated in database")
+		err = sql.ErrNoRows
 		level.Error(db.logger).Log("err", err)
-		return err
+		return storeerr.Classify(err)
 	}
 
 	return nil
 }
 
-func (db *DB) Delete(dn string, serial string) error {
+func (db *DB) Delete(ctx context.Context, dn string, serial string) error {
 	sqlStatement := `
 	DELETE FROM ca_store
 	WHERE dn = $1 AND serial = $2;
 	`
 	serialHex := fmt.Sprintf("%x", serial)
-	res, err := db.Exec(sqlStatement, dn, serialHex)
+	res, err := db.ExecContext(ctx, sqlStatement, dn, serialHex)
 	if err != nil {
 		level.Error(db.logger).Log("err", err, "msg", "Could not delete certificate with DN "+dn+" and serial "+serial+" from database")
-		return err
+		return storeerr.Classify(err)
 	}
 	count, err := res.RowsAffected()
 	if err != nil {
 		level.Error(db.logger).Log("err", err, "msg", "Could not delete certificate with DN "+dn+" and serial "+serial+" from database")
-		return err
+		return storeerr.Classify(err)
 	}
 	if count <= 0 {
-		err = errors.New("No rows have been updated in database")
+		err = sql.ErrNoRows
 		level.Error(db.logger).Log("err", err)
-		return err
+		return storeerr.Classify(err)
 	}
 	return nil
 }
@@ -0,0 +1,142 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/models/storeerr"
+	"github.com/lamassuiot/enroller/pkg/scep/crypto"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	_ "modernc.org/sqlite"
+)
+
+// DB stores the certificates issued through SCEP in a SQLite database, for
+// single node deployments. The table is created by the SCEP migrations
+// and serials are stored hex encoded, as in the Postgres store.
+type DB struct {
+	*sql.DB
+	logger log.Logger
+}
+
+func NewDB(dataSourceName string, logger log.Logger) (*DB, error) {
+	db, err := sql.Open("sqlite", dataSourceName)
+	if err != nil {
+		level.Error(logger).Log("err", err, "msg", "Could not open signed certificates SQLite database")
+		return nil, storeerr.Classify(err)
+	}
+	return &DB{db, logger}, nil
+}
+
+func (db *DB) InsertCRT(ctx context.Context, crt crypto.CRT) error {
+	sqlStatement := `
+	INSERT INTO ca_store(status, expirationDate, revocationDate, serial, dn, certPath, key, keySize)
+	VALUES($1, $2, $3, $4, $5, $6, $7, $8);
+	`
+	serialHex := fmt.Sprintf("%x", crt.Serial)
+	_, err := db.ExecContext(ctx, sqlStatement, crt.Status, crt.ExpirationDate, crt.RevocationDate, serialHex, crt.DN, crt.CRTPath, crt.Key, crt.KeySize)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not insert certificate with serial "+crt.Serial+" in database")
+		return storeerr.Classify(err)
+	}
+	level.Info(db.logger).Log("msg", "Certificate with serial "+serialHex+" inserted in database")
+	return nil
+}
+
+func (db *DB) SelectCRT(ctx context.Context, dn string, serial string) (crypto.CRT, error) {
+	sqlStatement := `
+	SELECT status, expirationDate, revocationDate, serial, dn, certPath, key, keySize
+	FROM ca_store
+	WHERE dn = $1 AND serial = $2;
+	`
+	var crt crypto.CRT
+	err := db.QueryRowContext(ctx, sqlStatement, dn, fmt.Sprintf("%x", serial)).Scan(&crt.Status, &crt.ExpirationDate, &crt.RevocationDate, &crt.Serial, &crt.DN, &crt.CRTPath, &crt.Key, &crt.KeySize)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not obtain certificate with DN "+dn+" and serial "+serial+" from database")
+		return crypto.CRT{}, storeerr.Classify(err)
+	}
+	level.Info(db.logger).Log("msg", "Certificate with DN "+dn+" and serial "+serial+" read from database")
+	return crt, nil
+}
+
+func (db *DB) GetCRTs(ctx context.Context) (crypto.CRTs, error) {
+	sqlStatement := `
+	SELECT status, expirationDate, revocationDate, serial, dn, certPath, key, keySize
+	FROM ca_store;
+	`
+	rows, err := db.QueryContext(ctx, sqlStatement)
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not obtain certificates from database")
+		return crypto.CRTs{CRTs: []crypto.CRT{}}, storeerr.Classify(err)
+	}
+	defer rows.Close()
+	crts := make([]crypto.CRT, 0)
+
+	for rows.Next() {
+		var crt crypto.CRT
+		err := rows.Scan(&crt.Status, &crt.ExpirationDate, &crt.RevocationDate, &crt.Serial, &crt.DN, &crt.CRTPath, &crt.Key, &crt.KeySize)
+		if err != nil {
+			level.Error(db.logger).Log("err", err, "msg", "Unable to read database certificate row")
+			return crypto.CRTs{CRTs: []crypto.CRT{}}, storeerr.Classify(err)
+		}
+		crts = append(crts, crt)
+	}
+	if err = rows.Err(); err != nil {
+		level.Error(db.logger).Log("err", err)
+		return crypto.CRTs{CRTs: []crypto.CRT{}}, storeerr.Classify(err)
+	}
+	level.Info(db.logger).Log("msg", strconv.Itoa(len(crts))+" certificates read from database")
+	return crypto.CRTs{CRTs: crts}, nil
+}
+
+func (db *DB) RevokeCRT(ctx context.Context, dn string, serial string) error {
+	err := db.exec(ctx, `
+	UPDATE ca_store
+	SET status = 'R', revocationDate = $1
+	WHERE dn = $2 AND serial = $3;
+	`, makeOpenSSLTime(time.Now()), dn, fmt.Sprintf("%x", serial))
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not revoke certificate with DN "+dn+" and serial "+serial+" in database")
+		return storeerr.Classify(err)
+	}
+	return nil
+}
+
+func (db *DB) Delete(ctx context.Context, dn string, serial string) error {
+	err := db.exec(ctx, `
+	DELETE FROM ca_store
+	WHERE dn = $1 AND serial = $2;
+	`, dn, fmt.Sprintf("%x", serial))
+	if err != nil {
+		level.Error(db.logger).Log("err", err, "msg", "Could not delete certificate with DN "+dn+" and serial "+serial+" from database")
+		return storeerr.Classify(err)
+	}
+	return nil
+}
+
+// exec runs sqlStatement and returns sql.ErrNoRows if no row was affected.
+func (db *DB) exec(ctx context.Context, sqlStatement string, args ...interface{}) error {
+	res, err := db.ExecContext(ctx, sqlStatement, args...)
+	if err != nil {
+		return storeerr.Classify(err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return storeerr.Classify(err)
+	}
+	if count <= 0 {
+		return storeerr.NotFound(sql.ErrNoRows)
+	}
+	return nil
+}
+
+func makeOpenSSLTime(t time.Time) string {
+	y := (int(t.Year()) % 100)
+	validDate := fmt.Sprintf("%02d%02d%02d%02d%02d%02dZ", y, t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second())
+	return validDate
+}
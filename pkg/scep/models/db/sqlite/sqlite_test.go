@@ -0,0 +1,29 @@
+package sqlite
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/lamassuiot/enroller/pkg/migrate"
+	"github.com/lamassuiot/enroller/pkg/scep/models/db/dbtest"
+	"github.com/lamassuiot/enroller/pkg/scep/models/migrations"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := NewDB("file:"+dir+"/scep.db", log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrate.NewMigrator(db.DB, "sqlite", migrations.SQLite, log.NewNopLogger()).Up(); err != nil {
+		t.Fatal(err)
+	}
+	dbtest.TestDB(t, db)
+}
@@ -0,0 +1,86 @@
+// Package migrations holds the SCEP database schema for each supported
+// driver, as migrations to be applied with the migrate package.
+//
+// The SCEP ca_store table is not the enroller one: it has no ID and stores
+// the key type and size of each certificate, and certificates are found by
+// their DN and serial.
+package migrations
+
+import (
+	"errors"
+
+	"github.com/lamassuiot/enroller/pkg/migrate"
+)
+
+// ForDriver returns the migrations for the named database driver.
+func ForDriver(driver string) ([]migrate.Migration, error) {
+	switch driver {
+	case "postgres":
+		return Postgres, nil
+	case "sqlite":
+		return SQLite, nil
+	default:
+		return nil, errors.New("no migrations for database driver " + driver)
+	}
+}
+
+const createTable = `
+CREATE TABLE IF NOT EXISTS ca_store (
+	status CHAR(1),
+	expirationDate TEXT,
+	revocationDate TEXT,
+	serial TEXT,
+	dn TEXT,
+	certPath TEXT,
+	key TEXT,
+	keySize INTEGER
+);
+`
+
+var Postgres = []migrate.Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up:      createTable,
+		Down:    `DROP TABLE IF EXISTS ca_store;`,
+	},
+	{
+		Version: 2,
+		Name:    "keys and indexes",
+		Up: `
+		ALTER TABLE ca_store ALTER COLUMN serial SET NOT NULL;
+		ALTER TABLE ca_store ALTER COLUMN dn SET NOT NULL;
+		ALTER TABLE ca_store ADD CONSTRAINT ca_store_pkey PRIMARY KEY (dn, serial);
+		CREATE INDEX ca_store_status_idx ON ca_store (status);
+		`,
+		Down: `
+		DROP INDEX ca_store_status_idx;
+		ALTER TABLE ca_store DROP CONSTRAINT ca_store_pkey;
+		ALTER TABLE ca_store ALTER COLUMN dn DROP NOT NULL;
+		ALTER TABLE ca_store ALTER COLUMN serial DROP NOT NULL;
+		`,
+	},
+}
+
+var SQLite = []migrate.Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up:      createTable,
+		Down:    `DROP TABLE IF EXISTS ca_store;`,
+	},
+	{
+		// SQLite can not add a primary key to an existing table, a unique
+		// index gives the same guarantee.
+		Version: 2,
+		Name:    "keys and indexes",
+		Up: `
+		CREATE UNIQUE INDEX ca_store_dn_serial_key ON ca_store (dn, serial);
+		CREATE INDEX ca_store_status_idx ON ca_store (status);
+		`,
+		Down: `
+		DROP INDEX ca_store_status_idx;
+		DROP INDEX ca_store_dn_serial_key;
+		`,
+	},
+}
@@ -0,0 +1,40 @@
+package configs
+
+import (
+	"github.com/kelseyhightower/envconfig"
+)
+
+type Config struct {
+	Port string
+
+	// CertFile and KeyFile are the TLS certificate of the signer. ClientCA
+	// issues the certificates of the enrollers allowed to use it.
+	CertFile string
+	KeyFile  string
+	ClientCA string
+
+	SecretEngine string `default:"file"`
+
+	CACertFile      string
+	CAKeyFile       string
+	CAKeyPassphrase string
+	CAHash          string
+	// CAChainFile holds the issuers of the CA certificate, up to the root.
+	CAChainFile string
+
+	PKCS11Module     string
+	PKCS11TokenLabel string
+	PKCS11Slot       uint
+	PKCS11PIN        string
+	PKCS11KeyLabel   string
+	PKCS11Sessions   int `default:"4"`
+}
+
+func NewConfig(prefix string) (error, Config) {
+	var cfg Config
+	err := envconfig.Process(prefix, &cfg)
+	if err != nil {
+		return err, Config{}
+	}
+	return nil, cfg
+}
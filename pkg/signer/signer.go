@@ -0,0 +1,235 @@
+// Package signer serves a CA key over gRPC, so that the key can be kept on
+// a hardened host while the enroller that approves the CSRs runs elsewhere.
+// The enroller builds the certificates and the signer only signs the ones
+// issued by its CA.
+package signer
+
+import (
+	"bytes"
+	"context"
+	stdcrypto "crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+
+	"github.com/lamassuiot/enroller/pkg/enroller/crypto"
+	"github.com/lamassuiot/enroller/pkg/signer/signerpb"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	errMalformedTBS       = errors.New("malformed TBS certificate")
+	errSignatureAlgorithm = errors.New("TBS certificate signature algorithm does not match the CA key")
+	errIssuer             = errors.New("TBS certificate is not issued by the signer CA")
+	errCA                 = errors.New("TBS certificate is a CA certificate")
+	errValidity           = errors.New("TBS certificate outlives the signer CA")
+)
+
+// Server signs with the CA key the certificates requested by the enroller.
+type Server struct {
+	cert               *x509.Certificate
+	chain              []*x509.Certificate
+	key                stdcrypto.Signer
+	signatureAlgorithm x509.SignatureAlgorithm
+	logger             log.Logger
+}
+
+// NewServer returns a server signing with key, the key of cert, and hash,
+// zero for the default of the key type. The chain holds the issuers of
+// cert, up to the root.
+func NewServer(cert *x509.Certificate, chain []*x509.Certificate, key stdcrypto.Signer, hash stdcrypto.Hash, logger log.Logger) (*Server, error) {
+	if err := crypto.CheckCA(cert, key); err != nil {
+		return nil, err
+	}
+	signatureAlgorithm, err := crypto.SignatureAlgorithm(key.Public(), hash)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{cert: cert, chain: chain, key: key, signatureAlgorithm: signatureAlgorithm, logger: logger}, nil
+}
+
+// Sign signs the TBS certificate of req. It is refused unless it is an end
+// entity certificate issued by the CA, within its validity, with the
+// signature algorithm of the CA key.
+func (s *Server) Sign(ctx context.Context, req *signerpb.SignRequest) (*signerpb.SignResponse, error) {
+	algorithm, err := tbsSignatureAlgorithm(req.TbsCertificate)
+	if err != nil {
+		level.Error(s.logger).Log("err", err, "msg", "Could not parse TBS certificate")
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// The certificate is parsed with an empty signature to check its
+	// contents before signing it.
+	unsigned, err := assemble(req.TbsCertificate, algorithm, nil)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	cert, err := x509.ParseCertificate(unsigned)
+	if err != nil {
+		level.Error(s.logger).Log("err", err, "msg", "Could not parse TBS certificate")
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := s.check(cert); err != nil {
+		level.Warn(s.logger).Log("err", err, "msg", "Refused to sign certificate for "+cert.Subject.String())
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	hash := signatureHash(s.signatureAlgorithm)
+	digest := req.TbsCertificate
+	if hash != 0 {
+		h := hash.New()
+		h.Write(req.TbsCertificate)
+		digest = h.Sum(nil)
+	}
+	signature, err := s.key.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		level.Error(s.logger).Log("err", err, "msg", "Could not sign certificate")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	der, err := assemble(req.TbsCertificate, algorithm, signature)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	level.Info(s.logger).Log("msg", "Certificate with serial "+fmt.Sprintf("%x", cert.SerialNumber)+" for "+cert.Subject.String()+" signed")
+	return &signerpb.SignResponse{Certificate: der}, nil
+}
+
+func (s *Server) check(cert *x509.Certificate) error {
+	if cert.SignatureAlgorithm != s.signatureAlgorithm {
+		return errSignatureAlgorithm
+	}
+	if !bytes.Equal(cert.RawIssuer, s.cert.RawSubject) {
+		return errIssuer
+	}
+	if cert.IsCA {
+		return errCA
+	}
+	if cert.NotAfter.After(s.cert.NotAfter) {
+		return errValidity
+	}
+	return nil
+}
+
+// GetCAChain returns the CA certificate followed by its issuers.
+func (s *Server) GetCAChain(ctx context.Context, req *signerpb.GetCAChainRequest) (*signerpb.GetCAChainResponse, error) {
+	certs := [][]byte{s.cert.Raw}
+	for _, cert := range s.chain {
+		certs = append(certs, cert.Raw)
+	}
+	return &signerpb.GetCAChainResponse{Certificates: certs}, nil
+}
+
+// healthMessage is signed by Health to check the CA key.
+var healthMessage = []byte("enroller signer health check")
+
+// Health tells whether the CA key can sign, by signing healthMessage and
+// checking the signature with the CA certificate.
+func (s *Server) Health(ctx context.Context, req *signerpb.HealthRequest) (*signerpb.HealthResponse, error) {
+	hash := signatureHash(s.signatureAlgorithm)
+	digest := healthMessage
+	if hash != 0 {
+		h := hash.New()
+		h.Write(healthMessage)
+		digest = h.Sum(nil)
+	}
+	signature, err := s.key.Sign(rand.Reader, digest, hash)
+	if err == nil {
+		err = s.cert.CheckSignature(s.signatureAlgorithm, healthMessage, signature)
+	}
+	if err != nil {
+		level.Error(s.logger).Log("err", err, "msg", "CA key health check failed")
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &signerpb.HealthResponse{Healthy: true}, nil
+}
+
+// tbsSignatureAlgorithm returns the DER AlgorithmIdentifier in tbs, which
+// is repeated in the certificate around it.
+func tbsSignatureAlgorithm(tbs []byte) ([]byte, error) {
+	input := cryptobyte.String(tbs)
+	var fields cryptobyte.String
+	if !input.ReadASN1(&fields, cbasn1.SEQUENCE) || !input.Empty() {
+		return nil, errMalformedTBS
+	}
+	var algorithm cryptobyte.String
+	if !fields.SkipOptionalASN1(cbasn1.Tag(0).Constructed().ContextSpecific()) ||
+		!fields.SkipASN1(cbasn1.INTEGER) ||
+		!fields.ReadASN1Element(&algorithm, cbasn1.SEQUENCE) {
+		return nil, errMalformedTBS
+	}
+	return algorithm, nil
+}
+
+// assemble returns the DER certificate made of tbs, its signature
+// algorithm and signature.
+func assemble(tbs []byte, algorithm []byte, signature []byte) ([]byte, error) {
+	return asn1.Marshal(struct {
+		TBSCertificate     asn1.RawValue
+		SignatureAlgorithm asn1.RawValue
+		SignatureValue     asn1.BitString
+	}{
+		TBSCertificate:     asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: asn1.RawValue{FullBytes: algorithm},
+		SignatureValue:     asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)},
+	})
+}
+
+// signatureHash returns the hash signed by algorithm, zero for the ones
+// that sign the whole message.
+func signatureHash(algorithm x509.SignatureAlgorithm) stdcrypto.Hash {
+	switch algorithm {
+	case x509.SHA256WithRSA, x509.ECDSAWithSHA256:
+		return stdcrypto.SHA256
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384:
+		return stdcrypto.SHA384
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512:
+		return stdcrypto.SHA512
+	}
+	return 0
+}
+
+// ServerTLSConfig returns the TLS configuration of a signer that only
+// accepts clients with a certificate issued by a CA in clientCA.
+func ServerTLSConfig(certFile string, keyFile string, clientCA string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := crypto.CreateCAPool(clientCA)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ClientTLSConfig returns the TLS configuration of a client authenticating
+// with its certificate to a signer with a certificate issued by a CA in
+// serverCA.
+func ClientTLSConfig(certFile string, keyFile string, serverCA string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := crypto.CreateCAPool(serverCA)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,201 @@
+package signer
+
+import (
+	"context"
+	stdcrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/enroller/pkg/signer/signerpb"
+
+	"github.com/go-kit/kit/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func testCA(t *testing.T, name string, key stdcrypto.Signer) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(2, 0, 0),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// tbs returns the TBS certificate of template issued by issuer and signed
+// with key.
+func tbs(t *testing.T, template *x509.Certificate, issuer *x509.Certificate, key stdcrypto.Signer) []byte {
+	deviceKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, deviceKey.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.RawTBSCertificate
+}
+
+func TestSign(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	for _, key := range []stdcrypto.Signer{rsaKey, p384Key, edKey} {
+		t.Run(fmt.Sprintf("Testing %T CA", key), func(t *testing.T) {
+			caCert := testCA(t, "Enroller CA", key)
+			server, err := NewServer(caCert, nil, key, 0, log.NewNopLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaf := func() *x509.Certificate {
+				return &x509.Certificate{
+					SerialNumber: big.NewInt(2),
+					Subject:      pkix.Name{CommonName: "device.test.com"},
+					NotBefore:    time.Now().Add(-time.Hour),
+					NotAfter:     time.Now().AddDate(1, 0, 0),
+					KeyUsage:     x509.KeyUsageDigitalSignature,
+				}
+			}
+			otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			caTemplate := leaf()
+			caTemplate.IsCA, caTemplate.BasicConstraintsValid = true, true
+			longTemplate := leaf()
+			longTemplate.NotAfter = caCert.NotAfter.Add(time.Hour)
+
+			testCases := []struct {
+				name string
+				tbs  []byte
+				code codes.Code
+			}{
+				{"Correct", tbs(t, leaf(), caCert, key), codes.OK},
+				{"Other issuer", tbs(t, leaf(), testCA(t, "Other CA", otherKey), otherKey), codes.PermissionDenied},
+				{"CA certificate", tbs(t, caTemplate, caCert, key), codes.PermissionDenied},
+				{"Outlives CA", tbs(t, longTemplate, caCert, key), codes.PermissionDenied},
+				{"Malformed", []byte{0x30, 0x01}, codes.InvalidArgument},
+			}
+			for _, tc := range testCases {
+				t.Run(tc.name, func(t *testing.T) {
+					resp, err := server.Sign(context.Background(), &signerpb.SignRequest{TbsCertificate: tc.tbs})
+					if status.Code(err) != tc.code {
+						t.Fatalf("Got result is %v; want %s", err, tc.code)
+					}
+					if err != nil {
+						return
+					}
+					cert, err := x509.ParseCertificate(resp.Certificate)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if err := cert.CheckSignatureFrom(caCert); err != nil {
+						t.Errorf("Got result is %s; want certificate signed by the CA key", err)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestSignOtherHash(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	caCert := testCA(t, "Enroller CA", key)
+	server, err := NewServer(caCert, nil, key, stdcrypto.SHA384, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:       big.NewInt(2),
+		Subject:            pkix.Name{CommonName: "device.test.com"},
+		NotBefore:          time.Now().Add(-time.Hour),
+		NotAfter:           time.Now().AddDate(1, 0, 0),
+		SignatureAlgorithm: x509.SHA256WithRSA,
+	}
+	_, err = server.Sign(context.Background(), &signerpb.SignRequest{TbsCertificate: tbs(t, template, caCert, key)})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Got result is %v; want %s", err, codes.PermissionDenied)
+	}
+}
+
+func TestGetCAChain(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caCert := testCA(t, "Enroller CA", key)
+	rootKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	root := testCA(t, "Root CA", rootKey)
+	server, err := NewServer(caCert, []*x509.Certificate{root}, key, 0, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := server.GetCAChain(context.Background(), &signerpb.GetCAChainRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Certificates) != 2 || string(resp.Certificates[0]) != string(caCert.Raw) || string(resp.Certificates[1]) != string(root.Raw) {
+		t.Errorf("Got %d certificates; want the CA certificate and its root", len(resp.Certificates))
+	}
+
+	if _, err := NewServer(caCert, nil, rootKey, 0, log.NewNopLogger()); err == nil {
+		t.Error("Got result is nil; want error for a key that does not match the CA certificate")
+	}
+}
+
+// failingKey is a CA key whose token has gone away.
+type failingKey struct {
+	stdcrypto.Signer
+}
+
+func (k failingKey) Sign(rand io.Reader, digest []byte, opts stdcrypto.SignerOpts) ([]byte, error) {
+	return nil, errors.New("token removed")
+}
+
+func TestHealth(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	for _, key := range []stdcrypto.Signer{rsaKey, p384Key, edKey} {
+		t.Run(fmt.Sprintf("Testing %T CA", key), func(t *testing.T) {
+			caCert := testCA(t, "Enroller CA", key)
+			server, err := NewServer(caCert, nil, key, 0, log.NewNopLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := server.Health(context.Background(), &signerpb.HealthRequest{})
+			if err != nil || !resp.Healthy {
+				t.Errorf("Got result is %v; want healthy signer", err)
+			}
+
+			server, err = NewServer(caCert, nil, failingKey{key}, 0, log.NewNopLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = server.Health(context.Background(), &signerpb.HealthRequest{})
+			if status.Code(err) != codes.Unavailable {
+				t.Errorf("Got result is %v; want %s", err, codes.Unavailable)
+			}
+		})
+	}
+}